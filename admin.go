@@ -0,0 +1,469 @@
+package main
+
+import (
+  "database/sql"
+  "encoding/json"
+  "fmt"
+  "log"
+  "net/http"
+  "os"
+  "strconv"
+  "time"
+  
+  "github.com/gorilla/mux"
+)
+
+//UsuarioAdmin es lo que ve el administrador de cada usuario.
+type UsuarioAdmin struct {
+  Nombre string `json:"nombre"`
+  Email string `json:"email,omitempty"`
+  Rol string `json:"rol"`
+  Activo bool `json:"activo"`
+  CambiarClave bool `json:"cambiarClave"`
+  DosFactores bool `json:"dosFactores"`
+}
+
+//EstadisticasUsuario es cuanto guarda cada usuario. Bytes es aproximado,
+//la suma del texto de sus registros mas el tamaño de sus exportaciones.
+type EstadisticasUsuario struct {
+  Nombre string `json:"nombre"`
+  Registros int `json:"registros"`
+  Categorias int `json:"categorias"`
+  SesionesActivas int `json:"sesionesActivas"`
+  ClavesApi int `json:"clavesApi"`
+  Exportaciones int `json:"exportaciones"`
+  BytesRegistros int64 `json:"bytesRegistros"`
+  BytesExportaciones int64 `json:"bytesExportaciones"`
+  PrimerRegistro *time.Time `json:"primerRegistro,omitempty"`
+  UltimoRegistro *time.Time `json:"ultimoRegistro,omitempty"`
+}
+
+//IntentoLogin es un intento de inicio de sesion guardado.
+type IntentoLogin struct {
+  Id int `json:"id"`
+  Usuario string `json:"usuario"`
+  Ip string `json:"ip"`
+  Fecha time.Time `json:"fecha"`
+  Exito bool `json:"exito"`
+  Motivo string `json:"motivo,omitempty"`
+}
+
+//initAdmin agrega el rol y el estado a los usuarios. El usuario de
+//ADMIN_USUARIO en el .env queda como administrador al iniciar.
+func initAdmin() {
+  agregarColumna("usuarios", "rol", "TEXT NOT NULL DEFAULT 'user'")
+  agregarColumna("usuarios", "activo", "INTEGER NOT NULL DEFAULT 1")
+  agregarColumna("usuarios", "cambiar_clave", "INTEGER NOT NULL DEFAULT 0")
+  
+  admin := os.Getenv("ADMIN_USUARIO")
+  if admin != "" {
+    _, err := db.Exec("UPDATE usuarios SET rol = 'admin' WHERE nombre = ?", admin)
+    if err != nil {
+      log.Fatal("Error asignando el administrador ", err)
+    }
+  }
+}
+
+//soloAdmin deja pasar solo a los usuarios con rol admin en el jwt. Va
+//despues de authMiddleware, las claves de api no tienen rol.
+func soloAdmin(siguiente http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if rol, _ := r.Context().Value("rol").(string); rol != "admin" {
+      http.Error(w, "Error, solo un administrador puede usar esta ruta.", http.StatusForbidden)
+      return
+    }
+    siguiente.ServeHTTP(w, r)
+  })
+}
+
+//rolUsuario retorna el rol del usuario para ponerlo en el jwt.
+func rolUsuario(usuario string) (string, error) {
+  var rol string
+  err := db.QueryRow("SELECT rol FROM usuarios WHERE nombre = ?", usuario).Scan(&rol)
+  if err != nil {
+    return "", fmt.Errorf("Error al consultar el rol, %v", err)
+  }
+  return rol, nil
+}
+
+//estadoUsuario dice si el usuario puede iniciar sesion y si debe cambiar
+//la clave antes.
+func estadoUsuario(usuario string) (activo bool, cambiarClave bool, err error) {
+  err = db.QueryRow("SELECT activo, cambiar_clave FROM usuarios WHERE nombre = ?", usuario).Scan(&activo, &cambiarClave)
+  if err != nil {
+    err = fmt.Errorf("Error al consultar el estado del usuario, %v", err)
+  }
+  return
+}
+
+//permitirLogin revisa que el usuario este activo y no tenga que cambiar la
+//clave, si no responde 403 y retorna false.
+func permitirLogin(w http.ResponseWriter, usuario string) bool {
+  activo, cambiarClave, err := estadoUsuario(usuario)
+  if err != nil {
+    writeError(w, "Error al consultar el usuario", err, http.StatusInternalServerError)
+    return false
+  }
+  if !activo {
+    http.Error(w, "Error, la cuenta esta desactivada.", http.StatusForbidden)
+    return false
+  }
+  if cambiarClave {
+    http.Error(w, "Error, debe restablecer la clave en /clave/olvido antes de iniciar sesion.", http.StatusForbidden)
+    return false
+  }
+  return true
+}
+
+//buscarUsuarioAdmin retorna el usuario de la url, si no existe responde 404.
+func buscarUsuarioAdmin(w http.ResponseWriter, r *http.Request) (UsuarioAdmin, bool) {
+  var u UsuarioAdmin
+  err := db.QueryRow("SELECT nombre, email, rol, activo, cambiar_clave, totp_activo FROM usuarios WHERE nombre = ?", mux.Vars(r)["nombre"]).Scan(
+    &u.Nombre, &u.Email, &u.Rol, &u.Activo, &u.CambiarClave, &u.DosFactores)
+  if err == sql.ErrNoRows {
+    http.Error(w, "El usuario no existe.", http.StatusNotFound)
+    return u, false
+  }
+  if err != nil {
+    writeError(w, "Error al consultar el usuario", err, http.StatusInternalServerError)
+    return u, false
+  }
+  return u, true
+}
+
+//getUsuariosAdmin lista todos los usuarios.
+//ejm http://100.69.187.16:8080/admin/usuarios
+func getUsuariosAdmin(w http.ResponseWriter, r *http.Request) {
+  rows, err := db.Query("SELECT nombre, email, rol, activo, cambiar_clave, totp_activo FROM usuarios ORDER BY nombre")
+  if err != nil {
+    writeError(w, "Error al consultar los usuarios", err, http.StatusInternalServerError)
+    return
+  }
+  defer rows.Close()
+  
+  usuarios := []UsuarioAdmin{}
+  for rows.Next() {
+    var u UsuarioAdmin
+    err = rows.Scan(&u.Nombre, &u.Email, &u.Rol, &u.Activo, &u.CambiarClave, &u.DosFactores)
+    if err != nil {
+      writeError(w, "Error al escanear los usuarios", err, http.StatusInternalServerError)
+      return
+    }
+    usuarios = append(usuarios, u)
+  }
+  if err = rows.Err(); err != nil {
+    writeError(w, "Error al consultar los usuarios", err, http.StatusInternalServerError)
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(usuarios)
+}
+
+//putActivoAdmin activa o desactiva un usuario. Al desactivarlo se cierran
+//sus sesiones y sus claves de api dejan de funcionar.
+//Json ejemplo{"activo": false}
+func putActivoAdmin(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  var datos struct {
+    Activo *bool `json:"activo"`
+  }
+  err := json.NewDecoder(r.Body).Decode(&datos)
+  if err != nil || datos.Activo == nil {
+    http.Error(w, "Error, falta activo en el body.", http.StatusBadRequest)
+    return
+  }
+  u, ok := buscarUsuarioAdmin(w, r)
+  if !ok {
+    return
+  }
+  if u.Nombre == nombreUsuario && !*datos.Activo {
+    http.Error(w, "Error, no se puede desactivar a si mismo.", http.StatusConflict)
+    return
+  }
+  
+  _, err = db.Exec("UPDATE usuarios SET activo = ? WHERE nombre = ?", *datos.Activo, u.Nombre)
+  if err != nil {
+    writeError(w, "Error al actualizar el usuario", err, http.StatusInternalServerError)
+    return
+  }
+  if !*datos.Activo {
+    _, err = db.Exec("UPDATE sesiones SET revocada = 1 WHERE usuario = ?", u.Nombre)
+    if err != nil {
+      writeError(w, "Error al cerrar las sesiones", err, http.StatusInternalServerError)
+      return
+    }
+  }
+  w.WriteHeader(http.StatusNoContent)
+}
+
+//restablecerAdmin obliga al usuario a cambiar la clave: cierra sus
+//sesiones, no lo deja iniciar sesion hasta que la restablezca y si tiene
+//email le envia el token para hacerlo.
+//ejm http://100.69.187.16:8080/admin/usuarios/ana1/restablecer
+func restablecerAdmin(w http.ResponseWriter, r *http.Request) {
+  u, ok := buscarUsuarioAdmin(w, r)
+  if !ok {
+    return
+  }
+  
+  _, err := db.Exec("UPDATE usuarios SET cambiar_clave = 1 WHERE nombre = ?", u.Nombre)
+  if err != nil {
+    writeError(w, "Error al actualizar el usuario", err, http.StatusInternalServerError)
+    return
+  }
+  _, err = db.Exec("UPDATE sesiones SET revocada = 1 WHERE usuario = ?", u.Nombre)
+  if err != nil {
+    writeError(w, "Error al cerrar las sesiones", err, http.StatusInternalServerError)
+    return
+  }
+  
+  enviado := false
+  if u.Email != "" {
+    err = enviarRestablecer(u.Nombre, u.Email)
+    if err != nil {
+      writeError(w, "Error al enviar el correo", err, http.StatusInternalServerError)
+      return
+    }
+    enviado = true
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(map[string]bool{
+    "correoEnviado": enviado,
+  })
+}
+
+//deleteUsuarioAdmin borra el usuario con sus registros, sus libros y todo
+//lo demas que tenga guardado. Los intentos de login se dejan como historial.
+//Sus partes en egresos divididos de otros pasan a quien pago el egreso.
+//ejm http://100.69.187.16:8080/admin/usuarios/ana1
+func deleteUsuarioAdmin(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  u, ok := buscarUsuarioAdmin(w, r)
+  if !ok {
+    return
+  }
+  if u.Nombre == nombreUsuario {
+    http.Error(w, "Error, no se puede borrar a si mismo.", http.StatusConflict)
+    return
+  }
+  
+  //los archivos de exportacion se borran despues de confirmar.
+  var archivos []string
+  rows, err := db.Query("SELECT archivo FROM exportaciones WHERE usuario = ? AND archivo != ''", u.Nombre)
+  if err != nil {
+    writeError(w, "Error al consultar las exportaciones", err, http.StatusInternalServerError)
+    return
+  }
+  for rows.Next() {
+    var archivo string
+    if rows.Scan(&archivo) == nil {
+      archivos = append(archivos, archivo)
+    }
+  }
+  rows.Close()
+  
+  tx, err := db.Begin()
+  if err != nil {
+    writeError(w, "Error al iniciar la transaccion", err, http.StatusInternalServerError)
+    return
+  }
+  defer tx.Rollback()
+  
+  //las categorias hijas se borran antes que los padres por la referencia.
+  consultas := []string{
+    //en los egresos divididos de otros su parte la asume quien pago, y si
+    //el pago se quita la division, asi no quedan deudas con alguien que no
+    //existe.
+    "DELETE FROM partes WHERE registro_id IN (SELECT registro_id FROM divisiones WHERE pagador = ?1)",
+    "DELETE FROM divisiones WHERE pagador = ?1",
+    `UPDATE partes AS p SET monto = p.monto + (SELECT monto FROM partes WHERE registro_id = p.registro_id AND usuario = ?1),
+    porcentaje = p.porcentaje + (SELECT porcentaje FROM partes WHERE registro_id = p.registro_id AND usuario = ?1)
+    WHERE p.usuario = (SELECT pagador FROM divisiones WHERE registro_id = p.registro_id)
+    AND p.registro_id IN (SELECT registro_id FROM partes WHERE usuario = ?1)`,
+    `UPDATE partes AS p SET usuario = (SELECT pagador FROM divisiones WHERE registro_id = p.registro_id)
+    WHERE p.usuario = ?1 AND NOT EXISTS (SELECT 1 FROM partes WHERE registro_id = p.registro_id AND usuario = (SELECT pagador FROM divisiones WHERE registro_id = p.registro_id))`,
+    "DELETE FROM partes WHERE usuario = ?1",
+    //los libros que creo se borran completos, de los demas solo sale el.
+    "DELETE FROM partes WHERE registro_id IN (SELECT id FROM registros WHERE usuario = ?1 OR libro_id IN (SELECT id FROM libros WHERE propietario = ?1))",
+    "DELETE FROM divisiones WHERE registro_id IN (SELECT id FROM registros WHERE usuario = ?1 OR libro_id IN (SELECT id FROM libros WHERE propietario = ?1))",
+    "DELETE FROM registros WHERE id IN (SELECT egreso_id FROM liquidaciones WHERE de = ?1 OR para = ?1) OR id IN (SELECT ingreso_id FROM liquidaciones WHERE de = ?1 OR para = ?1)",
+    "DELETE FROM liquidaciones WHERE de = ?1 OR para = ?1 OR libro_id IN (SELECT id FROM libros WHERE propietario = ?1)",
+    "DELETE FROM transferencias WHERE libro_id IN (SELECT id FROM libros WHERE propietario = ?1) OR id IN (SELECT transferencia_id FROM registros WHERE usuario = ?1)",
+    "DELETE FROM registros WHERE transferencia_id IS NOT NULL AND transferencia_id NOT IN (SELECT id FROM transferencias)",
+    "DELETE FROM registros WHERE usuario = ?1 OR libro_id IN (SELECT id FROM libros WHERE propietario = ?1)",
+    "DELETE FROM excepciones_recurrencia WHERE recurrencia_id IN (SELECT id FROM recurrencias WHERE usuario = ?1 OR libro_id IN (SELECT id FROM libros WHERE propietario = ?1))",
+    "DELETE FROM recurrencias WHERE usuario = ?1 OR libro_id IN (SELECT id FROM libros WHERE propietario = ?1)",
+    "UPDATE registros SET meta_id = NULL WHERE meta_id IN (SELECT id FROM metas WHERE usuario = ?1)",
+    "DELETE FROM metas WHERE usuario = ?1 OR libro_id IN (SELECT id FROM libros WHERE propietario = ?1)",
+    "DELETE FROM cuentas WHERE libro_id IN (SELECT id FROM libros WHERE propietario = ?1)",
+    "DELETE FROM presupuestos WHERE usuario = ?1 OR libro_id IN (SELECT id FROM libros WHERE propietario = ?1)",
+    "DELETE FROM asignaciones_sobres WHERE usuario = ?1 OR libro_id IN (SELECT id FROM libros WHERE propietario = ?1)",
+    "DELETE FROM sobres WHERE libro_id IN (SELECT id FROM libros WHERE propietario = ?1)",
+    "DELETE FROM libro_miembros WHERE usuario = ?1 OR libro_id IN (SELECT id FROM libros WHERE propietario = ?1)",
+    "DELETE FROM libros WHERE propietario = ?",
+    "UPDATE categorias SET padre_id = NULL WHERE usuario = ?",
+    "DELETE FROM categorias WHERE usuario = ?",
+    "DELETE FROM exportaciones WHERE usuario = ?",
+    "DELETE FROM sesiones WHERE usuario = ?",
+    "DELETE FROM restablecer_clave WHERE usuario = ?",
+    "DELETE FROM codigos_recuperacion WHERE usuario = ?",
+    "DELETE FROM claves_api WHERE usuario = ?",
+    "DELETE FROM usuarios WHERE nombre = ?",
+  }
+  for _, consulta := range consultas {
+    _, err = tx.Exec(consulta, u.Nombre)
+    if err != nil {
+      writeError(w, "Error al borrar el usuario", err, http.StatusInternalServerError)
+      return
+    }
+  }
+  err = tx.Commit()
+  if err != nil {
+    writeError(w, "Error al guardar los cambios", err, http.StatusInternalServerError)
+    return
+  }
+  
+  for _, archivo := range archivos {
+    os.Remove(archivo)
+  }
+  w.WriteHeader(http.StatusNoContent)
+}
+
+//getEstadisticasAdmin responde cuanto tiene guardado cada usuario.
+//ejm http://100.69.187.16:8080/admin/estadisticas
+func getEstadisticasAdmin(w http.ResponseWriter, r *http.Request) {
+  ahora := time.Now().UTC().Format(time.RFC3339)
+  rows, err := db.Query(`SELECT u.nombre,
+  (SELECT COUNT(*) FROM registros WHERE usuario = u.nombre),
+  (SELECT COALESCE(SUM(LENGTH(tipo) + LENGTH(COALESCE(descripcion, '')) + LENGTH(COALESCE(grupo, '')) + LENGTH(fecha) + LENGTH(COALESCE(fitid, '')) + 8), 0) FROM registros WHERE usuario = u.nombre),
+  (SELECT MIN(substr(fecha, 1, 10)) FROM registros WHERE usuario = u.nombre),
+  (SELECT MAX(substr(fecha, 1, 10)) FROM registros WHERE usuario = u.nombre),
+  (SELECT COUNT(*) FROM categorias WHERE usuario = u.nombre),
+  (SELECT COUNT(*) FROM sesiones WHERE usuario = u.nombre AND revocada = 0 AND expira > ?),
+  (SELECT COUNT(*) FROM claves_api WHERE usuario = u.nombre AND revocada = 0)
+  FROM usuarios u ORDER BY u.nombre`, ahora)
+  if err != nil {
+    writeError(w, "Error al consultar las estadisticas", err, http.StatusInternalServerError)
+    return
+  }
+  defer rows.Close()
+  
+  estadisticas := []EstadisticasUsuario{}
+  indices := map[string]int{}
+  for rows.Next() {
+    var e EstadisticasUsuario
+    var primero, ultimo sql.NullString
+    err = rows.Scan(&e.Nombre, &e.Registros, &e.BytesRegistros, &primero, &ultimo, &e.Categorias, &e.SesionesActivas, &e.ClavesApi)
+    if err != nil {
+      writeError(w, "Error al escanear las estadisticas", err, http.StatusInternalServerError)
+      return
+    }
+    e.PrimerRegistro = leerDiaNulo(primero)
+    e.UltimoRegistro = leerDiaNulo(ultimo)
+    indices[e.Nombre] = len(estadisticas)
+    estadisticas = append(estadisticas, e)
+  }
+  if err = rows.Err(); err != nil {
+    writeError(w, "Error al consultar las estadisticas", err, http.StatusInternalServerError)
+    return
+  }
+  rows.Close()
+  
+  //el tamaño de las exportaciones se toma de los archivos.
+  exportaciones, err := db.Query("SELECT usuario, archivo FROM exportaciones")
+  if err != nil {
+    writeError(w, "Error al consultar las exportaciones", err, http.StatusInternalServerError)
+    return
+  }
+  defer exportaciones.Close()
+  for exportaciones.Next() {
+    var usuario, archivo string
+    err = exportaciones.Scan(&usuario, &archivo)
+    if err != nil {
+      writeError(w, "Error al escanear las exportaciones", err, http.StatusInternalServerError)
+      return
+    }
+    i, ok := indices[usuario]
+    if !ok {
+      continue
+    }
+    estadisticas[i].Exportaciones++
+    if info, err := os.Stat(archivo); archivo != "" && err == nil {
+      estadisticas[i].BytesExportaciones += info.Size()
+    }
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(estadisticas)
+}
+
+//leerDiaNulo convierte un dia AAAA-MM-DD opcional de la base de datos.
+func leerDiaNulo(s sql.NullString) *time.Time {
+  if !s.Valid {
+    return nil
+  }
+  t, err := time.Parse("2006-01-02", s.String)
+  if err != nil {
+    return nil
+  }
+  return &t
+}
+
+//getIntentosAdmin lista los intentos de login, por defecto solo los
+//fallidos. Se puede filtrar por usuario, ip y exito.
+//ejm http://100.69.187.16:8080/admin/intentos?usuario=ana1&limite=100
+func getIntentosAdmin(w http.ResponseWriter, r *http.Request) {
+  q := r.URL.Query()
+  condiciones := "WHERE exito = ?"
+  exito := q.Get("exito") == "true"
+  args := []interface{}{exito}
+  if q.Get("usuario") != "" {
+    condiciones += " AND usuario = ?"
+    args = append(args, q.Get("usuario"))
+  }
+  if q.Get("ip") != "" {
+    condiciones += " AND ip = ?"
+    args = append(args, q.Get("ip"))
+  }
+  limite := 100
+  if q.Get("limite") != "" {
+    n, err := strconv.Atoi(q.Get("limite"))
+    if err != nil || n < 1 || n > 1000 {
+      http.Error(w, "Error, el limite debe ser un numero entre 1 y 1000.", http.StatusBadRequest)
+      return
+    }
+    limite = n
+  }
+  args = append(args, limite)
+  
+  rows, err := db.Query("SELECT id, usuario, ip, fecha, exito, motivo FROM intentos_login " + condiciones + " ORDER BY fecha DESC, id DESC LIMIT ?", args...)
+  if err != nil {
+    writeError(w, "Error al consultar los intentos", err, http.StatusInternalServerError)
+    return
+  }
+  defer rows.Close()
+  
+  intentos := []IntentoLogin{}
+  for rows.Next() {
+    var i IntentoLogin
+    var fecha string
+    err = rows.Scan(&i.Id, &i.Usuario, &i.Ip, &fecha, &i.Exito, &i.Motivo)
+    if err != nil {
+      writeError(w, "Error al escanear los intentos", err, http.StatusInternalServerError)
+      return
+    }
+    i.Fecha, _ = time.Parse(time.RFC3339, fecha)
+    intentos = append(intentos, i)
+  }
+  if err = rows.Err(); err != nil {
+    writeError(w, "Error al consultar los intentos", err, http.StatusInternalServerError)
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(intentos)
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+  "context"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  "time"
+  
+  "github.com/gorilla/mux"
+)
+
+func TestDeleteUsuarioAdmin(t *testing.T) {
+  prepararDB(t)
+  for _, nombre := range []string{"luis", "ana", "pedro"} {
+    if err := guardarUsuario(Usuario{Nombre: nombre, Clave: "Clave123#"}); err != nil {
+      t.Fatal(err)
+    }
+  }
+  
+  //luis tiene un libro compartido con ana y pedro.
+  res, err := db.Exec("INSERT INTO libros(nombre, propietario, creado) VALUES('casa', 'luis', ?)", time.Now().UTC().Format(time.RFC3339))
+  if err != nil {
+    t.Fatal(err)
+  }
+  id, _ := res.LastInsertId()
+  casa := int(id)
+  db.Exec("INSERT INTO libro_miembros(libro_id, usuario, rol) VALUES(?1, 'luis', 'propietario'), (?1, 'ana', 'editor'), (?1, 'pedro', 'editor')", casa)
+  
+  dia := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+  nuevo := func(usuario string, monto int64) int {
+    t.Helper()
+    id, err := insertarRegistro(db, Registro{Tipo: "egreso", Monto: Dinero{monto, 2}, Grupo: "Casa", Fecha: dia, Libro: casa}, usuario)
+    if err != nil {
+      t.Fatal(err)
+    }
+    return id
+  }
+  
+  //luis pago 90 entre los tres, pedro anoto 60 que pago ana entre los dos
+  //y ana tiene su propio egreso.
+  mercado := nuevo("luis", 9000)
+  guardarDivision(db, mercado, Division{Modo: "igual", Pagador: "luis", Partes: []Parte{{"luis", Dinero{3000, 2}, 0}, {"ana", Dinero{3000, 2}, 0}, {"pedro", Dinero{3000, 2}, 0}}})
+  luz := nuevo("pedro", 6000)
+  guardarDivision(db, luz, Division{Modo: "igual", Pagador: "ana", Partes: []Parte{{"pedro", Dinero{3000, 2}, 0}, {"ana", Dinero{3000, 2}, 0}}})
+  nuevo("ana", 1500)
+  
+  db.Exec("INSERT INTO sobres(libro_id, nombre) VALUES(?, 'comida')", casa)
+  db.Exec("INSERT INTO asignaciones_sobres(libro_id, destino_id, monto, fecha, usuario) VALUES(?, 1, 1000, ?, 'ana')", casa, dia)
+  if _, err = crearSesion("ana", httptest.NewRequest("POST", "/login", nil)); err != nil {
+    t.Fatal(err)
+  }
+  
+  r := httptest.NewRequest("DELETE", "/admin/usuarios/ana", nil)
+  r = mux.SetURLVars(r.WithContext(context.WithValue(r.Context(), "usuario", "luis")), map[string]string{"nombre": "ana"})
+  w := httptest.NewRecorder()
+  deleteUsuarioAdmin(w, r)
+  if w.Code != http.StatusNoContent {
+    t.Fatalf("borrar: %d %s", w.Code, w.Body)
+  }
+  
+  //ninguna tabla debe nombrar a ana, salvo el historial de intentos.
+  columnas := map[string][]string{
+    "usuarios": {"nombre"}, "registros": {"usuario"}, "libros": {"propietario"},
+    "libro_miembros": {"usuario"}, "divisiones": {"pagador"}, "partes": {"usuario"},
+    "liquidaciones": {"de", "para"}, "categorias": {"usuario"}, "metas": {"usuario"},
+    "presupuestos": {"usuario"}, "recurrencias": {"usuario"}, "asignaciones_sobres": {"usuario"},
+    "sesiones": {"usuario"}, "claves_api": {"usuario"}, "restablecer_clave": {"usuario"},
+    "codigos_recuperacion": {"usuario"}, "exportaciones": {"usuario"},
+  }
+  for tabla, cols := range columnas {
+    for _, col := range cols {
+      var n int
+      if err := db.QueryRow("SELECT COUNT(*) FROM " + tabla + " WHERE " + col + " = 'ana'").Scan(&n); err != nil {
+        t.Fatalf("%s.%s: %v", tabla, col, err)
+      }
+      if n != 0 {
+        t.Errorf("quedaron %d filas de ana en %s.%s", n, tabla, col)
+      }
+    }
+  }
+  
+  //la parte de ana en el mercado la asume luis, que fue quien pago.
+  var luis, total int64
+  db.QueryRow("SELECT monto FROM partes WHERE registro_id = ? AND usuario = 'luis'", mercado).Scan(&luis)
+  db.QueryRow("SELECT SUM(monto) FROM partes WHERE registro_id = ?", mercado).Scan(&total)
+  if luis != 6000 || total != 9000 {
+    t.Errorf("luis quedo con %d y las partes suman %d, esperaba 6000 y 9000", luis, total)
+  }
+  
+  //en las deudas solo queda que pedro le debe 30 a luis.
+  saldos, err := saldosLibro(casa, "luis")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if _, ok := saldos["ana"]; ok || saldos["luis"] != 300000 || saldos["pedro"] != -300000 {
+    t.Errorf("saldos inesperados %v", saldos)
+  }
+}
@@ -1,12 +1,14 @@
 package main
 
 import (
+  "bytes"
+  "errors"
+  "io"
   "net/http"
   "time"
   "fmt"
   "database/sql"
   "encoding/json"
-  "encoding/csv"
   "log"
   "strconv"
   
@@ -19,53 +21,32 @@ var db *sql.DB
 
 //GETS
 
-//getEgresos consulta los egresos en la tabla, que sean egresos y luego
-//los envia en formato json al navegador.
+//getEgresos lista los egresos del usuario. Es lo mismo que /movimientos con
+//tipo=egreso, asi que acepta los mismos filtros y responde paginado.
 func getEgresos(w http.ResponseWriter, r *http.Request) {
-  //obtenemos el usuario del contexto que es pasado del middleware.
-  nombreUsuario := r.Context().Value("usuario").(string)
-  
-  //consultamos en la tabla los egresos
-  registros, err := getRegistros("egreso", nombreUsuario)
-  if err != nil {
-    writeError(w, "Error en al consultar los registros", err, http.StatusInternalServerError)
-    return
-  }
-  
-  //Establecemos el header de tipo json
-  w.Header().Set("Contenct-Type", "application/json")
-  w.WriteHeader(http.StatusOK)
-  //Pasamos todos los datos del slice a json y los enviamos
-  //al usuario, valodamos el error
-  json.NewEncoder(w).Encode(registros)
+  getMovimientosTipo(w, r, "egreso")
 }
 
-//getIngresos consulta en la base de datos y retorna los ingresos ssegun el usuario.
+//getIngresos lista los ingresos del usuario, paginado igual que /movimientos.
 func getIngresos(w http.ResponseWriter, r *http.Request) {
-  nombreUsuario := r.Context().Value("usuario").(string)
-  
-  //consultamos los movimientos tipo ingreso, validamos el error.
-  registros, err := getRegistros("ingreso", nombreUsuario)
-  if err != nil {
-    writeError(w, "Error en al consultar los registros", err, http.StatusInternalServerError)
-    return
-  }
-  
-  //Establecemos el header de tipo json
-  w.Header().Set("Contenct-Type", "application/json")
-  w.WriteHeader(http.StatusOK)
- 
-  //Pasamos todos los datos del slice a json y los enviamos
-  //al usuario, valodamos el error
-  err = json.NewEncoder(w).Encode(registros)
-  if err != nil {
-    http.Error(w, "error al enviar los datos del getIngresos", http.StatusInternalServerError)
-  }
+  getMovimientosTipo(w, r, "ingreso")
+}
+
+//getMovimientosTipo le pasa la peticion a getMovimientos forzando el tipo.
+func getMovimientosTipo(w http.ResponseWriter, r *http.Request, tipo string) {
+  //clonamos la peticion para no modificar la URL original.
+  r = r.Clone(r.Context())
+  q := r.URL.Query()
+  q.Set("tipo", tipo)
+  r.URL.RawQuery = q.Encode()
+  
+  getMovimientos(w, r)
 }
 
 //getTotalEgresos devuelve el total de egresos dependiendo de las fechas
 //que se le pasen, sumara todo entre ellas y devolvera solo la suma
-//Ejm consulta http://100.69.187.16:8080/totalEgresos?desde=2024-12-20T00:00:00Z&hasta=2024-12-31T00:00:00Z
+//Con moneda=USD convierte cada egreso con la tasa de su fecha.
+//Ejm consulta http://100.69.187.16:8080/totalEgresos?desde=2024-12-20T00:00:00Z&hasta=2024-12-31T00:00:00Z&moneda=USD
 func getTotalEgresos(w http.ResponseWriter, r *http.Request) {
   nombreUsuario := r.Context().Value("usuario").(string)
   
@@ -83,23 +64,35 @@ func getTotalEgresos(w http.ResponseWriter, r *http.Request) {
     return
   }
   
+  moneda, err := leerMoneda(r)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  
+  libro, ok := libroPeticion(w, r, false)
+  if !ok {
+    return
+  }
+  
   //consultamos en la tabla egresos con fecha de inicio y fin.
-  total, err := getTotal("egreso", desde, hasta, nombreUsuario)
+  total, err := getTotal("egreso", desde, hasta, libro, nombreUsuario, moneda)
   if err != nil {
-    writeError(w, "Error en al consultar los registros", err, http.StatusInternalServerError)
+    writeError(w, "Error en al consultar los registros", err, statusConversion(err))
     return
   }
   
   // Devolvemos el total en JSON, lo pasamos a map ya que la funcion Encode
   //necesita un tipo de dato que sea compatiple para codificar.
-  jsonTotalEgresos := map[string]int{"total": total}
+  jsonTotalEgresos := map[string]Dinero{"total": total}
   w.Header().Set("Content-Type", "application/json")
   json.NewEncoder(w).Encode(jsonTotalEgresos)
 }
 
 //getTotalIngresos devuelve el total de ingresos dependiendo de las fechas
 //que se le pasen, sumara todo entre ellas y devolvera solo la suma
-//consulta http://100.69.187.16:8080/totalIngresos?desde=2024-12-04T00:00:00Z&hasta=2024-12-20T00:00:00Z
+//Con moneda=USD convierte cada ingreso con la tasa de su fecha.
+//consulta http://100.69.187.16:8080/totalIngresos?desde=2024-12-04T00:00:00Z&hasta=2024-12-20T00:00:00Z&moneda=USD
 func getTotalIngresos(w http.ResponseWriter, r *http.Request) {
   
   nombreUsuario := r.Context().Value("usuario").(string)
@@ -118,16 +111,27 @@ func getTotalIngresos(w http.ResponseWriter, r *http.Request) {
     return
   }
   
+  moneda, err := leerMoneda(r)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  
+  libro, ok := libroPeticion(w, r, false)
+  if !ok {
+    return
+  }
+  
   //consultamos en la tabla solos los ingresos entre las fechas.
-  total, err := getTotal("ingreso", desde, hasta, nombreUsuario)
+  total, err := getTotal("ingreso", desde, hasta, libro, nombreUsuario, moneda)
   if err != nil {
-    writeError(w, "Error en al consultar los registros", err, http.StatusInternalServerError)
+    writeError(w, "Error en al consultar los registros", err, statusConversion(err))
     return
   }
   
   // Devolvemos el total en JSON, lo pasamos a map ya que la funcion Encode
   //necesita un tipo de dato que sea compatiple para codificar.
-  jsonTotalIngresos := map[string]int{"total": total}
+  jsonTotalIngresos := map[string]Dinero{"total": total}
   w.Header().Set("Content-Type", "application/json")
   json.NewEncoder(w).Encode(jsonTotalIngresos)
 }
@@ -145,8 +149,12 @@ func getById(w http.ResponseWriter, r *http.Request) {
     return
   }
   
-  //consultamos la tabla con id y usuario.
+  //consultamos la tabla con id, solo si esta en un libro del usuario.
   m, err := getRegistroById(id, nombreUsuario)
+  if errors.Is(err, sql.ErrNoRows) {
+    http.Error(w, "No existe un registro con ese id.", http.StatusNotFound)
+    return
+  }
   if err != nil {
     writeError(w, "Error en al consultar el registro", err, http.StatusInternalServerError)
     return
@@ -157,122 +165,171 @@ func getById(w http.ResponseWriter, r *http.Request) {
   json.NewEncoder(w).Encode(m)
 }
 
-//exportFechas exporta a un archivo .json o .csv despendiendo del tipo 
-//dado solo los regustris que esten dentro del rango de fechas que se le pase.
+//exportFechas exporta a un archivo .json, .ndjson, .csv, .xlsx, .ofx o de
+//ledger despendiendo del tipo dado solo los regustris que esten dentro del
+//rango de fechas que se le pase. Los formatos por filas se van enviando
+//mientras se leen, para rangos muy grandes esta /exportaciones.
 //ejm http://10.151.44.98:8080/exportRango?desde=2024-12-04T00:00:00Z&hasta=2024-12-20T00:00:00Z&tipo=json
 func exportFechas(w http.ResponseWriter, r *http.Request) {
   nombreUsuario := r.Context().Value("usuario").(string)
   
   //Recibe las fechas y en el formato para time.Time y validamos el error.
-  desde, err := time.Parse("2006-01-02T00:00:00Z", r.URL.Query().Get("desde"))
+  desde, err := leerFecha(r, "desde")
   if err != nil {
-    errorStr := fmt.Sprintf("Error en la fecha ingresada 'desde', %v", err)
-    http.Error(w, errorStr, http.StatusBadRequest)
+    http.Error(w, err.Error(), http.StatusBadRequest)
     return
   }
-  hasta, err := time.Parse("2006-01-02T00:00:00Z", r.URL.Query().Get("hasta"))
+  hasta, err := leerFecha(r, "hasta")
   if err != nil {
-    errorStr := fmt.Sprintf("Error en la fecha ingresada 'hasta', %v", err)
-    http.Error(w, errorStr, http.StatusBadRequest)
+    http.Error(w, err.Error(), http.StatusBadRequest)
     return
   }
   //obtenemos el tipo de archivo y validamos que solo sean los que maneja
-  tipo := string(r.URL.Query().Get("tipo"))
-  if tipo != "json" && tipo != "csv" {
-    http.Error(w, "El tipo solo puede ser json o csv.", http.StatusBadRequest)
+  tipo := r.URL.Query().Get("tipo")
+  if tipo == "" {
+    tipo = "json"
+  }
+  formato, ok := formatosExportacion[tipo]
+  if !ok {
+    http.Error(w, "El tipo solo puede ser json, ndjson, csv, xlsx, ofx o ledger.", http.StatusBadRequest)
     return
   }
-  
-  //Consultamos la base de datis, validamos el error.
-  registros, err := getRegistrosFechas(desde, hasta, nombreUsuario)
-  if err != nil {
-    writeError(w, "Error al consultar los regustris en la base de datos.", err, http.StatusInternalServerError)
+  libro, ok := libroPeticion(w, r, false)
+  if !ok {
     return
   }
   
-	if tipo == "csv" {
-	  
-    //establecemos las cabeceras para indicar que es una descarga de archivo CSV
-	  w.Header().Set("Content-Disposition", "attachment; filename=registros.csv")
-	  //le informamos el tipo de arcrivo que sera.
-	  w.Header().Set("Content-Type", "text/csv")
-    
-    //creamos un writer del resposeWriter para poder escribirle
-    writer := csv.NewWriter(w)
-    defer writer.Flush() //Lo liberamos
-    
-    // Encabezado para el archivo
-	  writer.Write([]string{"Tipo", "Monto", "Descripcion", "Grupo", "Fecha"})
-    
-    //Recirremos el slite de movimientos para imprimirlos en cada fila del csv  
-    for _, fila := range registros {
-      //La funcion movimientoASlice pasa cada estructura tupo Registro a
-      //un slite de string con solo los campos de tipo, monto, Descripcion, grupo y fecha
-      err = writer.Write(movimientoASlice(fila))
-      if err != nil {
-        errorStr := fmt.Sprintf("Error al escribir el el archivo. %v", err)
-        http.Error(w, errorStr, http.StatusInternalServerError)
-        return
-      }
-    }
-	} else {
-    //establecemos las cabeceras para indicar que es una descarga de archivo CSV
-	  w.Header().Set("Content-Disposition", "attachment; filename=registros.json")
-	  //le informamos el tipo de arcrivo que sera.
-	  w.Header().Set("Content-Type", "application/json")
-  	
-  	//Creamos un Encoder del archivo para escribir formato json en el.
-  	encoder := json.NewEncoder(w)
-  	encoder.SetIndent("", "  ")
-  	//escribimos todo el slite de movimientos
-  	err = encoder.Encode(registrosASimples(registros))
-  	if err != nil {
-  	  http.Error(w, "Error al escribir en el archivo", http.StatusInternalServerError)
-  	  return
-  	}
-	}
+  //establecemos las cabeceras para indicar que es una descarga de archivo
+  w.Header().Set("Content-Disposition", "attachment; filename=registros." + formato.extension)
+  w.Header().Set("Content-Type", formato.contentType)
   
+  //cada vez que se vacia se extiende el WriteTimeout del servidor, asi una
+  //exportacion larga no se corta mientras siga enviando datos.
+  rc := http.NewResponseController(w)
+  vaciar := func() {
+    rc.SetWriteDeadline(time.Now().Add(30 * time.Second))
+    rc.Flush()
+  }
+  rc.SetWriteDeadline(time.Now().Add(30 * time.Second))
+  
+  salida := &escritorContado{w: w}
+  err = escribirExportacion(salida, tipo, libro, nombreUsuario, desde, hasta, vaciar)
+  if err != nil {
+    //si todavia no se envio nada aun podemos responder con el error, si
+    //falla a mitad los encabezados ya se enviaron y solo queda registrarlo.
+    if salida.n == 0 {
+      w.Header().Del("Content-Disposition")
+      writeError(w, "Error al exportar los registros", err, statusConversion(err))
+      return
+    }
+    log.Printf("Error al exportar los registros de %s, %v", nombreUsuario, err)
+  }
 }
 
 //POSTS
 
 //postEgreso agrega un moviviento en la tabla de tipo egreso, se resive con un Json.
-//Json ejemplo{"monto": 22,"fecha": "2024-12-05T00:00:00Z"}
+//Sin libro en el body o en ?libro= queda en el libro personal. Con division
+//el egreso se reparte entre miembros del libro (ver Division).
+//Json ejemplo{"monto": 22,"fecha": "2024-12-05T00:00:00Z", "libro": 2}
+//Json ejemplo{"monto": 90, "fecha": "2024-12-05T00:00:00Z", "libro": 2, "division": {"modo": "igual", "partes": [{"usuario": "ana1"}, {"usuario": "pedro1"}]}}
 func postEgreso(w http.ResponseWriter, r *http.Request) {
   nombreUsuario := r.Context().Value("usuario").(string)
   
-  //Creo la variable para almacenar los datos que envia el cliente
-  var m Registro
+  //Creo la variable para almacenar los datos que envia el cliente, el
+  //registro y si se divide la division. Las alertas del presupuesto solo
+  //van en la respuesta.
+  var datos struct {
+    Registro
+    Division *Division `json:"division,omitempty"`
+    Alertas []AlertaPresupuesto `json:"alertas,omitempty"`
+  }
   //Decodifico el dato de un json a la variable creada al mismo tiempo que evaluo el error
-  err := json.NewDecoder(r.Body).Decode(&m)
+  err := json.NewDecoder(r.Body).Decode(&datos)
   if err != nil {
     http.Error(w, "Error al leer el json.", http.StatusBadRequest)
     return
   }
+  m := datos.Registro
   //validamos que si engresara los campos obligatorios
   err = comprobarInfoRequest(m)
   if err != nil {
     http.Error(w, "Error, datos omitidos en el egreso", http.StatusBadRequest)
     return
   }
+  //el grupo debe ser una categoria del usuario.
+  if !resolverGrupoRequest(w, r, nombreUsuario, &m) {
+    return
+  }
+  if !libroRegistro(w, r, &m) {
+    return
+  }
+  //las transferencias solo se crean desde /transferencias y los registros
+  //de una recurrencia los crea el programador.
+  m.Transferencia = 0
+  m.Recurrencia = 0
+  if !validarCuentaRegistro(w, m) || !resolverMoneda(w, &m) {
+    return
+  }
   
   //Establesco las variables que se usaran para la manejar los movimientos.
   m.Tipo = "egreso"
+  m.Usuario = nombreUsuario
+  if !validarSobreRegistro(w, m) || !validarMetaRegistro(w, m) {
+    return
+  }
   
-  //Insertamos los datos en la tabla movimienos de la base de datos
-  _, err = db.Exec("INSERT INTO registros ( tipo, monto, descripcion, grupo, fecha, usuario ) VALUES(?, ?, ?, ?, ?, ?)", m.Tipo, m.Monto, m.Descripcion, m.Grupo, m.Fecha, nombreUsuario)
+  //las partes deben ser de miembros del libro y sumar el monto.
+  if datos.Division != nil {
+    miembros, err := miembrosLibro(m.Libro)
+    if err != nil {
+      writeError(w, "Error al consultar el libro", err, http.StatusInternalServerError)
+      return
+    }
+    err = calcularDivision(datos.Division, m, miembros)
+    if err != nil {
+      writeError(w, "Error en la division", err, http.StatusUnprocessableEntity)
+      return
+    }
+  }
+  
+  //el estado del presupuesto antes del egreso para saber que umbral se pasa.
+  antes, conPresupuesto := estadoGrupoEgreso(m, nombreUsuario)
+  
+  //Insertamos los datos en la tabla movimienos de la base de datos, con la
+  //division en la misma transaccion.
+  tx, err := db.Begin()
+  if err != nil {
+    http.Error(w, "Error al insertar egreso en la tabla.", http.StatusInternalServerError)
+    return
+  }
+  defer tx.Rollback()
+  m.Id, err = insertarRegistro(tx, m, nombreUsuario)
+  if err == nil && datos.Division != nil {
+    err = guardarDivision(tx, m.Id, *datos.Division)
+  }
+  if err == nil {
+    err = tx.Commit()
+  }
   //Valido el error al insertar los datos
   if err != nil {
     http.Error(w, "Error al insertar egreso en la tabla.", http.StatusInternalServerError)
     return
   }
+  datos.Registro = m
+  datos.Alertas = nil
+  if conPresupuesto {
+    if despues, ok := estadoGrupoEgreso(m, nombreUsuario); ok {
+      datos.Alertas = alertasPresupuesto(antes, despues)
+    }
+  }
   
   //Establesco la cabecera para responder
   w.Header().Set("Contenct-Type", "application/json")
   w.WriteHeader(http.StatusCreated)
   //Convertimos la estructura a json y enviamos los datos
   //comprobamos el error al pasarlos
-  err = json.NewEncoder(w).Encode(m)
+  err = json.NewEncoder(w).Encode(datos)
   if err != nil {
     errorStr := fmt.Sprintf("Error al escribir el json con los datos que se ingresaron. %v", err)
     http.Error(w, errorStr, http.StatusInternalServerError)
@@ -299,11 +356,28 @@ func postIngreso(w http.ResponseWriter, r *http.Request) {
     http.Error(w, "Error, datos de movimiento omitidos.", http.StatusBadRequest)
     return
   }
+  //el grupo debe ser una categoria del usuario.
+  if !resolverGrupoRequest(w, r, nombreUsuario, &m) {
+    return
+  }
+  if !libroRegistro(w, r, &m) {
+    return
+  }
+  m.Transferencia = 0
+  m.Recurrencia = 0
+  if !validarCuentaRegistro(w, m) || !resolverMoneda(w, &m) {
+    return
+  }
   
   m.Tipo = "ingreso"
+  m.Usuario = nombreUsuario
+  //los ingresos van a lo que hay por asignar, no a un sobre.
+  if !validarSobreRegistro(w, m) || !validarMetaRegistro(w, m) {
+    return
+  }
   
   //Insertamos los datos en la tabla movimienos de la base de datos
-  _, err = db.Exec("INSERT INTO registros ( tipo, monto, descripcion, grupo, fecha, usuario ) VALUES(?, ?, ?, ?, ?, ?)", m.Tipo, m.Monto, m.Descripcion, m.Grupo, m.Fecha, nombreUsuario)
+  m.Id, err = insertarRegistro(db, m, nombreUsuario)
   //Valido el error al insertar los datos
   if err != nil {
     http.Error(w, "Error al insertar ingreso en la tabla.", http.StatusInternalServerError)
@@ -340,6 +414,10 @@ func registrar(w http.ResponseWriter, r *http.Request) {
     http.Error(w, "Error, formato de clave errado.", http.StatusBadRequest)
     return
   }
+  if u.Email != "" && !validarEmail(u.Email) {
+    http.Error(w, "Error, formato de email errado.", http.StatusBadRequest)
+    return
+  }
   
   //guardamos el usuario y su clave en la base de datos
   err = guardarUsuario(u)
@@ -360,6 +438,7 @@ func login(w http.ResponseWriter, r *http.Request) {
   err := json.NewDecoder(r.Body).Decode(&u)
   if err != nil {
     writeError(w, "Error al obtener los datos del body", err, http.StatusBadRequest)
+    return
   }
     
   //validamos el usuario y la contraseña.
@@ -371,16 +450,55 @@ func login(w http.ResponseWriter, r *http.Request) {
     http.Error(w, "Error, formato de usuario errado.", http.StatusBadRequest)
     return
   }
+  
+  //si hubo muchos fallos seguidos el usuario o la ip deben esperar.
+  ip := ipCliente(r)
+  if !limitarIntentos(w, u.Nombre, ip) {
+    return
+  }
 
   //comparamos valores con los de la base de datos
   err = comprobarUsuario(u)
+  if err == errCredenciales {
+    registrarIntento(u.Nombre, ip, false, "clave")
+    http.Error(w, "Error el usuario o contraseña incorecto.", http.StatusUnauthorized)
+    return
+  }
+  if err != nil {
+    writeError(w, "Error al comprobar el usuario", err, http.StatusInternalServerError)
+    return
+  }
+  if !permitirLogin(w, u.Nombre) {
+    return
+  }
+  
+  //si tiene segundo factor no damos tokens todavia, solo un desafio que se
+  //cambia en /login/2fa con el codigo de la app.
+  activo, err := tiene2FA(u.Nombre)
   if err != nil {
-    writeError(w, "Error el usuario o contraseña incorecto.", err, http.StatusInternalServerError)
+    writeError(w, "Error al consultar el usuario", err, http.StatusInternalServerError)
     return
   }
+  //con segundo factor el intento correcto se guarda en /login/2fa, si se
+  //guardara aqui cada login con la clave borraria los codigos fallidos.
+  if activo {
+    desafio, err := crearDesafio2FA(u.Nombre)
+    if err != nil {
+      writeError(w, "Error al crear el desafio", err, http.StatusInternalServerError)
+      return
+    }
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(map[string]interface{}{
+      "requiere2fa": true,
+      "desafio": desafio,
+    })
+    return
+  }
+  registrarIntento(u.Nombre, ip, true, "")
   
-  //creamos un jwt para el usuario. Co  este podra usar lasdiferentes rutas de la api.
-  tokenString, err := crearJWT(u.Nombre)
+  //creamos una sesion para el usuario con su jwt y el refresh token. Con el
+  //jwt podra usar lasdiferentes rutas de la api y con el refresh pedir otro.
+  tokens, err := crearSesion(u.Nombre, r)
   if err != nil {
     writeError(w, "Error al crear el jwt.", err, http.StatusInternalServerError)
     return
@@ -388,9 +506,7 @@ func login(w http.ResponseWriter, r *http.Request) {
   
   //Enviamos el token
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"token": tokenString,
-	})
+	json.NewEncoder(w).Encode(tokens)
 }
 
 //PUTS
@@ -400,7 +516,7 @@ func login(w http.ResponseWriter, r *http.Request) {
 //asume que el cliente envia los datos completos.
 //ejm http://100.69.187.16:8080/movimiento/9
 // {"monto": 333, "grupo": "nuevo", "usuario": "carlos"}
-//ToDo: LOS DATOS OMITIDOS DEJARLOS CON EL MISMO VALOR.
+//Para actualizar solo algunos campos se usa el PATCH (patchById).
 func putById(w http.ResponseWriter, r *http.Request) {
   nombreUsuario := r.Context().Value("usuario").(string)
   
@@ -421,20 +537,173 @@ func putById(w http.ResponseWriter, r *http.Request) {
     http.Error(w, errorStr, http.StatusBadRequest)
     return
   }
+  //el grupo debe ser una categoria del usuario.
+  if !resolverGrupoRequest(w, r, nombreUsuario, &m) {
+    return
+  }
+  //la cuenta debe ser del libro del registro, que no cambia.
+  actual, err := getRegistroById(id, nombreUsuario)
+  if errors.Is(err, sql.ErrNoRows) {
+    http.Error(w, "No existe un registro con ese id o no lo puede modificar.", http.StatusNotFound)
+    return
+  }
+  if err != nil {
+    writeError(w, "Error en al consultar el registro", err, http.StatusInternalServerError)
+    return
+  }
+  if actual.Transferencia != 0 {
+    http.Error(w, "Error, el registro es de una transferencia, elimine la transferencia y creela de nuevo.", http.StatusConflict)
+    return
+  }
+  m.Libro = actual.Libro
+  m.Transferencia = 0
+  m.Recurrencia = actual.Recurrencia
+  //el PUT no cambia el tipo.
+  m.Tipo = actual.Tipo
+  //si sigue en una cuenta o un sobre ya archivado no se revisa.
+  if m.Cuenta != actual.Cuenta && !validarCuentaRegistro(w, m) {
+    return
+  }
+  if m.Sobre != actual.Sobre && !validarSobreRegistro(w, m) {
+    return
+  }
+  //la meta se revisa si cambia algo de lo que pide.
+  if (m.Meta != actual.Meta || m.Cuenta != actual.Cuenta || m.Grupo != actual.Grupo) && !validarMetaRegistro(w, m) {
+    return
+  }
+  if m.Moneda == "" {
+    m.Moneda = actual.Moneda
+  }
+  if !resolverMoneda(w, &m) {
+    return
+  }
+  //el PUT no cambia el tipo, solo revisamos que el monto siga cuadrando.
+  if !validarCambioDividido(w, id, m.Monto, "egreso") {
+    return
+  }
   
-  //Actualizamos los datos en la tabla por id y validamos el error.
-  _, err = db.Exec("UPDATE registros SET monto = ?, descripcion = ?, grupo = ?, fecha = ? WHERE id = ? AND usuario = ?", m.Monto, m.Descripcion, m.Grupo, m.Fecha, id, nombreUsuario)
+  //Actualizamos los datos en la tabla por id y validamos el error. Solo
+  //si el usuario puede editar el libro del registro, el libro no cambia.
+  res, err := db.Exec("UPDATE registros SET monto = ?, exponente = ?, moneda = ?, descripcion = ?, grupo = ?, fecha = ?, cuenta_id = NULLIF(?, 0), sobre_id = NULLIF(?, 0), meta_id = NULLIF(?, 0) WHERE id = ? AND " + condicionEditor, m.Monto.Unidades, m.Monto.Exponente, m.Moneda, m.Descripcion, m.Grupo, m.Fecha, m.Cuenta, m.Sobre, m.Meta, id, nombreUsuario)
   if err != nil {
     errorStr := fmt.Sprintf("Error al actualizar el registro en la base de datos con el id ingresado. %v", err)
     http.Error(w, errorStr, http.StatusInternalServerError)
     return
   }
+  if filas, _ := res.RowsAffected(); filas == 0 {
+    http.Error(w, "No existe un registro con ese id o no lo puede modificar.", http.StatusNotFound)
+    return
+  }
   
   //establecemos cabeceras y respondemos con un json.
   w.Header().Set("Content-Type", "application/json")
   json.NewEncoder(w).Encode(m)
 }
 
+//PATCHES
+
+//patchById actualiza solo los campos que envie el cliente. Acepta JSON Merge
+//Patch (application/merge-patch+json) y JSON Patch (application/json-patch+json).
+//ejm http://100.69.187.16:8080/movimiento/9
+// {"grupo": "nuevo"} o [{"op": "replace", "path": "/monto", "value": 333}]
+func patchById(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  //Extraemos la el id de la URL y aseguramos que sea un int.
+  id, err := strconv.Atoi(mux.Vars(r)["id"])
+  if err != nil {
+    http.Error(w, "Error en id, se esperaba un numero de tipo int.", http.StatusBadRequest)
+    return
+  }
+  
+  //consultamos el registro actual, si no esta en sus libros no existe para el.
+  actual, err := getRegistroById(id, nombreUsuario)
+  if errors.Is(err, sql.ErrNoRows) {
+    http.Error(w, "No existe un registro con ese id.", http.StatusNotFound)
+    return
+  }
+  if err != nil {
+    writeError(w, "Error en al consultar el registro", err, http.StatusInternalServerError)
+    return
+  }
+  if actual.Transferencia != 0 {
+    http.Error(w, "Error, el registro es de una transferencia, elimine la transferencia y creela de nuevo.", http.StatusConflict)
+    return
+  }
+  
+  //leemos el patch y lo aplicamos sobre el registro en formato json.
+  patch, err := io.ReadAll(r.Body)
+  if err != nil {
+    writeError(w, "Error al leer el body", err, http.StatusBadRequest)
+    return
+  }
+  original, err := json.Marshal(actual)
+  if err != nil {
+    writeError(w, "Error al convertir el registro a json", err, http.StatusInternalServerError)
+    return
+  }
+  resultado, err := aplicarPatch(original, patch, r.Header.Get("Content-Type"))
+  if err != nil {
+    writeError(w, "Error al aplicar el patch", err, http.StatusUnprocessableEntity)
+    return
+  }
+  
+  //pasamos el resultado a la estructura sin permitir campos desconocidos.
+  var m Registro
+  decoder := json.NewDecoder(bytes.NewReader(resultado))
+  decoder.DisallowUnknownFields()
+  err = decoder.Decode(&m)
+  if err != nil {
+    writeError(w, "Error en los datos del patch", err, http.StatusUnprocessableEntity)
+    return
+  }
+  
+  //el id, el usuario, el libro, la transferencia, la recurrencia y el fitid
+  //del banco no se pueden cambiar.
+  if m.Id != actual.Id || m.Usuario != actual.Usuario || m.Libro != actual.Libro || m.Transferencia != actual.Transferencia || m.Recurrencia != actual.Recurrencia || m.Fitid != actual.Fitid {
+    http.Error(w, "Error, el id, el usuario, el libro, la transferencia, la recurrencia y el fitid no se pueden modificar.", http.StatusUnprocessableEntity)
+    return
+  }
+  err = validarRegistro(m)
+  if err != nil {
+    writeError(w, "Error en los datos del registro", err, http.StatusUnprocessableEntity)
+    return
+  }
+  if !resolverGrupoRequest(w, r, nombreUsuario, &m) {
+    return
+  }
+  if m.Cuenta != actual.Cuenta && !validarCuentaRegistro(w, m) {
+    return
+  }
+  if (m.Sobre != actual.Sobre || m.Tipo != actual.Tipo) && !validarSobreRegistro(w, m) {
+    return
+  }
+  if (m.Meta != actual.Meta || m.Cuenta != actual.Cuenta || m.Grupo != actual.Grupo) && !validarMetaRegistro(w, m) {
+    return
+  }
+  if !resolverMoneda(w, &m) {
+    return
+  }
+  if !validarCambioDividido(w, id, m.Monto, m.Tipo) {
+    return
+  }
+  
+  //guardamos el registro ya mezclado, solo si puede editar el libro.
+  res, err := db.Exec("UPDATE registros SET tipo = ?, monto = ?, exponente = ?, moneda = ?, descripcion = ?, grupo = ?, fecha = ?, cuenta_id = NULLIF(?, 0), sobre_id = NULLIF(?, 0), meta_id = NULLIF(?, 0) WHERE id = ? AND " + condicionEditor, m.Tipo, m.Monto.Unidades, m.Monto.Exponente, m.Moneda, m.Descripcion, m.Grupo, m.Fecha, m.Cuenta, m.Sobre, m.Meta, id, nombreUsuario)
+  if err != nil {
+    writeError(w, "Error al actualizar el registro en la base de datos", err, http.StatusInternalServerError)
+    return
+  }
+  if filas, _ := res.RowsAffected(); filas == 0 {
+    http.Error(w, "Error, solo puede ver los registros de este libro.", http.StatusForbidden)
+    return
+  }
+  
+  //respondemos con el registro completo ya actualizado.
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(m)
+}
+
 //DELETES
 
 //deleteById elimina un registro segun el id ingresado.
@@ -448,8 +717,13 @@ func deleteById(w http.ResponseWriter, r *http.Request) {
     return
   }
   
+  //si es de una transferencia tambien se elimina el otro registro del par.
+  var transferencia int
+  db.QueryRow("SELECT COALESCE(transferencia_id, 0) FROM registros WHERE id = ? AND " + condicionEditor, id, nombreUsuario).Scan(&transferencia)
+  
   //preparamos la instruccion para sqlite.
-  stmt, err := db.Prepare("DELETE FROM registros WHERE id = ? AND usuario = ?")
+  //solo si el usuario puede editar el libro del registro.
+  stmt, err := db.Prepare("DELETE FROM registros WHERE id = ? AND " + condicionEditor)
   if err != nil {
     http.Error(w, "Error preparando SQL", http.StatusInternalServerError)
     return
@@ -470,10 +744,21 @@ func deleteById(w http.ResponseWriter, r *http.Request) {
     http.Error(w, "No se eliminó ningún registro", http.StatusNotFound)
     return
   }
+  //quitamos su division o su liquidacion para no descuadrar las deudas.
+  err = borrarDivisionRegistro(db, id)
+  if err != nil {
+    writeError(w, "Error al eliminar la division del registro", err, http.StatusInternalServerError)
+    return
+  }
+  err = borrarTransferenciaRegistro(db, transferencia)
+  if err != nil {
+    writeError(w, "Error al eliminar la transferencia del registro", err, http.StatusInternalServerError)
+    return
+  }
   
   //respondemos al usuario.
   w.WriteHeader(http.StatusOK)
-  fmt.Fprintf(w, "Movimiento con ID %s eliminado correctamente", id)
+  fmt.Fprintf(w, "Movimiento con ID %d eliminado correctamente", id)
 }
 
 func main() {
@@ -485,21 +770,105 @@ func main() {
   
   initDB()
   defer db.Close()
+  mailer = nuevoMailer()
+  iniciarProgramador()
   r := mux.NewRouter()
   
   r.HandleFunc("/registrar", registrar).Methods("POST")
   r.HandleFunc("/login", login).Methods("POST")
+  r.HandleFunc("/login/2fa", login2FA).Methods("POST")
+  r.HandleFunc("/token/refresh", refrescarToken).Methods("POST")
+  r.Handle("/logout", authMiddleware(requiereSesion(http.HandlerFunc(logout)))).Methods("POST")
+  r.Handle("/sesiones", authMiddleware(http.HandlerFunc(getSesiones))).Methods("GET")
+  r.Handle("/sesiones/{id}", authMiddleware(requiereSesion(http.HandlerFunc(deleteSesion)))).Methods("DELETE")
+  r.Handle("/usuario/clave", authMiddleware(requiereSesion(http.HandlerFunc(putClave)))).Methods("PUT")
+  r.Handle("/usuario/email", authMiddleware(requiereSesion(http.HandlerFunc(putEmail)))).Methods("PUT")
+  r.HandleFunc("/clave/olvido", olvideClave).Methods("POST")
+  r.HandleFunc("/clave/restablecer", restablecerClave).Methods("POST")
+  r.Handle("/2fa/inscribir", authMiddleware(requiereSesion(http.HandlerFunc(inscribir2FA)))).Methods("POST")
+  r.Handle("/2fa/confirmar", authMiddleware(requiereSesion(http.HandlerFunc(confirmar2FA)))).Methods("POST")
+  r.Handle("/2fa/desactivar", authMiddleware(requiereSesion(http.HandlerFunc(desactivar2FA)))).Methods("POST")
+  r.Handle("/2fa/recuperacion", authMiddleware(requiereSesion(http.HandlerFunc(regenerarRecuperacion)))).Methods("POST")
+  r.Handle("/claves-api", authMiddleware(http.HandlerFunc(getClavesApi))).Methods("GET")
+  r.Handle("/claves-api", authMiddleware(requiereSesion(http.HandlerFunc(postClaveApi)))).Methods("POST")
+  r.Handle("/claves-api/{id}", authMiddleware(requiereSesion(http.HandlerFunc(deleteClaveApi)))).Methods("DELETE")
+  
+  r.Handle("/libros", authMiddleware(http.HandlerFunc(getLibros))).Methods("GET")
+  r.Handle("/libros", authMiddleware(requiereEscritura(http.HandlerFunc(postLibro)))).Methods("POST")
+  r.Handle("/libros/{id}", authMiddleware(requiereEscritura(http.HandlerFunc(putLibro)))).Methods("PUT")
+  r.Handle("/libros/{id}", authMiddleware(requiereEscritura(http.HandlerFunc(deleteLibro)))).Methods("DELETE")
+  r.Handle("/libros/{id}/miembros", authMiddleware(http.HandlerFunc(getMiembrosLibro))).Methods("GET")
+  r.Handle("/libros/{id}/miembros/{usuario}", authMiddleware(requiereEscritura(http.HandlerFunc(putMiembroLibro)))).Methods("PUT")
+  r.Handle("/libros/{id}/miembros/{usuario}", authMiddleware(requiereEscritura(http.HandlerFunc(deleteMiembroLibro)))).Methods("DELETE")
+  
+  r.Handle("/cuentas", authMiddleware(http.HandlerFunc(getCuentas))).Methods("GET")
+  r.Handle("/cuentas", authMiddleware(requiereEscritura(http.HandlerFunc(postCuenta)))).Methods("POST")
+  r.Handle("/cuentas/{id}", authMiddleware(requiereEscritura(http.HandlerFunc(putCuenta)))).Methods("PUT")
+  r.Handle("/cuentas/{id}/balance", authMiddleware(http.HandlerFunc(getBalanceCuentaHasta))).Methods("GET")
+  r.Handle("/transferencias", authMiddleware(requiereEscritura(http.HandlerFunc(postTransferencia)))).Methods("POST")
+  r.Handle("/presupuestos", authMiddleware(http.HandlerFunc(getPresupuestos))).Methods("GET")
+  r.Handle("/presupuestos", authMiddleware(requiereEscritura(http.HandlerFunc(postPresupuesto)))).Methods("POST")
+  r.Handle("/presupuestos/estado", authMiddleware(http.HandlerFunc(getEstadoPresupuestos))).Methods("GET")
+  r.Handle("/presupuestos/{id}", authMiddleware(requiereEscritura(http.HandlerFunc(putPresupuesto)))).Methods("PUT")
+  r.Handle("/presupuestos/{id}", authMiddleware(requiereEscritura(http.HandlerFunc(deletePresupuesto)))).Methods("DELETE")
+  r.Handle("/sobres", authMiddleware(http.HandlerFunc(getSobres))).Methods("GET")
+  r.Handle("/sobres", authMiddleware(requiereEscritura(http.HandlerFunc(postSobre)))).Methods("POST")
+  r.Handle("/sobres/reporte", authMiddleware(http.HandlerFunc(getReporteSobres))).Methods("GET")
+  r.Handle("/sobres/asignaciones", authMiddleware(requiereEscritura(http.HandlerFunc(postAsignacionSobre)))).Methods("POST")
+  r.Handle("/sobres/asignaciones/{id}", authMiddleware(requiereEscritura(http.HandlerFunc(deleteAsignacionSobre)))).Methods("DELETE")
+  r.Handle("/sobres/{id}", authMiddleware(requiereEscritura(http.HandlerFunc(putSobre)))).Methods("PUT")
+  r.Handle("/recurrencias", authMiddleware(http.HandlerFunc(getRecurrencias))).Methods("GET")
+  r.Handle("/recurrencias", authMiddleware(requiereEscritura(http.HandlerFunc(postRecurrencia)))).Methods("POST")
+  r.Handle("/recurrencias/previsualizar", authMiddleware(http.HandlerFunc(getPrevisualizarRegla))).Methods("GET")
+  r.Handle("/recurrencias/{id}", authMiddleware(requiereEscritura(http.HandlerFunc(putRecurrencia)))).Methods("PUT")
+  r.Handle("/recurrencias/{id}", authMiddleware(requiereEscritura(http.HandlerFunc(deleteRecurrencia)))).Methods("DELETE")
+  r.Handle("/recurrencias/{id}/proximas", authMiddleware(http.HandlerFunc(getProximasRecurrencia))).Methods("GET")
+  r.Handle("/recurrencias/{id}/ocurrencias/{fecha}", authMiddleware(requiereEscritura(http.HandlerFunc(putOcurrenciaRecurrencia)))).Methods("PUT")
+  r.Handle("/recurrencias/{id}/ocurrencias/{fecha}", authMiddleware(requiereEscritura(http.HandlerFunc(deleteOcurrenciaRecurrencia)))).Methods("DELETE")
+  r.Handle("/metas", authMiddleware(http.HandlerFunc(getMetas))).Methods("GET")
+  r.Handle("/metas", authMiddleware(requiereEscritura(http.HandlerFunc(postMeta)))).Methods("POST")
+  r.Handle("/metas/{id}", authMiddleware(http.HandlerFunc(getMeta))).Methods("GET")
+  r.Handle("/metas/{id}", authMiddleware(requiereEscritura(http.HandlerFunc(putMeta)))).Methods("PUT")
+  r.Handle("/metas/{id}", authMiddleware(requiereEscritura(http.HandlerFunc(deleteMeta)))).Methods("DELETE")
+  
+  r.Handle("/deudas", authMiddleware(http.HandlerFunc(getDeudas))).Methods("GET")
+  r.Handle("/deudas/liquidar", authMiddleware(requiereEscritura(http.HandlerFunc(postLiquidacion)))).Methods("POST")
+  
+  r.Handle("/admin/usuarios", authMiddleware(soloAdmin(http.HandlerFunc(getUsuariosAdmin)))).Methods("GET")
+  r.Handle("/admin/usuarios/{nombre}/activo", authMiddleware(soloAdmin(http.HandlerFunc(putActivoAdmin)))).Methods("PUT")
+  r.Handle("/admin/usuarios/{nombre}/restablecer", authMiddleware(soloAdmin(http.HandlerFunc(restablecerAdmin)))).Methods("POST")
+  r.Handle("/admin/usuarios/{nombre}", authMiddleware(soloAdmin(http.HandlerFunc(deleteUsuarioAdmin)))).Methods("DELETE")
+  r.Handle("/admin/estadisticas", authMiddleware(soloAdmin(http.HandlerFunc(getEstadisticasAdmin)))).Methods("GET")
+  r.Handle("/admin/tasas", authMiddleware(soloAdmin(http.HandlerFunc(postTasas)))).Methods("POST")
+  r.Handle("/tasas", authMiddleware(http.HandlerFunc(getTasa))).Methods("GET")
+  r.Handle("/admin/intentos", authMiddleware(soloAdmin(http.HandlerFunc(getIntentosAdmin)))).Methods("GET")
   
   r.Handle("/egreso", authMiddleware(http.HandlerFunc(getEgresos))).Methods("GET")
   r.Handle("/ingreso", authMiddleware(http.HandlerFunc(getIngresos))).Methods("GET")
+  r.Handle("/movimientos", authMiddleware(http.HandlerFunc(getMovimientos))).Methods("GET")
   r.Handle("/totalEgresos", authMiddleware(http.HandlerFunc(getTotalEgresos))).Methods("GET")
   r.Handle("/totalIngresos", authMiddleware(http.HandlerFunc(getTotalIngresos))).Methods("GET")
+  r.Handle("/resumen", authMiddleware(http.HandlerFunc(getResumen))).Methods("GET")
+  r.Handle("/balance", authMiddleware(http.HandlerFunc(getBalanceHasta))).Methods("GET")
+  r.Handle("/balance/serie", authMiddleware(http.HandlerFunc(getSerieBalance))).Methods("GET")
   r.Handle("/movimiento/{id}", authMiddleware(http.HandlerFunc(getById))).Methods("GET")
   r.Handle("/exportRango", authMiddleware(http.HandlerFunc(exportFechas))).Methods("GET")
-  r.Handle("/ingreso", authMiddleware(http.HandlerFunc(postIngreso))).Methods("POST")
-  r.Handle("/egreso", authMiddleware(http.HandlerFunc(postEgreso))).Methods("POST")
-  r.Handle("/movimiento/{id}", authMiddleware(http.HandlerFunc(putById))).Methods("PUT")
-  r.Handle("/movimiento/{id}", authMiddleware(http.HandlerFunc(deleteById))).Methods("DELETE")
+  r.Handle("/exportaciones", authMiddleware(http.HandlerFunc(postExportacion))).Methods("POST")
+  r.Handle("/exportaciones/{id}", authMiddleware(http.HandlerFunc(getExportacion))).Methods("GET")
+  r.Handle("/reportes/mensual", authMiddleware(http.HandlerFunc(getReporteMensual))).Methods("GET")
+  r.Handle("/ingreso", authMiddleware(requiereEscritura(http.HandlerFunc(postIngreso)))).Methods("POST")
+  r.Handle("/egreso", authMiddleware(requiereEscritura(http.HandlerFunc(postEgreso)))).Methods("POST")
+  r.Handle("/importar", authMiddleware(requiereEscritura(http.HandlerFunc(importar)))).Methods("POST")
+  r.Handle("/importar/banco", authMiddleware(requiereEscritura(http.HandlerFunc(importarBanco)))).Methods("POST")
+  r.Handle("/movimiento/{id}", authMiddleware(requiereEscritura(http.HandlerFunc(putById)))).Methods("PUT")
+  r.Handle("/movimiento/{id}", authMiddleware(requiereEscritura(http.HandlerFunc(patchById)))).Methods("PATCH")
+  r.Handle("/movimiento/{id}", authMiddleware(requiereEscritura(http.HandlerFunc(deleteById)))).Methods("DELETE")
+  
+  r.Handle("/categorias", authMiddleware(http.HandlerFunc(listarCategorias))).Methods("GET")
+  r.Handle("/categorias", authMiddleware(requiereEscritura(http.HandlerFunc(postCategoria)))).Methods("POST")
+  r.Handle("/categorias/{id}", authMiddleware(http.HandlerFunc(getCategoriaById))).Methods("GET")
+  r.Handle("/categorias/{id}", authMiddleware(requiereEscritura(http.HandlerFunc(putCategoria)))).Methods("PUT")
+  r.Handle("/categorias/{id}", authMiddleware(requiereEscritura(http.HandlerFunc(deleteCategoria)))).Methods("DELETE")
   
   
   
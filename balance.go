@@ -0,0 +1,185 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "math/big"
+  "net/http"
+  "time"
+)
+
+//Balance es lo que tiene el usuario hasta una fecha.
+type Balance struct {
+  Hasta time.Time `json:"hasta"`
+  Ingresos Dinero `json:"ingresos"`
+  Egresos Dinero `json:"egresos"`
+  Balance Dinero `json:"balance"`
+}
+
+//PuntoBalance es un periodo de la serie del balance. Balance es el saldo
+//acumulado al final del periodo.
+type PuntoBalance struct {
+  Periodo string `json:"periodo"`
+  Ingresos Dinero `json:"ingresos"`
+  Egresos Dinero `json:"egresos"`
+  Neto Dinero `json:"neto"`
+  Balance Dinero `json:"balance"`
+}
+
+//getBalanceHasta responde con los ingresos menos los egresos hasta la fecha.
+//Con moneda=USD los montos se convierten con la tasa de cada fecha.
+//ejm http://100.69.187.16:8080/balance?hasta=2024-12-31T00:00:00Z&moneda=USD
+func getBalanceHasta(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  hasta, err := leerFecha(r, "hasta")
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  moneda, err := leerMoneda(r)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  
+  libro, ok := libroPeticion(w, r, false)
+  if !ok {
+    return
+  }
+  
+  b, err := getBalance(libro, nombreUsuario, hasta, true, moneda)
+  if err != nil {
+    writeError(w, "Error al consultar el balance", err, statusConversion(err))
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(b)
+}
+
+//getSerieBalance responde con el saldo acumulado al final de cada periodo.
+//ejm http://100.69.187.16:8080/balance/serie?desde=2024-01-01T00:00:00Z&hasta=2024-12-31T00:00:00Z&paso=mes
+func getSerieBalance(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  desde, err := leerFecha(r, "desde")
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  hasta, err := leerFecha(r, "hasta")
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  if hasta.Before(desde) {
+    http.Error(w, "Error, la fecha 'hasta' es anterior a 'desde'.", http.StatusBadRequest)
+    return
+  }
+  paso := r.URL.Query().Get("paso")
+  if paso == "" {
+    paso = "dia"
+  }
+  if paso != "dia" && paso != "mes" {
+    http.Error(w, "Error, el paso solo puede ser dia o mes.", http.StatusBadRequest)
+    return
+  }
+  moneda, err := leerMoneda(r)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  
+  libro, ok := libroPeticion(w, r, false)
+  if !ok {
+    return
+  }
+  
+  serie, err := getSerie(libro, nombreUsuario, desde, hasta, paso, moneda)
+  if err != nil {
+    writeError(w, "Error al consultar la serie del balance", err, statusConversion(err))
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(serie)
+}
+
+//getBalance suma los ingresos y egresos del libro hasta la fecha. Con
+//incluir en false no cuenta los registros de esa fecha, sirve para sacar
+//el saldo con el que inicia un periodo. Las transferencias entre cuentas no
+//se suman, no cambian el saldo del libro. Los montos se pasan a la moneda
+//con la tasa del dia de cada registro.
+func getBalance(libro int, usuario string, hasta time.Time, incluir bool, moneda string) (b Balance, err error) {
+  comparador := "<="
+  if !incluir {
+    comparador = "<"
+  }
+  
+  b.Hasta = hasta
+  rows, err := db.Query(`SELECT moneda, exponente, substr(fecha, 1, 10),
+  COALESCE(SUM(CASE WHEN tipo = 'ingreso' THEN monto END), 0),
+  COALESCE(SUM(CASE WHEN tipo = 'egreso' THEN monto END), 0)
+  FROM registros WHERE libro_id = ? AND ` + condicionMiembro + ` AND ` + sinTransferencias + ` AND fecha ` + comparador + ` ?
+  GROUP BY 1, 2, 3`, libro, usuario, hasta)
+  if err != nil {
+    return b, fmt.Errorf("Error al sumar los registros, %v", err)
+  }
+  defer rows.Close()
+  
+  conv := nuevoConversor(moneda)
+  ingresos, egresos := new(big.Rat), new(big.Rat)
+  for rows.Next() {
+    var monedaRegistro, dia string
+    var ingreso, egreso Dinero
+    err = rows.Scan(&monedaRegistro, &ingreso.Exponente, &dia, &ingreso.Unidades, &egreso.Unidades)
+    egreso.Exponente = ingreso.Exponente
+    if err != nil {
+      return b, fmt.Errorf("Error al escanear el balance, %v", err)
+    }
+    convertido, err := conv.convertir(ingreso, monedaRegistro, dia)
+    if err != nil {
+      return b, err
+    }
+    ingresos.Add(ingresos, convertido)
+    convertido, err = conv.convertir(egreso, monedaRegistro, dia)
+    if err != nil {
+      return b, err
+    }
+    egresos.Add(egresos, convertido)
+  }
+  if err = rows.Err(); err != nil {
+    return b, fmt.Errorf("Error al sumar los registros, %v", err)
+  }
+  
+  b.Ingresos = dineroDeRat(ingresos, exponenteMoneda(moneda))
+  b.Egresos = dineroDeRat(egresos, exponenteMoneda(moneda))
+  b.Balance = b.Ingresos.Menos(b.Egresos)
+  return b, nil
+}
+
+//getSerie arma el saldo acumulado por periodo partiendo del saldo que se
+//tenia antes de desde. Las sumas por periodo salen de getResumenes.
+func getSerie(libro int, usuario string, desde time.Time, hasta time.Time, paso string, moneda string) ([]PuntoBalance, error) {
+  //el saldo inicial es todo lo anterior al primer periodo.
+  inicio := inicioPeriodo(desde, paso)
+  inicial, err := getBalance(libro, usuario, inicio, false, moneda)
+  if err != nil {
+    return nil, err
+  }
+  
+  //pedimos desde el inicio del periodo para no partir el primero.
+  resumen, err := getResumenes(libro, usuario, inicio, hasta, false, paso, moneda)
+  if err != nil {
+    return nil, err
+  }
+  
+  saldo := inicial.Balance
+  serie := make([]PuntoBalance, 0, len(resumen))
+  for _, s := range resumen {
+    saldo = saldo.Mas(s.Neto)
+    serie = append(serie, PuntoBalance{s.Periodo, s.Ingresos, s.Egresos, s.Neto, saldo})
+  }
+  return serie, nil
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+  "database/sql"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log"
+  "net/http"
+  "regexp"
+  "strconv"
+  "strings"
+  "unicode/utf8"
+  
+  "github.com/gorilla/mux"
+)
+
+//Categoria es un grupo con el que el usuario clasifica sus registros.
+//Registro.Grupo guarda el nombre de la categoria.
+type Categoria struct {
+  Id int `json:"id"`
+  Nombre string `json:"nombre"`
+  Padre *int `json:"padre,omitempty"`
+  Color string `json:"color,omitempty"`
+  Icono string `json:"icono,omitempty"`
+}
+
+//errCategoriaNoExiste lo retorna resolverCategoria cuando el grupo no esta
+//creado y no se pidio crearlo.
+var errCategoriaNoExiste = errors.New("la categoria no existe, creela antes o envie crearCategoria=true")
+
+//el color se guarda en hexadecimal, ejm #ff8800
+var regColor = regexp.MustCompile(`^#[0-9A-Fa-f]{6}$`)
+
+//initCategorias crea la tabla de categorias y la llena con los grupos que
+//ya existen en los registros. La clave es el nombre normalizado, asi
+//"Comida", "comida" y "comida " son la misma categoria.
+func initCategorias() {
+  crearTablaCategorias := `
+  CREATE TABLE IF NOT EXISTS categorias(
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  usuario TEXT NOT NULL,
+  nombre TEXT NOT NULL,
+  clave TEXT NOT NULL,
+  padre_id INTEGER REFERENCES categorias(id),
+  color TEXT NOT NULL DEFAULT '',
+  icono TEXT NOT NULL DEFAULT '',
+  UNIQUE(usuario, clave)
+  );`
+  
+  _, err := db.Exec(crearTablaCategorias)
+  if err != nil {
+    log.Fatal("Error creando la tabla categorias", err)
+  }
+  
+  err = migrarGruposACategorias()
+  if err != nil {
+    log.Fatal("Error pasando los grupos a categorias ", err)
+  }
+}
+
+//migrarGruposACategorias crea una categoria por cada grupo distinto de los
+//registros y deja los registros con el nombre de la categoria. Si ya se
+//corrio antes no cambia nada.
+func migrarGruposACategorias() error {
+  rows, err := db.Query("SELECT DISTINCT usuario, grupo FROM registros WHERE grupo IS NOT NULL AND grupo != ''")
+  if err != nil {
+    return err
+  }
+  //leemos todo antes de escribir para no tener la consulta abierta.
+  var pares [][2]string
+  for rows.Next() {
+    var usuario, grupo string
+    err = rows.Scan(&usuario, &grupo)
+    if err != nil {
+      rows.Close()
+      return err
+    }
+    pares = append(pares, [2]string{usuario, grupo})
+  }
+  rows.Close()
+  
+  for _, p := range pares {
+    //la primera forma que se encuentre queda como el nombre.
+    nombre, err := resolverCategoria(p[0], p[1], true)
+    if err != nil {
+      return err
+    }
+    if nombre != p[1] {
+      _, err = db.Exec("UPDATE registros SET grupo = ? WHERE usuario = ? AND grupo = ?", nombre, p[0], p[1])
+      if err != nil {
+        return err
+      }
+    }
+  }
+  return nil
+}
+
+//normalizarCategoria quita espacios sobrantes del nombre y retorna el nombre
+//limpio y la clave con la que se compara.
+func normalizarCategoria(s string) (nombre string, clave string) {
+  nombre = strings.Join(strings.Fields(s), " ")
+  return nombre, strings.ToLower(nombre)
+}
+
+//resolverCategoria retorna el nombre con el que esta guardada la categoria
+//del grupo dado. Si no existe la crea solo cuando crear es true.
+func resolverCategoria(usuario string, grupo string, crear bool) (string, error) {
+  return resolverCategoriaEn(db, usuario, grupo, crear)
+}
+
+//resolverCategoriaEn es resolverCategoria dentro de una transaccion.
+func resolverCategoriaEn(ex ejecutor, usuario string, grupo string, crear bool) (string, error) {
+  nombre, clave := normalizarCategoria(grupo)
+  //el grupo es opcional.
+  if nombre == "" {
+    return "", nil
+  }
+  
+  var guardado string
+  err := ex.QueryRow("SELECT nombre FROM categorias WHERE usuario = ? AND clave = ?", usuario, clave).Scan(&guardado)
+  if err == nil {
+    return guardado, nil
+  }
+  if !errors.Is(err, sql.ErrNoRows) {
+    return "", err
+  }
+  if !crear {
+    return "", errCategoriaNoExiste
+  }
+  
+  _, err = ex.Exec("INSERT INTO categorias( usuario, nombre, clave ) VALUES( ?, ?, ? )", usuario, nombre, clave)
+  if err != nil {
+    return "", err
+  }
+  return nombre, nil
+}
+
+//resolverGrupoRequest valida el grupo de un registro que llega en una
+//peticion. Con ?crearCategoria=true se crea la categoria si no existe.
+//Si hay error ya lo escribe en w y retorna false.
+func resolverGrupoRequest(w http.ResponseWriter, r *http.Request, usuario string, m *Registro) bool {
+  crear := r.URL.Query().Get("crearCategoria") == "true"
+  
+  nombre, err := resolverCategoria(usuario, m.Grupo, crear)
+  if errors.Is(err, errCategoriaNoExiste) {
+    writeError(w, "Error en el grupo " + m.Grupo, err, http.StatusUnprocessableEntity)
+    return false
+  }
+  if err != nil {
+    writeError(w, "Error al consultar la categoria", err, http.StatusInternalServerError)
+    return false
+  }
+  
+  m.Grupo = nombre
+  return true
+}
+
+//validarCategoria revisa los datos de una categoria antes de guardarla.
+func validarCategoria(c Categoria, usuario string) error {
+  if c.Nombre == "" || utf8.RuneCountInString(c.Nombre) > 50 {
+    return fmt.Errorf("el nombre es obligatorio y de maximo 50 caracteres")
+  }
+  if c.Color != "" && !regColor.MatchString(c.Color) {
+    return fmt.Errorf("el color debe tener el formato #RRGGBB")
+  }
+  if utf8.RuneCountInString(c.Icono) > 30 {
+    return fmt.Errorf("el icono no puede tener mas de 30 caracteres")
+  }
+  if c.Padre == nil {
+    return nil
+  }
+  
+  //recorremos hacia arriba desde el padre para que no quede un ciclo.
+  padre := c.Padre
+  for padre != nil {
+    if c.Id != 0 && *padre == c.Id {
+      return fmt.Errorf("una categoria no puede ser su propio ancestro")
+    }
+    p, err := getCategoria(*padre, usuario)
+    if err != nil {
+      return fmt.Errorf("la categoria padre no existe")
+    }
+    padre = p.Padre
+  }
+  return nil
+}
+
+//getCategoria retorna una categoria del usuario por id.
+func getCategoria(id int, usuario string) (c Categoria, err error) {
+  err = db.QueryRow("SELECT id, nombre, padre_id, color, icono FROM categorias WHERE id = ? AND usuario = ?", id, usuario).Scan(&c.Id, &c.Nombre, &c.Padre, &c.Color, &c.Icono)
+  return
+}
+
+//getCategorias consulta todas las categorias del usuario.
+func getCategorias(usuario string) (categorias []Categoria, err error) {
+  rows, err := db.Query("SELECT id, nombre, padre_id, color, icono FROM categorias WHERE usuario = ? ORDER BY nombre", usuario)
+  if err != nil {
+    return nil, fmt.Errorf("Error al leer las categorias, %v", err)
+  }
+  defer rows.Close()
+  
+  categorias = []Categoria{}
+  for rows.Next() {
+    var c Categoria
+    err = rows.Scan(&c.Id, &c.Nombre, &c.Padre, &c.Color, &c.Icono)
+    if err != nil {
+      return nil, fmt.Errorf("Error al escanear las categorias, %v", err)
+    }
+    categorias = append(categorias, c)
+  }
+  return categorias, rows.Err()
+}
+
+//listarCategorias responde con las categorias del usuario.
+func listarCategorias(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  categorias, err := getCategorias(nombreUsuario)
+  if err != nil {
+    writeError(w, "Error al consultar las categorias", err, http.StatusInternalServerError)
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(categorias)
+}
+
+//getCategoriaById responde con una categoria.
+//ejm http://100.69.187.16:8080/categorias/3
+func getCategoriaById(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  id, err := strconv.Atoi(mux.Vars(r)["id"])
+  if err != nil {
+    http.Error(w, "Error en id, se esperaba un numero de tipo int.", http.StatusBadRequest)
+    return
+  }
+  
+  c, err := getCategoria(id, nombreUsuario)
+  if errors.Is(err, sql.ErrNoRows) {
+    http.Error(w, "No existe una categoria con ese id.", http.StatusNotFound)
+    return
+  }
+  if err != nil {
+    writeError(w, "Error al consultar la categoria", err, http.StatusInternalServerError)
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(c)
+}
+
+//postCategoria crea una categoria.
+//Json ejemplo {"nombre": "Mercado", "padre": 2, "color": "#33aa55", "icono": "carrito"}
+func postCategoria(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  var c Categoria
+  err := json.NewDecoder(r.Body).Decode(&c)
+  if err != nil {
+    writeError(w, "Error al leer el json", err, http.StatusBadRequest)
+    return
+  }
+  c.Id = 0
+  
+  var clave string
+  c.Nombre, clave = normalizarCategoria(c.Nombre)
+  err = validarCategoria(c, nombreUsuario)
+  if err != nil {
+    writeError(w, "Error en los datos de la categoria", err, http.StatusUnprocessableEntity)
+    return
+  }
+  
+  res, err := db.Exec("INSERT INTO categorias( usuario, nombre, clave, padre_id, color, icono ) VALUES( ?, ?, ?, ?, ?, ? )", nombreUsuario, c.Nombre, clave, c.Padre, c.Color, c.Icono)
+  if err != nil {
+    //la unica restriccion que puede fallar es el nombre repetido.
+    writeError(w, "Error, ya existe una categoria con ese nombre", err, http.StatusConflict)
+    return
+  }
+  id, _ := res.LastInsertId()
+  c.Id = int(id)
+  
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(http.StatusCreated)
+  json.NewEncoder(w).Encode(c)
+}
+
+//putCategoria actualiza una categoria. Si cambia el nombre tambien se
+//cambia en los registros que la usan.
+func putCategoria(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  id, err := strconv.Atoi(mux.Vars(r)["id"])
+  if err != nil {
+    http.Error(w, "Error en id, se esperaba un numero de tipo int.", http.StatusBadRequest)
+    return
+  }
+  
+  anterior, err := getCategoria(id, nombreUsuario)
+  if errors.Is(err, sql.ErrNoRows) {
+    http.Error(w, "No existe una categoria con ese id.", http.StatusNotFound)
+    return
+  }
+  if err != nil {
+    writeError(w, "Error al consultar la categoria", err, http.StatusInternalServerError)
+    return
+  }
+  
+  var c Categoria
+  err = json.NewDecoder(r.Body).Decode(&c)
+  if err != nil {
+    writeError(w, "Error al leer el json", err, http.StatusBadRequest)
+    return
+  }
+  c.Id = id
+  
+  var clave string
+  c.Nombre, clave = normalizarCategoria(c.Nombre)
+  err = validarCategoria(c, nombreUsuario)
+  if err != nil {
+    writeError(w, "Error en los datos de la categoria", err, http.StatusUnprocessableEntity)
+    return
+  }
+  
+  //la categoria y sus registros se actualizan juntos.
+  tx, err := db.Begin()
+  if err != nil {
+    writeError(w, "Error al iniciar la transaccion", err, http.StatusInternalServerError)
+    return
+  }
+  defer tx.Rollback()
+  
+  _, err = tx.Exec("UPDATE categorias SET nombre = ?, clave = ?, padre_id = ?, color = ?, icono = ? WHERE id = ? AND usuario = ?", c.Nombre, clave, c.Padre, c.Color, c.Icono, id, nombreUsuario)
+  if err != nil {
+    writeError(w, "Error, ya existe una categoria con ese nombre", err, http.StatusConflict)
+    return
+  }
+  _, err = tx.Exec("UPDATE registros SET grupo = ? WHERE usuario = ? AND grupo = ?", c.Nombre, nombreUsuario, anterior.Nombre)
+  if err != nil {
+    writeError(w, "Error al actualizar los registros de la categoria", err, http.StatusInternalServerError)
+    return
+  }
+  _, err = tx.Exec("UPDATE presupuestos SET grupo = ? WHERE usuario = ? AND grupo = ?", c.Nombre, nombreUsuario, anterior.Nombre)
+  if err != nil {
+    writeError(w, "Error, el grupo ya tiene un presupuesto en el libro", err, http.StatusConflict)
+    return
+  }
+  _, err = tx.Exec("UPDATE recurrencias SET grupo = ? WHERE usuario = ? AND grupo = ?", c.Nombre, nombreUsuario, anterior.Nombre)
+  if err != nil {
+    writeError(w, "Error al actualizar las recurrencias de la categoria", err, http.StatusInternalServerError)
+    return
+  }
+  _, err = tx.Exec("UPDATE metas SET grupo = ? WHERE usuario = ? AND grupo = ?", c.Nombre, nombreUsuario, anterior.Nombre)
+  if err != nil {
+    writeError(w, "Error al actualizar las metas de la categoria", err, http.StatusInternalServerError)
+    return
+  }
+  err = tx.Commit()
+  if err != nil {
+    writeError(w, "Error al guardar la categoria", err, http.StatusInternalServerError)
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(c)
+}
+
+//deleteCategoria elimina una categoria que no tenga registros ni subcategorias.
+func deleteCategoria(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  id, err := strconv.Atoi(mux.Vars(r)["id"])
+  if err != nil {
+    http.Error(w, "Error en id, se esperaba un numero de tipo int.", http.StatusBadRequest)
+    return
+  }
+  
+  c, err := getCategoria(id, nombreUsuario)
+  if errors.Is(err, sql.ErrNoRows) {
+    http.Error(w, "No existe una categoria con ese id.", http.StatusNotFound)
+    return
+  }
+  if err != nil {
+    writeError(w, "Error al consultar la categoria", err, http.StatusInternalServerError)
+    return
+  }
+  
+  //no dejamos registros, presupuestos, recurrencias ni metas con un grupo
+  //que ya no existe.
+  var enUso int
+  err = db.QueryRow("SELECT (SELECT COUNT(*) FROM registros WHERE usuario = ? AND grupo = ?) + (SELECT COUNT(*) FROM categorias WHERE usuario = ? AND padre_id = ?) + (SELECT COUNT(*) FROM presupuestos WHERE usuario = ? AND grupo = ?) + (SELECT COUNT(*) FROM recurrencias WHERE usuario = ? AND grupo = ?) + (SELECT COUNT(*) FROM metas WHERE usuario = ? AND grupo = ?)", nombreUsuario, c.Nombre, nombreUsuario, id, nombreUsuario, c.Nombre, nombreUsuario, c.Nombre, nombreUsuario, c.Nombre).Scan(&enUso)
+  if err != nil {
+    writeError(w, "Error al consultar el uso de la categoria", err, http.StatusInternalServerError)
+    return
+  }
+  if enUso > 0 {
+    http.Error(w, "Error, la categoria tiene registros, subcategorias, presupuestos, recurrencias o metas.", http.StatusConflict)
+    return
+  }
+  
+  _, err = db.Exec("DELETE FROM categorias WHERE id = ? AND usuario = ?", id, nombreUsuario)
+  if err != nil {
+    writeError(w, "Error al eliminar la categoria", err, http.StatusInternalServerError)
+    return
+  }
+  
+  w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+  "database/sql"
+  "encoding/json"
+  "fmt"
+  "log"
+  "net/http"
+  "net/mail"
+  "time"
+  
+  "golang.org/x/crypto/bcrypt"
+)
+
+//cuanto dura el token que se envia por correo para restablecer la clave.
+const duracionRestablecer = time.Hour
+
+//initClaves agrega el correo a los usuarios y crea la tabla de los tokens
+//para restablecer la clave. Igual que los refresh tokens se guarda el hash.
+func initClaves() {
+  agregarColumna("usuarios", "email", "TEXT NOT NULL DEFAULT ''")
+  
+  crearTablaRestablecer := `
+  CREATE TABLE IF NOT EXISTS restablecer_clave(
+  hash TEXT PRIMARY KEY,
+  usuario TEXT NOT NULL,
+  expira TEXT NOT NULL,
+  usado INTEGER NOT NULL DEFAULT 0
+  );`
+  
+  _, err := db.Exec(crearTablaRestablecer)
+  if err != nil {
+    log.Fatal("Error creando la tabla restablecer_clave", err)
+  }
+  _, err = db.Exec("DELETE FROM restablecer_clave WHERE expira < ?", time.Now().UTC().Format(time.RFC3339))
+  if err != nil {
+    log.Fatal("Error borrando los tokens para restablecer vencidos ", err)
+  }
+}
+
+//validarEmail comprueba que el correo sea solo una direccion, sin nombre.
+func validarEmail(s string) bool {
+  direccion, err := mail.ParseAddress(s)
+  return err == nil && direccion.Address == s && len(s) <= 254
+}
+
+//cambiarClave guarda el hash de la clave nueva y cierra todas las sesiones
+//del usuario, los tokens y las claves de api que tenga dejan de servir.
+//Tambien anula los tokens para restablecer pendientes y quita la obligacion
+//de cambiarla.
+func cambiarClave(ex ejecutor, usuario string, clave string) error {
+  hash, err := bcrypt.GenerateFromPassword([]byte(clave), bcrypt.DefaultCost)
+  if err != nil {
+    return err
+  }
+  _, err = ex.Exec("UPDATE usuarios SET clave = ?, cambiar_clave = 0 WHERE nombre = ?", string(hash), usuario)
+  if err != nil {
+    return fmt.Errorf("Error al guardar la clave, %v", err)
+  }
+  _, err = ex.Exec("UPDATE sesiones SET revocada = 1 WHERE usuario = ?", usuario)
+  if err != nil {
+    return fmt.Errorf("Error al cerrar las sesiones, %v", err)
+  }
+  _, err = ex.Exec("UPDATE claves_api SET revocada = 1 WHERE usuario = ?", usuario)
+  if err != nil {
+    return fmt.Errorf("Error al revocar las claves de api, %v", err)
+  }
+  //los tokens para restablecer que se hayan pedido antes ya no sirven.
+  _, err = ex.Exec("UPDATE restablecer_clave SET usado = 1 WHERE usuario = ?", usuario)
+  if err != nil {
+    return fmt.Errorf("Error al anular los tokens para restablecer, %v", err)
+  }
+  return nil
+}
+
+//putClave cambia la clave del usuario, pide la actual para confirmar.
+//Despues hay que volver a iniciar sesion.
+//Json ejemplo{"claveActual": "Clave1#", "claveNueva": "Nueva2#"}
+func putClave(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  var datos struct {
+    ClaveActual string `json:"claveActual"`
+    ClaveNueva string `json:"claveNueva"`
+  }
+  err := json.NewDecoder(r.Body).Decode(&datos)
+  if err != nil {
+    writeError(w, "Error al obtener los datos del body", err, http.StatusBadRequest)
+    return
+  }
+  if !validarStringPassword(datos.ClaveNueva) {
+    http.Error(w, "Error, formato de clave errado.", http.StatusBadRequest)
+    return
+  }
+  
+  err = comprobarUsuario(Usuario{Nombre: nombreUsuario, Clave: datos.ClaveActual})
+  if err != nil {
+    http.Error(w, "Error, la clave actual no es correcta.", http.StatusForbidden)
+    return
+  }
+  
+  err = cambiarClave(db, nombreUsuario, datos.ClaveNueva)
+  if err != nil {
+    writeError(w, "Error al cambiar la clave", err, http.StatusInternalServerError)
+    return
+  }
+  w.WriteHeader(http.StatusNoContent)
+}
+
+//putEmail cambia el correo al que llegan los tokens para restablecer.
+//Json ejemplo{"email": "ana@correo.com"}
+func putEmail(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  var datos struct {
+    Email string `json:"email"`
+  }
+  err := json.NewDecoder(r.Body).Decode(&datos)
+  if err != nil {
+    writeError(w, "Error al obtener los datos del body", err, http.StatusBadRequest)
+    return
+  }
+  if !validarEmail(datos.Email) {
+    http.Error(w, "Error, formato de email errado.", http.StatusBadRequest)
+    return
+  }
+  
+  _, err = db.Exec("UPDATE usuarios SET email = ? WHERE nombre = ?", datos.Email, nombreUsuario)
+  if err != nil {
+    writeError(w, "Error al guardar el email", err, http.StatusInternalServerError)
+    return
+  }
+  w.WriteHeader(http.StatusNoContent)
+}
+
+//olvideClave envia al correo del usuario un token para restablecer la
+//clave. Siempre responde 202 sin esperar la consulta ni el correo, asi ni
+//la respuesta ni lo que tarda revelan que usuarios existen.
+//Json ejemplo{"nombre": "ana1"}
+func olvideClave(w http.ResponseWriter, r *http.Request) {
+  var datos struct {
+    Nombre string `json:"nombre"`
+  }
+  err := json.NewDecoder(r.Body).Decode(&datos)
+  if err != nil || !validarStringUsuario(datos.Nombre) {
+    http.Error(w, "Error, formato de usuario errado.", http.StatusBadRequest)
+    return
+  }
+  
+  go func(usuario string) {
+    var email string
+    err := db.QueryRow("SELECT email FROM usuarios WHERE nombre = ?", usuario).Scan(&email)
+    if err != nil && err != sql.ErrNoRows {
+      log.Printf("Error al consultar el usuario %s para restablecer, %v", usuario, err)
+      return
+    }
+    if email == "" {
+      return
+    }
+    err = enviarRestablecer(usuario, email)
+    if err != nil {
+      log.Printf("Error al enviar el correo para restablecer a %s, %v", usuario, err)
+    }
+  }(datos.Nombre)
+  
+  w.WriteHeader(http.StatusAccepted)
+}
+
+//enviarRestablecer guarda un token nuevo para restablecer la clave del
+//usuario y se lo envia al correo.
+func enviarRestablecer(usuario string, email string) error {
+  token := tokenAleatorio(32)
+  expira := time.Now().UTC().Add(duracionRestablecer)
+  _, err := db.Exec("INSERT INTO restablecer_clave(hash, usuario, expira) VALUES(?, ?, ?)", hashToken(token), usuario, expira.Format(time.RFC3339))
+  if err != nil {
+    return fmt.Errorf("Error al guardar el token, %v", err)
+  }
+  
+  cuerpo := fmt.Sprintf("Hola %s,\n\nPara restablecer su clave envie este codigo a /clave/restablecer:\n\n%s\n\nVence a las %s UTC y solo se puede usar una vez. Si no lo pidio ignore este correo.",
+    usuario, token, expira.Format("2006-01-02 15:04"))
+  return mailer.Enviar(email, "Restablecer clave", cuerpo)
+}
+
+//restablecerClave cambia la clave con el token que llego al correo. El
+//token se marca como usado en la misma transaccion que cambia la clave.
+//Json ejemplo{"token": "9f86d0...", "claveNueva": "Nueva2#"}
+func restablecerClave(w http.ResponseWriter, r *http.Request) {
+  var datos struct {
+    Token string `json:"token"`
+    ClaveNueva string `json:"claveNueva"`
+  }
+  err := json.NewDecoder(r.Body).Decode(&datos)
+  if err != nil || datos.Token == "" {
+    http.Error(w, "Error, falta el token.", http.StatusBadRequest)
+    return
+  }
+  if !validarStringPassword(datos.ClaveNueva) {
+    http.Error(w, "Error, formato de clave errado.", http.StatusBadRequest)
+    return
+  }
+  
+  tx, err := db.Begin()
+  if err != nil {
+    writeError(w, "Error al iniciar la transaccion", err, http.StatusInternalServerError)
+    return
+  }
+  defer tx.Rollback()
+  
+  hash := hashToken(datos.Token)
+  var usuario string
+  err = tx.QueryRow("SELECT usuario FROM restablecer_clave WHERE hash = ? AND usado = 0 AND expira > ?", hash, time.Now().UTC().Format(time.RFC3339)).Scan(&usuario)
+  if err == sql.ErrNoRows {
+    http.Error(w, "El token no es valido, ya se uso o vencio.", http.StatusBadRequest)
+    return
+  }
+  if err != nil {
+    writeError(w, "Error al consultar el token", err, http.StatusInternalServerError)
+    return
+  }
+  
+  //cambiarClave marca como usado este token junto con los demas del usuario.
+  err = cambiarClave(tx, usuario, datos.ClaveNueva)
+  if err != nil {
+    writeError(w, "Error al cambiar la clave", err, http.StatusInternalServerError)
+    return
+  }
+  err = tx.Commit()
+  if err != nil {
+    writeError(w, "Error al guardar los cambios", err, http.StatusInternalServerError)
+    return
+  }
+  w.WriteHeader(http.StatusNoContent)
+}
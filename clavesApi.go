@@ -0,0 +1,250 @@
+package main
+
+import (
+  "context"
+  "database/sql"
+  "encoding/json"
+  "fmt"
+  "log"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+  "unicode/utf8"
+  
+  "github.com/gorilla/mux"
+)
+
+//las claves de api inician con este prefijo para reconocerlas si se filtran.
+const prefijoClaveApi = "am_"
+
+//ClaveApi es una clave para que los scripts usen la api sin la clave del
+//usuario. Clave solo va en la respuesta al crearla, despues solo se guarda
+//el hash y se muestra el prefijo.
+type ClaveApi struct {
+  Id int `json:"id"`
+  Nombre string `json:"nombre"`
+  Prefijo string `json:"prefijo"`
+  Alcance string `json:"alcance"`
+  Creada time.Time `json:"creada"`
+  Expira *time.Time `json:"expira,omitempty"`
+  UltimoUso *time.Time `json:"ultimoUso,omitempty"`
+  Clave string `json:"clave,omitempty"`
+}
+
+//initClavesApi crea la tabla de las claves de api.
+func initClavesApi() {
+  crearTablaClavesApi := `
+  CREATE TABLE IF NOT EXISTS claves_api(
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  usuario TEXT NOT NULL,
+  nombre TEXT NOT NULL,
+  prefijo TEXT NOT NULL,
+  hash TEXT UNIQUE NOT NULL,
+  alcance TEXT NOT NULL,
+  creada TEXT NOT NULL,
+  expira TEXT,
+  ultimo_uso TEXT,
+  revocada INTEGER NOT NULL DEFAULT 0
+  );`
+  
+  _, err := db.Exec(crearTablaClavesApi)
+  if err != nil {
+    log.Fatal("Error creando la tabla claves_api", err)
+  }
+}
+
+//contextoClaveApi busca la clave y si es valida retorna el contexto con el
+//usuario y el alcance. Las claves no tienen sesion ni jti.
+func contextoClaveApi(ctx context.Context, clave string) (context.Context, error) {
+  var id int
+  var usuario, alcance string
+  var expira sql.NullString
+  //las claves de un usuario desactivado no sirven.
+  err := db.QueryRow(`SELECT k.id, k.usuario, k.alcance, k.expira FROM claves_api k
+  JOIN usuarios u ON u.nombre = k.usuario AND u.activo = 1
+  WHERE k.hash = ? AND k.revocada = 0`, hashToken(clave)).Scan(&id, &usuario, &alcance, &expira)
+  if err != nil {
+    return nil, err
+  }
+  ahora := time.Now().UTC()
+  if expira.Valid {
+    fin, _ := time.Parse(time.RFC3339, expira.String)
+    if ahora.After(fin) {
+      return nil, sql.ErrNoRows
+    }
+  }
+  
+  //el ultimo uso se guarda maximo una vez por minuto para no escribir en
+  //cada peticion.
+  _, err = db.Exec("UPDATE claves_api SET ultimo_uso = ? WHERE id = ? AND (ultimo_uso IS NULL OR ultimo_uso < ?)",
+    ahora.Format(time.RFC3339), id, ahora.Add(-time.Minute).Format(time.RFC3339))
+  if err != nil {
+    log.Printf("Error al guardar el uso de la clave de api %d, %v", id, err)
+  }
+  
+  ctx = context.WithValue(ctx, "usuario", usuario)
+  ctx = context.WithValue(ctx, "sesion", "")
+  ctx = context.WithValue(ctx, "alcance", alcance)
+  return ctx, nil
+}
+
+//requiereEscritura deja pasar solo a quien puede modificar datos. Los jwt
+//de login siempre pueden, las claves de api solo si son de escritura.
+func requiereEscritura(siguiente http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if alcance, _ := r.Context().Value("alcance").(string); alcance != "escritura" {
+      http.Error(w, "Error, la clave de api solo es de lectura.", http.StatusForbidden)
+      return
+    }
+    siguiente.ServeHTTP(w, r)
+  })
+}
+
+//requiereSesion deja pasar solo peticiones con el jwt de login. Lo usan las
+//rutas de la cuenta (clave, 2FA, sesiones y claves de api), que no se
+//deben poder cambiar con una clave de api.
+func requiereSesion(siguiente http.Handler) http.Handler {
+  return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+    if sesion, _ := r.Context().Value("sesion").(string); sesion == "" {
+      http.Error(w, "Error, esta ruta solo se puede usar con una sesion de login.", http.StatusForbidden)
+      return
+    }
+    siguiente.ServeHTTP(w, r)
+  })
+}
+
+//postClaveApi crea una clave de api. La ruta va con requiereSesion para
+//que una clave no pueda crear otras.
+//Json ejemplo{"nombre": "respaldo", "alcance": "lectura", "expira": "2025-12-31T00:00:00Z"}
+func postClaveApi(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  var datos struct {
+    Nombre string `json:"nombre"`
+    Alcance string `json:"alcance"`
+    Expira *time.Time `json:"expira"`
+  }
+  err := json.NewDecoder(r.Body).Decode(&datos)
+  if err != nil {
+    writeError(w, "Error al obtener los datos del body", err, http.StatusBadRequest)
+    return
+  }
+  datos.Nombre = strings.TrimSpace(datos.Nombre)
+  if datos.Nombre == "" || utf8.RuneCountInString(datos.Nombre) > 50 {
+    http.Error(w, "Error, el nombre es obligatorio y maximo de 50 caracteres.", http.StatusBadRequest)
+    return
+  }
+  if datos.Alcance == "" {
+    datos.Alcance = "lectura"
+  }
+  if datos.Alcance != "lectura" && datos.Alcance != "escritura" {
+    http.Error(w, "Error, el alcance solo puede ser lectura o escritura.", http.StatusBadRequest)
+    return
+  }
+  if datos.Expira != nil && !datos.Expira.After(time.Now()) {
+    http.Error(w, "Error, la fecha de vencimiento ya paso.", http.StatusBadRequest)
+    return
+  }
+  
+  k := ClaveApi{
+    Nombre: datos.Nombre,
+    Alcance: datos.Alcance,
+    Creada: time.Now().UTC().Truncate(time.Second),
+    Clave: prefijoClaveApi + tokenAleatorio(24),
+  }
+  k.Prefijo = k.Clave[:len(prefijoClaveApi) + 6]
+  var expira interface{}
+  if datos.Expira != nil {
+    t := datos.Expira.UTC().Truncate(time.Second)
+    k.Expira = &t
+    expira = t.Format(time.RFC3339)
+  }
+  
+  res, err := db.Exec("INSERT INTO claves_api(usuario, nombre, prefijo, hash, alcance, creada, expira) VALUES(?, ?, ?, ?, ?, ?, ?)",
+    nombreUsuario, k.Nombre, k.Prefijo, hashToken(k.Clave), k.Alcance, k.Creada.Format(time.RFC3339), expira)
+  if err != nil {
+    writeError(w, "Error al guardar la clave de api", err, http.StatusInternalServerError)
+    return
+  }
+  id, _ := res.LastInsertId()
+  k.Id = int(id)
+  
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(http.StatusCreated)
+  json.NewEncoder(w).Encode(k)
+}
+
+//getClavesApi lista las claves de api del usuario que no se han revocado.
+//ejm http://100.69.187.16:8080/claves-api
+func getClavesApi(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  rows, err := db.Query("SELECT id, nombre, prefijo, alcance, creada, expira, ultimo_uso FROM claves_api WHERE usuario = ? AND revocada = 0 ORDER BY id", nombreUsuario)
+  if err != nil {
+    writeError(w, "Error al consultar las claves de api", err, http.StatusInternalServerError)
+    return
+  }
+  defer rows.Close()
+  
+  claves := []ClaveApi{}
+  for rows.Next() {
+    var k ClaveApi
+    var creada string
+    var expira, ultimoUso sql.NullString
+    err = rows.Scan(&k.Id, &k.Nombre, &k.Prefijo, &k.Alcance, &creada, &expira, &ultimoUso)
+    if err != nil {
+      writeError(w, "Error al escanear las claves de api", err, http.StatusInternalServerError)
+      return
+    }
+    k.Creada, _ = time.Parse(time.RFC3339, creada)
+    k.Expira = leerFechaNula(expira)
+    k.UltimoUso = leerFechaNula(ultimoUso)
+    claves = append(claves, k)
+  }
+  if err = rows.Err(); err != nil {
+    writeError(w, "Error al consultar las claves de api", err, http.StatusInternalServerError)
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(claves)
+}
+
+//deleteClaveApi revoca la clave, deja de funcionar de inmediato.
+//ejm http://100.69.187.16:8080/claves-api/3
+func deleteClaveApi(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  id, err := strconv.Atoi(mux.Vars(r)["id"])
+  if err != nil {
+    http.Error(w, "Error, el id debe ser un numero.", http.StatusBadRequest)
+    return
+  }
+  
+  res, err := db.Exec("UPDATE claves_api SET revocada = 1 WHERE id = ? AND usuario = ? AND revocada = 0", id, nombreUsuario)
+  if err != nil {
+    writeError(w, "Error al revocar la clave de api", err, http.StatusInternalServerError)
+    return
+  }
+  if n, _ := res.RowsAffected(); n == 0 {
+    http.Error(w, "La clave de api no existe.", http.StatusNotFound)
+    return
+  }
+  w.WriteHeader(http.StatusNoContent)
+}
+
+//leerFechaNula convierte una fecha RFC3339 opcional de la base de datos.
+func leerFechaNula(s sql.NullString) *time.Time {
+  if !s.Valid {
+    return nil
+  }
+  t, err := time.Parse(time.RFC3339, s.String)
+  if err != nil {
+    return nil
+  }
+  return &t
+}
+
+//errClaveApi es el error que ve el cliente cuando la clave no sirve.
+var errClaveApi = fmt.Errorf("la clave de api no existe, esta revocada o vencio")
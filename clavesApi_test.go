@@ -0,0 +1,89 @@
+package main
+
+import (
+  "encoding/json"
+  "net/http"
+  "testing"
+)
+
+//respuestaVacia es un handler que solo responde 204, para probar los
+//middleware sin depender de una ruta en particular.
+var respuestaVacia = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+  w.WriteHeader(http.StatusNoContent)
+})
+
+//claveApiPrueba crea una clave con la sesion dada y retorna la clave y su id.
+func claveApiPrueba(t *testing.T, tokens Tokens, alcance string) (string, int) {
+  t.Helper()
+  w := peticion(authMiddleware(requiereSesion(http.HandlerFunc(postClaveApi))), "POST", "Bearer " + tokens.Token, `{"nombre": "script", "alcance": "` + alcance + `"}`)
+  if w.Code != http.StatusCreated {
+    t.Fatalf("crear clave: %d %s", w.Code, w.Body)
+  }
+  var k ClaveApi
+  if err := json.NewDecoder(w.Body).Decode(&k); err != nil {
+    t.Fatal(err)
+  }
+  return k.Clave, k.Id
+}
+
+func TestClaveApiAlcance(t *testing.T) {
+  prepararDB(t)
+  tokens := sesionPrueba(t, "anita")
+  lectura, _ := claveApiPrueba(t, tokens, "lectura")
+  escritura, _ := claveApiPrueba(t, tokens, "escritura")
+  
+  lee := authMiddleware(respuestaVacia)
+  escribe := authMiddleware(requiereEscritura(respuestaVacia))
+  cuenta := authMiddleware(requiereSesion(respuestaVacia))
+  casos := []struct {
+    nombre string
+    h http.Handler
+    autorizacion string
+    status int
+  }{
+    {"lectura lee", lee, "ApiKey " + lectura, http.StatusNoContent},
+    {"lectura no escribe", escribe, "ApiKey " + lectura, http.StatusForbidden},
+    {"escritura lee", lee, "ApiKey " + escritura, http.StatusNoContent},
+    {"escritura escribe", escribe, "ApiKey " + escritura, http.StatusNoContent},
+    {"jwt escribe", escribe, "Bearer " + tokens.Token, http.StatusNoContent},
+    //con una clave no se puede tocar la cuenta, ni siquiera con escritura.
+    {"escritura no cambia la cuenta", cuenta, "ApiKey " + escritura, http.StatusForbidden},
+    {"jwt cambia la cuenta", cuenta, "Bearer " + tokens.Token, http.StatusNoContent},
+    {"clave inventada", lee, "ApiKey am_noexiste", http.StatusUnauthorized},
+  }
+  for _, c := range casos {
+    if w := peticion(c.h, "POST", c.autorizacion, ""); w.Code != c.status {
+      t.Errorf("%s: respondio %d, esperaba %d", c.nombre, w.Code, c.status)
+    }
+  }
+}
+
+func TestClaveApiRechazada(t *testing.T) {
+  prepararDB(t)
+  tokens := sesionPrueba(t, "anita")
+  h := authMiddleware(respuestaVacia)
+  
+  casos := []struct {
+    nombre string
+    invalidar string
+  }{
+    {"vencida", "UPDATE claves_api SET expira = '2020-01-01T00:00:00Z' WHERE id = ?"},
+    {"revocada", "UPDATE claves_api SET revocada = 1 WHERE id = ?"},
+    {"usuario desactivado", "UPDATE usuarios SET activo = 0 WHERE nombre = (SELECT usuario FROM claves_api WHERE id = ?)"},
+  }
+  for _, c := range casos {
+    t.Run(c.nombre, func(t *testing.T) {
+      db.Exec("UPDATE usuarios SET activo = 1 WHERE nombre = 'anita'")
+      clave, id := claveApiPrueba(t, tokens, "escritura")
+      if w := peticion(h, "GET", "ApiKey " + clave, ""); w.Code != http.StatusNoContent {
+        t.Fatalf("la clave no sirvio antes de invalidarla: %d", w.Code)
+      }
+      if _, err := db.Exec(c.invalidar, id); err != nil {
+        t.Fatal(err)
+      }
+      if w := peticion(h, "GET", "ApiKey " + clave, ""); w.Code != http.StatusUnauthorized {
+        t.Errorf("respondio %d, esperaba %d", w.Code, http.StatusUnauthorized)
+      }
+    })
+  }
+}
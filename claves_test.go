@@ -0,0 +1,124 @@
+package main
+
+import (
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "path/filepath"
+  "regexp"
+  "strings"
+  "testing"
+  "time"
+)
+
+//prepararDB crea la base de datos en una carpeta temporal, initDB siempre
+//usa registros.db en la carpeta actual.
+func prepararDB(t *testing.T) {
+  t.Helper()
+  anterior, err := os.Getwd()
+  if err != nil {
+    t.Fatal(err)
+  }
+  if err = os.Chdir(t.TempDir()); err != nil {
+    t.Fatal(err)
+  }
+  t.Setenv("FRASE", "frase de prueba")
+  initDB()
+  t.Cleanup(func() {
+    db.Close()
+    os.Chdir(anterior)
+  })
+}
+
+//esperarArchivo espera a que el correo que se envia aparte quede escrito.
+func esperarArchivo(t *testing.T, ruta string) []byte {
+  t.Helper()
+  for i := 0; i < 100; i++ {
+    contenido, err := os.ReadFile(ruta)
+    if err == nil && strings.Contains(string(contenido), "----") {
+      return contenido
+    }
+    time.Sleep(20 * time.Millisecond)
+  }
+  t.Fatalf("no se escribio el correo en %s", ruta)
+  return nil
+}
+
+//enviarJSON llama al handler con el body dado y retorna la respuesta.
+func enviarJSON(h http.HandlerFunc, body string) *httptest.ResponseRecorder {
+  w := httptest.NewRecorder()
+  h(w, httptest.NewRequest("POST", "/", strings.NewReader(body)))
+  return w
+}
+
+func TestRestablecerClave(t *testing.T) {
+  prepararDB(t)
+  ruta := filepath.Join(t.TempDir(), "correos.txt")
+  anterior := mailer
+  mailer = MailerArchivo{Ruta: ruta}
+  t.Cleanup(func() { mailer = anterior })
+  
+  if err := guardarUsuario(Usuario{Nombre: "anita", Clave: "Clave123#"}); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := db.Exec("UPDATE usuarios SET email = ? WHERE nombre = ?", "anita@correo.com", "anita"); err != nil {
+    t.Fatal(err)
+  }
+  
+  //un usuario que no existe recibe la misma respuesta y no se envia nada.
+  if w := enviarJSON(olvideClave, `{"nombre": "nadie"}`); w.Code != http.StatusAccepted {
+    t.Fatalf("olvido de usuario inexistente: %d %s", w.Code, w.Body)
+  }
+  if _, err := os.Stat(ruta); !os.IsNotExist(err) {
+    t.Fatalf("se envio un correo para un usuario que no existe")
+  }
+  
+  if w := enviarJSON(olvideClave, `{"nombre": "anita"}`); w.Code != http.StatusAccepted {
+    t.Fatalf("olvido: %d %s", w.Code, w.Body)
+  }
+  correo := esperarArchivo(t, ruta)
+  //el unico correo es el de anita, al usuario que no existe no se le envio.
+  if strings.Count(string(correo), "Para: ") != 1 || !strings.Contains(string(correo), "Para: anita@correo.com") {
+    t.Fatalf("el correo no es para anita:\n%s", correo)
+  }
+  token := regexp.MustCompile(`[0-9a-f]{64}`).FindString(string(correo))
+  if token == "" {
+    t.Fatalf("el correo no tiene el token:\n%s", correo)
+  }
+  
+  body := `{"token": "` + token + `", "claveNueva": "Nueva456#"}`
+  if w := enviarJSON(restablecerClave, body); w.Code != http.StatusNoContent {
+    t.Fatalf("restablecer: %d %s", w.Code, w.Body)
+  }
+  if err := comprobarUsuario(Usuario{Nombre: "anita", Clave: "Nueva456#"}); err != nil {
+    t.Errorf("la clave nueva no sirve: %v", err)
+  }
+  if err := comprobarUsuario(Usuario{Nombre: "anita", Clave: "Clave123#"}); err != errCredenciales {
+    t.Errorf("la clave anterior todavia sirve: %v", err)
+  }
+  
+  //el token solo se puede usar una vez.
+  body = `{"token": "` + token + `", "claveNueva": "Otra789#"}`
+  if w := enviarJSON(restablecerClave, body); w.Code != http.StatusBadRequest {
+    t.Errorf("el token se pudo usar dos veces: %d %s", w.Code, w.Body)
+  }
+}
+
+func TestCambiarClaveRevocaCredenciales(t *testing.T) {
+  prepararDB(t)
+  tokens := sesionPrueba(t, "anita")
+  clave, _ := claveApiPrueba(t, tokens, "escritura")
+  
+  body := `{"claveActual": "Clave123#", "claveNueva": "Nueva456#"}`
+  if w := peticion(authMiddleware(requiereSesion(http.HandlerFunc(putClave))), "PUT", "Bearer " + tokens.Token, body); w.Code != http.StatusNoContent {
+    t.Fatalf("cambiar clave: %d %s", w.Code, w.Body)
+  }
+  
+  //ni la sesion ni la clave de api sirven despues del cambio.
+  if w := peticion(authMiddleware(respuestaVacia), "GET", "Bearer " + tokens.Token, ""); w.Code != http.StatusUnauthorized {
+    t.Errorf("el token sigue sirviendo: %d", w.Code)
+  }
+  if w := peticion(authMiddleware(respuestaVacia), "GET", "ApiKey " + clave, ""); w.Code != http.StatusUnauthorized {
+    t.Errorf("la clave de api sigue sirviendo: %d", w.Code)
+  }
+}
@@ -0,0 +1,507 @@
+package main
+
+import (
+  "database/sql"
+  "encoding/json"
+  "fmt"
+  "log"
+  "net/http"
+  "regexp"
+  "strconv"
+  "strings"
+  "time"
+  "unicode/utf8"
+  
+  "github.com/gorilla/mux"
+)
+
+//Cuenta es donde esta la plata de un libro: efectivo, una cuenta de banco,
+//una tarjeta de credito. Los registros pueden indicar su cuenta y el saldo
+//de la cuenta es el inicial mas sus ingresos menos sus egresos.
+type Cuenta struct {
+  Id int `json:"id"`
+  Libro int `json:"libro"`
+  Nombre string `json:"nombre"`
+  Tipo string `json:"tipo"`
+  SaldoInicial Dinero `json:"saldoInicial"`
+  Moneda string `json:"moneda"`
+  Archivada bool `json:"archivada"`
+  Saldo Dinero `json:"saldo"`
+}
+
+//BalanceCuenta es el saldo de una cuenta a una fecha. Ingresos y Egresos
+//incluyen las transferencias porque mueven la plata de la cuenta.
+type BalanceCuenta struct {
+  Cuenta int `json:"cuenta"`
+  Hasta time.Time `json:"hasta"`
+  SaldoInicial Dinero `json:"saldoInicial"`
+  Ingresos Dinero `json:"ingresos"`
+  Egresos Dinero `json:"egresos"`
+  Balance Dinero `json:"balance"`
+}
+
+//TransferenciaCuenta mueve plata entre dos cuentas del mismo libro. Se
+//guarda como un egreso en la cuenta de origen y un ingreso en la de
+//destino, que no cuentan en los totales de ingresos y egresos.
+type TransferenciaCuenta struct {
+  Id int `json:"id"`
+  Libro int `json:"libro"`
+  Origen int `json:"origen"`
+  Destino int `json:"destino"`
+  Monto Dinero `json:"monto"`
+  Fecha time.Time `json:"fecha"`
+  Descripcion string `json:"descripcion"`
+  EgresoId int `json:"egresoId"`
+  IngresoId int `json:"ingresoId"`
+}
+
+//tipos de cuenta que se aceptan.
+var tiposCuenta = map[string]bool{"efectivo": true, "banco": true, "tarjeta": true, "ahorro": true, "otro": true}
+
+//la moneda es el codigo ISO 4217, ejm COP o USD.
+var regMoneda = regexp.MustCompile(`^[A-Z]{3}$`)
+
+//sinTransferencias se agrega a las sumas de ingresos y egresos para no
+//contar la plata que solo se movio entre cuentas.
+const sinTransferencias = "transferencia_id IS NULL"
+
+//initCuentas crea las tablas de cuentas y transferencias y agrega la cuenta
+//y la transferencia a los registros.
+func initCuentas() {
+  crearTablaCuentas := `
+  CREATE TABLE IF NOT EXISTS cuentas(
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  libro_id INTEGER NOT NULL REFERENCES libros(id),
+  nombre TEXT NOT NULL,
+  tipo TEXT NOT NULL,
+  saldo_inicial INTEGER NOT NULL DEFAULT 0,
+  moneda TEXT NOT NULL DEFAULT 'COP',
+  archivada INTEGER NOT NULL DEFAULT 0
+  );`
+  
+  crearTablaTransferencias := `
+  CREATE TABLE IF NOT EXISTS transferencias(
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  libro_id INTEGER NOT NULL REFERENCES libros(id),
+  origen_id INTEGER NOT NULL REFERENCES cuentas(id),
+  destino_id INTEGER NOT NULL REFERENCES cuentas(id),
+  monto INTEGER NOT NULL,
+  fecha DATETIME NOT NULL,
+  descripcion TEXT NOT NULL DEFAULT '',
+  egreso_id INTEGER NOT NULL,
+  ingreso_id INTEGER NOT NULL
+  );`
+  
+  _, err := db.Exec(crearTablaCuentas)
+  if err != nil {
+    log.Fatal("Error creando la tabla cuentas", err)
+  }
+  _, err = db.Exec(crearTablaTransferencias)
+  if err != nil {
+    log.Fatal("Error creando la tabla transferencias", err)
+  }
+  
+  agregarColumna("registros", "cuenta_id", "INTEGER REFERENCES cuentas(id)")
+  agregarColumna("registros", "transferencia_id", "INTEGER REFERENCES transferencias(id)")
+  _, err = db.Exec("CREATE INDEX IF NOT EXISTS registros_cuenta ON registros(cuenta_id, fecha)")
+  if err != nil {
+    log.Fatal("Error creando el indice de cuentas", err)
+  }
+}
+
+//validarCuenta revisa los datos de la cuenta antes de guardarla.
+func validarCuenta(c *Cuenta) error {
+  c.Nombre = strings.TrimSpace(c.Nombre)
+  if c.Nombre == "" || utf8.RuneCountInString(c.Nombre) > 50 {
+    return fmt.Errorf("el nombre es obligatorio y de maximo 50 caracteres")
+  }
+  if !tiposCuenta[c.Tipo] {
+    return fmt.Errorf("el tipo solo puede ser efectivo, banco, tarjeta, ahorro u otro")
+  }
+  if c.Moneda == "" {
+    c.Moneda = monedaBase()
+  }
+  c.Moneda = strings.ToUpper(c.Moneda)
+  if !regMoneda.MatchString(c.Moneda) {
+    return fmt.Errorf("la moneda debe ser un codigo de 3 letras, ejm COP")
+  }
+  saldo, err := c.SaldoInicial.Escalar(exponenteMoneda(c.Moneda))
+  if err != nil {
+    return fmt.Errorf("en el saldo inicial, %v", err)
+  }
+  c.SaldoInicial = saldo
+  return nil
+}
+
+//buscarCuenta retorna la cuenta si esta en un libro del usuario. Con
+//escritura exige que pueda modificar el libro. Si no responde el error y
+//retorna false.
+func buscarCuenta(w http.ResponseWriter, r *http.Request, id int, escritura bool) (Cuenta, bool) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  var c Cuenta
+  err := db.QueryRow("SELECT id, libro_id, nombre, tipo, saldo_inicial, moneda, archivada FROM cuentas WHERE id = ? AND " + condicionMiembro, id, nombreUsuario).Scan(
+    &c.Id, &c.Libro, &c.Nombre, &c.Tipo, &c.SaldoInicial.Unidades, &c.Moneda, &c.Archivada)
+  c.SaldoInicial.Exponente = exponenteMoneda(c.Moneda)
+  if err == sql.ErrNoRows {
+    http.Error(w, "La cuenta no existe.", http.StatusNotFound)
+    return c, false
+  }
+  if err != nil {
+    writeError(w, "Error al consultar la cuenta", err, http.StatusInternalServerError)
+    return c, false
+  }
+  if escritura && !permisoLibro(w, c.Libro, nombreUsuario, true) {
+    return c, false
+  }
+  return c, true
+}
+
+//cuentaPeticion retorna la cuenta de ?cuenta= validada para registrar en
+//el libro, una cuenta vacia si no viene. Si responde un error retorna false.
+func cuentaPeticion(w http.ResponseWriter, r *http.Request, libro int) (Cuenta, bool) {
+  s := r.URL.Query().Get("cuenta")
+  if s == "" {
+    return Cuenta{}, true
+  }
+  id, err := strconv.Atoi(s)
+  if err != nil {
+    http.Error(w, "Error, la cuenta debe ser un numero.", http.StatusBadRequest)
+    return Cuenta{}, false
+  }
+  if !validarCuentaRegistro(w, Registro{Cuenta: id, Libro: libro}) {
+    return Cuenta{}, false
+  }
+  return buscarCuenta(w, r, id, true)
+}
+
+//validarCuentaRegistro revisa que la cuenta del registro sea del mismo
+//libro y no este archivada. Sin cuenta no revisa nada. Si responde un
+//error retorna false.
+func validarCuentaRegistro(w http.ResponseWriter, m Registro) bool {
+  if m.Cuenta == 0 {
+    return true
+  }
+  var archivada bool
+  err := db.QueryRow("SELECT archivada FROM cuentas WHERE id = ? AND libro_id = ?", m.Cuenta, m.Libro).Scan(&archivada)
+  if err == sql.ErrNoRows {
+    http.Error(w, "Error, la cuenta no existe en el libro del registro.", http.StatusUnprocessableEntity)
+    return false
+  }
+  if err != nil {
+    writeError(w, "Error al consultar la cuenta", err, http.StatusInternalServerError)
+    return false
+  }
+  if archivada {
+    http.Error(w, "Error, la cuenta esta archivada.", http.StatusUnprocessableEntity)
+    return false
+  }
+  return true
+}
+
+//getBalanceCuenta suma los registros de la cuenta hasta la fecha, con las
+//transferencias, y le agrega el saldo inicial. Todos los registros de la
+//cuenta estan en su moneda.
+func getBalanceCuenta(c Cuenta, hasta time.Time) (b BalanceCuenta, err error) {
+  b.Cuenta = c.Id
+  b.Hasta = hasta
+  b.SaldoInicial = c.SaldoInicial
+  b.Ingresos.Exponente = c.SaldoInicial.Exponente
+  b.Egresos.Exponente = c.SaldoInicial.Exponente
+  err = db.QueryRow(`SELECT
+  COALESCE(SUM(CASE WHEN tipo = 'ingreso' THEN monto END), 0),
+  COALESCE(SUM(CASE WHEN tipo = 'egreso' THEN monto END), 0)
+  FROM registros WHERE cuenta_id = ? AND fecha <= ?`, c.Id, hasta).Scan(&b.Ingresos.Unidades, &b.Egresos.Unidades)
+  if err != nil {
+    return b, fmt.Errorf("Error al sumar los registros de la cuenta, %v", err)
+  }
+  b.Balance = b.SaldoInicial.Mas(b.Ingresos).Menos(b.Egresos)
+  return b, nil
+}
+
+//getCuentas lista las cuentas del libro con su saldo actual. Las archivadas
+//solo salen con archivadas=true.
+//ejm http://100.69.187.16:8080/cuentas?libro=2&archivadas=true
+func getCuentas(w http.ResponseWriter, r *http.Request) {
+  libro, ok := libroPeticion(w, r, false)
+  if !ok {
+    return
+  }
+  consulta := `SELECT c.id, c.libro_id, c.nombre, c.tipo, c.saldo_inicial, c.moneda, c.archivada,
+  c.saldo_inicial + COALESCE((SELECT SUM(CASE WHEN tipo = 'ingreso' THEN monto ELSE -monto END) FROM registros WHERE cuenta_id = c.id), 0)
+  FROM cuentas c WHERE c.libro_id = ?`
+  if r.URL.Query().Get("archivadas") != "true" {
+    consulta += " AND c.archivada = 0"
+  }
+  rows, err := db.Query(consulta + " ORDER BY c.archivada, c.nombre", libro)
+  if err != nil {
+    writeError(w, "Error al consultar las cuentas", err, http.StatusInternalServerError)
+    return
+  }
+  defer rows.Close()
+  
+  cuentas := []Cuenta{}
+  for rows.Next() {
+    var c Cuenta
+    err = rows.Scan(&c.Id, &c.Libro, &c.Nombre, &c.Tipo, &c.SaldoInicial.Unidades, &c.Moneda, &c.Archivada, &c.Saldo.Unidades)
+    if err != nil {
+      writeError(w, "Error al escanear las cuentas", err, http.StatusInternalServerError)
+      return
+    }
+    c.SaldoInicial.Exponente = exponenteMoneda(c.Moneda)
+    c.Saldo.Exponente = c.SaldoInicial.Exponente
+    cuentas = append(cuentas, c)
+  }
+  if err = rows.Err(); err != nil {
+    writeError(w, "Error al consultar las cuentas", err, http.StatusInternalServerError)
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(cuentas)
+}
+
+//postCuenta crea una cuenta en el libro.
+//ejm http://100.69.187.16:8080/cuentas?libro=2
+//Json ejemplo{"nombre": "Bancolombia", "tipo": "banco", "saldoInicial": 150000, "moneda": "COP"}
+func postCuenta(w http.ResponseWriter, r *http.Request) {
+  libro, ok := libroPeticion(w, r, true)
+  if !ok {
+    return
+  }
+  var c Cuenta
+  err := json.NewDecoder(r.Body).Decode(&c)
+  if err != nil {
+    http.Error(w, "Error al leer el json.", http.StatusBadRequest)
+    return
+  }
+  err = validarCuenta(&c)
+  if err != nil {
+    writeError(w, "Error en la cuenta", err, http.StatusBadRequest)
+    return
+  }
+  c.Libro = libro
+  c.Archivada = false
+  c.Saldo = c.SaldoInicial
+  
+  res, err := db.Exec("INSERT INTO cuentas(libro_id, nombre, tipo, saldo_inicial, moneda) VALUES(?, ?, ?, ?, ?)",
+    c.Libro, c.Nombre, c.Tipo, c.SaldoInicial.Unidades, c.Moneda)
+  if err != nil {
+    writeError(w, "Error al guardar la cuenta", err, http.StatusInternalServerError)
+    return
+  }
+  id, _ := res.LastInsertId()
+  c.Id = int(id)
+  
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(http.StatusCreated)
+  json.NewEncoder(w).Encode(c)
+}
+
+//putCuenta actualiza la cuenta, con archivada en true deja de salir en la
+//lista y no recibe registros nuevos. La moneda no se puede cambiar si la
+//cuenta ya tiene registros.
+//ejm http://100.69.187.16:8080/cuentas/3
+//Json ejemplo{"nombre": "Efectivo", "tipo": "efectivo", "saldoInicial": 0, "moneda": "COP", "archivada": true}
+func putCuenta(w http.ResponseWriter, r *http.Request) {
+  id, err := strconv.Atoi(mux.Vars(r)["id"])
+  if err != nil {
+    http.Error(w, "Error, el id debe ser un numero.", http.StatusBadRequest)
+    return
+  }
+  anterior, ok := buscarCuenta(w, r, id, true)
+  if !ok {
+    return
+  }
+  
+  var c Cuenta
+  err = json.NewDecoder(r.Body).Decode(&c)
+  if err != nil {
+    http.Error(w, "Error al leer el json.", http.StatusBadRequest)
+    return
+  }
+  err = validarCuenta(&c)
+  if err != nil {
+    writeError(w, "Error en la cuenta", err, http.StatusBadRequest)
+    return
+  }
+  c.Id = anterior.Id
+  c.Libro = anterior.Libro
+  
+  if c.Moneda != anterior.Moneda {
+    var usados int
+    err = db.QueryRow("SELECT COUNT(*) FROM registros WHERE cuenta_id = ?", c.Id).Scan(&usados)
+    if err != nil {
+      writeError(w, "Error al consultar los registros de la cuenta", err, http.StatusInternalServerError)
+      return
+    }
+    if usados > 0 {
+      http.Error(w, "Error, la cuenta ya tiene registros, la moneda no se puede cambiar.", http.StatusConflict)
+      return
+    }
+  }
+  
+  _, err = db.Exec("UPDATE cuentas SET nombre = ?, tipo = ?, saldo_inicial = ?, moneda = ?, archivada = ? WHERE id = ?",
+    c.Nombre, c.Tipo, c.SaldoInicial.Unidades, c.Moneda, c.Archivada, c.Id)
+  if err != nil {
+    writeError(w, "Error al actualizar la cuenta", err, http.StatusInternalServerError)
+    return
+  }
+  b, err := getBalanceCuenta(c, time.Now().UTC())
+  if err != nil {
+    writeError(w, "Error al consultar el saldo", err, http.StatusInternalServerError)
+    return
+  }
+  c.Saldo = b.Balance
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(c)
+}
+
+//getBalanceCuentaHasta responde el saldo de la cuenta a la fecha, sin
+//fecha es el saldo de hoy.
+//ejm http://100.69.187.16:8080/cuentas/3/balance?hasta=2024-12-31T00:00:00Z
+func getBalanceCuentaHasta(w http.ResponseWriter, r *http.Request) {
+  id, err := strconv.Atoi(mux.Vars(r)["id"])
+  if err != nil {
+    http.Error(w, "Error, el id debe ser un numero.", http.StatusBadRequest)
+    return
+  }
+  hasta := time.Now().UTC()
+  if r.URL.Query().Get("hasta") != "" {
+    hasta, err = leerFecha(r, "hasta")
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusBadRequest)
+      return
+    }
+  }
+  c, ok := buscarCuenta(w, r, id, false)
+  if !ok {
+    return
+  }
+  
+  b, err := getBalanceCuenta(c, hasta)
+  if err != nil {
+    writeError(w, "Error al consultar el balance de la cuenta", err, http.StatusInternalServerError)
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(b)
+}
+
+//postTransferencia mueve plata entre dos cuentas del mismo libro. Crea un
+//egreso en el origen y un ingreso en el destino enlazados a la
+//transferencia, los dos se excluyen de los totales.
+//ejm http://100.69.187.16:8080/transferencias
+//Json ejemplo{"origen": 1, "destino": 3, "monto": 200000, "fecha": "2024-12-05T00:00:00Z", "descripcion": "retiro cajero"}
+func postTransferencia(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  var t TransferenciaCuenta
+  err := json.NewDecoder(r.Body).Decode(&t)
+  if err != nil {
+    http.Error(w, "Error al leer el json.", http.StatusBadRequest)
+    return
+  }
+  if t.Monto.Unidades <= 0 || t.Fecha.IsZero() {
+    http.Error(w, "Error, el monto debe ser mayor a 0 y la fecha es obligatoria.", http.StatusBadRequest)
+    return
+  }
+  if t.Origen == t.Destino {
+    http.Error(w, "Error, el origen y el destino deben ser cuentas distintas.", http.StatusBadRequest)
+    return
+  }
+  if utf8.RuneCountInString(t.Descripcion) > 255 {
+    http.Error(w, "Error, la descripcion no puede tener mas de 255 caracteres.", http.StatusBadRequest)
+    return
+  }
+  origen, ok := buscarCuenta(w, r, t.Origen, true)
+  if !ok {
+    return
+  }
+  destino, ok := buscarCuenta(w, r, t.Destino, true)
+  if !ok {
+    return
+  }
+  if origen.Libro != destino.Libro {
+    http.Error(w, "Error, las cuentas deben ser del mismo libro.", http.StatusUnprocessableEntity)
+    return
+  }
+  if origen.Archivada || destino.Archivada {
+    http.Error(w, "Error, la cuenta esta archivada.", http.StatusUnprocessableEntity)
+    return
+  }
+  if origen.Moneda != destino.Moneda {
+    http.Error(w, "Error, las cuentas tienen monedas distintas.", http.StatusUnprocessableEntity)
+    return
+  }
+  t.Libro = origen.Libro
+  t.Monto, err = t.Monto.Escalar(exponenteMoneda(origen.Moneda))
+  if err != nil {
+    writeError(w, "Error en el monto", err, http.StatusBadRequest)
+    return
+  }
+  
+  tx, err := db.Begin()
+  if err != nil {
+    writeError(w, "Error al iniciar la transaccion", err, http.StatusInternalServerError)
+    return
+  }
+  defer tx.Rollback()
+  
+  //primero la transferencia para tener el id que llevan los registros.
+  res, err := tx.Exec("INSERT INTO transferencias(libro_id, origen_id, destino_id, monto, fecha, descripcion, egreso_id, ingreso_id) VALUES(?, ?, ?, ?, ?, ?, 0, 0)",
+    t.Libro, t.Origen, t.Destino, t.Monto.Unidades, t.Fecha, t.Descripcion)
+  if err != nil {
+    writeError(w, "Error al guardar la transferencia", err, http.StatusInternalServerError)
+    return
+  }
+  id, _ := res.LastInsertId()
+  t.Id = int(id)
+  
+  descripcion := t.Descripcion
+  if descripcion == "" {
+    descripcion = "Transferencia de " + origen.Nombre + " a " + destino.Nombre
+  }
+  egreso := Registro{Tipo: "egreso", Monto: t.Monto, Moneda: origen.Moneda, Descripcion: descripcion, Fecha: t.Fecha, Libro: t.Libro, Cuenta: t.Origen, Transferencia: t.Id}
+  t.EgresoId, err = insertarRegistro(tx, egreso, nombreUsuario)
+  if err != nil {
+    writeError(w, "Error al guardar el egreso", err, http.StatusInternalServerError)
+    return
+  }
+  ingreso := Registro{Tipo: "ingreso", Monto: t.Monto, Moneda: destino.Moneda, Descripcion: descripcion, Fecha: t.Fecha, Libro: t.Libro, Cuenta: t.Destino, Transferencia: t.Id}
+  t.IngresoId, err = insertarRegistro(tx, ingreso, nombreUsuario)
+  if err != nil {
+    writeError(w, "Error al guardar el ingreso", err, http.StatusInternalServerError)
+    return
+  }
+  _, err = tx.Exec("UPDATE transferencias SET egreso_id = ?, ingreso_id = ? WHERE id = ?", t.EgresoId, t.IngresoId, t.Id)
+  if err != nil {
+    writeError(w, "Error al guardar la transferencia", err, http.StatusInternalServerError)
+    return
+  }
+  err = tx.Commit()
+  if err != nil {
+    writeError(w, "Error al guardar los cambios", err, http.StatusInternalServerError)
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(http.StatusCreated)
+  json.NewEncoder(w).Encode(t)
+}
+
+//borrarTransferenciaRegistro elimina la transferencia del registro que se
+//elimino junto con el otro registro del par.
+func borrarTransferenciaRegistro(ex ejecutor, transferencia int) error {
+  if transferencia == 0 {
+    return nil
+  }
+  _, err := ex.Exec("DELETE FROM registros WHERE transferencia_id = ?", transferencia)
+  if err != nil {
+    return err
+  }
+  _, err = ex.Exec("DELETE FROM transferencias WHERE id = ?", transferencia)
+  return err
+}
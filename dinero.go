@@ -0,0 +1,225 @@
+package main
+
+import (
+  "database/sql"
+  "encoding/json"
+  "fmt"
+  "log"
+  "math/big"
+  "strings"
+)
+
+//Dinero es un monto exacto guardado en la unidad menor de su moneda. Con
+//Unidades 1250 y Exponente 2 el monto es 12.50, asi no se pierden centavos
+//como pasa con float. En json se escribe como numero decimal y se lee de
+//un numero o de un texto, ejm 12.50 o "12.50".
+type Dinero struct {
+  Unidades int64
+  Exponente int
+}
+
+//exponenteMaximo es la mayor cantidad de decimales que se acepta, la de
+//monedas como el CLF.
+const exponenteMaximo = 4
+
+//montoNormalizado pasa la columna monto a diezmilesimas para comparar y
+//ordenar registros de monedas con distinto exponente.
+const montoNormalizado = "(monto * CASE exponente WHEN 0 THEN 10000 WHEN 1 THEN 1000 WHEN 2 THEN 100 WHEN 3 THEN 10 ELSE 1 END)"
+
+//exponentesMoneda son las monedas ISO 4217 que no usan 2 decimales.
+var exponentesMoneda = map[string]int{
+  "BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+  "PYG": 0, "RWF": 0, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+  "BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+  "CLF": 4, "UYW": 4,
+}
+
+//exponenteMoneda retorna los decimales de la moneda, 2 si no es una de
+//las excepciones.
+func exponenteMoneda(moneda string) int {
+  if e, ok := exponentesMoneda[moneda]; ok {
+    return e
+  }
+  return 2
+}
+
+//potencia10 retorna 10^n.
+func potencia10(n int) *big.Int {
+  return new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(n)), nil)
+}
+
+//leerDinero lee un monto decimal como 12.50 o -3, con el menor exponente
+//que lo representa exacto.
+func leerDinero(s string) (Dinero, error) {
+  numero, ok := new(big.Rat).SetString(strings.TrimPrefix(strings.TrimSpace(s), "+"))
+  if !ok {
+    return Dinero{}, fmt.Errorf("monto invalido %q", s)
+  }
+  for e := 0; e <= exponenteMaximo; e++ {
+    escalado := new(big.Rat).Mul(numero, new(big.Rat).SetInt(potencia10(e)))
+    if escalado.IsInt() {
+      if !escalado.Num().IsInt64() {
+        return Dinero{}, fmt.Errorf("monto demasiado grande %q", s)
+      }
+      return Dinero{escalado.Num().Int64(), e}, nil
+    }
+  }
+  return Dinero{}, fmt.Errorf("el monto %q tiene mas de %d decimales", s, exponenteMaximo)
+}
+
+//dineroDeRat pasa un numero al exponente dado redondeando, la mitad se
+//aleja del cero.
+func dineroDeRat(r *big.Rat, exponente int) Dinero {
+  escalado := new(big.Rat).Mul(r, new(big.Rat).SetInt(potencia10(exponente)))
+  n, resto := new(big.Int).QuoRem(escalado.Num(), escalado.Denom(), new(big.Int))
+  if resto.Abs(resto).Mul(resto, big.NewInt(2)).Cmp(escalado.Denom()) >= 0 {
+    if escalado.Sign() < 0 {
+      n.Sub(n, big.NewInt(1))
+    } else {
+      n.Add(n, big.NewInt(1))
+    }
+  }
+  return Dinero{n.Int64(), exponente}
+}
+
+//Rat retorna el monto en la unidad mayor, ejm 12.50.
+func (d Dinero) Rat() *big.Rat {
+  return new(big.Rat).SetFrac(big.NewInt(d.Unidades), potencia10(d.Exponente))
+}
+
+//Float64 es solo para graficas y hojas de calculo, para sumar se usa Rat.
+func (d Dinero) Float64() float64 {
+  f, _ := d.Rat().Float64()
+  return f
+}
+
+//Escalar pasa el monto a otro exponente sin perder nada, si sobran
+//decimales retorna un error.
+func (d Dinero) Escalar(exponente int) (Dinero, error) {
+  r := d.Rat()
+  escalado := dineroDeRat(r, exponente)
+  if escalado.Rat().Cmp(r) != 0 {
+    return d, fmt.Errorf("el monto %s tiene mas de %d decimales", d, exponente)
+  }
+  return escalado, nil
+}
+
+//Redondear pasa el monto a otro exponente redondeando si sobran decimales.
+func (d Dinero) Redondear(exponente int) Dinero {
+  return dineroDeRat(d.Rat(), exponente)
+}
+
+//Abs retorna el monto sin signo.
+func (d Dinero) Abs() Dinero {
+  if d.Unidades < 0 {
+    d.Unidades = -d.Unidades
+  }
+  return d
+}
+
+//Mas suma los montos en el mayor de los dos exponentes.
+func (d Dinero) Mas(o Dinero) Dinero {
+  if o.Exponente > d.Exponente {
+    d = d.Redondear(o.Exponente)
+  } else {
+    o = o.Redondear(d.Exponente)
+  }
+  return Dinero{d.Unidades + o.Unidades, d.Exponente}
+}
+
+//Menos resta los montos en el mayor de los dos exponentes.
+func (d Dinero) Menos(o Dinero) Dinero {
+  return d.Mas(Dinero{-o.Unidades, o.Exponente})
+}
+
+//String escribe el monto con todos los decimales de su exponente.
+func (d Dinero) String() string {
+  return d.Rat().FloatString(d.Exponente)
+}
+
+//Normalizado es el monto en diezmilesimas, como montoNormalizado en sql.
+func (d Dinero) Normalizado() int64 {
+  return d.Redondear(exponenteMaximo).Unidades
+}
+
+//MarshalJSON escribe el monto como un numero decimal exacto.
+func (d Dinero) MarshalJSON() ([]byte, error) {
+  return []byte(d.String()), nil
+}
+
+//UnmarshalJSON lee el monto de un numero o de un texto.
+func (d *Dinero) UnmarshalJSON(b []byte) error {
+  s := string(b)
+  if s == "null" {
+    return nil
+  }
+  if strings.HasPrefix(s, `"`) {
+    err := json.Unmarshal(b, &s)
+    if err != nil {
+      return err
+    }
+  }
+  leido, err := leerDinero(s)
+  if err != nil {
+    return err
+  }
+  *d = leido
+  return nil
+}
+
+//MarshalText lo usa el xml, ejm el TRNAMT del ofx.
+func (d Dinero) MarshalText() ([]byte, error) {
+  return []byte(d.String()), nil
+}
+
+//initDinero agrega el exponente a los registros y pasa los montos que
+//estaban en enteros a la unidad menor de su moneda.
+func initDinero() {
+  agregarColumna("registros", "exponente", "INTEGER NOT NULL DEFAULT 0")
+  migrar("montos_unidad_menor", migrarMontosUnidadMenor)
+}
+
+//migrarMontosUnidadMenor multiplica por 10^exponente los montos enteros de
+//los registros, las partes, las liquidaciones, las cuentas y las
+//transferencias, cada uno segun su moneda.
+func migrarMontosUnidadMenor(tx *sql.Tx) error {
+  rows, err := tx.Query("SELECT moneda FROM registros UNION SELECT moneda FROM cuentas")
+  if err != nil {
+    return err
+  }
+  var monedas []string
+  for rows.Next() {
+    var moneda string
+    err = rows.Scan(&moneda)
+    if err != nil {
+      rows.Close()
+      return err
+    }
+    monedas = append(monedas, moneda)
+  }
+  rows.Close()
+  
+  for _, moneda := range monedas {
+    e := exponenteMoneda(moneda)
+    factor := potencia10(e).Int64()
+    consultas := []string{
+      //partes y liquidaciones primero, dependen de la moneda del registro.
+      "UPDATE partes SET monto = monto * ? WHERE registro_id IN (SELECT id FROM registros WHERE moneda = ?)",
+      "UPDATE liquidaciones SET monto = monto * ? WHERE egreso_id IN (SELECT id FROM registros WHERE moneda = ?)",
+      "UPDATE transferencias SET monto = monto * ? WHERE origen_id IN (SELECT id FROM cuentas WHERE moneda = ?)",
+      "UPDATE cuentas SET saldo_inicial = saldo_inicial * ? WHERE moneda = ?",
+    }
+    for _, consulta := range consultas {
+      _, err = tx.Exec(consulta, factor, moneda)
+      if err != nil {
+        return fmt.Errorf("%v, moneda %s", err, moneda)
+      }
+    }
+    _, err = tx.Exec("UPDATE registros SET monto = monto * ?, exponente = ? WHERE moneda = ?", factor, e, moneda)
+    if err != nil {
+      return fmt.Errorf("%v, moneda %s", err, moneda)
+    }
+    log.Printf("Montos en %s pasados a la unidad menor, exponente %d", moneda, e)
+  }
+  return nil
+}
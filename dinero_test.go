@@ -0,0 +1,127 @@
+package main
+
+import (
+  "encoding/json"
+  "math/big"
+  "testing"
+)
+
+func TestLeerDinero(t *testing.T) {
+  casos := []struct {
+    texto string
+    esperado Dinero
+    falla bool
+  }{
+    {"12.50", Dinero{125, 1}, false},
+    {"12.5", Dinero{125, 1}, false},
+    {"12.05", Dinero{1205, 2}, false},
+    {"-3", Dinero{-3, 0}, false},
+    {"+7.25", Dinero{725, 2}, false},
+    {" 0.0001 ", Dinero{1, 4}, false},
+    {"1000", Dinero{1000, 0}, false},
+    {"0", Dinero{0, 0}, false},
+    {"0.00001", Dinero{}, true},
+    {"1/3", Dinero{}, true},
+    {"", Dinero{}, true},
+    {"doce", Dinero{}, true},
+    {"12,50", Dinero{}, true},
+    {"99999999999999999999", Dinero{}, true},
+  }
+  
+  for _, c := range casos {
+    d, err := leerDinero(c.texto)
+    if c.falla {
+      if err == nil {
+        t.Errorf("leerDinero(%q) = %v, esperaba un error", c.texto, d)
+      }
+      continue
+    }
+    if err != nil {
+      t.Errorf("leerDinero(%q) error inesperado %v", c.texto, err)
+      continue
+    }
+    if d != c.esperado {
+      t.Errorf("leerDinero(%q) = %+v, esperaba %+v", c.texto, d, c.esperado)
+    }
+  }
+}
+
+func TestDineroEscalar(t *testing.T) {
+  casos := []struct {
+    d Dinero
+    exponente int
+    esperado Dinero
+    falla bool
+  }{
+    {Dinero{125, 1}, 2, Dinero{1250, 2}, false},
+    {Dinero{1250, 2}, 0, Dinero{}, true},
+    {Dinero{1200, 2}, 0, Dinero{12, 0}, false},
+    {Dinero{-5, 0}, 4, Dinero{-50000, 4}, false},
+    {Dinero{1, 4}, 2, Dinero{}, true},
+    {Dinero{0, 3}, 0, Dinero{0, 0}, false},
+  }
+  
+  for _, c := range casos {
+    d, err := c.d.Escalar(c.exponente)
+    if c.falla {
+      if err == nil {
+        t.Errorf("%+v.Escalar(%d) = %+v, esperaba un error", c.d, c.exponente, d)
+      }
+      continue
+    }
+    if err != nil {
+      t.Errorf("%+v.Escalar(%d) error inesperado %v", c.d, c.exponente, err)
+      continue
+    }
+    if d != c.esperado {
+      t.Errorf("%+v.Escalar(%d) = %+v, esperaba %+v", c.d, c.exponente, d, c.esperado)
+    }
+  }
+}
+
+func TestDineroDeRat(t *testing.T) {
+  casos := []struct {
+    rat string
+    exponente int
+    esperado Dinero
+  }{
+    {"12.345", 2, Dinero{1235, 2}},
+    {"12.344", 2, Dinero{1234, 2}},
+    {"-12.345", 2, Dinero{-1235, 2}},
+    {"-12.344", 2, Dinero{-1234, 2}},
+    {"0.5", 0, Dinero{1, 0}},
+    {"-0.5", 0, Dinero{-1, 0}},
+    {"2.5", 0, Dinero{3, 0}},
+    {"1/3", 4, Dinero{3333, 4}},
+    {"2/3", 2, Dinero{67, 2}},
+    {"-2/3", 2, Dinero{-67, 2}},
+    {"7", 2, Dinero{700, 2}},
+  }
+  
+  for _, c := range casos {
+    r, _ := new(big.Rat).SetString(c.rat)
+    d := dineroDeRat(r, c.exponente)
+    if d != c.esperado {
+      t.Errorf("dineroDeRat(%s, %d) = %+v, esperaba %+v", c.rat, c.exponente, d, c.esperado)
+    }
+  }
+}
+
+func TestDineroJSON(t *testing.T) {
+  var d struct {
+    Monto Dinero `json:"monto"`
+  }
+  for _, entrada := range []string{`{"monto": 12.50}`, `{"monto": "12.50"}`} {
+    if err := json.Unmarshal([]byte(entrada), &d); err != nil {
+      t.Fatalf("%s: %v", entrada, err)
+    }
+    if d.Monto != (Dinero{125, 1}) {
+      t.Errorf("%s se leyo como %+v", entrada, d.Monto)
+    }
+  }
+  
+  b, _ := json.Marshal(Dinero{1250, 2})
+  if string(b) != "12.50" {
+    t.Errorf("se escribio %s, esperaba 12.50", b)
+  }
+}
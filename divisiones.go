@@ -0,0 +1,572 @@
+package main
+
+import (
+  "database/sql"
+  "encoding/json"
+  "fmt"
+  "log"
+  "math"
+  "net/http"
+  "sort"
+  "time"
+)
+
+//Division reparte un egreso entre varios miembros del libro. Pagador es
+//quien puso la plata, por defecto el que crea el egreso. Con modo igual se
+//reparte en partes iguales, con exacto cada parte trae su monto y con
+//porcentaje cada parte trae su porcentaje.
+type Division struct {
+  Modo string `json:"modo"`
+  Pagador string `json:"pagador,omitempty"`
+  Partes []Parte `json:"partes"`
+}
+
+//Parte es lo que le toca pagar a un usuario de un egreso dividido.
+type Parte struct {
+  Usuario string `json:"usuario"`
+  Monto Dinero `json:"monto"`
+  Porcentaje float64 `json:"porcentaje,omitempty"`
+}
+
+//Transferencia es un pago que salda deudas, De le paga a Para.
+type Transferencia struct {
+  De string `json:"de"`
+  Para string `json:"para"`
+  Monto Dinero `json:"monto"`
+}
+
+//Deudas es el estado de cuentas de un libro. En Saldos un valor positivo es
+//lo que le deben al usuario y uno negativo lo que debe.
+type Deudas struct {
+  Libro int `json:"libro"`
+  Saldos map[string]Dinero `json:"saldos"`
+  Transferencias []Transferencia `json:"transferencias"`
+}
+
+//Liquidacion es un pago registrado entre dos miembros. Se guarda como un
+//egreso de quien paga y un ingreso de quien recibe en el mismo libro, asi
+//el balance del libro no cambia.
+type Liquidacion struct {
+  Id int `json:"id"`
+  Libro int `json:"libro"`
+  De string `json:"de"`
+  Para string `json:"para"`
+  Monto Dinero `json:"monto"`
+  Fecha time.Time `json:"fecha"`
+  EgresoId int `json:"egresoId"`
+  IngresoId int `json:"ingresoId"`
+}
+
+//hasta con esta cantidad de personas con saldo se busca el minimo exacto de
+//transferencias, con mas se usa el metodo voraz.
+const maxPersonasExacto = 15
+
+//initDivisiones crea las tablas de divisiones, partes y liquidaciones.
+func initDivisiones() {
+  crearTablaDivisiones := `
+  CREATE TABLE IF NOT EXISTS divisiones(
+  registro_id INTEGER PRIMARY KEY REFERENCES registros(id),
+  pagador TEXT NOT NULL,
+  modo TEXT NOT NULL
+  );`
+  
+  crearTablaPartes := `
+  CREATE TABLE IF NOT EXISTS partes(
+  registro_id INTEGER NOT NULL REFERENCES registros(id),
+  usuario TEXT NOT NULL,
+  monto INTEGER NOT NULL,
+  porcentaje REAL,
+  PRIMARY KEY(registro_id, usuario)
+  );`
+  
+  crearTablaLiquidaciones := `
+  CREATE TABLE IF NOT EXISTS liquidaciones(
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  libro_id INTEGER NOT NULL REFERENCES libros(id),
+  de TEXT NOT NULL,
+  para TEXT NOT NULL,
+  monto INTEGER NOT NULL,
+  fecha DATETIME NOT NULL,
+  egreso_id INTEGER NOT NULL,
+  ingreso_id INTEGER NOT NULL
+  );`
+  
+  _, err := db.Exec(crearTablaDivisiones)
+  if err != nil {
+    log.Fatal("Error creando la tabla divisiones", err)
+  }
+  _, err = db.Exec(crearTablaPartes)
+  if err != nil {
+    log.Fatal("Error creando la tabla partes", err)
+  }
+  _, err = db.Exec(crearTablaLiquidaciones)
+  if err != nil {
+    log.Fatal("Error creando la tabla liquidaciones", err)
+  }
+}
+
+//miembrosLibro retorna los usuarios del libro.
+func miembrosLibro(libro int) (map[string]bool, error) {
+  rows, err := db.Query("SELECT usuario FROM libro_miembros WHERE libro_id = ?", libro)
+  if err != nil {
+    return nil, fmt.Errorf("Error al consultar los miembros, %v", err)
+  }
+  defer rows.Close()
+  
+  miembros := map[string]bool{}
+  for rows.Next() {
+    var usuario string
+    err = rows.Scan(&usuario)
+    if err != nil {
+      return nil, fmt.Errorf("Error al escanear los miembros, %v", err)
+    }
+    miembros[usuario] = true
+  }
+  return miembros, rows.Err()
+}
+
+//calcularDivision valida la division del egreso m y llena el monto de cada
+//parte, las partes siempre suman exacto el monto del egreso.
+func calcularDivision(d *Division, m Registro, miembros map[string]bool) error {
+  if m.Monto.Unidades <= 0 {
+    return fmt.Errorf("el monto del egreso debe ser mayor a 0")
+  }
+  if d.Pagador == "" {
+    d.Pagador = m.Usuario
+  }
+  if !miembros[d.Pagador] {
+    return fmt.Errorf("el pagador %q no es miembro del libro", d.Pagador)
+  }
+  if len(d.Partes) == 0 {
+    return fmt.Errorf("la division debe tener al menos una parte")
+  }
+  vistos := map[string]bool{}
+  for _, p := range d.Partes {
+    if !miembros[p.Usuario] {
+      return fmt.Errorf("el usuario %q no es miembro del libro", p.Usuario)
+    }
+    if vistos[p.Usuario] {
+      return fmt.Errorf("el usuario %q esta repetido", p.Usuario)
+    }
+    vistos[p.Usuario] = true
+  }
+  
+  switch d.Modo {
+  case "igual":
+    pesos := make([]int, len(d.Partes))
+    for i := range pesos {
+      pesos[i] = 1
+    }
+    repartirMonto(d.Partes, m.Monto, pesos)
+  case "exacto":
+    //las partes van con los decimales de la moneda del egreso.
+    suma := Dinero{0, m.Monto.Exponente}
+    for i, p := range d.Partes {
+      if p.Monto.Unidades < 0 {
+        return fmt.Errorf("el monto de %q no puede ser negativo", p.Usuario)
+      }
+      monto, err := p.Monto.Escalar(m.Monto.Exponente)
+      if err != nil {
+        return fmt.Errorf("en la parte de %q, %v", p.Usuario, err)
+      }
+      d.Partes[i].Monto = monto
+      suma = suma.Mas(monto)
+    }
+    if suma != m.Monto {
+      return fmt.Errorf("las partes suman %s y el egreso es de %s", suma, m.Monto)
+    }
+  case "porcentaje":
+    //los porcentajes se llevan a centesimas para sumarlos sin errores.
+    pesos := make([]int, len(d.Partes))
+    suma := 0
+    for i, p := range d.Partes {
+      if p.Porcentaje < 0 {
+        return fmt.Errorf("el porcentaje de %q no puede ser negativo", p.Usuario)
+      }
+      pesos[i] = int(math.Round(p.Porcentaje * 100))
+      suma += pesos[i]
+    }
+    if suma != 10000 {
+      return fmt.Errorf("los porcentajes deben sumar 100")
+    }
+    repartirMonto(d.Partes, m.Monto, pesos)
+  default:
+    return fmt.Errorf("el modo solo puede ser igual, exacto o porcentaje")
+  }
+  return nil
+}
+
+//repartirMonto le da a cada parte el monto proporcional a su peso y el
+//residuo, unidad menor por unidad menor, a las de mayor fraccion.
+func repartirMonto(partes []Parte, monto Dinero, pesos []int) {
+  var total int64
+  for _, p := range pesos {
+    total += int64(p)
+  }
+  var asignado int64
+  residuos := make([]int64, len(partes))
+  for i := range partes {
+    partes[i].Monto = Dinero{monto.Unidades * int64(pesos[i]) / total, monto.Exponente}
+    residuos[i] = monto.Unidades * int64(pesos[i]) % total
+    asignado += partes[i].Monto.Unidades
+  }
+  
+  orden := make([]int, len(partes))
+  for i := range orden {
+    orden[i] = i
+  }
+  sort.SliceStable(orden, func(a, b int) bool { return residuos[orden[a]] > residuos[orden[b]] })
+  for i := 0; asignado < monto.Unidades; i++ {
+    partes[orden[i % len(orden)]].Monto.Unidades++
+    asignado++
+  }
+}
+
+//guardarDivision guarda la division ya calculada del registro.
+func guardarDivision(ex ejecutor, registro int, d Division) error {
+  _, err := ex.Exec("INSERT INTO divisiones(registro_id, pagador, modo) VALUES(?, ?, ?)", registro, d.Pagador, d.Modo)
+  if err != nil {
+    return fmt.Errorf("Error al guardar la division, %v", err)
+  }
+  for _, p := range d.Partes {
+    var porcentaje interface{}
+    if d.Modo == "porcentaje" {
+      porcentaje = p.Porcentaje
+    }
+    _, err = ex.Exec("INSERT INTO partes(registro_id, usuario, monto, porcentaje) VALUES(?, ?, ?, ?)", registro, p.Usuario, p.Monto.Unidades, porcentaje)
+    if err != nil {
+      return fmt.Errorf("Error al guardar la parte de %s, %v", p.Usuario, err)
+    }
+  }
+  return nil
+}
+
+//montoDividido retorna la suma de las partes si el registro esta dividido.
+//Sirve para no dejar la division descuadrada al editar el egreso. Las
+//partes estan en la unidad menor de la moneda del registro.
+func montoDividido(id int) (Dinero, bool, error) {
+  var suma sql.NullInt64
+  var exponente sql.NullInt64
+  err := db.QueryRow("SELECT SUM(p.monto), MAX(r.exponente) FROM partes p JOIN registros r ON r.id = p.registro_id WHERE p.registro_id = ?", id).Scan(&suma, &exponente)
+  if err != nil {
+    return Dinero{}, false, fmt.Errorf("Error al consultar la division, %v", err)
+  }
+  return Dinero{suma.Int64, int(exponente.Int64)}, suma.Valid, nil
+}
+
+//validarCambioDividido responde 409 si el cambio deja descuadrada la
+//division del registro. Si ya respondio retorna false.
+func validarCambioDividido(w http.ResponseWriter, id int, monto Dinero, tipo string) bool {
+  total, dividido, err := montoDividido(id)
+  if err != nil {
+    writeError(w, "Error al consultar la division", err, http.StatusInternalServerError)
+    return false
+  }
+  if dividido && (monto.Normalizado() != total.Normalizado() || tipo != "egreso") {
+    http.Error(w, "Error, el egreso esta dividido, el monto y el tipo no se pueden cambiar. Eliminelo y creelo de nuevo.", http.StatusConflict)
+    return false
+  }
+  return true
+}
+
+//borrarDivisionRegistro quita la division del registro que se elimino y si
+//era parte de una liquidacion la elimina con el otro registro, asi las
+//deudas y el balance quedan iguales.
+func borrarDivisionRegistro(ex ejecutor, id int) error {
+  _, err := ex.Exec("DELETE FROM partes WHERE registro_id = ?", id)
+  if err != nil {
+    return err
+  }
+  _, err = ex.Exec("DELETE FROM divisiones WHERE registro_id = ?", id)
+  if err != nil {
+    return err
+  }
+  //egreso_id + ingreso_id - id es el otro registro de la liquidacion.
+  _, err = ex.Exec("DELETE FROM registros WHERE id IN (SELECT egreso_id + ingreso_id - ? FROM liquidaciones WHERE egreso_id = ? OR ingreso_id = ?)", id, id, id)
+  if err != nil {
+    return err
+  }
+  _, err = ex.Exec("DELETE FROM liquidaciones WHERE egreso_id = ? OR ingreso_id = ?", id, id)
+  return err
+}
+
+//saldosLibro calcula cuanto le deben o debe cada miembro del libro sumando
+//las divisiones y restando las liquidaciones. Cada parte se pasa a la
+//moneda base con la tasa del dia de su registro, y los saldos van en
+//diezmilesimas de la moneda base.
+func saldosLibro(libro int, usuario string) (map[string]int, error) {
+  saldos := map[string]int{}
+  conv := nuevoConversor(monedaBase())
+  
+  //el pagador puso todo el egreso y cada uno debe su parte.
+  rows, err := db.Query(`SELECT d.pagador, p.usuario, p.monto, r.exponente, r.moneda, substr(r.fecha, 1, 10) FROM divisiones d
+  JOIN registros r ON r.id = d.registro_id
+  JOIN partes p ON p.registro_id = d.registro_id
+  WHERE r.libro_id = ? AND r.` + condicionMiembro, libro, usuario)
+  if err != nil {
+    return nil, fmt.Errorf("Error al consultar las divisiones, %v", err)
+  }
+  for rows.Next() {
+    var pagador, deudor, moneda, dia string
+    var monto Dinero
+    err = rows.Scan(&pagador, &deudor, &monto.Unidades, &monto.Exponente, &moneda, &dia)
+    if err != nil {
+      rows.Close()
+      return nil, fmt.Errorf("Error al escanear las divisiones, %v", err)
+    }
+    base, err := saldoBase(conv, monto, moneda, dia)
+    if err != nil {
+      rows.Close()
+      return nil, err
+    }
+    saldos[pagador] += base
+    saldos[deudor] -= base
+  }
+  rows.Close()
+  if err = rows.Err(); err != nil {
+    return nil, fmt.Errorf("Error al consultar las divisiones, %v", err)
+  }
+  
+  rows, err = db.Query("SELECT l.de, l.para, l.monto, r.exponente, r.moneda, substr(r.fecha, 1, 10) FROM liquidaciones l JOIN registros r ON r.id = l.egreso_id WHERE l.libro_id = ? AND l." + condicionMiembro, libro, usuario)
+  if err != nil {
+    return nil, fmt.Errorf("Error al consultar las liquidaciones, %v", err)
+  }
+  defer rows.Close()
+  for rows.Next() {
+    var de, para, moneda, dia string
+    var monto Dinero
+    err = rows.Scan(&de, &para, &monto.Unidades, &monto.Exponente, &moneda, &dia)
+    if err != nil {
+      return nil, fmt.Errorf("Error al escanear las liquidaciones, %v", err)
+    }
+    base, err := saldoBase(conv, monto, moneda, dia)
+    if err != nil {
+      return nil, err
+    }
+    saldos[de] += base
+    saldos[para] -= base
+  }
+  if err = rows.Err(); err != nil {
+    return nil, fmt.Errorf("Error al consultar las liquidaciones, %v", err)
+  }
+  
+  for u, s := range saldos {
+    if s == 0 {
+      delete(saldos, u)
+    }
+  }
+  return saldos, nil
+}
+
+//transferenciasMinimas arma los pagos que dejan todos los saldos en 0. El
+//minimo de pagos es la cantidad de personas menos la cantidad de grupos en
+//que se pueden partir con suma 0, esos grupos se buscan probando todos los
+//subconjuntos. Si hay demasiadas personas se usa solo el metodo voraz.
+func transferenciasMinimas(saldos map[string]int) []Transferencia {
+  nombres := make([]string, 0, len(saldos))
+  for u, s := range saldos {
+    if s != 0 {
+      nombres = append(nombres, u)
+    }
+  }
+  sort.Strings(nombres)
+  n := len(nombres)
+  if n == 0 {
+    return []Transferencia{}
+  }
+  if n > maxPersonasExacto {
+    return transferenciasVoraz(nombres, saldos)
+  }
+  
+  //suma[mask] es el saldo del subconjunto y grupos[mask] la mayor
+  //cantidad de grupos con suma 0 en que se puede partir.
+  total := 1 << n
+  suma := make([]int, total)
+  grupos := make([]int, total)
+  quitar := make([]int, total)
+  for mask := 1; mask < total; mask++ {
+    for i := 0; i < n; i++ {
+      if mask & (1 << i) == 0 {
+        continue
+      }
+      anterior := mask ^ (1 << i)
+      suma[mask] = suma[anterior] + saldos[nombres[i]]
+      if grupos[anterior] >= grupos[mask] {
+        grupos[mask] = grupos[anterior]
+        quitar[mask] = i
+      }
+    }
+    if suma[mask] == 0 {
+      grupos[mask]++
+    }
+  }
+  
+  //recorremos el camino desde el conjunto completo, cada vez que la suma
+  //queda en 0 se cierra un grupo.
+  transferencias := []Transferencia{}
+  var grupo []string
+  for mask := total - 1; mask > 0; {
+    i := quitar[mask]
+    grupo = append(grupo, nombres[i])
+    mask ^= 1 << i
+    if suma[mask] == 0 {
+      transferencias = append(transferencias, transferenciasVoraz(grupo, saldos)...)
+      grupo = nil
+    }
+  }
+  return transferencias
+}
+
+//transferenciasVoraz salda el grupo pagando siempre del que mas debe al que
+//mas le deben. En un grupo de k personas usa maximo k-1 pagos.
+func transferenciasVoraz(nombres []string, saldos map[string]int) []Transferencia {
+  pendientes := map[string]int{}
+  for _, u := range nombres {
+    pendientes[u] = saldos[u]
+  }
+  
+  transferencias := []Transferencia{}
+  for {
+    deudor, acreedor := "", ""
+    for _, u := range nombres {
+      if pendientes[u] < 0 && (deudor == "" || pendientes[u] < pendientes[deudor]) {
+        deudor = u
+      }
+      if pendientes[u] > 0 && (acreedor == "" || pendientes[u] > pendientes[acreedor]) {
+        acreedor = u
+      }
+    }
+    if deudor == "" || acreedor == "" {
+      return transferencias
+    }
+    monto := -pendientes[deudor]
+    if pendientes[acreedor] < monto {
+      monto = pendientes[acreedor]
+    }
+    pendientes[deudor] += monto
+    pendientes[acreedor] -= monto
+    transferencias = append(transferencias, Transferencia{deudor, acreedor, dineroSaldo(monto)})
+  }
+}
+
+//saldoBase pasa el monto a diezmilesimas de la moneda base con la tasa del
+//dia.
+func saldoBase(conv *conversor, monto Dinero, moneda string, dia string) (int, error) {
+  convertido, err := conv.convertir(monto, moneda, dia)
+  if err != nil {
+    return 0, err
+  }
+  return int(dineroDeRat(convertido, exponenteMaximo).Unidades), nil
+}
+
+//dineroSaldo pasa un saldo en diezmilesimas a los decimales de la moneda
+//base.
+func dineroSaldo(saldo int) Dinero {
+  return Dinero{int64(saldo), exponenteMaximo}.Redondear(exponenteMoneda(monedaBase()))
+}
+
+//getDeudas responde los saldos del libro y los pagos minimos para quedar
+//a paz y salvo.
+//ejm http://100.69.187.16:8080/deudas?libro=2
+func getDeudas(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  libro, ok := libroPeticion(w, r, false)
+  if !ok {
+    return
+  }
+  saldos, err := saldosLibro(libro, nombreUsuario)
+  if err != nil {
+    writeError(w, "Error al calcular las deudas", err, statusConversion(err))
+    return
+  }
+  
+  deudas := Deudas{Libro: libro, Saldos: map[string]Dinero{}, Transferencias: transferenciasMinimas(saldos)}
+  for u, s := range saldos {
+    deudas.Saldos[u] = dineroSaldo(s)
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(deudas)
+}
+
+//postLiquidacion registra que el usuario le pago a otro miembro. Se crea
+//un egreso del usuario y un ingreso del que recibe en el libro, y el pago
+//se descuenta de las deudas.
+//ejm http://100.69.187.16:8080/deudas/liquidar?libro=2
+//Json ejemplo{"para": "pedro1", "monto": 15000, "fecha": "2024-12-05T00:00:00Z"}
+func postLiquidacion(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  libro, ok := libroPeticion(w, r, true)
+  if !ok {
+    return
+  }
+  var l Liquidacion
+  err := json.NewDecoder(r.Body).Decode(&l)
+  if err != nil {
+    http.Error(w, "Error al leer el json.", http.StatusBadRequest)
+    return
+  }
+  l.Libro = libro
+  l.De = nombreUsuario
+  if l.Fecha.IsZero() {
+    l.Fecha = time.Now().UTC().Truncate(24 * time.Hour)
+  }
+  if l.Monto.Unidades <= 0 {
+    http.Error(w, "Error, el monto debe ser mayor a 0.", http.StatusBadRequest)
+    return
+  }
+  //los pagos quedan en la moneda base.
+  l.Monto, err = l.Monto.Escalar(exponenteMoneda(monedaBase()))
+  if err != nil {
+    writeError(w, "Error en el monto", err, http.StatusBadRequest)
+    return
+  }
+  miembros, err := miembrosLibro(libro)
+  if err != nil {
+    writeError(w, "Error al consultar el libro", err, http.StatusInternalServerError)
+    return
+  }
+  if !miembros[l.Para] || l.Para == l.De {
+    http.Error(w, "Error, para debe ser otro miembro del libro.", http.StatusUnprocessableEntity)
+    return
+  }
+  
+  tx, err := db.Begin()
+  if err != nil {
+    writeError(w, "Error al iniciar la transaccion", err, http.StatusInternalServerError)
+    return
+  }
+  defer tx.Rollback()
+  
+  egreso := Registro{Tipo: "egreso", Monto: l.Monto, Descripcion: "Pago a " + l.Para, Fecha: l.Fecha, Libro: libro}
+  l.EgresoId, err = insertarRegistro(tx, egreso, l.De)
+  if err != nil {
+    writeError(w, "Error al guardar el egreso", err, http.StatusInternalServerError)
+    return
+  }
+  ingreso := Registro{Tipo: "ingreso", Monto: l.Monto, Descripcion: "Pago de " + l.De, Fecha: l.Fecha, Libro: libro}
+  l.IngresoId, err = insertarRegistro(tx, ingreso, l.Para)
+  if err != nil {
+    writeError(w, "Error al guardar el ingreso", err, http.StatusInternalServerError)
+    return
+  }
+  res, err := tx.Exec("INSERT INTO liquidaciones(libro_id, de, para, monto, fecha, egreso_id, ingreso_id) VALUES(?, ?, ?, ?, ?, ?, ?)",
+    l.Libro, l.De, l.Para, l.Monto.Unidades, l.Fecha, l.EgresoId, l.IngresoId)
+  if err != nil {
+    writeError(w, "Error al guardar la liquidacion", err, http.StatusInternalServerError)
+    return
+  }
+  id, _ := res.LastInsertId()
+  l.Id = int(id)
+  err = tx.Commit()
+  if err != nil {
+    writeError(w, "Error al guardar los cambios", err, http.StatusInternalServerError)
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(http.StatusCreated)
+  json.NewEncoder(w).Encode(l)
+}
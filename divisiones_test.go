@@ -0,0 +1,90 @@
+package main
+
+import (
+  "testing"
+)
+
+func TestRepartirMonto(t *testing.T) {
+  casos := []struct {
+    nombre string
+    monto Dinero
+    pesos []int
+    esperado []int64
+  }{
+    {"iguales exacto", Dinero{9000, 2}, []int{1, 1, 1}, []int64{3000, 3000, 3000}},
+    {"iguales con residuo", Dinero{10000, 2}, []int{1, 1, 1}, []int64{3334, 3333, 3333}},
+    {"residuo de dos unidades", Dinero{11, 0}, []int{1, 1, 1}, []int64{4, 4, 3}},
+    {"residuo a la mayor fraccion", Dinero{1000, 0}, []int{3333, 3333, 3334}, []int64{333, 333, 334}},
+    {"porcentajes", Dinero{15000, 2}, []int{5000, 2500, 2500}, []int64{7500, 3750, 3750}},
+    {"peso cero", Dinero{100, 2}, []int{0, 1}, []int64{0, 100}},
+    {"una unidad", Dinero{1, 2}, []int{1, 1}, []int64{1, 0}},
+  }
+  
+  for _, c := range casos {
+    t.Run(c.nombre, func(t *testing.T) {
+      partes := make([]Parte, len(c.pesos))
+      repartirMonto(partes, c.monto, c.pesos)
+      
+      var suma int64
+      for i, p := range partes {
+        if p.Monto.Exponente != c.monto.Exponente {
+          t.Errorf("la parte %d quedo con exponente %d", i, p.Monto.Exponente)
+        }
+        if p.Monto.Unidades != c.esperado[i] {
+          t.Errorf("la parte %d es %d, esperaba %d", i, p.Monto.Unidades, c.esperado[i])
+        }
+        suma += p.Monto.Unidades
+      }
+      //las partes siempre suman el monto completo.
+      if suma != c.monto.Unidades {
+        t.Errorf("las partes suman %d y el monto es %d", suma, c.monto.Unidades)
+      }
+    })
+  }
+}
+
+func TestTransferenciasMinimas(t *testing.T) {
+  t.Setenv("MONEDA_BASE", "USD")
+  
+  //los saldos van en diezmilesimas, 10000 es 1.00 USD.
+  casos := []struct {
+    nombre string
+    saldos map[string]int
+    cantidad int
+  }{
+    {"sin saldos", map[string]int{}, 0},
+    {"todos a paz y salvo", map[string]int{"ana": 0, "luis": 0}, 0},
+    {"dos personas", map[string]int{"ana": 50000, "luis": -50000}, 1},
+    {"un acreedor", map[string]int{"ana": 30000, "luis": -10000, "pedro": -20000}, 2},
+    {"dos grupos independientes", map[string]int{"a": 50000, "b": -50000, "c": 70000, "d": -70000}, 2},
+    //el metodo voraz usa 4 pagos, separando {a, b, c} y {d, e} se usan 3.
+    {"mejor que el voraz", map[string]int{"a": 50000, "b": -30000, "c": -20000, "d": -40000, "e": 40000}, 3},
+  }
+  
+  for _, c := range casos {
+    t.Run(c.nombre, func(t *testing.T) {
+      transferencias := transferenciasMinimas(c.saldos)
+      if len(transferencias) != c.cantidad {
+        t.Errorf("se hicieron %d transferencias, esperaba %d: %+v", len(transferencias), c.cantidad, transferencias)
+      }
+      
+      //despues de los pagos todos deben quedar en 0.
+      pendientes := map[string]int64{}
+      for u, s := range c.saldos {
+        pendientes[u] = int64(s)
+      }
+      for _, tr := range transferencias {
+        if tr.Monto.Unidades <= 0 {
+          t.Errorf("transferencia sin monto %+v", tr)
+        }
+        pendientes[tr.De] += tr.Monto.Normalizado()
+        pendientes[tr.Para] -= tr.Monto.Normalizado()
+      }
+      for u, p := range pendientes {
+        if p != 0 {
+          t.Errorf("%s quedo con saldo %d", u, p)
+        }
+      }
+    })
+  }
+}
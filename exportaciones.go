@@ -0,0 +1,222 @@
+package main
+
+import (
+  "database/sql"
+  "encoding/json"
+  "fmt"
+  "log"
+  "net/http"
+  "os"
+  "path/filepath"
+  "time"
+  
+  "github.com/gorilla/mux"
+)
+
+//Exportacion es un trabajo de exportacion que corre en segundo plano. El
+//estado pasa de pendiente a procesando y termina en terminada o error.
+type Exportacion struct {
+  Id string `json:"id"`
+  Tipo string `json:"tipo"`
+  Libro int `json:"libro"`
+  Desde time.Time `json:"desde"`
+  Hasta time.Time `json:"hasta"`
+  Estado string `json:"estado"`
+  Error string `json:"error,omitempty"`
+  Creada time.Time `json:"creada"`
+  Terminada *time.Time `json:"terminada,omitempty"`
+  Descarga string `json:"descarga,omitempty"`
+}
+
+//cuantas exportaciones se procesan al mismo tiempo, las demas esperan.
+var turnosExportacion = make(chan struct{}, 2)
+
+//initExportaciones crea la tabla de exportaciones. Las que quedaron sin
+//terminar cuando se apago el servidor ya no van a correr, las marcamos
+//con error para que el usuario las vuelva a pedir.
+func initExportaciones() {
+  crearTablaExportaciones := `
+  CREATE TABLE IF NOT EXISTS exportaciones(
+  id TEXT PRIMARY KEY,
+  usuario TEXT NOT NULL,
+  tipo TEXT NOT NULL,
+  desde TEXT NOT NULL,
+  hasta TEXT NOT NULL,
+  estado TEXT NOT NULL,
+  error TEXT NOT NULL DEFAULT '',
+  archivo TEXT NOT NULL DEFAULT '',
+  creada TEXT NOT NULL,
+  terminada TEXT
+  );`
+  
+  _, err := db.Exec(crearTablaExportaciones)
+  if err != nil {
+    log.Fatal("Error creando la tabla exportaciones", err)
+  }
+  
+  _, err = db.Exec("UPDATE exportaciones SET estado = 'error', error = 'el servidor se detuvo antes de terminar' WHERE estado IN ('pendiente', 'procesando')")
+  if err != nil {
+    log.Fatal("Error actualizando las exportaciones pendientes ", err)
+  }
+}
+
+//dirExportaciones es la carpeta donde quedan los archivos generados.
+func dirExportaciones() string {
+  dir := os.Getenv("DIR_EXPORTACIONES")
+  if dir == "" {
+    dir = "exportaciones"
+  }
+  return dir
+}
+
+//postExportacion crea un trabajo para exportar el rango en segundo plano y
+//responde de una vez con su id para consultarlo en /exportaciones/{id}.
+//Solo lee registros, asi que basta con una clave de api de lectura.
+//ejm http://100.69.187.16:8080/exportaciones?desde=2020-01-01T00:00:00Z&hasta=2024-12-31T00:00:00Z&tipo=csv
+func postExportacion(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  desde, err := leerFecha(r, "desde")
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  hasta, err := leerFecha(r, "hasta")
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  tipo := r.URL.Query().Get("tipo")
+  if tipo == "" {
+    tipo = "json"
+  }
+  if _, ok := formatosExportacion[tipo]; !ok {
+    http.Error(w, "El tipo solo puede ser json, ndjson, csv, xlsx, ofx o ledger.", http.StatusBadRequest)
+    return
+  }
+  libro, ok := libroPeticion(w, r, false)
+  if !ok {
+    return
+  }
+  
+  e := Exportacion{
+    Id: tokenAleatorio(16),
+    Tipo: tipo,
+    Libro: libro,
+    Desde: desde,
+    Hasta: hasta,
+    Estado: "pendiente",
+    Creada: time.Now().UTC().Truncate(time.Second),
+  }
+  _, err = db.Exec("INSERT INTO exportaciones(id, usuario, libro_id, tipo, desde, hasta, estado, creada) VALUES(?, ?, ?, ?, ?, ?, ?, ?)",
+    e.Id, nombreUsuario, e.Libro, e.Tipo, e.Desde.Format(time.RFC3339), e.Hasta.Format(time.RFC3339), e.Estado, e.Creada.Format(time.RFC3339))
+  if err != nil {
+    writeError(w, "Error al crear la exportacion", err, http.StatusInternalServerError)
+    return
+  }
+  
+  go procesarExportacion(e, nombreUsuario)
+  
+  w.Header().Set("Content-Type", "application/json")
+  w.Header().Set("Location", "/exportaciones/" + e.Id)
+  w.WriteHeader(http.StatusAccepted)
+  json.NewEncoder(w).Encode(e)
+}
+
+//procesarExportacion escribe el archivo de la exportacion y guarda como
+//termino. Espera turno para no cargar la base con muchas a la vez.
+func procesarExportacion(e Exportacion, usuario string) {
+  turnosExportacion <- struct{}{}
+  defer func() { <-turnosExportacion }()
+  
+  _, err := db.Exec("UPDATE exportaciones SET estado = 'procesando' WHERE id = ?", e.Id)
+  if err != nil {
+    log.Printf("Error al actualizar la exportacion %s, %v", e.Id, err)
+  }
+  
+  archivo := filepath.Join(dirExportaciones(), e.Id + "." + formatosExportacion[e.Tipo].extension)
+  err = escribirArchivoExportacion(archivo, e, usuario)
+  
+  estado, mensaje := "terminada", ""
+  if err != nil {
+    estado, mensaje = "error", err.Error()
+    os.Remove(archivo)
+    archivo = ""
+    log.Printf("Error en la exportacion %s, %v", e.Id, err)
+  }
+  _, err = db.Exec("UPDATE exportaciones SET estado = ?, error = ?, archivo = ?, terminada = ? WHERE id = ?",
+    estado, mensaje, archivo, time.Now().UTC().Format(time.RFC3339), e.Id)
+  if err != nil {
+    log.Printf("Error al actualizar la exportacion %s, %v", e.Id, err)
+  }
+}
+
+//escribirArchivoExportacion crea el archivo y escribe en el los registros.
+func escribirArchivoExportacion(archivo string, e Exportacion, usuario string) error {
+  err := os.MkdirAll(filepath.Dir(archivo), 0o755)
+  if err != nil {
+    return fmt.Errorf("Error al crear la carpeta de exportaciones, %v", err)
+  }
+  f, err := os.Create(archivo)
+  if err != nil {
+    return fmt.Errorf("Error al crear el archivo, %v", err)
+  }
+  
+  //en un archivo no hay nada que vaciar mientras se escribe.
+  err = escribirExportacion(f, e.Tipo, e.Libro, usuario, e.Desde, e.Hasta, func() {})
+  if err != nil {
+    f.Close()
+    return err
+  }
+  return f.Close()
+}
+
+//getExportacion responde con el estado de la exportacion. Cuando esta
+//terminada incluye el enlace de descarga y con descargar=true envia el archivo.
+//ejm http://100.69.187.16:8080/exportaciones/3f2a...?descargar=true
+func getExportacion(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  id := mux.Vars(r)["id"]
+  
+  var e Exportacion
+  var desde, hasta, creada, archivo string
+  var terminada sql.NullString
+  err := db.QueryRow("SELECT id, tipo, COALESCE(libro_id, 0), desde, hasta, estado, error, archivo, creada, terminada FROM exportaciones WHERE id = ? AND usuario = ?", id, nombreUsuario).Scan(
+    &e.Id, &e.Tipo, &e.Libro, &desde, &hasta, &e.Estado, &e.Error, &archivo, &creada, &terminada)
+  if err == sql.ErrNoRows {
+    http.Error(w, "La exportacion no existe.", http.StatusNotFound)
+    return
+  }
+  if err != nil {
+    writeError(w, "Error al consultar la exportacion", err, http.StatusInternalServerError)
+    return
+  }
+  e.Desde, _ = time.Parse(time.RFC3339, desde)
+  e.Hasta, _ = time.Parse(time.RFC3339, hasta)
+  e.Creada, _ = time.Parse(time.RFC3339, creada)
+  if terminada.Valid {
+    t, _ := time.Parse(time.RFC3339, terminada.String)
+    e.Terminada = &t
+  }
+  
+  if e.Estado == "terminada" {
+    e.Descarga = "/exportaciones/" + e.Id + "?descargar=true"
+  }
+  
+  if r.URL.Query().Get("descargar") == "true" {
+    if e.Estado != "terminada" {
+      http.Error(w, "La exportacion todavia no esta terminada.", http.StatusConflict)
+      return
+    }
+    formato := formatosExportacion[e.Tipo]
+    w.Header().Set("Content-Disposition", "attachment; filename=registros." + formato.extension)
+    w.Header().Set("Content-Type", formato.contentType)
+    //el archivo puede ser grande, damos mas tiempo que el WriteTimeout.
+    http.NewResponseController(w).SetWriteDeadline(time.Now().Add(10 * time.Minute))
+    http.ServeFile(w, r, archivo)
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(e)
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+  "encoding/csv"
+  "encoding/json"
+  "encoding/xml"
+  "fmt"
+  "io"
+  "strconv"
+  "strings"
+  "time"
+  
+  "github.com/xuri/excelize/v2"
+)
+
+//cada cuantas filas se vacia lo escrito al cliente cuando se exporta.
+const filasPorVaciado = 500
+
+//escritorContado cuenta los bytes escritos para saber si ya se le envio
+//algo al cliente.
+type escritorContado struct {
+  w io.Writer
+  n int64
+}
+
+func (e *escritorContado) Write(p []byte) (int, error) {
+  n, err := e.w.Write(p)
+  e.n += int64(n)
+  return n, err
+}
+
+//formatoExportacion es la extension y el content type de cada tipo de archivo.
+type formatoExportacion struct {
+  extension string
+  contentType string
+}
+
+//formatosExportacion son los tipos que acepta exportRango y /exportaciones.
+var formatosExportacion = map[string]formatoExportacion{
+  "csv": {"csv", "text/csv"},
+  "json": {"json", "application/json"},
+  "ndjson": {"ndjson", "application/x-ndjson"},
+  "xlsx": {"xlsx", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"},
+  "ofx": {"ofx", "application/x-ofx"},
+  "ledger": {"journal", "text/plain; charset=utf-8"},
+}
+
+//escribirExportacion escribe en w los registros del libro en el rango y en
+//el tipo dado. csv, json, ndjson y ledger se escriben a medida que se leen
+//de la base de datos y cada filasPorVaciado filas se llama a vaciar para
+//que el cliente los vaya recibiendo. xlsx y ofx necesitan todo el archivo
+//armado antes. csv, json, ndjson y ledger llevan la moneda de cada registro,
+//xlsx y ofx suman montos y los pasan a la moneda base.
+func escribirExportacion(w io.Writer, tipo string, libro int, usuario string, desde time.Time, hasta time.Time, vaciar func()) error {
+  switch tipo {
+  case "xlsx":
+    registros, err := getRegistrosFechas(desde, hasta, libro, usuario)
+    if err != nil {
+      return err
+    }
+    return exportarXLSX(w, registrosASimples(registros))
+  case "ofx":
+    registros, err := getRegistrosFechas(desde, hasta, libro, usuario)
+    if err != nil {
+      return err
+    }
+    //el saldo del extracto es el balance a la fecha final.
+    b, err := getBalance(libro, usuario, hasta, true, monedaBase())
+    if err != nil {
+      return err
+    }
+    return exportarOFX(w, registros, usuario, desde, hasta, b.Balance)
+  }
+  
+  //para los que se escriben por filas definimos como escribir cada una
+  //y como cerrar el archivo.
+  var escribir func(Registro) error
+  terminar := func() error { return nil }
+  vaciarFormato := func() {}
+  
+  switch tipo {
+  case "csv":
+    writer := csv.NewWriter(w)
+    // Encabezado para el archivo
+    err := writer.Write([]string{"Tipo", "Monto", "Descripcion", "Grupo", "Fecha", "Moneda"})
+    if err != nil {
+      return err
+    }
+    escribir = func(m Registro) error {
+      return writer.Write(movimientoASlice(m))
+    }
+    vaciarFormato = writer.Flush
+    terminar = func() error {
+      writer.Flush()
+      return writer.Error()
+    }
+  case "json":
+    //un arreglo igual al que se armaba con registrosASimples, pero
+    //escribiendo cada elemento por separado.
+    primero := true
+    _, err := io.WriteString(w, "[")
+    if err != nil {
+      return err
+    }
+    escribir = func(m Registro) error {
+      b, err := json.MarshalIndent(registrosASimples([]Registro{m})[0], "  ", "  ")
+      if err != nil {
+        return err
+      }
+      separador := ",\n  "
+      if primero {
+        separador, primero = "\n  ", false
+      }
+      _, err = io.WriteString(w, separador + string(b))
+      return err
+    }
+    terminar = func() error {
+      final := "\n]\n"
+      if primero {
+        final = "]\n"
+      }
+      _, err := io.WriteString(w, final)
+      return err
+    }
+  case "ndjson":
+    //un objeto json por linea.
+    encoder := json.NewEncoder(w)
+    escribir = func(m Registro) error {
+      return encoder.Encode(registrosASimples([]Registro{m})[0])
+    }
+  case "ledger":
+    escribir = func(m Registro) error {
+      return escribirLedger(w, registrosASimples([]Registro{m})[0])
+    }
+  default:
+    return fmt.Errorf("tipo de exportacion desconocido %q", tipo)
+  }
+  
+  n := 0
+  err := recorrerRegistrosFechas(desde, hasta, libro, usuario, func(m Registro) error {
+    err := escribir(m)
+    if err != nil {
+      return err
+    }
+    n++
+    if n % filasPorVaciado == 0 {
+      vaciarFormato()
+      vaciar()
+    }
+    return nil
+  })
+  if err != nil {
+    return err
+  }
+  return terminar()
+}
+
+//exportarXLSX escribe un libro de excel con una hoja por mes y una hoja
+//Resumen que suma cada mes con formulas, asi se puede editar y recalcula.
+//Para que las sumas tengan sentido el monto va en la moneda base y al
+//final de la fila el monto y la moneda originales.
+func exportarXLSX(w io.Writer, registros []RegistroSimple) error {
+  f := excelize.NewFile()
+  defer f.Close()
+  
+  //separamos los registros por mes conservando el orden en que aparecen.
+  var meses []string
+  porMes := map[string][]RegistroSimple{}
+  for _, m := range registros {
+    mes := m.Fecha.Format("2006-01")
+    if _, ok := porMes[mes]; !ok {
+      meses = append(meses, mes)
+    }
+    porMes[mes] = append(porMes[mes], m)
+  }
+  
+  base := monedaBase()
+  conv := nuevoConversor(base)
+  
+  //la hoja por defecto se renombra para el resumen.
+  resumen := "Resumen"
+  f.SetSheetName("Sheet1", resumen)
+  f.SetSheetRow(resumen, "A1", &[]interface{}{"Mes", "Ingresos " + base, "Egresos " + base, "Neto " + base})
+  
+  for i, mes := range meses {
+    f.NewSheet(mes)
+    f.SetSheetRow(mes, "A1", &[]interface{}{"Tipo", "Monto " + base, "Descripcion", "Grupo", "Fecha", "Monto original", "Moneda"})
+    for j, m := range porMes[mes] {
+      convertido, err := conv.convertir(m.Monto, m.Moneda, m.Fecha.Format("2006-01-02"))
+      if err != nil {
+        return err
+      }
+      monto := dineroDeRat(convertido, exponenteMoneda(base))
+      celda, _ := excelize.CoordinatesToCellName(1, j + 2)
+      f.SetSheetRow(mes, celda, &[]interface{}{m.Tipo, monto.Float64(), m.Descripcion, m.Grupo, m.Fecha.Format("2006-01-02"), m.Monto.Float64(), m.Moneda})
+    }
+  
+    //la fila del mes en el resumen suma la hoja del mes segun el tipo.
+    fila := strconv.Itoa(i + 2)
+    f.SetCellValue(resumen, "A" + fila, mes)
+    f.SetCellFormula(resumen, "B" + fila, fmt.Sprintf(`SUMIF('%s'!A:A,"ingreso",'%s'!B:B)`, mes, mes))
+    f.SetCellFormula(resumen, "C" + fila, fmt.Sprintf(`SUMIF('%s'!A:A,"egreso",'%s'!B:B)`, mes, mes))
+    f.SetCellFormula(resumen, "D" + fila, "B" + fila + "-C" + fila)
+  }
+  
+  //fila de totales con SUM de cada columna.
+  ultima := strconv.Itoa(len(meses) + 1)
+  total := strconv.Itoa(len(meses) + 2)
+  f.SetCellValue(resumen, "A" + total, "Total")
+  for _, col := range []string{"B", "C", "D"} {
+    f.SetCellFormula(resumen, col + total, "SUM(" + col + "2:" + col + ultima + ")")
+  }
+  
+  return f.Write(w)
+}
+
+//escribirLedger escribe un registro como transaccion de ledger. Los egresos
+//van de Activos:Caja a Gastos:<grupo> y los ingresos de Ingresos:<grupo>
+//a Activos:Caja. La moneda va como commodity despues del monto, ejm 12.50 USD.
+func escribirLedger(w io.Writer, m RegistroSimple) error {
+  grupo := cuentaLedger(m.Grupo)
+  descripcion := strings.Join(strings.Fields(m.Descripcion), " ")
+  if descripcion == "" {
+    descripcion = m.Grupo
+  }
+  
+  destino, origen := "Gastos:" + grupo, "Activos:Caja"
+  if m.Tipo == "ingreso" {
+    destino, origen = "Activos:Caja", "Ingresos:" + grupo
+  }
+  
+  //la segunda cuenta va sin monto, ledger lo calcula para cuadrar.
+  _, err := fmt.Fprintf(w, "%s %s\n    %-40s  %s %s\n    %s\n\n", m.Fecha.Format("2006-01-02"), descripcion, destino, m.Monto, m.Moneda, origen)
+  return err
+}
+
+//cuentaLedger limpia el grupo para usarlo como nombre de cuenta. En ledger
+//los ":" separan subcuentas y dos espacios terminan el nombre.
+func cuentaLedger(grupo string) string {
+  grupo = strings.Join(strings.Fields(strings.ReplaceAll(grupo, ":", " ")), " ")
+  if grupo == "" {
+    return "Otros"
+  }
+  return grupo
+}
+
+//Estructuras de OFX 2.x (xml). Solo tienen los campos que se necesitan
+//para un extracto bancario.
+type ofxDocumento struct {
+  XMLName xml.Name `xml:"OFX"`
+  Estado ofxEstadoSesion `xml:"SIGNONMSGSRSV1>SONRS"`
+  Extracto ofxRespuestaExtracto `xml:"BANKMSGSRSV1>STMTTRNRS"`
+}
+
+type ofxEstado struct {
+  Codigo int `xml:"CODE"`
+  Severidad string `xml:"SEVERITY"`
+}
+
+type ofxEstadoSesion struct {
+  Estado ofxEstado `xml:"STATUS"`
+  Fecha string `xml:"DTSERVER"`
+  Idioma string `xml:"LANGUAGE"`
+}
+
+type ofxRespuestaExtracto struct {
+  Id string `xml:"TRNUID"`
+  Estado ofxEstado `xml:"STATUS"`
+  Moneda string `xml:"STMTRS>CURDEF"`
+  Banco string `xml:"STMTRS>BANKACCTFROM>BANKID"`
+  Cuenta string `xml:"STMTRS>BANKACCTFROM>ACCTID"`
+  TipoCuenta string `xml:"STMTRS>BANKACCTFROM>ACCTTYPE"`
+  Desde string `xml:"STMTRS>BANKTRANLIST>DTSTART"`
+  Hasta string `xml:"STMTRS>BANKTRANLIST>DTEND"`
+  Transacciones []ofxTransaccion `xml:"STMTRS>BANKTRANLIST>STMTTRN"`
+  Saldo Dinero `xml:"STMTRS>LEDGERBAL>BALAMT"`
+  FechaSaldo string `xml:"STMTRS>LEDGERBAL>DTASOF"`
+}
+
+type ofxTransaccion struct {
+  Tipo string `xml:"TRNTYPE"`
+  Fecha string `xml:"DTPOSTED"`
+  Monto Dinero `xml:"TRNAMT"`
+  Id string `xml:"FITID"`
+  Nombre string `xml:"NAME,omitempty"`
+  Memo string `xml:"MEMO,omitempty"`
+}
+
+//formato de fecha de OFX.
+const fechaOFX = "20060102150405"
+
+//exportarOFX escribe un extracto OFX 2.2 con los registros del rango. El
+//saldo es el balance del usuario a la fecha hasta. Los egresos salen como
+//DEBIT con monto negativo y los ingresos como CREDIT. Un extracto tiene una
+//sola moneda, asi que todo va en la moneda base igual que el saldo.
+func exportarOFX(w io.Writer, registros []Registro, usuario string, desde time.Time, hasta time.Time, saldo Dinero) error {
+  base := monedaBase()
+  conv := nuevoConversor(base)
+  doc := ofxDocumento{}
+  doc.Estado = ofxEstadoSesion{ofxEstado{0, "INFO"}, time.Now().UTC().Format(fechaOFX), "SPA"}
+  
+  e := &doc.Extracto
+  e.Id = "1"
+  e.Estado = ofxEstado{0, "INFO"}
+  e.Moneda = base
+  e.Banco = "apiMoney"
+  e.Cuenta = usuario
+  e.TipoCuenta = "CHECKING"
+  e.Desde = desde.Format(fechaOFX)
+  e.Hasta = hasta.Format(fechaOFX)
+  e.Saldo = saldo
+  e.FechaSaldo = hasta.Format(fechaOFX)
+  
+  for _, m := range registros {
+    convertido, err := conv.convertir(m.Monto, m.Moneda, m.Fecha.Format("2006-01-02"))
+    if err != nil {
+      return err
+    }
+    monto := dineroDeRat(convertido, exponenteMoneda(base))
+    t := ofxTransaccion{Tipo: "CREDIT", Fecha: m.Fecha.Format(fechaOFX), Monto: monto, Id: m.Fitid}
+    if m.Tipo == "egreso" {
+      t.Tipo, t.Monto = "DEBIT", Dinero{-monto.Unidades, monto.Exponente}
+    }
+    //si no vino de un banco usamos el id del registro.
+    if t.Id == "" {
+      t.Id = "am-" + strconv.Itoa(m.Id)
+    }
+    //en NAME va el grupo (maximo 32 caracteres en OFX) y en MEMO la descripcion.
+    t.Nombre, t.Memo = m.Grupo, m.Descripcion
+    if r := []rune(t.Nombre); len(r) > 32 {
+      t.Nombre = string(r[:32])
+    }
+    e.Transacciones = append(e.Transacciones, t)
+  }
+  
+  _, err := io.WriteString(w, xml.Header + `<?OFX OFXHEADER="200" VERSION="220" SECURITY="NONE" OLDFILEUID="NONE" NEWFILEUID="NONE"?>` + "\n")
+  if err != nil {
+    return err
+  }
+  encoder := xml.NewEncoder(w)
+  encoder.Indent("", "  ")
+  return encoder.Encode(doc)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+  "bytes"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+  "time"
+)
+
+//prepararExportacion crea a anita con un egreso en USD y un ingreso en COP
+//y la tasa de ese dia, y retorna su libro.
+func prepararExportacion(t *testing.T) int {
+  t.Helper()
+  prepararDB(t)
+  t.Setenv("MONEDA_BASE", "COP")
+  if err := guardarUsuario(Usuario{Nombre: "anita", Clave: "Clave123#"}); err != nil {
+    t.Fatal(err)
+  }
+  libro, err := libroPersonal(db, "anita")
+  if err != nil {
+    t.Fatal(err)
+  }
+  
+  dia := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+  registros := []Registro{
+    {Tipo: "egreso", Monto: Dinero{1000, 2}, Moneda: "USD", Descripcion: "libro", Grupo: "Compras", Fecha: dia, Libro: libro},
+    {Tipo: "ingreso", Monto: Dinero{50000, 0}, Moneda: "COP", Descripcion: "venta", Grupo: "Ventas", Fecha: dia, Libro: libro},
+  }
+  for _, m := range registros {
+    if _, err := insertarRegistro(db, m, "anita"); err != nil {
+      t.Fatal(err)
+    }
+  }
+  if _, err := db.Exec("INSERT INTO tasas_cambio(base, moneda, fecha, tasa) VALUES('USD', 'COP', '2024-03-01', '4000')"); err != nil {
+    t.Fatal(err)
+  }
+  return libro
+}
+
+func exportarPrueba(t *testing.T, tipo string, libro int) string {
+  t.Helper()
+  var b bytes.Buffer
+  desde := time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC)
+  hasta := time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC)
+  if err := escribirExportacion(&b, tipo, libro, "anita", desde, hasta, func() {}); err != nil {
+    t.Fatalf("exportando %s, %v", tipo, err)
+  }
+  return b.String()
+}
+
+func TestExportarConMoneda(t *testing.T) {
+  libro := prepararExportacion(t)
+  
+  csv := exportarPrueba(t, "csv", libro)
+  if !strings.HasPrefix(csv, "Tipo,Monto,Descripcion,Grupo,Fecha,Moneda\n") || !strings.Contains(csv, "egreso,10.00,libro,Compras,2024-03-10,USD") {
+    t.Errorf("el csv no tiene la moneda de cada registro:\n%s", csv)
+  }
+  
+  ledger := exportarPrueba(t, "ledger", libro)
+  if !strings.Contains(ledger, "10.00 USD") || !strings.Contains(ledger, "50000.00 COP") {
+    t.Errorf("el ledger no tiene la moneda como commodity:\n%s", ledger)
+  }
+  
+  //el ofx tiene una sola moneda, el egreso de 10 USD queda en COP.
+  ofx := exportarPrueba(t, "ofx", libro)
+  for _, esperado := range []string{"<CURDEF>COP</CURDEF>", "<TRNAMT>-40000.00</TRNAMT>", "<TRNAMT>50000.00</TRNAMT>", "<BALAMT>10000.00</BALAMT>"} {
+    if !strings.Contains(ofx, esperado) {
+      t.Errorf("el ofx no tiene %s:\n%s", esperado, ofx)
+    }
+  }
+  
+  //sin tasa para convertir el xlsx no se puede armar.
+  exportarPrueba(t, "xlsx", libro)
+  db.Exec("DELETE FROM tasas_cambio")
+  var b bytes.Buffer
+  err := escribirExportacion(&b, "xlsx", libro, "anita", time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), time.Date(2024, 3, 31, 0, 0, 0, 0, time.UTC), func() {})
+  if statusConversion(err) != http.StatusUnprocessableEntity {
+    t.Errorf("sin tasa esperaba un error de conversion, obtuvo %v", err)
+  }
+}
+
+func TestExportarCSVReimportaMoneda(t *testing.T) {
+  libro := prepararExportacion(t)
+  csv := exportarPrueba(t, "csv", libro)
+  
+  filas, err := leerCSVImportar([]byte(csv), httptest.NewRequest("POST", "/importar", nil))
+  if err != nil {
+    t.Fatal(err)
+  }
+  res, err := guardarImportacion(filas, libro, "anita", false, true)
+  if err != nil || len(res.Errores) > 0 {
+    t.Fatalf("error al importar %v %+v", err, res.Errores)
+  }
+  
+  var usd int
+  db.QueryRow("SELECT COUNT(*) FROM registros WHERE moneda = 'USD' AND monto = 1000 AND exponente = 2").Scan(&usd)
+  if usd != 2 {
+    t.Errorf("hay %d egresos de 10.00 USD, esperaba 2 (el original y el importado)", usd)
+  }
+}
@@ -1,16 +1,20 @@
 package main
 
 import (
+  "crypto/rand"
+  "encoding/hex"
   "fmt"
   "database/sql"
-  "strconv"
   "strings"
   "log"
   "os"
   "time"
+  "math/big"
   "net/http"
   "context"
   "regexp"
+  "unicode"
+  "unicode/utf8"
   
   "golang.org/x/crypto/bcrypt"
   "github.com/golang-jwt/jwt"
@@ -23,33 +27,58 @@ import (
 type Registro struct {
   Id int `json:"id"`
   Tipo string `json:"tipo"`
-  Monto int `json:"monto"`
+  //Monto es exacto en la unidad menor de la moneda, ejm 12.50.
+  Monto Dinero `json:"monto"`
+  //Moneda es el codigo ISO 4217 del monto, sin ella es la moneda base.
+  Moneda string `json:"moneda"`
   Descripcion string `json:"descripcion"`
   Grupo string `json:"grupo"`
   Fecha time.Time `json:"fecha"`
   Usuario string `json:"usuario"`
+  //Libro es el libro al que pertenece, Usuario es quien lo creo.
+  Libro int `json:"libro"`
+  //Cuenta es la cuenta de donde sale o a donde entra la plata, es opcional.
+  Cuenta int `json:"cuenta,omitempty"`
+  //Sobre es el sobre del que sale un egreso, es opcional.
+  Sobre int `json:"sobre,omitempty"`
+  //Transferencia es la transferencia entre cuentas que creo el registro,
+  //esos registros no cuentan en los totales.
+  Transferencia int `json:"transferencia,omitempty"`
+  //Recurrencia es la recurrencia que genero el registro.
+  Recurrencia int `json:"recurrencia,omitempty"`
+  //Meta es la meta de ahorro a la que aporta, es opcional.
+  Meta int `json:"meta,omitempty"`
+  //Fitid es el id que le da el banco al movimiento cuando se importa un
+  //extracto, evita que se importe dos veces.
+  Fitid string `json:"fitid,omitempty"`
 }
 
 //Escructura para dar respuesta de los datos. De momebto solo usada en 
 //la funcion que exporta para el tipo de archivo csv
 type RegistroSimple struct {
   Tipo string `json:"tipo"`
-  Monto int `json:"monto"`
+  Monto Dinero `json:"monto"`
   Descripcion string `json:"descripcion"`
   Grupo string `json:"grupo"`
   Fecha time.Time `json:"fecha"`
+  Moneda string `json:"moneda"`
 }
 
 type Usuario struct {
   Nombre string `json:"nombre"`
   Clave string `json:"clave"`
+  //Email es opcional, sin el no se puede restablecer la clave.
+  Email string `json:"email,omitempty"`
 }
 
 //Funcion que crea la base de datos. crea el archivo y
 //la inicializa si no existe
 func initDB() {
   var err error
-  db, err = sql.Open("sqlite", "registros.db")
+  //con WAL las lecturas no bloquean a las escrituras, asi una exportacion
+  //que envia a un cliente lento no deja a los demas sin poder guardar.
+  //busy_timeout hace que dos escrituras al tiempo esperen en vez de fallar.
+  db, err = sql.Open("sqlite", "registros.db?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
   if err != nil {
     log.Fatal(err)
   }
@@ -83,18 +112,124 @@ func initDB() {
   if err != nil {
     log.Fatal("Error creando la tabla usuarios", err)
   }
+  
+  //columnas que se agregaron despues de crear la tabla registros.
+  agregarColumna("registros", "fitid", "TEXT")
+  
+  //tablas de cada funcionalidad.
+  initCategorias()
+  initExportaciones()
+  initSesiones()
+  initClaves()
+  initSegundoFactor()
+  initClavesApi()
+  initIntentosLogin()
+  initAdmin()
+  initLibros()
+  initDivisiones()
+  initCuentas()
+  initMonedas()
+  initDinero()
+  initPresupuestos()
+  initSobres()
+  initRecurrencias()
+  initMetas()
+}
+
+//agregarColumna agrega una columna a una tabla que ya existe si todavia no
+//la tiene. Sirve para actualizar bases de datos creadas con versiones viejas.
+func agregarColumna(tabla string, columna string, definicion string) {
+  rows, err := db.Query("SELECT name FROM pragma_table_info(?)", tabla)
+  if err != nil {
+    log.Fatal("Error consultando las columnas de ", tabla, err)
+  }
+  defer rows.Close()
+  
+  for rows.Next() {
+    var nombre string
+    err = rows.Scan(&nombre)
+    if err != nil {
+      log.Fatal("Error consultando las columnas de ", tabla, err)
+    }
+    if nombre == columna {
+      return
+    }
+  }
+  
+  _, err = db.Exec("ALTER TABLE " + tabla + " ADD COLUMN " + columna + " " + definicion)
+  if err != nil {
+    log.Fatal("Error agregando la columna ", columna, err)
+  }
+}
+
+//migrar corre una sola vez los cambios de datos que no se pueden repetir,
+//como multiplicar montos. El nombre queda en la tabla migraciones en la
+//misma transaccion que los cambios.
+func migrar(nombre string, fn func(tx *sql.Tx) error) {
+  _, err := db.Exec("CREATE TABLE IF NOT EXISTS migraciones(nombre TEXT PRIMARY KEY, fecha DATETIME NOT NULL)")
+  if err != nil {
+    log.Fatal("Error creando la tabla migraciones", err)
+  }
+  
+  tx, err := db.Begin()
+  if err != nil {
+    log.Fatal("Error iniciando la migracion ", nombre, err)
+  }
+  defer tx.Rollback()
+  
+  res, err := tx.Exec("INSERT OR IGNORE INTO migraciones(nombre, fecha) VALUES(?, ?)", nombre, time.Now().UTC())
+  if err != nil {
+    log.Fatal("Error registrando la migracion ", nombre, err)
+  }
+  if filas, _ := res.RowsAffected(); filas == 0 {
+    return
+  }
+  err = fn(tx)
+  if err != nil {
+    log.Fatal("Error en la migracion ", nombre, err)
+  }
+  err = tx.Commit()
+  if err != nil {
+    log.Fatal("Error guardando la migracion ", nombre, err)
+  }
 }
 
 //comprobarInfoRequest se encarga de comprobar si para un registro los datos
 //estan el el formato correcto y si estan completos.
 //ToDo: AGREGAR LAS VALIDACIONES DE DATOS PARA DAR MAS SEGURIDAD
 func comprobarInfoRequest(m Registro) error{
-  if m.Monto == 0 || m.Fecha.IsZero() {
+  if m.Monto.Unidades == 0 || m.Fecha.IsZero() {
     return fmt.Errorf("Error al ingresar los datos, datos importantes son omitidos")
   }
   return nil
 }
 
+//validarRegistro hace una validacion completa de un registro ya armado,
+//se usa cuando el registro se construye mezclando datos como en el PATCH.
+func validarRegistro(m Registro) error {
+  if m.Tipo != "ingreso" && m.Tipo != "egreso" {
+    return fmt.Errorf("Error, el tipo solo puede ser ingreso o egreso")
+  }
+  //el signo lo da el tipo, por eso el monto siempre es positivo.
+  if m.Monto.Unidades <= 0 {
+    return fmt.Errorf("Error, el monto debe ser mayor a 0")
+  }
+  if m.Fecha.IsZero() || m.Fecha.Year() < 1900 || m.Fecha.Year() > 2100 {
+    return fmt.Errorf("Error, la fecha es obligatoria y debe estar entre 1900 y 2100")
+  }
+  if utf8.RuneCountInString(m.Descripcion) > 255 {
+    return fmt.Errorf("Error, la descripcion no puede tener mas de 255 caracteres")
+  }
+  if utf8.RuneCountInString(m.Grupo) > 50 {
+    return fmt.Errorf("Error, el grupo no puede tener mas de 50 caracteres")
+  }
+  //no dejamos caracteres de control, dañan el csv al exportar.
+  if strings.IndexFunc(m.Descripcion + m.Grupo, unicode.IsControl) != -1 {
+    return fmt.Errorf("Error, la descripcion o el grupo tienen caracteres no permitidos")
+  }
+  return nil
+}
+
 //validarStringUsuario comprueba que el nombre de usuario tengan un formato expecifico.
 func validarStringUsuario(s string) bool {
   //Caracteres que se pueden usar [A-Za-z\d_]
@@ -134,10 +269,11 @@ func validarStringPassword(s string) bool {
 func movimientoASlice(m Registro) []string {
 	return []string{
 		m.Tipo,
-		strconv.Itoa(m.Monto),
+		m.Monto.String(),
 		m.Descripcion,
 		m.Grupo,
 		m.Fecha.Format("2006-01-02"),
+		m.Moneda,
 	}
 }
 
@@ -149,107 +285,151 @@ func registrosASimples(registros []Registro) (s []RegistroSimple) {
 		  m.Descripcion,
 		  m.Grupo,
 		  m.Fecha,
+		  m.Moneda,
     })
   }
   
   return 
 }
 
-//getRegistros consulta en la base de datos los registros que coincidan con el
-//usuario y tipo de registro dado.
-func getRegistros(tipo string, usuario string) (registros []Registro, err error) {
-  
-  //el puntero que recibira la consulta Query, lo usaremos para escanaer los datos.
-  var rows *sql.Rows
-  
-  if tipo == "todos" {
-      //consultamos en la tabla todos los registros
-    rows, err = db.Query("SELECT id, tipo, monto, descripcion, grupo, fecha, usuario FROM registros WHERE usuario = ?", usuario)
-  } else {
-    //consultamos en la tabla los registros segun el tipo.
-    rows, err = db.Query("SELECT id, tipo, monto, descripcion, grupo, fecha, usuario FROM registros WHERE tipo = ? AND usuario = ?", tipo, usuario)
+//columnasRegistro son las columnas de la tabla registros en el orden en
+//que las lee escanearRegistro. Todas las consultas de registros la usan.
+const columnasRegistro = "id, tipo, monto, exponente, moneda, descripcion, grupo, fecha, usuario, COALESCE(libro_id, 0), COALESCE(cuenta_id, 0), COALESCE(sobre_id, 0), COALESCE(transferencia_id, 0), COALESCE(recurrencia_id, 0), COALESCE(meta_id, 0), COALESCE(fitid, '')"
+
+//escaner lo cumplen *sql.Row y *sql.Rows.
+type escaner interface {
+  Scan(dest ...interface{}) error
+}
+
+//escanearRegistro lee un registro seleccionado con columnasRegistro.
+func escanearRegistro(s escaner) (m Registro, err error) {
+  err = s.Scan(&m.Id, &m.Tipo, &m.Monto.Unidades, &m.Monto.Exponente, &m.Moneda, &m.Descripcion, &m.Grupo, &m.Fecha, &m.Usuario, &m.Libro, &m.Cuenta, &m.Sobre, &m.Transferencia, &m.Recurrencia, &m.Meta, &m.Fitid)
+  return
+}
+
+//ejecutor lo cumplen *sql.DB y *sql.Tx, asi las funciones que lo reciben
+//sirven dentro o fuera de una transaccion.
+type ejecutor interface {
+  Exec(query string, args ...interface{}) (sql.Result, error)
+  Query(query string, args ...interface{}) (*sql.Rows, error)
+  QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+//insertarRegistro guarda un registro del usuario en m.Libro y retorna el id
+//creado. El permiso sobre el libro se revisa antes. Sin moneda queda en la
+//moneda base, y el monto se guarda con los decimales de la moneda.
+func insertarRegistro(ex ejecutor, m Registro, usuario string) (int, error) {
+  if m.Moneda == "" {
+    m.Moneda = monedaBase()
   }
-  //Comprobamos el error
+  monto, err := m.Monto.Escalar(exponenteMoneda(m.Moneda))
   if err != nil {
-    err = fmt.Errorf("Error al leer los datos de la tabla, %v", err)
-    return 
+    return 0, fmt.Errorf("%v, la moneda es %s", err, m.Moneda)
   }
-  defer rows.Close() //cerramos la base de consulta
-  
-  //Recorremos cada fila con el for.
-  for rows.Next() {
-    var m Registro//Variable para escanear los registros
-    
-    //Escaneamos cada registo ya que es un for y cada vez escaneamos y comprobamos el error.
-    err = rows.Scan(&m.Id, &m.Tipo, &m.Monto, &m.Descripcion, &m.Grupo, &m.Fecha, &m.Usuario)
-    if err != nil {
-      err = fmt.Errorf("Error al escanear en la estructura cada registro, %v", err)
-      return
-    }
-    
-    //Almacenamos los datos para retornarlos en un slite
-    registros = append(registros, m)
+  res, err := ex.Exec("INSERT INTO registros ( tipo, monto, exponente, moneda, descripcion, grupo, fecha, usuario, libro_id, cuenta_id, sobre_id, transferencia_id, meta_id, fitid ) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, 0), NULLIF(?, 0), NULLIF(?, 0), NULLIF(?, 0), NULLIF(?, ''))",
+    m.Tipo, monto.Unidades, monto.Exponente, m.Moneda, m.Descripcion, m.Grupo, m.Fecha, usuario, m.Libro, m.Cuenta, m.Sobre, m.Transferencia, m.Meta, m.Fitid)
+  if err != nil {
+    return 0, err
   }
-  
-  return 
+  id, err := res.LastInsertId()
+  return int(id), err
 }
 
 //getRegistrosFechas devuelve los registros que esten dentro de las fechas
-//dadas para cada usuario.
-func getRegistrosFechas(desde time.Time, hasta time.Time, usuario string) (registros []Registro, err error) {
-  //consultamos en la tabla los egresos
-  rows, err := db.Query("SELECT id, tipo, monto, descripcion, grupo, fecha, usuario FROM registros WHERE usuario = ? AND fecha BETWEEN ? AND ?", usuario, desde, hasta)
+//dadas en el libro, si el usuario es miembro.
+func getRegistrosFechas(desde time.Time, hasta time.Time, libro int, usuario string) (registros []Registro, err error) {
+  //Almacenamos los datos para luego retornar el slite
+  err = recorrerRegistrosFechas(desde, hasta, libro, usuario, func(m Registro) error {
+    registros = append(registros, m)
+    return nil
+  })
+  return
+}
 
+//recorrerRegistrosFechas llama a fn con cada registro dentro de las fechas
+//a medida que se leen, sin cargarlos todos en memoria. Si fn retorna error
+//se deja de leer y se retorna ese error.
+func recorrerRegistrosFechas(desde time.Time, hasta time.Time, libro int, usuario string, fn func(Registro) error) error {
+  //consultamos en la tabla los registros del rango en orden de fecha.
+  rows, err := db.Query("SELECT " + columnasRegistro + " FROM registros WHERE libro_id = ? AND " + condicionMiembro + " AND fecha BETWEEN ? AND ? ORDER BY fecha, id", libro, usuario, desde, hasta)
   //Comprobamos el error
   if err != nil {
-    err = fmt.Errorf("Error al leer los datos de la tabla, %v", err)
-    return 
+    return fmt.Errorf("Error al leer los datos de la tabla, %v", err)
   }
   defer rows.Close() //cerramos la consulta
   
   //Recorremos cada fila con el for.
   for rows.Next() {
-    var m Registro//Variable para escanear los registros
     //Escaneamos cada registo ya que es un for y cada vez escaneamos y comprobamos el error.
-    err = rows.Scan(&m.Id, &m.Tipo, &m.Monto, &m.Descripcion, &m.Grupo, &m.Fecha, &m.Usuario)
+    m, err := escanearRegistro(rows)
     if err != nil {
-      err = fmt.Errorf("Error al escanear en la estructura cada registro, %v", err)
-      return
+      return fmt.Errorf("Error al escanear en la estructura cada registro, %v", err)
+    }
+    err = fn(m)
+    if err != nil {
+      return err
     }
-    
-    //Almacenamos los datos para luego retornar el slite
-    registros = append(registros, m)
   }
   
-  return 
+  return rows.Err()
+}
+
+//tokenAleatorio retorna n bytes aleatorios en hexadecimal, para ids y
+//tokens que no se deben poder adivinar.
+func tokenAleatorio(n int) string {
+  b := make([]byte, n)
+  _, err := rand.Read(b)
+  if err != nil {
+    log.Fatal("Error generando bytes aleatorios ", err)
+  }
+  return hex.EncodeToString(b)
 }
 
 //getTotal retorna la suma de cada registro que este dentro del rango dado
-//dependiendo del tipo y el usuario.
-func getTotal(tipo string, desde time.Time, hasta time.Time, usuario string) (int, error) {
-    //variable para escanear el total
-  var total int
-  //Consultamos cada monto que coincida con el tipo y los sumamos.
-  //asegurando con COALESCE que no devuelva nil siempre que no tenga valores
-  //entre las fechas dadas. Validamos el error y scaneamos el total.
-  err := db.QueryRow("SELECT COALESCE(SUM(monto), 0) FROM registros WHERE tipo = ? AND usuario = ? AND fecha BETWEEN ? AND ?", tipo, usuario, desde, hasta).Scan(&total)
+//dependiendo del tipo y el libro, si el usuario es miembro. Las
+//transferencias entre cuentas no cuentan. El total queda en la moneda dada
+//con la tasa del dia de cada registro, la suma es exacta y solo se
+//redondea al final a los decimales de la moneda.
+func getTotal(tipo string, desde time.Time, hasta time.Time, libro int, usuario string, moneda string) (Dinero, error) {
+  //Consultamos cada monto que coincida con el tipo y los sumamos por
+  //moneda y dia, que es lo que cambia la tasa.
+  rows, err := db.Query("SELECT moneda, exponente, substr(fecha, 1, 10), SUM(monto) FROM registros WHERE tipo = ? AND libro_id = ? AND " + condicionMiembro + " AND " + sinTransferencias + " AND fecha BETWEEN ? AND ? GROUP BY 1, 2, 3", tipo, libro, usuario, desde, hasta)
   if err != nil {
     err := fmt.Errorf("Error al consultar y sumar los egresos de la base de datos, %v", err)
-    return 0, err
+    return Dinero{}, err
   }
+  defer rows.Close()
   
-  return total, err
+  conv := nuevoConversor(moneda)
+  total := new(big.Rat)
+  for rows.Next() {
+    var monedaRegistro, dia string
+    var suma Dinero
+    err = rows.Scan(&monedaRegistro, &suma.Exponente, &dia, &suma.Unidades)
+    if err != nil {
+      return Dinero{}, fmt.Errorf("Error al escanear los totales, %v", err)
+    }
+    convertido, err := conv.convertir(suma, monedaRegistro, dia)
+    if err != nil {
+      return Dinero{}, err
+    }
+    total.Add(total, convertido)
+  }
+  if err = rows.Err(); err != nil {
+    return Dinero{}, fmt.Errorf("Error al consultar y sumar los egresos de la base de datos, %v", err)
+  }
+  
+  return dineroDeRat(total, exponenteMoneda(moneda)), nil
 }
 
-//getRegistroById retorna un registro segun el id y el usuario.
+//getRegistroById retorna un registro segun el id si esta en un libro del
+//que el usuario es miembro.
 func getRegistroById(id int, usuario string) (Registro, error) {
-  //Estructura para obtener los datos de la base de dato.
-  var m Registro
-  
   //consultamos por id y validamos el error.
-  err := db.QueryRow("SELECT id, tipo, monto, descripcion, grupo, fecha, usuario FROM registros WHERE id = ? AND usuario = ?", id, usuario).Scan(&m.Id, &m.Tipo, &m.Monto, &m.Descripcion, &m.Grupo, &m.Fecha, &m.Usuario)
+  m, err := escanearRegistro(db.QueryRow("SELECT " + columnasRegistro + " FROM registros WHERE id = ? AND " + condicionMiembro, id, usuario))
   if err != nil {
-    err := fmt.Errorf("Error al consultar en la base de datos el id ingresado. %v", err)
+    //usamos %w para que el handler pueda saber si fue sql.ErrNoRows.
+    err := fmt.Errorf("Error al consultar en la base de datos el id ingresado. %w", err)
     return m, err
   }
   
@@ -268,7 +448,7 @@ func guardarUsuario(u Usuario) error {
   u.Clave = string(hash)
   
   //almacenamos el nombre de usuario y el hash de la clave
-  _, err = db.Exec("INSERT INTO usuarios( nombre, clave ) VALUES( ?, ? )", u.Nombre, u.Clave)
+  _, err = db.Exec("INSERT INTO usuarios( nombre, clave, email ) VALUES( ?, ?, ? )", u.Nombre, u.Clave, u.Email)
   if err != nil {
     return err
   }
@@ -276,31 +456,45 @@ func guardarUsuario(u Usuario) error {
 }
 
 //comprobar usuario se encarga de validar que la clave coincida con la que
-//esta almacenada en la base de datos para ese usuario.
+//esta almacenada en la base de datos para ese usuario. Si el usuario no
+//existe o la clave no coincide retorna errCredenciales.
 func comprobarUsuario(u Usuario) error {
   var hashUser string
   //consultamos el usuario y escaneamos el hash de la clave almacenada.
   err := db.QueryRow("SELECT clave FROM usuarios WHERE nombre = ?", u.Nombre).Scan(&hashUser)
+  if err == sql.ErrNoRows {
+    //comparamos igual contra un hash falso para que no se note por el
+    //tiempo de respuesta que el usuario no existe.
+    bcrypt.CompareHashAndPassword(hashFalso, []byte(u.Clave))
+    return errCredenciales
+  }
   if err != nil {
     return err
   }
   
-  //si no hay error al escanear retornamos el error que surja al comparar
-  //las claves, teniendo en cuenta que se comparan los hash. Si no son iguales
-  //retorna un error de lo contrario retorna nil
-  return bcrypt.CompareHashAndPassword([]byte(hashUser), []byte(u.Clave))
+  //si no hay error al escanear comparamos las claves, teniendo en cuenta
+  //que se comparan los hash. Si no son iguales retorna errCredenciales.
+  err = bcrypt.CompareHashAndPassword([]byte(hashUser), []byte(u.Clave))
+  if err != nil {
+    return errCredenciales
+  }
+  return nil
 }
 
-//crearJWT devuelve un jwt firmado con la variable de entorno y el
-//nombre de usuario con 2 hora de vencimiento
-func crearJWT(nombre string) (string, error) {
+//crearJWT devuelve un jwt firmado con la variable de entorno, el nombre
+//de usuario, su rol y la sesion a la que pertenece. Vence en
+//duracionAcceso y el jti permite revocarlo antes.
+func crearJWT(nombre string, sesion string, rol string) (string, error) {
   //buscamos en .env la frase para firmar el jwt
   firma := os.Getenv("FRASE")
   
   //preparamos los datos para el jwt: el nombre de usuario y el tiempo maximo.
   token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
 		"nombreUsuario": nombre,
-		"exp": time.Now().Add(2 * time.Hour).Unix(),
+		"sid": sesion,
+		"rol": rol,
+		"jti": tokenAleatorio(16),
+		"exp": time.Now().Add(duracionAcceso).Unix(),
 	})
 	
 	//firmamos e token.
@@ -322,6 +516,22 @@ func authMiddleware(siguiente http.Handler) http.Handler {
     
     //obtenemos del header la autorizacio.
     autorizacion := r.Header.Get("Authorization")
+  
+    //los scripts pueden usar una clave de api en vez del jwt.
+    if strings.HasPrefix(autorizacion, "ApiKey ") {
+      ctx, err := contextoClaveApi(r.Context(), strings.TrimPrefix(autorizacion, "ApiKey "))
+      if err == sql.ErrNoRows {
+        writeError(w, "Clave de api invalida", errClaveApi, http.StatusUnauthorized)
+        return
+      }
+      if err != nil {
+        writeError(w, "Error al validar la clave de api", err, http.StatusInternalServerError)
+        return
+      }
+      siguiente.ServeHTTP(w, r.WithContext(ctx))
+      return
+    }
+    
     //verificamls que tenga Bearer al inicio.
     if !strings.HasPrefix(autorizacion, "Bearer ") {
       http.Error(w, "Falta el token o toke  errado.", http.StatusBadRequest)
@@ -366,10 +576,34 @@ func authMiddleware(siguiente http.Handler) http.Handler {
     }
     
     //extraemos el nombre de usuario y lo casteamos a string
-    nombre := claims["nombreUsuario"].(string)
+    nombre, _ := claims["nombreUsuario"].(string)
+    sesion, _ := claims["sid"].(string)
+    jti, _ := claims["jti"].(string)
+    rol, _ := claims["rol"].(string)
+    if nombre == "" || sesion == "" || jti == "" {
+      http.Error(w, "Token invalido.", http.StatusBadRequest)
+      return
+    }
     
-    //Lo convertimos a contexto para pasarlo a al siguiente HandlerFunc
+    //el token puede estar revocado aunque no haya vencido.
+    revocado, err := tokenRevocado(jti, sesion)
+    if err != nil {
+      writeError(w, "Error al validar el token", err, http.StatusInternalServerError)
+      return
+    }
+    if revocado {
+      http.Error(w, "Error, token revocado.", http.StatusUnauthorized)
+      return
+    }
+    
+    //Lo convertimos a contexto para pasarlo a al siguiente HandlerFunc, con
+    //la sesion y el jti para poder cerrarla.
     ctx := context.WithValue(r.Context(), "usuario", nombre)
+    ctx = context.WithValue(ctx, "sesion", sesion)
+    ctx = context.WithValue(ctx, "jti", jti)
+    ctx = context.WithValue(ctx, "expira", time.Unix(int64(exp), 0))
+    ctx = context.WithValue(ctx, "alcance", "escritura")
+    ctx = context.WithValue(ctx, "rol", rol)
     
     //llamamos al la funcuon que se encargara de llamar al handlerFunc solo
     //que esta le pasara el contexto con el nombre de usuario
@@ -377,6 +611,19 @@ func authMiddleware(siguiente http.Handler) http.Handler {
   })
 }
 
+//formatoFecha es el formato en el que se reciben las fechas por la URL,
+//el mismo que usan getTotalEgresos y exportFechas.
+const formatoFecha = "2006-01-02T00:00:00Z"
+
+//leerFecha convierte a time.Time el parametro de la URL con el nombre dado.
+func leerFecha(r *http.Request, nombre string) (time.Time, error) {
+  fecha, err := time.Parse(formatoFecha, r.URL.Query().Get(nombre))
+  if err != nil {
+    return fecha, fmt.Errorf("Error en la fecha ingresada '%s', %v", nombre, err)
+  }
+  return fecha, nil
+}
+
 //writeError se encarga de escribir en el responseWriter el error dado.
 func writeError(w http.ResponseWriter, s string, err error, status int) {
   errorStr := fmt.Sprintf("Error: %s, Descripcion: %v", s, err)
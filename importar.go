@@ -0,0 +1,446 @@
+package main
+
+import (
+  "bytes"
+  "encoding/csv"
+  "encoding/json"
+  "fmt"
+  "io"
+  "net/http"
+  "path/filepath"
+  "strings"
+  "time"
+)
+
+//tamaño maximo del archivo que se puede importar.
+const maxImportacion = 10 << 20
+
+//ErrorLinea es un error de validacion de una linea del archivo importado.
+type ErrorLinea struct {
+  Linea int `json:"linea"`
+  Error string `json:"error"`
+}
+
+//ResultadoImportacion es la respuesta de /importar. En modo prueba no se
+//guarda nada pero se reportan los mismos errores.
+type ResultadoImportacion struct {
+  Prueba bool `json:"prueba"`
+  Total int `json:"total"`
+  Insertados int `json:"insertados"`
+  Errores []ErrorLinea `json:"errores"`
+}
+
+//filaImportada es un registro leido del archivo con la linea donde estaba.
+type filaImportada struct {
+  linea int
+  registro Registro
+  err error
+}
+
+//formatos de fecha que se intentan si no se envia formatoFecha. El primero
+//es el que usa movimientoASlice al exportar.
+var formatosFechaImportar = []string{"2006-01-02", time.RFC3339, "02/01/2006", "2006/01/02"}
+
+//importar recibe un archivo csv o json como los que genera exportRango y
+//guarda todos sus registros en una sola transaccion. Si alguna linea tiene
+//error no se guarda ninguna.
+//El archivo llega en el campo "archivo" de un multipart o como body.
+//Parametros opcionales (URL o campos del form):
+//  formato=csv|json, si no se envia se saca de la extension o el content type.
+//  prueba=true no guarda nada, solo reporta los errores por linea.
+//  separador=; para csv que no usen coma.
+//  columnas=fecha:Date,monto:Amount,descripcion:Memo para csv de bancos.
+//  formatoFecha=02/01/2006 con el formato de fecha de go.
+//  decimal=, si los montos usan coma decimal o decimal=. para confirmar
+//  el punto, sin el un monto como 1.000, 12,50 o 1.234,56 es un error.
+//  crearCategoria=true crea las categorias que no existan.
+//Si el csv no tiene columna tipo, el signo del monto lo decide (o las
+//columnas debito/credito si se mapean). Sin columna moneda los montos
+//quedan en la moneda base.
+func importar(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  //los registros van al libro de ?libro= o al personal.
+  libro, ok := libroPeticion(w, r, true)
+  if !ok {
+    return
+  }
+  
+  r.Body = http.MaxBytesReader(w, r.Body, maxImportacion)
+  contenido, nombreArchivo, err := leerArchivoImportar(r)
+  if err != nil {
+    writeError(w, "Error al leer el archivo", err, http.StatusBadRequest)
+    return
+  }
+  
+  formato := r.FormValue("formato")
+  if formato == "" {
+    formato = detectarFormato(nombreArchivo, r.Header.Get("Content-Type"), contenido)
+  }
+  
+  var filas []filaImportada
+  switch formato {
+  case "csv":
+    filas, err = leerCSVImportar(contenido, r)
+  case "json":
+    filas, err = leerJSONImportar(contenido)
+  default:
+    http.Error(w, "Error, el formato solo puede ser csv o json.", http.StatusBadRequest)
+    return
+  }
+  if err != nil {
+    writeError(w, "Error al leer el archivo " + formato, err, http.StatusBadRequest)
+    return
+  }
+  
+  resultado, err := guardarImportacion(filas, libro, nombreUsuario, r.FormValue("prueba") == "true", r.FormValue("crearCategoria") == "true")
+  if err != nil {
+    writeError(w, "Error al guardar los registros", err, http.StatusInternalServerError)
+    return
+  }
+  
+  //si hubo errores y no era prueba no se guardo nada.
+  status := http.StatusCreated
+  if resultado.Prueba {
+    status = http.StatusOK
+  } else if len(resultado.Errores) > 0 {
+    status = http.StatusUnprocessableEntity
+  }
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(status)
+  json.NewEncoder(w).Encode(resultado)
+}
+
+//leerArchivoImportar saca el contenido del campo "archivo" si la peticion
+//es multipart, si no usa el body completo.
+func leerArchivoImportar(r *http.Request) ([]byte, string, error) {
+  if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+    err := r.ParseMultipartForm(maxImportacion)
+    if err != nil {
+      return nil, "", err
+    }
+    archivo, cabecera, err := r.FormFile("archivo")
+    if err != nil {
+      return nil, "", fmt.Errorf("falta el campo archivo, %v", err)
+    }
+    defer archivo.Close()
+  
+    contenido, err := io.ReadAll(archivo)
+    return contenido, cabecera.Filename, err
+  }
+  
+  contenido, err := io.ReadAll(r.Body)
+  return contenido, "", err
+}
+
+//detectarFormato decide el formato por la extension, el content type o el
+//primer caracter del archivo, en ese orden.
+func detectarFormato(nombreArchivo string, contentType string, contenido []byte) string {
+  if ext := strings.ToLower(strings.TrimPrefix(filepath.Ext(nombreArchivo), ".")); ext != "" {
+    return ext
+  }
+  if strings.Contains(contentType, "json") {
+    return "json"
+  }
+  if strings.Contains(contentType, "csv") {
+    return "csv"
+  }
+  recortado := bytes.TrimSpace(contenido)
+  if len(recortado) > 0 && recortado[0] == '[' {
+    return "json"
+  }
+  return "csv"
+}
+
+//leerJSONImportar lee un arreglo con la forma de RegistroSimple, que es la
+//que genera registrosASimples al exportar.
+func leerJSONImportar(contenido []byte) ([]filaImportada, error) {
+  var simples []RegistroSimple
+  err := json.Unmarshal(contenido, &simples)
+  if err != nil {
+    return nil, err
+  }
+  
+  filas := make([]filaImportada, len(simples))
+  for i, s := range simples {
+    //en json la "linea" es la posicion en el arreglo, iniciando en 1.
+    filas[i] = filaImportada{linea: i + 1, registro: Registro{Tipo: s.Tipo, Monto: s.Monto, Moneda: strings.ToUpper(s.Moneda), Descripcion: s.Descripcion, Grupo: s.Grupo, Fecha: s.Fecha}}
+  }
+  return filas, nil
+}
+
+//leerCSVImportar lee el csv usando el encabezado para ubicar las columnas.
+//Por defecto espera el encabezado que escribe exportFechas.
+func leerCSVImportar(contenido []byte, r *http.Request) ([]filaImportada, error) {
+  lector := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(contenido, []byte("\xef\xbb\xbf"))))
+  lector.FieldsPerRecord = -1
+  lector.TrimLeadingSpace = true
+  if sep := r.FormValue("separador"); sep != "" {
+    if len([]rune(sep)) != 1 {
+      return nil, fmt.Errorf("el separador debe ser un solo caracter")
+    }
+    lector.Comma = []rune(sep)[0]
+  }
+  
+  encabezado, err := lector.Read()
+  if err != nil {
+    return nil, fmt.Errorf("no se pudo leer el encabezado, %v", err)
+  }
+  columnas, err := mapearColumnas(encabezado, r.FormValue("columnas"))
+  if err != nil {
+    return nil, err
+  }
+  
+  //sin decimal= se asume punto, pero leerMontoTexto rechaza los montos que
+  //podrian ser de miles como 1.000 o tener coma decimal como 12,50.
+  decimal := r.FormValue("decimal")
+  formatosFecha := formatosFechaImportar
+  if f := r.FormValue("formatoFecha"); f != "" {
+    formatosFecha = []string{f}
+  }
+  
+  var filas []filaImportada
+  for {
+    campos, err := lector.Read()
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      //si la linea esta mal formada el error trae el numero.
+      linea := 0
+      if errCSV, ok := err.(*csv.ParseError); ok {
+        linea = errCSV.StartLine
+      }
+      //despues de un error de comillas no se puede seguir leyendo.
+      filas = append(filas, filaImportada{linea: linea, err: err})
+      break
+    }
+    linea, _ := lector.FieldPos(0)
+    //saltamos las lineas vacias del final.
+    if len(campos) == 1 && strings.TrimSpace(campos[0]) == "" {
+      continue
+    }
+  
+    m, err := filaCSVARegistro(campos, columnas, decimal, formatosFecha)
+    filas = append(filas, filaImportada{linea: linea, registro: m, err: err})
+  }
+  return filas, nil
+}
+
+//mapearColumnas retorna la posicion de cada campo del registro en el csv.
+//mapeo tiene la forma campo:Encabezado separados por coma. Los campos que
+//no se mapean se buscan por su mismo nombre sin importar mayusculas.
+func mapearColumnas(encabezado []string, mapeo string) (map[string]int, error) {
+  nombres := map[string]string{}
+  for _, campo := range []string{"tipo", "monto", "moneda", "descripcion", "grupo", "fecha", "debito", "credito"} {
+    nombres[campo] = campo
+  }
+  if mapeo != "" {
+    for _, par := range strings.Split(mapeo, ",") {
+      partes := strings.SplitN(par, ":", 2)
+      campo := strings.ToLower(strings.TrimSpace(partes[0]))
+      if _, ok := nombres[campo]; !ok || len(partes) != 2 {
+        return nil, fmt.Errorf("mapeo de columna invalido %q", par)
+      }
+      nombres[campo] = strings.TrimSpace(partes[1])
+    }
+  }
+  
+  columnas := map[string]int{}
+  for campo, nombre := range nombres {
+    for i, e := range encabezado {
+      if strings.EqualFold(strings.TrimSpace(e), nombre) {
+        columnas[campo] = i
+        break
+      }
+    }
+  }
+  
+  //sin fecha o sin forma de saber el monto no se puede importar.
+  if _, ok := columnas["fecha"]; !ok {
+    return nil, fmt.Errorf("no se encontro la columna de fecha")
+  }
+  _, monto := columnas["monto"]
+  _, debito := columnas["debito"]
+  _, credito := columnas["credito"]
+  if !monto && !debito && !credito {
+    return nil, fmt.Errorf("no se encontro la columna de monto ni las de debito/credito")
+  }
+  return columnas, nil
+}
+
+//filaCSVARegistro convierte una fila del csv a Registro.
+func filaCSVARegistro(campos []string, columnas map[string]int, decimal string, formatosFecha []string) (m Registro, err error) {
+  valor := func(campo string) string {
+    i, ok := columnas[campo]
+    if !ok || i >= len(campos) {
+      return ""
+    }
+    return strings.TrimSpace(campos[i])
+  }
+  
+  m.Descripcion = valor("descripcion")
+  m.Grupo = valor("grupo")
+  m.Moneda = strings.ToUpper(valor("moneda"))
+  
+  m.Fecha, err = leerFechaImportar(valor("fecha"), formatosFecha)
+  if err != nil {
+    return m, err
+  }
+  
+  //el monto sale de la columna monto o de debito/credito.
+  monto := Dinero{}
+  switch {
+  case valor("monto") != "":
+    monto, err = leerMontoTexto(valor("monto"), decimal)
+  case valor("debito") != "":
+    monto, err = leerMontoTexto(valor("debito"), decimal)
+    monto.Unidades = -monto.Abs().Unidades
+  case valor("credito") != "":
+    monto, err = leerMontoTexto(valor("credito"), decimal)
+    monto = monto.Abs()
+  }
+  if err != nil {
+    return m, err
+  }
+  
+  //si hay columna tipo manda ella, si no el signo.
+  m.Tipo = strings.ToLower(valor("tipo"))
+  if m.Tipo == "" {
+    m.Tipo = "ingreso"
+    if monto.Unidades < 0 {
+      m.Tipo = "egreso"
+    }
+  }
+  m.Monto = monto.Abs()
+  return m, nil
+}
+
+//leerFechaImportar prueba los formatos de fecha en orden.
+func leerFechaImportar(s string, formatos []string) (time.Time, error) {
+  for _, f := range formatos {
+    fecha, err := time.Parse(f, s)
+    if err == nil {
+      return fecha, nil
+    }
+  }
+  return time.Time{}, fmt.Errorf("fecha invalida %q", s)
+}
+
+//leerMontoTexto convierte un monto escrito como en los bancos (con signo de
+//moneda, separador de miles o parentesis para negativos) a un Dinero. Sin
+//decimal se usa el punto, y si el monto se puede leer distinto con coma
+//decimal es un error, ejm 1.000 o 12,50.
+func leerMontoTexto(s string, decimal string) (Dinero, error) {
+  original := s
+  negativo := strings.HasPrefix(s, "(") && strings.HasSuffix(s, ")")
+  if decimal == "" {
+    decimal = "."
+    if montoAmbiguo(s) {
+      return Dinero{}, fmt.Errorf("monto ambiguo %q, envie decimal=. o decimal=, para indicar el separador decimal", original)
+    }
+  }
+  
+  //quitamos todo lo que no sea digito, signo o el separador decimal.
+  var b strings.Builder
+  for _, c := range s {
+    switch {
+    case c >= '0' && c <= '9', c == '-', c == '+':
+      b.WriteRune(c)
+    case string(c) == decimal:
+      b.WriteRune('.')
+    }
+  }
+  
+  monto, err := leerDinero(b.String())
+  if err != nil {
+    return monto, fmt.Errorf("monto invalido %q", original)
+  }
+  if negativo {
+    monto.Unidades = -monto.Abs().Unidades
+  }
+  return monto, nil
+}
+
+//montoAmbiguo dice si el monto se leeria distinto con coma decimal que con
+//punto decimal. Lo es un solo punto con 3 digitos despues (1.000), varios
+//puntos (1.234.567) y una coma al final que no es de miles (12,50, 12,500 o
+//1.234,56). En cambio 1,234,567 y 1,234.56 solo se leen de una forma.
+func montoAmbiguo(s string) bool {
+  puntos := strings.Count(s, ".")
+  comas := strings.Count(s, ",")
+  i := strings.LastIndexAny(s, ".,")
+  if i < 0 {
+    return false
+  }
+  digitos := 0
+  for _, c := range s[i + 1:] {
+    if c < '0' || c > '9' {
+      break
+    }
+    digitos++
+  }
+  
+  if s[i] == '.' {
+    return puntos > 1 || (puntos == 1 && comas == 0 && digitos == 3)
+  }
+  return comas == 1 || puntos > 0 || digitos != 3
+}
+
+//validarFilaImportada aplica las mismas validaciones que postEgreso y
+//postIngreso a una fila.
+func validarFilaImportada(m Registro) error {
+  if m.Tipo != "ingreso" && m.Tipo != "egreso" {
+    return fmt.Errorf("el tipo solo puede ser ingreso o egreso")
+  }
+  //sin moneda queda en la moneda base, como en postEgreso.
+  if m.Moneda != "" && !regMoneda.MatchString(m.Moneda) {
+    return fmt.Errorf("la moneda debe ser un codigo de 3 letras, ejm COP")
+  }
+  return comprobarInfoRequest(m)
+}
+
+//guardarImportacion valida e inserta las filas en una transaccion. Si hay
+//errores o es prueba se hace rollback, asi nunca quedan registros a medias.
+func guardarImportacion(filas []filaImportada, libro int, usuario string, prueba bool, crearCategoria bool) (res ResultadoImportacion, err error) {
+  res.Prueba = prueba
+  res.Total = len(filas)
+  res.Errores = []ErrorLinea{}
+  
+  tx, err := db.Begin()
+  if err != nil {
+    return res, err
+  }
+  //si no llegamos al commit se deshace todo.
+  defer tx.Rollback()
+  
+  for _, f := range filas {
+    m := f.registro
+    m.Libro = libro
+    err := f.err
+    if err == nil {
+      err = validarFilaImportada(m)
+    }
+    if err == nil {
+      m.Grupo, err = resolverCategoriaEn(tx, usuario, m.Grupo, crearCategoria)
+    }
+    if err == nil {
+      _, err = insertarRegistro(tx, m, usuario)
+    }
+    if err != nil {
+      res.Errores = append(res.Errores, ErrorLinea{f.linea, err.Error()})
+      continue
+    }
+    res.Insertados++
+  }
+  
+  if prueba || len(res.Errores) > 0 {
+    //en prueba se informa cuantos se hubieran insertado.
+    if !prueba {
+      res.Insertados = 0
+    }
+    return res, nil
+  }
+  
+  return res, tx.Commit()
+}
@@ -0,0 +1,358 @@
+package main
+
+import (
+  "bufio"
+  "bytes"
+  "crypto/sha256"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "html"
+  "net/http"
+  "regexp"
+  "strings"
+  "time"
+)
+
+//ResultadoImportacionBanco es la respuesta de /importar/banco. Omitidos son
+//los movimientos que ya estaban importados (mismo fitid).
+type ResultadoImportacionBanco struct {
+  Prueba bool `json:"prueba"`
+  Total int `json:"total"`
+  Insertados int `json:"insertados"`
+  Omitidos int `json:"omitidos"`
+  Errores []ErrorLinea `json:"errores"`
+}
+
+//regTransaccionOFX encuentra cada transaccion del OFX. En SGML (1.x) los
+//elementos no se cierran pero los agregados como STMTTRN si, y en XML (2.x)
+//se cierra todo, asi que la misma expresion sirve para los dos.
+var regTransaccionOFX = regexp.MustCompile(`(?is)<STMTTRN>(.*?)</STMTTRN>`)
+
+//formatos de fecha de QIF que se intentan si no se envia formatoFecha.
+//Los bancos de EEUU usan mes/dia y el año con apostrofe desde el 2000.
+var formatosFechaQIF = []string{"01/02/2006", "1/2/2006", "01/02/06", "1/2/06", "2006-01-02", "02.01.2006"}
+
+//importarBanco recibe un extracto OFX/QFX o QIF y guarda los movimientos.
+//Los debitos quedan como egreso y los creditos como ingreso. El FITID del
+//banco se guarda para que al subir el mismo extracto no se dupliquen.
+//Acepta los mismos prueba, formatoFecha y crearCategoria de /importar.
+//ejm http://100.69.187.16:8080/importar/banco?formato=ofx
+func importarBanco(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  libro, ok := libroPeticion(w, r, true)
+  if !ok {
+    return
+  }
+  //el extracto suele ser de una cuenta, ?cuenta= la asigna a todos.
+  cuenta, ok := cuentaPeticion(w, r, libro)
+  if !ok {
+    return
+  }
+  
+  r.Body = http.MaxBytesReader(w, r.Body, maxImportacion)
+  contenido, nombreArchivo, err := leerArchivoImportar(r)
+  if err != nil {
+    writeError(w, "Error al leer el archivo", err, http.StatusBadRequest)
+    return
+  }
+  
+  formato := strings.ToLower(r.FormValue("formato"))
+  if formato == "" {
+    formato = detectarFormatoBanco(nombreArchivo, contenido)
+  }
+  
+  var filas []filaImportada
+  switch formato {
+  case "ofx", "qfx":
+    filas, err = leerOFX(contenido)
+  case "qif":
+    formatos := formatosFechaQIF
+    if f := r.FormValue("formatoFecha"); f != "" {
+      formatos = []string{f}
+    }
+    filas, err = leerQIF(contenido, formatos)
+  default:
+    http.Error(w, "Error, el formato solo puede ser ofx, qfx o qif.", http.StatusBadRequest)
+    return
+  }
+  if err != nil {
+    writeError(w, "Error al leer el extracto " + formato, err, http.StatusBadRequest)
+    return
+  }
+  
+  resultado, err := guardarImportacionBanco(filas, libro, cuenta, nombreUsuario, r.FormValue("prueba") == "true", r.FormValue("crearCategoria") == "true")
+  if err != nil {
+    writeError(w, "Error al guardar los movimientos", err, http.StatusInternalServerError)
+    return
+  }
+  
+  status := http.StatusCreated
+  if resultado.Prueba {
+    status = http.StatusOK
+  } else if len(resultado.Errores) > 0 {
+    status = http.StatusUnprocessableEntity
+  }
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(status)
+  json.NewEncoder(w).Encode(resultado)
+}
+
+//detectarFormatoBanco decide el formato por la extension o por el contenido.
+func detectarFormatoBanco(nombreArchivo string, contenido []byte) string {
+  nombre := strings.ToLower(nombreArchivo)
+  for _, ext := range []string{"ofx", "qfx", "qif"} {
+    if strings.HasSuffix(nombre, "." + ext) {
+      return ext
+    }
+  }
+  inicio := bytes.ToUpper(bytes.TrimSpace(contenido))
+  if bytes.HasPrefix(inicio, []byte("!TYPE")) || bytes.HasPrefix(inicio, []byte("!ACCOUNT")) || bytes.HasPrefix(inicio, []byte("!OPTION")) {
+    return "qif"
+  }
+  if bytes.Contains(inicio, []byte("<OFX>")) {
+    return "ofx"
+  }
+  return ""
+}
+
+//valorOFX retorna el valor de un elemento dentro de un bloque OFX.
+func valorOFX(bloque string, etiqueta string) string {
+  reg := regexp.MustCompile(`(?i)<` + etiqueta + `>([^<\r\n]*)`)
+  coincidencia := reg.FindStringSubmatch(bloque)
+  if coincidencia == nil {
+    return ""
+  }
+  return html.UnescapeString(strings.TrimSpace(coincidencia[1]))
+}
+
+//leerOFX lee las transacciones (STMTTRN) de un extracto OFX 1.x o 2.x.
+//Sirve igual para extractos de cuenta y de tarjeta de credito.
+func leerOFX(contenido []byte) ([]filaImportada, error) {
+  texto := string(contenido)
+  if !strings.Contains(strings.ToUpper(texto), "<OFX>") {
+    return nil, fmt.Errorf("el archivo no tiene la etiqueta <OFX>")
+  }
+  
+  var filas []filaImportada
+  for i, t := range regTransaccionOFX.FindAllStringSubmatch(texto, -1) {
+    bloque := t[1]
+    //no hay lineas utiles en OFX, usamos la posicion de la transaccion.
+    f := filaImportada{linea: i + 1}
+  
+    m := &f.registro
+    m.Fitid = valorOFX(bloque, "FITID")
+    m.Descripcion = unirDescripcion(valorOFX(bloque, "NAME"), valorOFX(bloque, "MEMO"))
+  
+    //DTPOSTED viene como YYYYMMDDHHMMSS.XXX[-5:EST], solo usamos el dia.
+    fecha := valorOFX(bloque, "DTPOSTED")
+    if len(fecha) < 8 {
+      f.err = fmt.Errorf("DTPOSTED invalido %q", fecha)
+      filas = append(filas, f)
+      continue
+    }
+    m.Fecha, f.err = time.Parse("20060102", fecha[:8])
+    if f.err != nil {
+      filas = append(filas, f)
+      continue
+    }
+  
+    //algunos bancos usan coma decimal en TRNAMT.
+    monto := strings.Replace(valorOFX(bloque, "TRNAMT"), ",", ".", 1)
+    var valor Dinero
+    valor, f.err = leerDinero(monto)
+    if f.err != nil {
+      filas = append(filas, f)
+      continue
+    }
+    m.Tipo = "ingreso"
+    if valor.Unidades < 0 || (valor.Unidades == 0 && strings.EqualFold(valorOFX(bloque, "TRNTYPE"), "DEBIT")) {
+      m.Tipo = "egreso"
+    }
+    m.Monto = valor.Abs()
+  
+    //si el banco no manda FITID lo calculamos con los datos.
+    if m.Fitid == "" {
+      m.Fitid = fitidCalculado("ofx", *m, 0)
+    }
+    filas = append(filas, f)
+  }
+  
+  return filas, nil
+}
+
+//leerQIF lee un archivo QIF. Cada transaccion termina en una linea "^" y
+//cada linea inicia con una letra que dice que campo es.
+func leerQIF(contenido []byte, formatosFecha []string) ([]filaImportada, error) {
+  var filas []filaImportada
+  var actual filaImportada
+  var montoTexto string
+  hayDatos := false
+  //cuenta los movimientos identicos para que no se tomen como duplicados.
+  repetidos := map[string]int{}
+  
+  lector := bufio.NewScanner(bytes.NewReader(contenido))
+  linea := 0
+  for lector.Scan() {
+    linea++
+    texto := strings.TrimRight(lector.Text(), "\r ")
+    if texto == "" {
+      continue
+    }
+    codigo, valor := texto[0], strings.TrimSpace(texto[1:])
+  
+    switch codigo {
+    case '!':
+      //encabezados como !Type:Bank, no tienen datos del movimiento.
+      continue
+    case 'D':
+      actual.registro.Fecha, actual.err = leerFechaImportar(strings.ReplaceAll(valor, "'", "/"), formatosFecha)
+    case 'T', 'U':
+      montoTexto = valor
+    case 'P':
+      actual.registro.Descripcion = unirDescripcion(valor, actual.registro.Descripcion)
+    case 'M':
+      actual.registro.Descripcion = unirDescripcion(actual.registro.Descripcion, valor)
+    case 'L':
+      //las categorias entre [] son transferencias entre cuentas.
+      if !strings.HasPrefix(valor, "[") {
+        actual.registro.Grupo = strings.SplitN(valor, ":", 2)[0]
+      }
+    case '^':
+      if hayDatos {
+        filas = append(filas, terminarFilaQIF(actual, montoTexto, repetidos))
+      }
+      actual, montoTexto, hayDatos = filaImportada{}, "", false
+      continue
+    }
+    if !hayDatos {
+      actual.linea = linea
+      hayDatos = true
+    }
+  }
+  if err := lector.Err(); err != nil {
+    return nil, err
+  }
+  //el ultimo movimiento puede no tener "^".
+  if hayDatos {
+    filas = append(filas, terminarFilaQIF(actual, montoTexto, repetidos))
+  }
+  
+  return filas, nil
+}
+
+//terminarFilaQIF pone el tipo, el monto y el fitid calculado a una fila QIF.
+func terminarFilaQIF(f filaImportada, montoTexto string, repetidos map[string]int) filaImportada {
+  if f.err != nil {
+    return f
+  }
+  if montoTexto == "" {
+    f.err = fmt.Errorf("el movimiento no tiene monto")
+    return f
+  }
+  valor, err := leerDinero(strings.ReplaceAll(montoTexto, ",", ""))
+  if err != nil {
+    f.err = err
+    return f
+  }
+  
+  m := &f.registro
+  m.Tipo = "ingreso"
+  if valor.Unidades < 0 {
+    m.Tipo = "egreso"
+  }
+  m.Monto = valor.Abs()
+  
+  //QIF no trae id, usamos los datos y cuantas veces se repiten en el archivo.
+  base := fitidCalculado("qif", *m, 0)
+  m.Fitid = fitidCalculado("qif", *m, repetidos[base])
+  repetidos[base]++
+  return f
+}
+
+//fitidCalculado arma un id estable para movimientos que el banco no
+//identifica. n diferencia movimientos iguales del mismo archivo. El monto
+//va como fraccion para que los montos enteros den el mismo id de antes.
+func fitidCalculado(prefijo string, m Registro, n int) string {
+  suma := sha256.Sum256([]byte(fmt.Sprintf("%s|%s|%s|%s|%d", m.Fecha.Format("2006-01-02"), m.Tipo, m.Monto.Rat().RatString(), m.Descripcion, n)))
+  return prefijo + ":" + hex.EncodeToString(suma[:12])
+}
+
+//unirDescripcion junta el nombre y la nota del banco sin dejar separadores
+//de sobra si alguno esta vacio.
+func unirDescripcion(a string, b string) string {
+  if a == "" || strings.EqualFold(a, b) {
+    return b
+  }
+  if b == "" {
+    return a
+  }
+  return a + " - " + b
+}
+
+//guardarImportacionBanco inserta en una transaccion los movimientos que no
+//esten ya importados. Si alguno tiene error no se guarda ninguno.
+func guardarImportacionBanco(filas []filaImportada, libro int, cuenta Cuenta, usuario string, prueba bool, crearCategoria bool) (res ResultadoImportacionBanco, err error) {
+  res.Prueba = prueba
+  res.Total = len(filas)
+  res.Errores = []ErrorLinea{}
+  
+  tx, err := db.Begin()
+  if err != nil {
+    return res, err
+  }
+  defer tx.Rollback()
+  
+  vistos := map[string]bool{}
+  for _, f := range filas {
+    m := f.registro
+    m.Libro = libro
+    m.Cuenta = cuenta.Id
+    m.Moneda = cuenta.Moneda
+    err := f.err
+    if err == nil {
+      err = validarFilaImportada(m)
+    }
+    if err != nil {
+      res.Errores = append(res.Errores, ErrorLinea{f.linea, err.Error()})
+      continue
+    }
+  
+    //omitimos lo que ya se importo antes al libro o se repite en el archivo.
+    var existe int
+    err = tx.QueryRow("SELECT COUNT(*) FROM registros WHERE libro_id = ? AND fitid = ?", libro, m.Fitid).Scan(&existe)
+    if err != nil {
+      return res, err
+    }
+    if existe > 0 || vistos[m.Fitid] {
+      res.Omitidos++
+      continue
+    }
+    vistos[m.Fitid] = true
+  
+    //las categorias del banco son opcionales, si no existen se dejan vacias.
+    m.Grupo, err = resolverCategoriaEn(tx, usuario, m.Grupo, crearCategoria)
+    if errors.Is(err, errCategoriaNoExiste) {
+      m.Grupo, err = "", nil
+    }
+    if err == nil {
+      _, err = insertarRegistro(tx, m, usuario)
+    }
+    if err != nil {
+      res.Errores = append(res.Errores, ErrorLinea{f.linea, err.Error()})
+      continue
+    }
+    res.Insertados++
+  }
+  
+  if prueba || len(res.Errores) > 0 {
+    if !prueba {
+      res.Insertados = 0
+    }
+    return res, nil
+  }
+  
+  return res, tx.Commit()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+  "strings"
+  "testing"
+)
+
+func TestLeerMontoTexto(t *testing.T) {
+  casos := []struct {
+    texto string
+    decimal string
+    esperado Dinero
+    err string
+  }{
+    //sin decimal= se usa el punto.
+    {"12.50", "", Dinero{125, 1}, ""},
+    {"1234", "", Dinero{1234, 0}, ""},
+    {"-45.99", "", Dinero{-4599, 2}, ""},
+    {"(45.99)", "", Dinero{-4599, 2}, ""},
+    {"$ 1,234.56", "", Dinero{123456, 2}, ""},
+    {"1,234,567", "", Dinero{1234567, 0}, ""},
+    {"12.5", "", Dinero{125, 1}, ""},
+    //sin decimal= lo que se puede leer de dos formas es un error.
+    {"1.000", "", Dinero{}, "ambiguo"},
+    {"1,000", "", Dinero{}, "ambiguo"},
+    {"12,50", "", Dinero{}, "ambiguo"},
+    {"12,5", "", Dinero{}, "ambiguo"},
+    {"(45,99)", "", Dinero{}, "ambiguo"},
+    {"12,50 €", "", Dinero{}, "ambiguo"},
+    {"1.234,56", "", Dinero{}, "ambiguo"},
+    {"1.234.567", "", Dinero{}, "ambiguo"},
+    {"1,234,56", "", Dinero{}, "ambiguo"},
+    //con decimal= se lee como se indica.
+    {"1.000", ".", Dinero{1, 0}, ""},
+    {"1.000", ",", Dinero{1000, 0}, ""},
+    {"12,50", ",", Dinero{125, 1}, ""},
+    {"(45,99)", ",", Dinero{-4599, 2}, ""},
+    {"1.234,56", ",", Dinero{123456, 2}, ""},
+    {"1.234.567", ",", Dinero{1234567, 0}, ""},
+    {"abc", "", Dinero{}, "invalido"},
+  }
+  
+  for _, c := range casos {
+    monto, err := leerMontoTexto(c.texto, c.decimal)
+    if c.err != "" {
+      if err == nil || !strings.Contains(err.Error(), c.err) {
+        t.Errorf("leerMontoTexto(%q, %q) = %v, %v, esperaba error %q", c.texto, c.decimal, monto, err, c.err)
+      }
+      continue
+    }
+    if err != nil {
+      t.Errorf("leerMontoTexto(%q, %q) error inesperado %v", c.texto, c.decimal, err)
+      continue
+    }
+    if monto != c.esperado {
+      t.Errorf("leerMontoTexto(%q, %q) = %+v, esperaba %+v", c.texto, c.decimal, monto, c.esperado)
+    }
+  }
+}
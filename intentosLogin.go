@@ -0,0 +1,166 @@
+package main
+
+import (
+  "errors"
+  "fmt"
+  "log"
+  "math"
+  "net"
+  "net/http"
+  "strconv"
+  "time"
+  
+  "golang.org/x/crypto/bcrypt"
+)
+
+//limites para los intentos fallidos. Despues de fallosAntesDeEspera cada
+//fallo duplica la espera, y con fallosBloqueo se bloquea por duracionBloqueo.
+//Solo cuentan los fallos de la ultima ventanaIntentos desde el ultimo exito.
+const (
+  fallosAntesDeEspera = 3
+  fallosBloqueo = 10
+  fallosBloqueoIp = 50
+  duracionBloqueo = 15 * time.Minute
+  ventanaIntentos = time.Hour
+  //los intentos se guardan 90 dias para poder revisarlos.
+  retencionIntentos = 90 * 24 * time.Hour
+)
+
+//las fechas de los intentos llevan milisegundos y ancho fijo para poder
+//compararlas como texto en sql.
+const formatoIntento = "2006-01-02T15:04:05.000Z"
+
+//errCredenciales es el error de login, igual si el usuario no existe o si
+//la clave esta mal.
+var errCredenciales = errors.New("usuario o clave incorrecto")
+
+//hashFalso se compara cuando el usuario no existe para que la respuesta
+//tarde lo mismo que con un usuario real.
+var hashFalso []byte
+
+//initIntentosLogin crea la tabla de intentos, borra los muy viejos y
+//prepara el hash falso.
+func initIntentosLogin() {
+  crearTablaIntentos := `
+  CREATE TABLE IF NOT EXISTS intentos_login(
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  usuario TEXT NOT NULL,
+  ip TEXT NOT NULL,
+  fecha TEXT NOT NULL,
+  exito INTEGER NOT NULL,
+  motivo TEXT NOT NULL DEFAULT ''
+  );`
+  
+  _, err := db.Exec(crearTablaIntentos)
+  if err != nil {
+    log.Fatal("Error creando la tabla intentos_login", err)
+  }
+  _, err = db.Exec("CREATE INDEX IF NOT EXISTS intentos_login_usuario ON intentos_login(usuario, fecha)")
+  if err != nil {
+    log.Fatal("Error creando el indice de intentos_login", err)
+  }
+  _, err = db.Exec("CREATE INDEX IF NOT EXISTS intentos_login_ip ON intentos_login(ip, fecha)")
+  if err != nil {
+    log.Fatal("Error creando el indice de intentos_login", err)
+  }
+  _, err = db.Exec("DELETE FROM intentos_login WHERE fecha < ?", time.Now().UTC().Add(-retencionIntentos).Format(formatoIntento))
+  if err != nil {
+    log.Fatal("Error borrando los intentos viejos ", err)
+  }
+  
+  hashFalso, err = bcrypt.GenerateFromPassword([]byte(tokenAleatorio(8)), bcrypt.DefaultCost)
+  if err != nil {
+    log.Fatal("Error generando el hash falso ", err)
+  }
+}
+
+//ipCliente es la ip de quien hace la peticion, sin el puerto.
+func ipCliente(r *http.Request) string {
+  ip, _, err := net.SplitHostPort(r.RemoteAddr)
+  if err != nil {
+    return r.RemoteAddr
+  }
+  return ip
+}
+
+//registrarIntento guarda el intento. Si falla solo se registra en el log
+//para no cambiar la respuesta del login.
+func registrarIntento(usuario string, ip string, exito bool, motivo string) {
+  _, err := db.Exec("INSERT INTO intentos_login(usuario, ip, fecha, exito, motivo) VALUES(?, ?, ?, ?, ?)",
+    usuario, ip, time.Now().UTC().Format(formatoIntento), exito, motivo)
+  if err != nil {
+    log.Printf("Error al guardar el intento de login de %s, %v", usuario, err)
+  }
+}
+
+//esperaLogin retorna cuanto falta para que el usuario o la ip puedan
+//intentar de nuevo, 0 si ya pueden.
+func esperaLogin(usuario string, ip string) (time.Duration, error) {
+  ahora := time.Now().UTC()
+  desde := ahora.Add(-ventanaIntentos).Format(formatoIntento)
+  
+  //fallos del usuario despues de su ultimo login correcto.
+  var fallos int
+  var ultimo string
+  err := db.QueryRow(`SELECT COUNT(*), COALESCE(MAX(fecha), '') FROM intentos_login
+  WHERE usuario = ? AND exito = 0 AND fecha > ?
+  AND fecha > COALESCE((SELECT MAX(fecha) FROM intentos_login WHERE usuario = ? AND exito = 1), '')`,
+    usuario, desde, usuario).Scan(&fallos, &ultimo)
+  if err != nil {
+    return 0, fmt.Errorf("Error al consultar los intentos del usuario, %v", err)
+  }
+  espera := calcularEspera(fallos, ultimo, fallosBloqueo, ahora)
+  
+  //la ip solo se bloquea con muchos fallos, para frenar a quien prueba
+  //muchos usuarios sin afectar una red compartida.
+  err = db.QueryRow("SELECT COUNT(*), COALESCE(MAX(fecha), '') FROM intentos_login WHERE ip = ? AND exito = 0 AND fecha > ?",
+    ip, desde).Scan(&fallos, &ultimo)
+  if err != nil {
+    return 0, fmt.Errorf("Error al consultar los intentos de la ip, %v", err)
+  }
+  if fallos >= fallosBloqueoIp {
+    espera = maxDuracion(espera, calcularEspera(fallos, ultimo, fallosBloqueoIp, ahora))
+  }
+  return espera, nil
+}
+
+//calcularEspera da la espera para n fallos contada desde el ultimo.
+func calcularEspera(fallos int, ultimo string, bloqueo int, ahora time.Time) time.Duration {
+  if fallos < fallosAntesDeEspera || ultimo == "" {
+    return 0
+  }
+  fin, err := time.Parse(time.RFC3339, ultimo)
+  if err != nil {
+    return 0
+  }
+  
+  espera := duracionBloqueo
+  if fallos < bloqueo {
+    espera = time.Duration(math.Pow(2, float64(fallos - fallosAntesDeEspera))) * time.Second
+  }
+  return maxDuracion(0, fin.Add(espera).Sub(ahora))
+}
+
+func maxDuracion(a time.Duration, b time.Duration) time.Duration {
+  if a > b {
+    return a
+  }
+  return b
+}
+
+//limitarIntentos revisa si se puede intentar y si no responde 429 con el
+//Retry-After en segundos. Retorna false si ya respondio.
+func limitarIntentos(w http.ResponseWriter, usuario string, ip string) bool {
+  espera, err := esperaLogin(usuario, ip)
+  if err != nil {
+    writeError(w, "Error al validar los intentos", err, http.StatusInternalServerError)
+    return false
+  }
+  if espera > 0 {
+    segundos := int(math.Ceil(espera.Seconds()))
+    w.Header().Set("Retry-After", strconv.Itoa(segundos))
+    http.Error(w, fmt.Sprintf("Demasiados intentos fallidos, intente de nuevo en %d segundos.", segundos), http.StatusTooManyRequests)
+    return false
+  }
+  return true
+}
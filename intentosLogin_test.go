@@ -0,0 +1,130 @@
+package main
+
+import (
+  "fmt"
+  "net/http"
+  "net/http/httptest"
+  "testing"
+  "time"
+)
+
+func TestCalcularEspera(t *testing.T) {
+  ahora := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+  hace := func(d time.Duration) string {
+    return ahora.Add(-d).Format(formatoIntento)
+  }
+  
+  casos := []struct {
+    nombre string
+    fallos int
+    ultimo string
+    bloqueo int
+    esperado time.Duration
+  }{
+    {"sin fallos", 0, "", fallosBloqueo, 0},
+    {"dos fallos", 2, hace(0), fallosBloqueo, 0},
+    //desde el tercero la espera es 2^(n-3) segundos.
+    {"tres fallos", 3, hace(0), fallosBloqueo, time.Second},
+    {"cuatro fallos", 4, hace(0), fallosBloqueo, 2 * time.Second},
+    {"cinco fallos", 5, hace(0), fallosBloqueo, 4 * time.Second},
+    {"nueve fallos", 9, hace(0), fallosBloqueo, 64 * time.Second},
+    {"diez fallos bloquean", 10, hace(0), fallosBloqueo, duracionBloqueo},
+    {"mas de diez", 25, hace(0), fallosBloqueo, duracionBloqueo},
+    //la espera se cuenta desde el ultimo fallo.
+    {"ya paso parte", 5, hace(3 * time.Second), fallosBloqueo, time.Second},
+    {"ya paso toda", 5, hace(10 * time.Second), fallosBloqueo, 0},
+    {"bloqueo que ya paso", 10, hace(duracionBloqueo + time.Second), fallosBloqueo, 0},
+    {"bloqueo de ip", 50, hace(time.Minute), fallosBloqueoIp, duracionBloqueo - time.Minute},
+  }
+  
+  for _, c := range casos {
+    if espera := calcularEspera(c.fallos, c.ultimo, c.bloqueo, ahora); espera != c.esperado {
+      t.Errorf("%s: calcularEspera = %v, esperaba %v", c.nombre, espera, c.esperado)
+    }
+  }
+}
+
+//fallar registra n intentos fallidos.
+func fallar(usuario string, ip string, n int) {
+  for i := 0; i < n; i++ {
+    registrarIntento(usuario, ip, false, "clave")
+  }
+}
+
+//retryAfter llama a limitarIntentos y retorna el Retry-After, "" si se
+//puede intentar.
+func retryAfter(t *testing.T, usuario string, ip string) string {
+  t.Helper()
+  w := httptest.NewRecorder()
+  if limitarIntentos(w, usuario, ip) {
+    return ""
+  }
+  if w.Code != http.StatusTooManyRequests {
+    t.Fatalf("limitarIntentos respondio %d %s", w.Code, w.Body)
+  }
+  return w.Header().Get("Retry-After")
+}
+
+func TestLimitarIntentosUsuario(t *testing.T) {
+  prepararDB(t)
+  
+  fallar("anita", "10.0.0.1", 2)
+  if espera := retryAfter(t, "anita", "10.0.0.1"); espera != "" {
+    t.Errorf("con 2 fallos hay que esperar %s", espera)
+  }
+  fallar("anita", "10.0.0.1", 1)
+  if espera := retryAfter(t, "anita", "10.0.0.1"); espera != "1" {
+    t.Errorf("con 3 fallos Retry-After es %q, esperaba 1", espera)
+  }
+  //el usuario queda bloqueado aunque cambie de ip.
+  fallar("anita", "10.0.0.2", 7)
+  if espera := retryAfter(t, "anita", "10.0.0.3"); espera != fmt.Sprint(int(duracionBloqueo.Seconds())) {
+    t.Errorf("con 10 fallos Retry-After es %q, esperaba %d", espera, int(duracionBloqueo.Seconds()))
+  }
+  if espera := retryAfter(t, "pedro", "10.0.0.1"); espera != "" {
+    t.Errorf("otro usuario desde la misma ip debe esperar %s", espera)
+  }
+  
+  //un login correcto reinicia la cuenta.
+  registrarIntento("anita", "10.0.0.1", true, "")
+  if espera := retryAfter(t, "anita", "10.0.0.1"); espera != "" {
+    t.Errorf("despues de un login correcto hay que esperar %s", espera)
+  }
+}
+
+func TestLimitarIntentosIp(t *testing.T) {
+  prepararDB(t)
+  
+  //49 fallos repartidos en muchos usuarios todavia no bloquean la ip.
+  for i := 0; i < fallosBloqueoIp - 1; i++ {
+    fallar(fmt.Sprintf("usuario%d", i), "10.0.0.9", 1)
+  }
+  if espera := retryAfter(t, "nuevo", "10.0.0.9"); espera != "" {
+    t.Errorf("con 49 fallos la ip debe esperar %s", espera)
+  }
+  fallar("otro", "10.0.0.9", 1)
+  if espera := retryAfter(t, "nuevo", "10.0.0.9"); espera != fmt.Sprint(int(duracionBloqueo.Seconds())) {
+    t.Errorf("con 50 fallos Retry-After es %q", espera)
+  }
+  if espera := retryAfter(t, "nuevo", "10.0.0.10"); espera != "" {
+    t.Errorf("otra ip debe esperar %s", espera)
+  }
+}
+
+func TestLoginEsperaDespuesDeFallos(t *testing.T) {
+  prepararDB(t)
+  if err := guardarUsuario(Usuario{Nombre: "anita", Clave: "Clave123#"}); err != nil {
+    t.Fatal(err)
+  }
+  
+  for i := 0; i < fallosAntesDeEspera; i++ {
+    if w := enviarJSON(login, `{"nombre": "anita", "clave": "Errada123#"}`); w.Code != http.StatusUnauthorized {
+      t.Fatalf("intento %d respondio %d", i, w.Code)
+    }
+  }
+  //aun con la clave correcta hay que esperar.
+  w := enviarJSON(login, `{"nombre": "anita", "clave": "Clave123#"}`)
+  if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+    t.Errorf("login respondio %d con Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+  }
+}
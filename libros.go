@@ -0,0 +1,585 @@
+package main
+
+import (
+  "database/sql"
+  "encoding/json"
+  "errors"
+  "log"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+  "unicode/utf8"
+  
+  "github.com/gorilla/mux"
+)
+
+//Libro es un conjunto de registros que pueden ver varios usuarios, por
+//ejemplo los gastos de la casa. Cada usuario tiene un libro personal que
+//solo es suyo. Rol es el permiso del usuario que consulta.
+type Libro struct {
+  Id int `json:"id"`
+  Nombre string `json:"nombre"`
+  Propietario string `json:"propietario"`
+  Personal bool `json:"personal"`
+  Creado time.Time `json:"creado"`
+  Rol string `json:"rol,omitempty"`
+}
+
+//MiembroLibro es un usuario con acceso al libro. El propietario puede
+//administrarlo, el editor agrega y cambia registros y el lector solo los ve.
+type MiembroLibro struct {
+  Usuario string `json:"usuario"`
+  Rol string `json:"rol"`
+}
+
+//roles que se pueden dar al agregar un miembro, propietario solo hay uno.
+var rolesLibro = map[string]bool{"editor": true, "lector": true}
+
+//condicionMiembro limita una consulta sobre registros a los libros de los
+//que el usuario es miembro. condicionEditor ademas exige que pueda
+//modificarlos. Las dos reciben el usuario como argumento.
+const (
+  condicionMiembro = "libro_id IN (SELECT libro_id FROM libro_miembros WHERE usuario = ?)"
+  condicionEditor = "libro_id IN (SELECT libro_id FROM libro_miembros WHERE usuario = ? AND rol != 'lector')"
+)
+
+//initLibros crea las tablas de libros, agrega el libro a los registros y
+//pasa los registros que no tienen libro al libro personal de su usuario.
+func initLibros() {
+  crearTablaLibros := `
+  CREATE TABLE IF NOT EXISTS libros(
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  nombre TEXT NOT NULL,
+  propietario TEXT NOT NULL,
+  personal INTEGER NOT NULL DEFAULT 0,
+  creado TEXT NOT NULL
+  );`
+  
+  crearTablaMiembros := `
+  CREATE TABLE IF NOT EXISTS libro_miembros(
+  libro_id INTEGER NOT NULL REFERENCES libros(id),
+  usuario TEXT NOT NULL,
+  rol TEXT NOT NULL,
+  PRIMARY KEY(libro_id, usuario)
+  );`
+  
+  _, err := db.Exec(crearTablaLibros)
+  if err != nil {
+    log.Fatal("Error creando la tabla libros", err)
+  }
+  _, err = db.Exec(crearTablaMiembros)
+  if err != nil {
+    log.Fatal("Error creando la tabla libro_miembros", err)
+  }
+  //cada usuario tiene un solo libro personal.
+  _, err = db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS libros_personal ON libros(propietario) WHERE personal = 1")
+  if err != nil {
+    log.Fatal("Error creando el indice de libros", err)
+  }
+  _, err = db.Exec("CREATE INDEX IF NOT EXISTS libro_miembros_usuario ON libro_miembros(usuario)")
+  if err != nil {
+    log.Fatal("Error creando el indice de libro_miembros", err)
+  }
+  
+  //usuario sigue en registros como quien lo creo.
+  agregarColumna("registros", "libro_id", "INTEGER REFERENCES libros(id)")
+  agregarColumna("exportaciones", "libro_id", "INTEGER")
+  _, err = db.Exec("CREATE INDEX IF NOT EXISTS registros_libro ON registros(libro_id, fecha)")
+  if err != nil {
+    log.Fatal("Error creando el indice de registros", err)
+  }
+  //el fitid ahora es unico por libro y no por usuario.
+  _, err = db.Exec("DROP INDEX IF EXISTS registros_fitid")
+  if err != nil {
+    log.Fatal("Error borrando el indice de fitid", err)
+  }
+  _, err = db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS registros_libro_fitid ON registros(libro_id, fitid) WHERE fitid IS NOT NULL")
+  if err != nil {
+    log.Fatal("Error creando el indice de fitid", err)
+  }
+  
+  err = migrarRegistrosALibros()
+  if err != nil {
+    log.Fatal("Error pasando los registros a libros ", err)
+  }
+}
+
+//migrarRegistrosALibros deja cada registro sin libro en el libro personal
+//de su usuario. Si ya se corrio antes no cambia nada.
+func migrarRegistrosALibros() error {
+  rows, err := db.Query("SELECT DISTINCT usuario FROM registros WHERE libro_id IS NULL")
+  if err != nil {
+    return err
+  }
+  //leemos todo antes de escribir para no tener la consulta abierta.
+  var usuarios []string
+  for rows.Next() {
+    var usuario string
+    err = rows.Scan(&usuario)
+    if err != nil {
+      rows.Close()
+      return err
+    }
+    usuarios = append(usuarios, usuario)
+  }
+  rows.Close()
+  
+  for _, usuario := range usuarios {
+    libro, err := libroPersonal(db, usuario)
+    if err != nil {
+      return err
+    }
+    _, err = db.Exec("UPDATE registros SET libro_id = ? WHERE usuario = ? AND libro_id IS NULL", libro, usuario)
+    if err != nil {
+      return err
+    }
+  }
+  return nil
+}
+
+//libroPersonal retorna el id del libro personal del usuario y lo crea si
+//todavia no lo tiene.
+func libroPersonal(ex ejecutor, usuario string) (int, error) {
+  var id int
+  err := ex.QueryRow("SELECT id FROM libros WHERE propietario = ? AND personal = 1", usuario).Scan(&id)
+  if err == nil {
+    return id, nil
+  }
+  if err != sql.ErrNoRows {
+    return 0, err
+  }
+  
+  //con el indice unico, si otra peticion lo creo al mismo tiempo esta no
+  //inserta nada y se lee el que quedo.
+  _, err = ex.Exec("INSERT OR IGNORE INTO libros(nombre, propietario, personal, creado) VALUES('Personal', ?, 1, ?)",
+    usuario, time.Now().UTC().Format(time.RFC3339))
+  if err != nil {
+    return 0, err
+  }
+  err = ex.QueryRow("SELECT id FROM libros WHERE propietario = ? AND personal = 1", usuario).Scan(&id)
+  if err != nil {
+    return 0, err
+  }
+  _, err = ex.Exec("INSERT OR IGNORE INTO libro_miembros(libro_id, usuario, rol) VALUES(?, ?, 'propietario')", id, usuario)
+  return id, err
+}
+
+//rolEnLibro retorna el rol del usuario en el libro, sql.ErrNoRows si no es
+//miembro.
+func rolEnLibro(libro int, usuario string) (string, error) {
+  var rol string
+  err := db.QueryRow("SELECT rol FROM libro_miembros WHERE libro_id = ? AND usuario = ?", libro, usuario).Scan(&rol)
+  return rol, err
+}
+
+//permisoLibro revisa que el usuario sea miembro del libro y, si se va a
+//escribir, que no sea lector. Si no responde 404 o 403 y retorna false.
+func permisoLibro(w http.ResponseWriter, libro int, usuario string, escritura bool) bool {
+  rol, err := rolEnLibro(libro, usuario)
+  if err == sql.ErrNoRows {
+    http.Error(w, "El libro no existe.", http.StatusNotFound)
+    return false
+  }
+  if err != nil {
+    writeError(w, "Error al consultar el libro", err, http.StatusInternalServerError)
+    return false
+  }
+  if escritura && rol == "lector" {
+    http.Error(w, "Error, solo puede ver los registros de este libro.", http.StatusForbidden)
+    return false
+  }
+  return true
+}
+
+//libroPeticion retorna el libro de ?libro= ya validado, sin el parametro
+//es el libro personal del usuario. Si responde un error retorna false.
+func libroPeticion(w http.ResponseWriter, r *http.Request, escritura bool) (int, bool) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  s := r.URL.Query().Get("libro")
+  if s == "" {
+    libro, err := libroPersonal(db, nombreUsuario)
+    if err != nil {
+      writeError(w, "Error al consultar el libro personal", err, http.StatusInternalServerError)
+      return 0, false
+    }
+    return libro, true
+  }
+  libro, err := strconv.Atoi(s)
+  if err != nil {
+    http.Error(w, "Error, el libro debe ser un numero.", http.StatusBadRequest)
+    return 0, false
+  }
+  return libro, permisoLibro(w, libro, nombreUsuario, escritura)
+}
+
+//libroRegistro asigna el libro al registro que se va a crear. Puede venir
+//en el body o en ?libro=, si no va al libro personal.
+func libroRegistro(w http.ResponseWriter, r *http.Request, m *Registro) bool {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  if m.Libro != 0 {
+    return permisoLibro(w, m.Libro, nombreUsuario, true)
+  }
+  libro, ok := libroPeticion(w, r, true)
+  m.Libro = libro
+  return ok
+}
+
+//buscarLibroPropietario retorna el libro de la url si el usuario es el
+//propietario, si no responde el error y retorna false.
+func buscarLibroPropietario(w http.ResponseWriter, r *http.Request) (Libro, bool) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  var l Libro
+  id, err := strconv.Atoi(mux.Vars(r)["id"])
+  if err != nil {
+    http.Error(w, "Error, el id debe ser un numero.", http.StatusBadRequest)
+    return l, false
+  }
+  var creado string
+  err = db.QueryRow(`SELECT l.id, l.nombre, l.propietario, l.personal, l.creado, m.rol FROM libros l
+  JOIN libro_miembros m ON m.libro_id = l.id AND m.usuario = ?
+  WHERE l.id = ?`, nombreUsuario, id).Scan(&l.Id, &l.Nombre, &l.Propietario, &l.Personal, &creado, &l.Rol)
+  if err == sql.ErrNoRows {
+    http.Error(w, "El libro no existe.", http.StatusNotFound)
+    return l, false
+  }
+  if err != nil {
+    writeError(w, "Error al consultar el libro", err, http.StatusInternalServerError)
+    return l, false
+  }
+  l.Creado, _ = time.Parse(time.RFC3339, creado)
+  if l.Rol != "propietario" {
+    http.Error(w, "Error, solo el propietario puede administrar el libro.", http.StatusForbidden)
+    return l, false
+  }
+  return l, true
+}
+
+//getLibros lista los libros de los que el usuario es miembro, el
+//personal primero.
+//ejm http://100.69.187.16:8080/libros
+func getLibros(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  //asi el libro personal siempre aparece aunque no tenga registros.
+  _, err := libroPersonal(db, nombreUsuario)
+  if err != nil {
+    writeError(w, "Error al consultar el libro personal", err, http.StatusInternalServerError)
+    return
+  }
+  
+  rows, err := db.Query(`SELECT l.id, l.nombre, l.propietario, l.personal, l.creado, m.rol FROM libros l
+  JOIN libro_miembros m ON m.libro_id = l.id
+  WHERE m.usuario = ? ORDER BY l.personal DESC, l.id`, nombreUsuario)
+  if err != nil {
+    writeError(w, "Error al consultar los libros", err, http.StatusInternalServerError)
+    return
+  }
+  defer rows.Close()
+  
+  libros := []Libro{}
+  for rows.Next() {
+    var l Libro
+    var creado string
+    err = rows.Scan(&l.Id, &l.Nombre, &l.Propietario, &l.Personal, &creado, &l.Rol)
+    if err != nil {
+      writeError(w, "Error al escanear los libros", err, http.StatusInternalServerError)
+      return
+    }
+    l.Creado, _ = time.Parse(time.RFC3339, creado)
+    libros = append(libros, l)
+  }
+  if err = rows.Err(); err != nil {
+    writeError(w, "Error al consultar los libros", err, http.StatusInternalServerError)
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(libros)
+}
+
+//leerNombreLibro lee y valida el nombre del body.
+func leerNombreLibro(r *http.Request) (string, error) {
+  var datos struct {
+    Nombre string `json:"nombre"`
+  }
+  err := json.NewDecoder(r.Body).Decode(&datos)
+  if err != nil {
+    return "", errors.New("Error al leer el json.")
+  }
+  nombre := strings.TrimSpace(datos.Nombre)
+  if nombre == "" || utf8.RuneCountInString(nombre) > 50 {
+    return "", errors.New("Error, el nombre es obligatorio y maximo de 50 caracteres.")
+  }
+  return nombre, nil
+}
+
+//postLibro crea un libro compartido, quien lo crea queda como propietario.
+//Json ejemplo{"nombre": "Casa"}
+func postLibro(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  nombre, err := leerNombreLibro(r)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  l := Libro{
+    Nombre: nombre,
+    Propietario: nombreUsuario,
+    Creado: time.Now().UTC().Truncate(time.Second),
+    Rol: "propietario",
+  }
+  
+  tx, err := db.Begin()
+  if err != nil {
+    writeError(w, "Error al iniciar la transaccion", err, http.StatusInternalServerError)
+    return
+  }
+  defer tx.Rollback()
+  
+  res, err := tx.Exec("INSERT INTO libros(nombre, propietario, creado) VALUES(?, ?, ?)", l.Nombre, l.Propietario, l.Creado.Format(time.RFC3339))
+  if err != nil {
+    writeError(w, "Error al guardar el libro", err, http.StatusInternalServerError)
+    return
+  }
+  id, _ := res.LastInsertId()
+  l.Id = int(id)
+  _, err = tx.Exec("INSERT INTO libro_miembros(libro_id, usuario, rol) VALUES(?, ?, 'propietario')", l.Id, nombreUsuario)
+  if err != nil {
+    writeError(w, "Error al guardar el propietario", err, http.StatusInternalServerError)
+    return
+  }
+  err = tx.Commit()
+  if err != nil {
+    writeError(w, "Error al guardar los cambios", err, http.StatusInternalServerError)
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(http.StatusCreated)
+  json.NewEncoder(w).Encode(l)
+}
+
+//putLibro cambia el nombre del libro.
+//ejm http://100.69.187.16:8080/libros/2
+//Json ejemplo{"nombre": "Apartamento"}
+func putLibro(w http.ResponseWriter, r *http.Request) {
+  l, ok := buscarLibroPropietario(w, r)
+  if !ok {
+    return
+  }
+  nombre, err := leerNombreLibro(r)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  
+  _, err = db.Exec("UPDATE libros SET nombre = ? WHERE id = ?", nombre, l.Id)
+  if err != nil {
+    writeError(w, "Error al actualizar el libro", err, http.StatusInternalServerError)
+    return
+  }
+  l.Nombre = nombre
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(l)
+}
+
+//deleteLibro elimina un libro compartido que ya no tenga registros. El
+//libro personal no se puede eliminar.
+//ejm http://100.69.187.16:8080/libros/2
+func deleteLibro(w http.ResponseWriter, r *http.Request) {
+  l, ok := buscarLibroPropietario(w, r)
+  if !ok {
+    return
+  }
+  if l.Personal {
+    http.Error(w, "Error, el libro personal no se puede eliminar.", http.StatusConflict)
+    return
+  }
+  
+  var enUso int
+  err := db.QueryRow("SELECT COUNT(*) FROM registros WHERE libro_id = ?", l.Id).Scan(&enUso)
+  if err != nil {
+    writeError(w, "Error al consultar los registros del libro", err, http.StatusInternalServerError)
+    return
+  }
+  if enUso > 0 {
+    http.Error(w, "Error, el libro tiene registros, elimine o mueva los registros antes.", http.StatusConflict)
+    return
+  }
+  
+  tx, err := db.Begin()
+  if err != nil {
+    writeError(w, "Error al iniciar la transaccion", err, http.StatusInternalServerError)
+    return
+  }
+  defer tx.Rollback()
+  
+  _, err = tx.Exec("DELETE FROM excepciones_recurrencia WHERE recurrencia_id IN (SELECT id FROM recurrencias WHERE libro_id = ?)", l.Id)
+  if err != nil {
+    writeError(w, "Error al eliminar los datos del libro", err, http.StatusInternalServerError)
+    return
+  }
+  for _, tabla := range []string{"presupuestos", "recurrencias", "metas", "asignaciones_sobres", "sobres"} {
+    _, err = tx.Exec("DELETE FROM " + tabla + " WHERE libro_id = ?", l.Id)
+    if err != nil {
+      writeError(w, "Error al eliminar los datos del libro", err, http.StatusInternalServerError)
+      return
+    }
+  }
+  _, err = tx.Exec("DELETE FROM libro_miembros WHERE libro_id = ?", l.Id)
+  if err != nil {
+    writeError(w, "Error al eliminar los miembros", err, http.StatusInternalServerError)
+    return
+  }
+  _, err = tx.Exec("DELETE FROM libros WHERE id = ?", l.Id)
+  if err != nil {
+    writeError(w, "Error al eliminar el libro", err, http.StatusInternalServerError)
+    return
+  }
+  err = tx.Commit()
+  if err != nil {
+    writeError(w, "Error al guardar los cambios", err, http.StatusInternalServerError)
+    return
+  }
+  w.WriteHeader(http.StatusNoContent)
+}
+
+//getMiembrosLibro lista los miembros del libro, cualquier miembro los
+//puede ver.
+//ejm http://100.69.187.16:8080/libros/2/miembros
+func getMiembrosLibro(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  id, err := strconv.Atoi(mux.Vars(r)["id"])
+  if err != nil {
+    http.Error(w, "Error, el id debe ser un numero.", http.StatusBadRequest)
+    return
+  }
+  if !permisoLibro(w, id, nombreUsuario, false) {
+    return
+  }
+  
+  rows, err := db.Query("SELECT usuario, rol FROM libro_miembros WHERE libro_id = ? ORDER BY rol = 'propietario' DESC, usuario", id)
+  if err != nil {
+    writeError(w, "Error al consultar los miembros", err, http.StatusInternalServerError)
+    return
+  }
+  defer rows.Close()
+  
+  miembros := []MiembroLibro{}
+  for rows.Next() {
+    var m MiembroLibro
+    err = rows.Scan(&m.Usuario, &m.Rol)
+    if err != nil {
+      writeError(w, "Error al escanear los miembros", err, http.StatusInternalServerError)
+      return
+    }
+    miembros = append(miembros, m)
+  }
+  if err = rows.Err(); err != nil {
+    writeError(w, "Error al consultar los miembros", err, http.StatusInternalServerError)
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(miembros)
+}
+
+//putMiembroLibro agrega un usuario al libro o le cambia el rol. Solo el
+//propietario puede, y el libro personal no se comparte.
+//ejm http://100.69.187.16:8080/libros/2/miembros/maria1
+//Json ejemplo{"rol": "editor"}
+func putMiembroLibro(w http.ResponseWriter, r *http.Request) {
+  l, ok := buscarLibroPropietario(w, r)
+  if !ok {
+    return
+  }
+  if l.Personal {
+    http.Error(w, "Error, el libro personal no se puede compartir.", http.StatusConflict)
+    return
+  }
+  
+  var m MiembroLibro
+  err := json.NewDecoder(r.Body).Decode(&m)
+  if err != nil {
+    http.Error(w, "Error al leer el json.", http.StatusBadRequest)
+    return
+  }
+  if !rolesLibro[m.Rol] {
+    http.Error(w, "Error, el rol solo puede ser editor o lector.", http.StatusBadRequest)
+    return
+  }
+  m.Usuario = mux.Vars(r)["usuario"]
+  if m.Usuario == l.Propietario {
+    http.Error(w, "Error, no se puede cambiar el rol del propietario.", http.StatusConflict)
+    return
+  }
+  
+  var existe int
+  err = db.QueryRow("SELECT COUNT(*) FROM usuarios WHERE nombre = ?", m.Usuario).Scan(&existe)
+  if err != nil {
+    writeError(w, "Error al consultar el usuario", err, http.StatusInternalServerError)
+    return
+  }
+  if existe == 0 {
+    http.Error(w, "El usuario no existe.", http.StatusNotFound)
+    return
+  }
+  
+  _, err = db.Exec(`INSERT INTO libro_miembros(libro_id, usuario, rol) VALUES(?, ?, ?)
+  ON CONFLICT(libro_id, usuario) DO UPDATE SET rol = excluded.rol`, l.Id, m.Usuario, m.Rol)
+  if err != nil {
+    writeError(w, "Error al guardar el miembro", err, http.StatusInternalServerError)
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(m)
+}
+
+//deleteMiembroLibro saca a un usuario del libro. El propietario puede sacar
+//a cualquiera y los demas solo a si mismos. Los registros que creo se
+//quedan en el libro.
+//ejm http://100.69.187.16:8080/libros/2/miembros/maria1
+func deleteMiembroLibro(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  id, err := strconv.Atoi(mux.Vars(r)["id"])
+  if err != nil {
+    http.Error(w, "Error, el id debe ser un numero.", http.StatusBadRequest)
+    return
+  }
+  usuario := mux.Vars(r)["usuario"]
+  
+  rol, err := rolEnLibro(id, nombreUsuario)
+  if err == sql.ErrNoRows {
+    http.Error(w, "El libro no existe.", http.StatusNotFound)
+    return
+  }
+  if err != nil {
+    writeError(w, "Error al consultar el libro", err, http.StatusInternalServerError)
+    return
+  }
+  if usuario != nombreUsuario && rol != "propietario" {
+    http.Error(w, "Error, solo el propietario puede sacar a otros miembros.", http.StatusForbidden)
+    return
+  }
+  
+  //el propietario no se puede sacar, tendria que eliminar el libro.
+  res, err := db.Exec("DELETE FROM libro_miembros WHERE libro_id = ? AND usuario = ? AND rol != 'propietario'", id, usuario)
+  if err != nil {
+    writeError(w, "Error al sacar al miembro", err, http.StatusInternalServerError)
+    return
+  }
+  if n, _ := res.RowsAffected(); n == 0 {
+    http.Error(w, "El usuario no es miembro del libro o es el propietario.", http.StatusNotFound)
+    return
+  }
+  w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+  "fmt"
+  "log"
+  "net/smtp"
+  "os"
+  "strings"
+  "sync"
+  "time"
+)
+
+//Mailer envia correos al usuario. Hay uno por SMTP para produccion y otro
+//que escribe los correos en un archivo o en el log para pruebas.
+type Mailer interface {
+  Enviar(para string, asunto string, cuerpo string) error
+}
+
+//mailer es el que usa la api, se elige en main con nuevoMailer.
+var mailer Mailer = MailerArchivo{}
+
+//nuevoMailer arma el mailer segun el .env. Si no hay SMTP_SERVIDOR los
+//correos van a CORREOS_ARCHIVO o al log si tampoco esta.
+func nuevoMailer() Mailer {
+  servidor := os.Getenv("SMTP_SERVIDOR")
+  if servidor == "" {
+    return MailerArchivo{Ruta: os.Getenv("CORREOS_ARCHIVO")}
+  }
+  puerto := os.Getenv("SMTP_PUERTO")
+  if puerto == "" {
+    puerto = "587"
+  }
+  return MailerSMTP{
+    Servidor: servidor,
+    Puerto: puerto,
+    Usuario: os.Getenv("SMTP_USUARIO"),
+    Clave: os.Getenv("SMTP_CLAVE"),
+    De: os.Getenv("SMTP_DE"),
+  }
+}
+
+//MailerSMTP envia los correos por un servidor SMTP con autenticacion PLAIN.
+type MailerSMTP struct {
+  Servidor string
+  Puerto string
+  Usuario string
+  Clave string
+  De string
+}
+
+func (m MailerSMTP) Enviar(para string, asunto string, cuerpo string) error {
+  //los saltos de linea en las cabeceras permitirian agregar otras.
+  if strings.ContainsAny(para + asunto, "\r\n") {
+    return fmt.Errorf("Error, el destinatario o el asunto tienen saltos de linea")
+  }
+  mensaje := "From: " + m.De + "\r\n" +
+    "To: " + para + "\r\n" +
+    "Subject: " + asunto + "\r\n" +
+    "MIME-Version: 1.0\r\n" +
+    "Content-Type: text/plain; charset=utf-8\r\n" +
+    "\r\n" + cuerpo + "\r\n"
+  
+  var auth smtp.Auth
+  if m.Usuario != "" {
+    auth = smtp.PlainAuth("", m.Usuario, m.Clave, m.Servidor)
+  }
+  err := smtp.SendMail(m.Servidor + ":" + m.Puerto, auth, m.De, []string{para}, []byte(mensaje))
+  if err != nil {
+    return fmt.Errorf("Error al enviar el correo, %v", err)
+  }
+  return nil
+}
+
+//MailerArchivo agrega cada correo al final del archivo Ruta, si Ruta esta
+//vacia lo escribe en el log.
+type MailerArchivo struct {
+  Ruta string
+}
+
+//evita que dos correos al tiempo se mezclen en el archivo.
+var muMailerArchivo sync.Mutex
+
+func (m MailerArchivo) Enviar(para string, asunto string, cuerpo string) error {
+  texto := fmt.Sprintf("Fecha: %s\nPara: %s\nAsunto: %s\n\n%s\n----\n", time.Now().Format(time.RFC3339), para, asunto, cuerpo)
+  if m.Ruta == "" {
+    log.Print("Correo\n" + texto)
+    return nil
+  }
+  
+  muMailerArchivo.Lock()
+  defer muMailerArchivo.Unlock()
+  f, err := os.OpenFile(m.Ruta, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+  if err != nil {
+    return fmt.Errorf("Error al abrir el archivo de correos, %v", err)
+  }
+  _, err = f.WriteString(texto)
+  if err != nil {
+    f.Close()
+    return fmt.Errorf("Error al escribir el correo, %v", err)
+  }
+  return f.Close()
+}
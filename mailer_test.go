@@ -0,0 +1,41 @@
+package main
+
+import (
+  "os"
+  "path/filepath"
+  "strings"
+  "testing"
+)
+
+func TestMailerArchivoAgregaCorreos(t *testing.T) {
+  ruta := filepath.Join(t.TempDir(), "correos.txt")
+  m := MailerArchivo{Ruta: ruta}
+  
+  if err := m.Enviar("ana@correo.com", "Primero", "hola"); err != nil {
+    t.Fatal(err)
+  }
+  if err := m.Enviar("luis@correo.com", "Segundo", "chao"); err != nil {
+    t.Fatal(err)
+  }
+  
+  contenido, err := os.ReadFile(ruta)
+  if err != nil {
+    t.Fatal(err)
+  }
+  texto := string(contenido)
+  //el segundo correo va despues del primero, no lo reemplaza.
+  for _, esperado := range []string{"Para: ana@correo.com", "Asunto: Primero", "hola", "Para: luis@correo.com", "Asunto: Segundo", "chao"} {
+    if !strings.Contains(texto, esperado) {
+      t.Errorf("el archivo no tiene %q:\n%s", esperado, texto)
+    }
+  }
+  if strings.Index(texto, "Primero") > strings.Index(texto, "Segundo") {
+    t.Errorf("los correos no quedaron en orden:\n%s", texto)
+  }
+}
+
+func TestMailerArchivoSinRutaNoFalla(t *testing.T) {
+  if err := (MailerArchivo{}).Enviar("ana@correo.com", "Asunto", "cuerpo"); err != nil {
+    t.Fatal(err)
+  }
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+  "database/sql"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log"
+  "math/big"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+  
+  "github.com/gorilla/mux"
+)
+
+//Meta es un ahorro con un objetivo y una fecha limite. Los aportes son
+//registros normales marcados con la meta. Con cuenta los ingresos a la
+//cuenta suman y los egresos restan, sin cuenta es al reves: los egresos
+//son la plata que se aparta, ejm al grupo Ahorro.
+type Meta struct {
+  Id int `json:"id"`
+  Libro int `json:"libro"`
+  Nombre string `json:"nombre"`
+  Objetivo Dinero `json:"objetivo"`
+  Moneda string `json:"moneda"`
+  FechaLimite time.Time `json:"fechaLimite"`
+  Grupo string `json:"grupo,omitempty"`
+  Cuenta int `json:"cuenta,omitempty"`
+}
+
+//EstadoMeta es el avance de la meta hoy. AporteMensual es lo que falta
+//repartido en los meses que quedan, contando el actual y el de la fecha
+//limite. RitmoMensual es el promedio de lo aportado por mes desde el
+//primer aporte y FechaEstimada es cuando se llega a ese ritmo.
+type EstadoMeta struct {
+  Meta
+  Aportado Dinero `json:"aportado"`
+  Faltante Dinero `json:"faltante"`
+  Porcentaje int `json:"porcentaje"`
+  Completada bool `json:"completada"`
+  MesesRestantes int `json:"mesesRestantes"`
+  AporteMensual Dinero `json:"aporteMensual"`
+  RitmoMensual Dinero `json:"ritmoMensual"`
+  FechaEstimada *time.Time `json:"fechaEstimada,omitempty"`
+  EnCamino bool `json:"enCamino"`
+}
+
+//initMetas crea la tabla de metas y agrega a los registros la meta a la
+//que aportan.
+func initMetas() {
+  crearTablaMetas := `
+  CREATE TABLE IF NOT EXISTS metas(
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  libro_id INTEGER NOT NULL REFERENCES libros(id),
+  usuario TEXT NOT NULL,
+  nombre TEXT NOT NULL,
+  objetivo INTEGER NOT NULL,
+  moneda TEXT NOT NULL,
+  fecha_limite DATETIME NOT NULL,
+  grupo TEXT NOT NULL DEFAULT '',
+  cuenta_id INTEGER REFERENCES cuentas(id)
+  );`
+  
+  _, err := db.Exec(crearTablaMetas)
+  if err != nil {
+    log.Fatal("Error creando la tabla metas", err)
+  }
+  agregarColumna("registros", "meta_id", "INTEGER REFERENCES metas(id)")
+}
+
+//leerMeta lee y valida la meta del body. La cuenta debe ser del libro y
+//la moneda es la de la cuenta, el grupo debe ser una categoria del
+//usuario. Si hay error ya lo escribe en w y retorna false.
+func leerMeta(w http.ResponseWriter, r *http.Request, libro int) (Meta, bool) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  var m Meta
+  err := json.NewDecoder(r.Body).Decode(&m)
+  if err != nil {
+    http.Error(w, "Error al leer el json.", http.StatusBadRequest)
+    return m, false
+  }
+  m.Libro = libro
+  m.Nombre = strings.TrimSpace(m.Nombre)
+  if m.Nombre == "" || m.FechaLimite.IsZero() {
+    http.Error(w, "Error, el nombre y la fecha limite son obligatorios.", http.StatusBadRequest)
+    return m, false
+  }
+  m.FechaLimite = soloDia(m.FechaLimite)
+  
+  m.Moneda = strings.ToUpper(m.Moneda)
+  if m.Cuenta != 0 {
+    var monedaCuenta string
+    err = db.QueryRow("SELECT moneda FROM cuentas WHERE id = ? AND libro_id = ?", m.Cuenta, libro).Scan(&monedaCuenta)
+    if err == sql.ErrNoRows {
+      http.Error(w, "Error, la cuenta no existe en el libro.", http.StatusUnprocessableEntity)
+      return m, false
+    }
+    if err != nil {
+      writeError(w, "Error al consultar la cuenta", err, http.StatusInternalServerError)
+      return m, false
+    }
+    if m.Moneda != "" && m.Moneda != monedaCuenta {
+      http.Error(w, "Error, la moneda de la meta debe ser la de su cuenta.", http.StatusUnprocessableEntity)
+      return m, false
+    }
+    m.Moneda = monedaCuenta
+  }
+  if m.Moneda == "" {
+    m.Moneda = monedaBase()
+  }
+  if !regMoneda.MatchString(m.Moneda) {
+    http.Error(w, "Error, la moneda debe ser un codigo de 3 letras, ejm COP.", http.StatusBadRequest)
+    return m, false
+  }
+  objetivo, err := m.Objetivo.Escalar(exponenteMoneda(m.Moneda))
+  if err != nil || objetivo.Unidades <= 0 {
+    http.Error(w, "Error, el objetivo debe ser mayor a 0 y con los decimales de la moneda.", http.StatusBadRequest)
+    return m, false
+  }
+  m.Objetivo = objetivo
+  
+  if strings.TrimSpace(m.Grupo) != "" {
+    nombre, err := resolverCategoria(nombreUsuario, m.Grupo, false)
+    if errors.Is(err, errCategoriaNoExiste) {
+      writeError(w, "Error en el grupo " + m.Grupo, err, http.StatusUnprocessableEntity)
+      return m, false
+    }
+    if err != nil {
+      writeError(w, "Error al consultar la categoria", err, http.StatusInternalServerError)
+      return m, false
+    }
+    m.Grupo = nombre
+  }
+  return m, true
+}
+
+//columnas en el orden que las lee escanearMeta.
+const columnasMeta = "id, libro_id, nombre, objetivo, moneda, fecha_limite, grupo, COALESCE(cuenta_id, 0)"
+
+//escanearMeta lee una meta con las columnas de columnasMeta.
+func escanearMeta(s escaner) (m Meta, err error) {
+  err = s.Scan(&m.Id, &m.Libro, &m.Nombre, &m.Objetivo.Unidades, &m.Moneda, &m.FechaLimite, &m.Grupo, &m.Cuenta)
+  m.Objetivo.Exponente = exponenteMoneda(m.Moneda)
+  return
+}
+
+//buscarMeta retorna la meta si esta en un libro del usuario. Con escritura
+//exige que pueda modificar el libro. Si no responde el error y retorna
+//false.
+func buscarMeta(w http.ResponseWriter, r *http.Request, escritura bool) (Meta, bool) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  id, err := strconv.Atoi(mux.Vars(r)["id"])
+  if err != nil {
+    http.Error(w, "Error, el id debe ser un numero.", http.StatusBadRequest)
+    return Meta{}, false
+  }
+  m, err := escanearMeta(db.QueryRow("SELECT " + columnasMeta + " FROM metas WHERE id = ? AND " + condicionMiembro, id, nombreUsuario))
+  if err == sql.ErrNoRows {
+    http.Error(w, "La meta no existe.", http.StatusNotFound)
+    return m, false
+  }
+  if err != nil {
+    writeError(w, "Error al consultar la meta", err, http.StatusInternalServerError)
+    return m, false
+  }
+  if escritura && !permisoLibro(w, m.Libro, nombreUsuario, true) {
+    return m, false
+  }
+  return m, true
+}
+
+//validarMetaRegistro revisa que la meta del registro sea del mismo libro
+//y que el registro tenga la cuenta y el grupo de la meta si los tiene. Sin
+//meta no revisa nada. Si responde un error retorna false.
+func validarMetaRegistro(w http.ResponseWriter, m Registro) bool {
+  if m.Meta == 0 {
+    return true
+  }
+  var grupo string
+  var cuenta int
+  err := db.QueryRow("SELECT grupo, COALESCE(cuenta_id, 0) FROM metas WHERE id = ? AND libro_id = ?", m.Meta, m.Libro).Scan(&grupo, &cuenta)
+  if err == sql.ErrNoRows {
+    http.Error(w, "Error, la meta no existe en el libro del registro.", http.StatusUnprocessableEntity)
+    return false
+  }
+  if err != nil {
+    writeError(w, "Error al consultar la meta", err, http.StatusInternalServerError)
+    return false
+  }
+  if cuenta != 0 && m.Cuenta != cuenta {
+    http.Error(w, "Error, los aportes a la meta deben ser de su cuenta.", http.StatusUnprocessableEntity)
+    return false
+  }
+  if grupo != "" && m.Grupo != grupo {
+    http.Error(w, "Error, los aportes a la meta deben ser del grupo " + grupo + ".", http.StatusUnprocessableEntity)
+    return false
+  }
+  return true
+}
+
+//getMetas lista las metas del libro.
+//ejm http://100.69.187.16:8080/metas?libro=2
+func getMetas(w http.ResponseWriter, r *http.Request) {
+  libro, ok := libroPeticion(w, r, false)
+  if !ok {
+    return
+  }
+  rows, err := db.Query("SELECT " + columnasMeta + " FROM metas WHERE libro_id = ? ORDER BY fecha_limite, id", libro)
+  if err != nil {
+    writeError(w, "Error al consultar las metas", err, http.StatusInternalServerError)
+    return
+  }
+  defer rows.Close()
+  
+  metas := []Meta{}
+  for rows.Next() {
+    m, err := escanearMeta(rows)
+    if err != nil {
+      writeError(w, "Error al escanear las metas", err, http.StatusInternalServerError)
+      return
+    }
+    metas = append(metas, m)
+  }
+  if err = rows.Err(); err != nil {
+    writeError(w, "Error al consultar las metas", err, http.StatusInternalServerError)
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(metas)
+}
+
+//postMeta crea la meta en el libro.
+//ejm http://100.69.187.16:8080/metas?libro=2
+//Json ejemplo{"nombre": "Viaje", "objetivo": 5000000, "fechaLimite": "2025-12-01T00:00:00Z", "cuenta": 3}
+func postMeta(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  libro, ok := libroPeticion(w, r, true)
+  if !ok {
+    return
+  }
+  m, ok := leerMeta(w, r, libro)
+  if !ok {
+    return
+  }
+  
+  res, err := db.Exec("INSERT INTO metas(libro_id, usuario, nombre, objetivo, moneda, fecha_limite, grupo, cuenta_id) VALUES(?, ?, ?, ?, ?, ?, ?, NULLIF(?, 0))",
+    m.Libro, nombreUsuario, m.Nombre, m.Objetivo.Unidades, m.Moneda, m.FechaLimite, m.Grupo, m.Cuenta)
+  if err != nil {
+    writeError(w, "Error al guardar la meta", err, http.StatusInternalServerError)
+    return
+  }
+  id, _ := res.LastInsertId()
+  m.Id = int(id)
+  
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(http.StatusCreated)
+  json.NewEncoder(w).Encode(m)
+}
+
+//putMeta actualiza la meta, el libro no cambia. Los aportes que ya tiene
+//se quedan aunque cambie la cuenta o el grupo.
+//ejm http://100.69.187.16:8080/metas/5
+//Json ejemplo{"nombre": "Viaje", "objetivo": 6000000, "fechaLimite": "2026-03-01T00:00:00Z", "cuenta": 3}
+func putMeta(w http.ResponseWriter, r *http.Request) {
+  anterior, ok := buscarMeta(w, r, true)
+  if !ok {
+    return
+  }
+  m, ok := leerMeta(w, r, anterior.Libro)
+  if !ok {
+    return
+  }
+  m.Id = anterior.Id
+  
+  _, err := db.Exec("UPDATE metas SET nombre = ?, objetivo = ?, moneda = ?, fecha_limite = ?, grupo = ?, cuenta_id = NULLIF(?, 0) WHERE id = ?",
+    m.Nombre, m.Objetivo.Unidades, m.Moneda, m.FechaLimite, m.Grupo, m.Cuenta, m.Id)
+  if err != nil {
+    writeError(w, "Error al actualizar la meta", err, http.StatusInternalServerError)
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(m)
+}
+
+//deleteMeta elimina la meta, sus aportes quedan como registros normales.
+//ejm http://100.69.187.16:8080/metas/5
+func deleteMeta(w http.ResponseWriter, r *http.Request) {
+  m, ok := buscarMeta(w, r, true)
+  if !ok {
+    return
+  }
+  
+  tx, err := db.Begin()
+  if err != nil {
+    writeError(w, "Error al iniciar la transaccion", err, http.StatusInternalServerError)
+    return
+  }
+  defer tx.Rollback()
+  
+  _, err = tx.Exec("UPDATE registros SET meta_id = NULL WHERE meta_id = ?", m.Id)
+  if err != nil {
+    writeError(w, "Error al actualizar los aportes de la meta", err, http.StatusInternalServerError)
+    return
+  }
+  _, err = tx.Exec("DELETE FROM metas WHERE id = ?", m.Id)
+  if err != nil {
+    writeError(w, "Error al eliminar la meta", err, http.StatusInternalServerError)
+    return
+  }
+  err = tx.Commit()
+  if err != nil {
+    writeError(w, "Error al guardar los cambios", err, http.StatusInternalServerError)
+    return
+  }
+  w.WriteHeader(http.StatusNoContent)
+}
+
+//getMeta responde la meta con su avance, lo que hay que aportar por mes
+//para llegar a la fecha limite y cuando se llega al ritmo de hoy.
+//ejm http://100.69.187.16:8080/metas/5
+func getMeta(w http.ResponseWriter, r *http.Request) {
+  m, ok := buscarMeta(w, r, false)
+  if !ok {
+    return
+  }
+  e, err := estadoMeta(m, soloDia(time.Now()))
+  if err != nil {
+    writeError(w, "Error al calcular el avance de la meta", err, statusConversion(err))
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(e)
+}
+
+//aportesMeta suma los aportes de la meta hasta hoy en su moneda, con la
+//tasa del dia de cada registro, y retorna el dia del primer aporte.
+func aportesMeta(m Meta, hoy time.Time) (*big.Rat, time.Time, error) {
+  rows, err := db.Query("SELECT tipo, moneda, exponente, substr(fecha, 1, 10), SUM(monto) FROM registros WHERE meta_id = ? AND fecha <= ? GROUP BY 1, 2, 3, 4 ORDER BY 4", m.Id, hoy)
+  if err != nil {
+    return nil, time.Time{}, fmt.Errorf("Error al sumar los aportes, %v", err)
+  }
+  defer rows.Close()
+  
+  //con cuenta aportan los ingresos, sin cuenta los egresos.
+  tipoAporte := "egreso"
+  if m.Cuenta != 0 {
+    tipoAporte = "ingreso"
+  }
+  conv := nuevoConversor(m.Moneda)
+  aportado := new(big.Rat)
+  var primero time.Time
+  for rows.Next() {
+    var tipo, moneda, dia string
+    var monto Dinero
+    err = rows.Scan(&tipo, &moneda, &monto.Exponente, &dia, &monto.Unidades)
+    if err != nil {
+      return nil, time.Time{}, fmt.Errorf("Error al escanear los aportes, %v", err)
+    }
+    convertido, err := conv.convertir(monto, moneda, dia)
+    if err != nil {
+      return nil, time.Time{}, err
+    }
+    if tipo != tipoAporte {
+      convertido.Neg(convertido)
+    }
+    aportado.Add(aportado, convertido)
+    if primero.IsZero() {
+      primero, _ = time.Parse("2006-01-02", dia)
+    }
+  }
+  return aportado, primero, rows.Err()
+}
+
+//mesesEntre cuenta los meses de desde a hasta incluyendo los dos, ejm de
+//octubre a diciembre son 3. Si hasta es antes de desde retorna 0.
+func mesesEntre(desde time.Time, hasta time.Time) int {
+  if hasta.Before(desde) {
+    return 0
+  }
+  return (hasta.Year() - desde.Year()) * 12 + int(hasta.Month()) - int(desde.Month()) + 1
+}
+
+//estadoMeta calcula el avance de la meta al dia hoy.
+func estadoMeta(m Meta, hoy time.Time) (EstadoMeta, error) {
+  aportado, primero, err := aportesMeta(m, hoy)
+  if err != nil {
+    return EstadoMeta{}, err
+  }
+  
+  exponente := m.Objetivo.Exponente
+  faltante := new(big.Rat).Sub(m.Objetivo.Rat(), aportado)
+  if faltante.Sign() < 0 {
+    faltante.SetInt64(0)
+  }
+  e := EstadoMeta{
+    Meta: m,
+    Aportado: dineroDeRat(aportado, exponente),
+    Faltante: dineroDeRat(faltante, exponente),
+    Completada: faltante.Sign() == 0,
+    MesesRestantes: mesesEntre(hoy, m.FechaLimite),
+    RitmoMensual: Dinero{0, exponente},
+  }
+  
+  //el porcentaje va sin decimales y hacia abajo igual que en presupuestos.
+  porcentaje := new(big.Rat).Quo(new(big.Rat).Mul(aportado, big.NewRat(100, 1)), m.Objetivo.Rat())
+  e.Porcentaje = int(new(big.Int).Quo(porcentaje.Num(), porcentaje.Denom()).Int64())
+  
+  //si ya paso la fecha limite lo que falta hay que ponerlo de una vez.
+  e.AporteMensual = e.Faltante
+  if e.MesesRestantes > 1 {
+    mensual := new(big.Rat).Quo(faltante, big.NewRat(int64(e.MesesRestantes), 1))
+    e.AporteMensual = dineroDeRat(mensual, exponente)
+  }
+  
+  if e.Completada {
+    e.EnCamino = true
+    return e, nil
+  }
+  if primero.IsZero() || aportado.Sign() <= 0 {
+    return e, nil
+  }
+  ritmo := new(big.Rat).Quo(aportado, big.NewRat(int64(mesesEntre(primero, hoy)), 1))
+  e.RitmoMensual = dineroDeRat(ritmo, exponente)
+  
+  //meses que faltan al ritmo de hoy, redondeado hacia arriba.
+  meses := new(big.Rat).Quo(faltante, ritmo)
+  faltanMeses := new(big.Int).Quo(meses.Num(), meses.Denom())
+  if !meses.IsInt() {
+    faltanMeses.Add(faltanMeses, big.NewInt(1))
+  }
+  //mas de 100 años no es una fecha que sirva.
+  if faltanMeses.Cmp(big.NewInt(1200)) <= 0 {
+    estimada := hoy.AddDate(0, int(faltanMeses.Int64()), 0)
+    e.FechaEstimada = &estimada
+    e.EnCamino = !estimada.After(m.FechaLimite)
+  }
+  return e, nil
+}
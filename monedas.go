@@ -0,0 +1,395 @@
+package main
+
+import (
+  "bytes"
+  "database/sql"
+  "encoding/csv"
+  "encoding/json"
+  "encoding/xml"
+  "errors"
+  "fmt"
+  "io"
+  "log"
+  "math/big"
+  "net/http"
+  "os"
+  "strings"
+  "time"
+)
+
+//TasaCambio es lo que vale una unidad de Base en Moneda desde Fecha. La
+//tasa se guarda como fraccion para no perder decimales al convertir.
+type TasaCambio struct {
+  Base string `json:"base"`
+  Moneda string `json:"moneda"`
+  Fecha string `json:"fecha"`
+  Tasa string `json:"tasa"`
+}
+
+//errSinTasa se retorna cuando no hay una tasa para convertir, el handler
+//responde 422 en vez de 500.
+var errSinTasa = errors.New("no hay tasa de cambio")
+
+//monedaBase es la moneda de los registros que no indican una, se cambia
+//con MONEDA_BASE en el .env.
+func monedaBase() string {
+  moneda := os.Getenv("MONEDA_BASE")
+  if moneda == "" {
+    return "COP"
+  }
+  return moneda
+}
+
+//initMonedas agrega la moneda a los registros y crea la tabla de tasas.
+//Los registros que ya estaban quedan en la moneda base.
+func initMonedas() {
+  if !regMoneda.MatchString(monedaBase()) {
+    log.Fatal("Error, MONEDA_BASE debe ser un codigo de 3 letras, ejm COP")
+  }
+  agregarColumna("registros", "moneda", "TEXT NOT NULL DEFAULT '" + monedaBase() + "'")
+  
+  crearTablaTasas := `
+  CREATE TABLE IF NOT EXISTS tasas_cambio(
+  base TEXT NOT NULL,
+  moneda TEXT NOT NULL,
+  fecha TEXT NOT NULL,
+  tasa TEXT NOT NULL,
+  PRIMARY KEY(base, moneda, fecha)
+  );`
+  
+  _, err := db.Exec(crearTablaTasas)
+  if err != nil {
+    log.Fatal("Error creando la tabla tasas_cambio", err)
+  }
+}
+
+//leerMoneda lee ?moneda= para convertir los montos, sin ella se usa la
+//moneda base.
+func leerMoneda(r *http.Request) (string, error) {
+  moneda := strings.ToUpper(r.URL.Query().Get("moneda"))
+  if moneda == "" {
+    return monedaBase(), nil
+  }
+  if !regMoneda.MatchString(moneda) {
+    return "", fmt.Errorf("Error, la moneda debe ser un codigo de 3 letras, ejm COP")
+  }
+  return moneda, nil
+}
+
+//statusConversion da 422 si faltaba una tasa y 500 para lo demas.
+func statusConversion(err error) int {
+  if errors.Is(err, errSinTasa) {
+    return http.StatusUnprocessableEntity
+  }
+  return http.StatusInternalServerError
+}
+
+//resolverMoneda deja la moneda del registro en mayusculas. Sin moneda
+//toma la de su cuenta o la base, con cuenta debe ser la de la cuenta. El
+//monto queda con los decimales de la moneda. Si responde un error retorna
+//false.
+func resolverMoneda(w http.ResponseWriter, m *Registro) bool {
+  m.Moneda = strings.ToUpper(m.Moneda)
+  monedaCuenta := ""
+  if m.Cuenta != 0 {
+    err := db.QueryRow("SELECT moneda FROM cuentas WHERE id = ?", m.Cuenta).Scan(&monedaCuenta)
+    if err != nil && err != sql.ErrNoRows {
+      writeError(w, "Error al consultar la cuenta", err, http.StatusInternalServerError)
+      return false
+    }
+  }
+  if m.Moneda == "" {
+    m.Moneda = monedaCuenta
+  }
+  if m.Moneda == "" {
+    m.Moneda = monedaBase()
+  }
+  if !regMoneda.MatchString(m.Moneda) {
+    http.Error(w, "Error, la moneda debe ser un codigo de 3 letras, ejm COP.", http.StatusUnprocessableEntity)
+    return false
+  }
+  if monedaCuenta != "" && m.Moneda != monedaCuenta {
+    http.Error(w, "Error, la moneda del registro debe ser la de su cuenta.", http.StatusUnprocessableEntity)
+    return false
+  }
+  monto, err := m.Monto.Escalar(exponenteMoneda(m.Moneda))
+  if err != nil {
+    writeError(w, "Error en el monto para " + m.Moneda, err, http.StatusUnprocessableEntity)
+    return false
+  }
+  m.Monto = monto
+  return true
+}
+
+//buscarTasa retorna la ultima tasa de base a moneda vigente en el dia.
+func buscarTasa(base string, moneda string, dia string) (*big.Rat, bool, error) {
+  var texto string
+  err := db.QueryRow("SELECT tasa FROM tasas_cambio WHERE base = ? AND moneda = ? AND fecha <= ? ORDER BY fecha DESC LIMIT 1",
+    base, moneda, dia).Scan(&texto)
+  if err == sql.ErrNoRows {
+    return nil, false, nil
+  }
+  if err != nil {
+    return nil, false, fmt.Errorf("Error al consultar la tasa de cambio, %v", err)
+  }
+  tasa, ok := new(big.Rat).SetString(texto)
+  if !ok {
+    return nil, false, fmt.Errorf("Error, la tasa guardada de %s a %s no es un numero", base, moneda)
+  }
+  return tasa, true, nil
+}
+
+//tasaCambio retorna cuanto vale una unidad de la moneda de en la moneda a
+//en el dia (AAAA-MM-DD). Busca la tasa directa, la inversa o pasando por
+//una tercera moneda que tenga tasa para las dos, como el EUR del BCE.
+func tasaCambio(de string, a string, dia string) (*big.Rat, error) {
+  if de == a {
+    return big.NewRat(1, 1), nil
+  }
+  tasa, ok, err := buscarTasa(de, a, dia)
+  if err != nil || ok {
+    return tasa, err
+  }
+  tasa, ok, err = buscarTasa(a, de, dia)
+  if err != nil {
+    return nil, err
+  }
+  if ok {
+    return tasa.Inv(tasa), nil
+  }
+  
+  //las bases que tienen tasa para las dos monedas.
+  rows, err := db.Query("SELECT base FROM tasas_cambio WHERE moneda IN (?, ?) AND fecha <= ? GROUP BY base HAVING COUNT(DISTINCT moneda) = 2 ORDER BY base",
+    de, a, dia)
+  if err != nil {
+    return nil, fmt.Errorf("Error al consultar las tasas de cambio, %v", err)
+  }
+  var bases []string
+  for rows.Next() {
+    var base string
+    err = rows.Scan(&base)
+    if err != nil {
+      rows.Close()
+      return nil, fmt.Errorf("Error al escanear las tasas de cambio, %v", err)
+    }
+    bases = append(bases, base)
+  }
+  rows.Close()
+  if len(bases) > 0 {
+    tasaDe, _, err := buscarTasa(bases[0], de, dia)
+    if err != nil {
+      return nil, err
+    }
+    tasaA, _, err := buscarTasa(bases[0], a, dia)
+    if err != nil {
+      return nil, err
+    }
+    return new(big.Rat).Quo(tasaA, tasaDe), nil
+  }
+  return nil, fmt.Errorf("%w de %s a %s para el %s", errSinTasa, de, a, dia)
+}
+
+//conversor pasa montos a una moneda con la tasa del dia de cada uno.
+//Guarda las tasas que ya consulto para no repetir la consulta.
+type conversor struct {
+  moneda string
+  tasas map[[2]string]*big.Rat
+}
+
+//nuevoConversor crea un conversor a la moneda sin tasas guardadas.
+func nuevoConversor(moneda string) *conversor {
+  return &conversor{moneda: moneda, tasas: map[[2]string]*big.Rat{}}
+}
+
+//convertir retorna el monto en la unidad mayor de la moneda del conversor,
+//sin redondear. El dia es el texto AAAA-MM-DD de la fecha del registro.
+func (c *conversor) convertir(monto Dinero, moneda string, dia string) (*big.Rat, error) {
+  clave := [2]string{moneda, dia}
+  tasa, ok := c.tasas[clave]
+  if !ok {
+    var err error
+    tasa, err = tasaCambio(moneda, c.moneda, dia)
+    if err != nil {
+      return nil, err
+    }
+    c.tasas[clave] = tasa
+  }
+  return new(big.Rat).Mul(monto.Rat(), tasa), nil
+}
+
+//leerTasasCSV lee un csv con encabezado fecha,base,moneda,tasa en cualquier
+//orden. La fecha es AAAA-MM-DD y la tasa es lo que vale 1 base en moneda.
+func leerTasasCSV(contenido []byte) ([]TasaCambio, error) {
+  reader := csv.NewReader(bytes.NewReader(contenido))
+  reader.TrimLeadingSpace = true
+  encabezado, err := reader.Read()
+  if err != nil {
+    return nil, fmt.Errorf("Error al leer el encabezado, %v", err)
+  }
+  columnas := map[string]int{}
+  for i, nombre := range encabezado {
+    columnas[strings.ToLower(strings.TrimSpace(nombre))] = i
+  }
+  for _, nombre := range []string{"fecha", "base", "moneda", "tasa"} {
+    if _, ok := columnas[nombre]; !ok {
+      return nil, fmt.Errorf("Error, falta la columna %s", nombre)
+    }
+  }
+  
+  var tasas []TasaCambio
+  for linea := 2; ; linea++ {
+    campos, err := reader.Read()
+    if err == io.EOF {
+      break
+    }
+    if err != nil {
+      return nil, fmt.Errorf("Error en la linea %d, %v", linea, err)
+    }
+    t := TasaCambio{
+      Base: campos[columnas["base"]],
+      Moneda: campos[columnas["moneda"]],
+      Fecha: campos[columnas["fecha"]],
+      Tasa: campos[columnas["tasa"]],
+    }
+    tasas = append(tasas, t)
+  }
+  return tasas, nil
+}
+
+//archivoBCE es el xml de tasas del Banco Central Europeo, todas con base
+//EUR. ejm https://www.ecb.europa.eu/stats/eurofxref/eurofxref-hist-90d.xml
+type archivoBCE struct {
+  Dias []struct {
+    Fecha string `xml:"time,attr"`
+    Tasas []struct {
+      Moneda string `xml:"currency,attr"`
+      Tasa string `xml:"rate,attr"`
+    } `xml:"Cube"`
+  } `xml:"Cube>Cube"`
+}
+
+//leerTasasBCE pasa el xml del BCE a tasas con base EUR.
+func leerTasasBCE(contenido []byte) ([]TasaCambio, error) {
+  var archivo archivoBCE
+  err := xml.Unmarshal(contenido, &archivo)
+  if err != nil {
+    return nil, fmt.Errorf("Error al leer el xml, %v", err)
+  }
+  var tasas []TasaCambio
+  for _, dia := range archivo.Dias {
+    for _, t := range dia.Tasas {
+      tasas = append(tasas, TasaCambio{Base: "EUR", Moneda: t.Moneda, Fecha: dia.Fecha, Tasa: t.Tasa})
+    }
+  }
+  if len(tasas) == 0 {
+    return nil, fmt.Errorf("Error, el xml no tiene tasas")
+  }
+  return tasas, nil
+}
+
+//validarTasa revisa la tasa y la deja lista para guardar, con la moneda en
+//mayusculas y la tasa como fraccion.
+func validarTasa(t *TasaCambio) error {
+  t.Base = strings.ToUpper(strings.TrimSpace(t.Base))
+  t.Moneda = strings.ToUpper(strings.TrimSpace(t.Moneda))
+  if !regMoneda.MatchString(t.Base) || !regMoneda.MatchString(t.Moneda) || t.Base == t.Moneda {
+    return fmt.Errorf("las monedas deben ser dos codigos de 3 letras distintos")
+  }
+  fecha, err := time.Parse("2006-01-02", strings.TrimSpace(t.Fecha))
+  if err != nil {
+    return fmt.Errorf("la fecha debe ser AAAA-MM-DD")
+  }
+  t.Fecha = fecha.Format("2006-01-02")
+  tasa, ok := new(big.Rat).SetString(strings.TrimSpace(t.Tasa))
+  if !ok || tasa.Sign() <= 0 {
+    return fmt.Errorf("la tasa debe ser un numero mayor a 0")
+  }
+  t.Tasa = tasa.RatString()
+  return nil
+}
+
+//postTasas carga tasas de cambio desde un csv (fecha,base,moneda,tasa) o el
+//xml del BCE. Las tasas de un dia que ya existian se reemplazan.
+//ejm http://100.69.187.16:8080/admin/tasas con el archivo en el campo archivo
+func postTasas(w http.ResponseWriter, r *http.Request) {
+  r.Body = http.MaxBytesReader(w, r.Body, maxImportacion)
+  contenido, _, err := leerArchivoImportar(r)
+  if err != nil {
+    writeError(w, "Error al leer el archivo", err, http.StatusBadRequest)
+    return
+  }
+  
+  var tasas []TasaCambio
+  if bytes.HasPrefix(bytes.TrimSpace(contenido), []byte("<")) {
+    tasas, err = leerTasasBCE(contenido)
+  } else {
+    tasas, err = leerTasasCSV(contenido)
+  }
+  if err != nil {
+    writeError(w, "Error en el archivo de tasas", err, http.StatusUnprocessableEntity)
+    return
+  }
+  for i := range tasas {
+    err = validarTasa(&tasas[i])
+    if err != nil {
+      writeError(w, fmt.Sprintf("Error en la tasa %d", i + 1), err, http.StatusUnprocessableEntity)
+      return
+    }
+  }
+  
+  tx, err := db.Begin()
+  if err != nil {
+    writeError(w, "Error al iniciar la transaccion", err, http.StatusInternalServerError)
+    return
+  }
+  defer tx.Rollback()
+  for _, t := range tasas {
+    _, err = tx.Exec("INSERT OR REPLACE INTO tasas_cambio(base, moneda, fecha, tasa) VALUES(?, ?, ?, ?)", t.Base, t.Moneda, t.Fecha, t.Tasa)
+    if err != nil {
+      writeError(w, "Error al guardar las tasas", err, http.StatusInternalServerError)
+      return
+    }
+  }
+  err = tx.Commit()
+  if err != nil {
+    writeError(w, "Error al guardar las tasas", err, http.StatusInternalServerError)
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(map[string]int{"cargadas": len(tasas)})
+}
+
+//getTasa responde la tasa que se usa para convertir en la fecha, sin fecha
+//es la de hoy.
+//ejm http://100.69.187.16:8080/tasas?de=USD&a=COP&fecha=2024-12-05T00:00:00Z
+func getTasa(w http.ResponseWriter, r *http.Request) {
+  de := strings.ToUpper(r.URL.Query().Get("de"))
+  a := strings.ToUpper(r.URL.Query().Get("a"))
+  if a == "" {
+    a = monedaBase()
+  }
+  if !regMoneda.MatchString(de) || !regMoneda.MatchString(a) {
+    http.Error(w, "Error, de y a deben ser codigos de 3 letras, ejm USD.", http.StatusBadRequest)
+    return
+  }
+  fecha := time.Now().UTC()
+  if r.URL.Query().Get("fecha") != "" {
+    var err error
+    fecha, err = leerFecha(r, "fecha")
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusBadRequest)
+      return
+    }
+  }
+  
+  dia := fecha.Format("2006-01-02")
+  tasa, err := tasaCambio(de, a, dia)
+  if err != nil {
+    writeError(w, "Error al consultar la tasa", err, statusConversion(err))
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(TasaCambio{Base: de, Moneda: a, Fecha: dia, Tasa: tasa.FloatString(8)})
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+  "encoding/base64"
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+)
+
+//Limites de registros por pagina en /movimientos.
+const (
+  limitePorDefecto = 50
+  limiteMaximo = 200
+)
+
+//Pagina es el sobre con el que se responde un listado paginado. Siguiente
+//y Anterior son los cursores que se pasan en ?cursor= para moverse.
+type Pagina struct {
+  Datos []Registro `json:"datos"`
+  Total int `json:"total"`
+  Siguiente string `json:"siguiente,omitempty"`
+  Anterior string `json:"anterior,omitempty"`
+}
+
+//cursor guarda el ultimo registro visto (valor de la columna de orden y id)
+//y si la pagina se pide hacia atras. Viaja en base64 para el cliente.
+type cursor struct {
+  Valor string `json:"v"`
+  Id int `json:"id"`
+  Atras bool `json:"a,omitempty"`
+}
+
+//FiltroMovimientos tiene los filtros y el orden que se pueden pedir al
+//listar. Los punteros en nil significan que no se filtra por ese campo.
+type FiltroMovimientos struct {
+  Tipo string
+  Grupo string
+  Texto string
+  MontoMin *int64
+  MontoMax *int64
+  Desde *time.Time
+  Hasta *time.Time
+  Orden string
+  Desc bool
+  Limite int
+  Cursor *cursor
+}
+
+//getMovimientos lista los registros del usuario paginados por cursor.
+//ejm http://100.69.187.16:8080/movimientos?tipo=egreso&grupo=comida&montoMin=1000&q=mercado&orden=-fecha&limite=20
+//Para la siguiente pagina se pasa el cursor que llega en "siguiente".
+func getMovimientos(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  //leemos y validamos los filtros de la URL.
+  f, err := leerFiltroMovimientos(r)
+  if err != nil {
+    writeError(w, "Error en los filtros", err, http.StatusBadRequest)
+    return
+  }
+  
+  libro, ok := libroPeticion(w, r, false)
+  if !ok {
+    return
+  }
+  
+  //consultamos la pagina y el total de registros con esos filtros.
+  pagina, err := getPaginaMovimientos(f, libro, nombreUsuario)
+  if err != nil {
+    writeError(w, "Error al consultar los registros", err, http.StatusInternalServerError)
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(http.StatusOK)
+  json.NewEncoder(w).Encode(pagina)
+}
+
+//leerFiltroMovimientos arma el filtro con los parametros de la URL.
+func leerFiltroMovimientos(r *http.Request) (f FiltroMovimientos, err error) {
+  q := r.URL.Query()
+  
+  f.Tipo = q.Get("tipo")
+  if f.Tipo != "" && f.Tipo != "ingreso" && f.Tipo != "egreso" {
+    return f, fmt.Errorf("el tipo solo puede ser ingreso o egreso")
+  }
+  f.Grupo = q.Get("grupo")
+  f.Texto = q.Get("q")
+  
+  //rango de montos, se guardan en diezmilesimas como montoNormalizado.
+  for nombre, destino := range map[string]**int64{"montoMin": &f.MontoMin, "montoMax": &f.MontoMax} {
+    if q.Get(nombre) == "" {
+      continue
+    }
+    monto, err := leerDinero(q.Get(nombre))
+    if err != nil {
+      return f, fmt.Errorf("%s debe ser un numero, %v", nombre, err)
+    }
+    normalizado := monto.Normalizado()
+    *destino = &normalizado
+  }
+  
+  //rango de fechas en el mismo formato del resto de la api.
+  for nombre, destino := range map[string]**time.Time{"desde": &f.Desde, "hasta": &f.Hasta} {
+    if q.Get(nombre) == "" {
+      continue
+    }
+    fecha, err := leerFecha(r, nombre)
+    if err != nil {
+      return f, err
+    }
+    *destino = &fecha
+  }
+  
+  //el orden es fecha o monto, con "-" adelante es descendente.
+  //Por defecto los mas recientes primero.
+  orden := q.Get("orden")
+  if orden == "" {
+    orden = "-fecha"
+  }
+  f.Desc = strings.HasPrefix(orden, "-")
+  f.Orden = strings.TrimPrefix(orden, "-")
+  if f.Orden != "fecha" && f.Orden != "monto" {
+    return f, fmt.Errorf("el orden solo puede ser fecha, -fecha, monto o -monto")
+  }
+  
+  f.Limite = limitePorDefecto
+  if q.Get("limite") != "" {
+    f.Limite, err = strconv.Atoi(q.Get("limite"))
+    if err != nil || f.Limite < 1 || f.Limite > limiteMaximo {
+      return f, fmt.Errorf("el limite debe ser un numero entre 1 y %d", limiteMaximo)
+    }
+  }
+  
+  if q.Get("cursor") != "" {
+    f.Cursor, err = leerCursor(q.Get("cursor"))
+    if err != nil {
+      return f, err
+    }
+  }
+  
+  return f, nil
+}
+
+//leerCursor decodifica el cursor que se le entrego al cliente.
+func leerCursor(s string) (*cursor, error) {
+  b, err := base64.RawURLEncoding.DecodeString(s)
+  if err != nil {
+    return nil, fmt.Errorf("cursor invalido")
+  }
+  var c cursor
+  err = json.Unmarshal(b, &c)
+  if err != nil {
+    return nil, fmt.Errorf("cursor invalido")
+  }
+  return &c, nil
+}
+
+//crearCursor arma el cursor a partir del registro donde termina la pagina.
+func crearCursor(m Registro, orden string, atras bool) string {
+  c := cursor{Id: m.Id, Atras: atras}
+  if orden == "monto" {
+    c.Valor = strconv.FormatInt(m.Monto.Normalizado(), 10)
+  } else {
+    c.Valor = m.Fecha.Format(time.RFC3339Nano)
+  }
+  
+  b, _ := json.Marshal(c)
+  return base64.RawURLEncoding.EncodeToString(b)
+}
+
+//condicionesMovimientos arma el WHERE con los filtros, sin tener en cuenta
+//el cursor, y los argumentos para la consulta.
+func condicionesMovimientos(f FiltroMovimientos, libro int, usuario string) (string, []interface{}) {
+  condiciones := []string{"libro_id = ?", condicionMiembro}
+  args := []interface{}{libro, usuario}
+  
+  if f.Tipo != "" {
+    condiciones = append(condiciones, "tipo = ?")
+    args = append(args, f.Tipo)
+  }
+  if f.Grupo != "" {
+    condiciones = append(condiciones, "grupo = ? COLLATE NOCASE")
+    args = append(args, f.Grupo)
+  }
+  if f.Texto != "" {
+    //escapamos los comodines del LIKE para buscar el texto tal cual.
+    texto := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(f.Texto)
+    condiciones = append(condiciones, `descripcion LIKE ? ESCAPE '\'`)
+    args = append(args, "%" + texto + "%")
+  }
+  if f.MontoMin != nil {
+    condiciones = append(condiciones, montoNormalizado + " >= ?")
+    args = append(args, *f.MontoMin)
+  }
+  if f.MontoMax != nil {
+    condiciones = append(condiciones, montoNormalizado + " <= ?")
+    args = append(args, *f.MontoMax)
+  }
+  if f.Desde != nil {
+    condiciones = append(condiciones, "fecha >= ?")
+    args = append(args, *f.Desde)
+  }
+  if f.Hasta != nil {
+    condiciones = append(condiciones, "fecha <= ?")
+    args = append(args, *f.Hasta)
+  }
+  
+  return strings.Join(condiciones, " AND "), args
+}
+
+//getPaginaMovimientos consulta una pagina usando keyset sobre (orden, id)
+//para que pedir paginas lejanas no sea mas lento, y el total con los filtros.
+func getPaginaMovimientos(f FiltroMovimientos, libro int, usuario string) (p Pagina, err error) {
+  where, args := condicionesMovimientos(f, libro, usuario)
+  
+  //el total no depende del cursor.
+  err = db.QueryRow("SELECT COUNT(*) FROM registros WHERE " + where, args...).Scan(&p.Total)
+  if err != nil {
+    return p, fmt.Errorf("Error al contar los registros, %v", err)
+  }
+  
+  //si se pide hacia atras se invierte el orden y luego se voltea el resultado.
+  desc := f.Desc
+  atras := f.Cursor != nil && f.Cursor.Atras
+  if atras {
+    desc = !desc
+  }
+  comparador, direccion := ">", "ASC"
+  if desc {
+    comparador, direccion = "<", "DESC"
+  }
+  
+  //el monto se ordena normalizado para mezclar monedas con distinto exponente.
+  columna := f.Orden
+  if columna == "monto" {
+    columna = montoNormalizado
+  }
+  
+  //la condicion del cursor: despues del ultimo visto, desempatando por id.
+  if f.Cursor != nil {
+    var valor interface{}
+    if f.Orden == "monto" {
+      valor, err = strconv.ParseInt(f.Cursor.Valor, 10, 64)
+    } else {
+      valor, err = time.Parse(time.RFC3339Nano, f.Cursor.Valor)
+    }
+    if err != nil {
+      return p, fmt.Errorf("cursor invalido")
+    }
+    where += fmt.Sprintf(" AND (%s %s ? OR (%s = ? AND id %s ?))", columna, comparador, columna, comparador)
+    args = append(args, valor, valor, f.Cursor.Id)
+  }
+  
+  //pedimos uno de mas para saber si hay otra pagina.
+  consulta := fmt.Sprintf("SELECT %s FROM registros WHERE %s ORDER BY %s %s, id %s LIMIT ?", columnasRegistro, where, columna, direccion, direccion)
+  rows, err := db.Query(consulta, append(args, f.Limite + 1)...)
+  if err != nil {
+    return p, fmt.Errorf("Error al leer los datos de la tabla, %v", err)
+  }
+  defer rows.Close()
+  
+  p.Datos = []Registro{}
+  for rows.Next() {
+    m, err := escanearRegistro(rows)
+    if err != nil {
+      return p, fmt.Errorf("Error al escanear en la estructura cada registro, %v", err)
+    }
+    p.Datos = append(p.Datos, m)
+  }
+  if err = rows.Err(); err != nil {
+    return p, fmt.Errorf("Error al leer los datos de la tabla, %v", err)
+  }
+  
+  hayMas := len(p.Datos) > f.Limite
+  if hayMas {
+    p.Datos = p.Datos[:f.Limite]
+  }
+  if atras {
+    for i, j := 0, len(p.Datos)-1; i < j; i, j = i+1, j-1 {
+      p.Datos[i], p.Datos[j] = p.Datos[j], p.Datos[i]
+    }
+  }
+  if len(p.Datos) == 0 {
+    return p, nil
+  }
+  
+  //hacia adelante hay siguiente si sobro uno, y anterior si vinimos con cursor.
+  //Hacia atras es al contrario.
+  primero, ultimo := p.Datos[0], p.Datos[len(p.Datos)-1]
+  if (!atras && hayMas) || atras {
+    p.Siguiente = crearCursor(ultimo, f.Orden, false)
+  }
+  if (atras && hayMas) || (!atras && f.Cursor != nil) {
+    p.Anterior = crearCursor(primero, f.Orden, true)
+  }
+  
+  return p, nil
+}
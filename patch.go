@@ -0,0 +1,334 @@
+package main
+
+import (
+  "bytes"
+  "encoding/json"
+  "fmt"
+  "reflect"
+  "strconv"
+  "strings"
+)
+
+//Tipos de contenido que acepta el PATCH. Si el cliente manda solo
+//application/json se decide por la forma del body (objeto o arreglo).
+const (
+  contenidoMergePatch = "application/merge-patch+json"
+  contenidoJSONPatch = "application/json-patch+json"
+)
+
+//OperacionPatch es una operacion de un documento JSON Patch (RFC 6902).
+//Value es RawMessage para poder distinguir un null de un valor omitido.
+type OperacionPatch struct {
+  Op string `json:"op"`
+  Path string `json:"path"`
+  From string `json:"from"`
+  Value json.RawMessage `json:"value"`
+}
+
+//aplicarPatch recibe el registro actual en formato json y el body del PATCH,
+//elige el tipo de patch segun el content type y retorna el json resultante.
+func aplicarPatch(original []byte, patch []byte, contentType string) ([]byte, error) {
+  //quitamos parametros como "; charset=utf-8"
+  tipo := strings.TrimSpace(strings.Split(contentType, ";")[0])
+  
+  switch tipo {
+  case contenidoMergePatch:
+    return aplicarMergePatch(original, patch)
+  case contenidoJSONPatch:
+    return aplicarJSONPatch(original, patch)
+  }
+  
+  //si no lo especifica miramos el primer caracter del body.
+  recortado := bytes.TrimSpace(patch)
+  if len(recortado) > 0 && recortado[0] == '[' {
+    return aplicarJSONPatch(original, patch)
+  }
+  return aplicarMergePatch(original, patch)
+}
+
+//aplicarMergePatch aplica un JSON Merge Patch (RFC 7396). Los campos con
+//null se eliminan y los objetos se mezclan de forma recursiva.
+func aplicarMergePatch(original []byte, patch []byte) ([]byte, error) {
+  var doc, p interface{}
+  
+  err := json.Unmarshal(original, &doc)
+  if err != nil {
+    return nil, fmt.Errorf("Error al leer el documento original, %v", err)
+  }
+  err = json.Unmarshal(patch, &p)
+  if err != nil {
+    return nil, fmt.Errorf("Error al leer el merge patch, %v", err)
+  }
+  
+  return json.Marshal(mezclar(doc, p))
+}
+
+//mezclar es el algoritmo MergePatch(Target, Patch) de la RFC 7396.
+func mezclar(destino interface{}, patch interface{}) interface{} {
+  p, ok := patch.(map[string]interface{})
+  //si el patch no es un objeto reemplaza todo el destino.
+  if !ok {
+    return patch
+  }
+  
+  d, ok := destino.(map[string]interface{})
+  if !ok {
+    d = map[string]interface{}{}
+  }
+  
+  for k, v := range p {
+    if v == nil {
+      delete(d, k)
+      continue
+    }
+    d[k] = mezclar(d[k], v)
+  }
+  return d
+}
+
+//aplicarJSONPatch aplica en orden las operaciones de un JSON Patch (RFC 6902).
+//Si alguna operacion falla no se aplica ninguna.
+func aplicarJSONPatch(original []byte, patch []byte) ([]byte, error) {
+  var doc interface{}
+  var ops []OperacionPatch
+  
+  err := json.Unmarshal(original, &doc)
+  if err != nil {
+    return nil, fmt.Errorf("Error al leer el documento original, %v", err)
+  }
+  err = json.Unmarshal(patch, &ops)
+  if err != nil {
+    return nil, fmt.Errorf("Error al leer el json patch, %v", err)
+  }
+  
+  for i, op := range ops {
+    doc, err = aplicarOperacion(doc, op)
+    if err != nil {
+      return nil, fmt.Errorf("Error en la operacion %d (%s %s), %v", i, op.Op, op.Path, err)
+    }
+  }
+  
+  return json.Marshal(doc)
+}
+
+//aplicarOperacion ejecuta una sola operacion sobre el documento y retorna
+//el documento modificado.
+func aplicarOperacion(doc interface{}, op OperacionPatch) (interface{}, error) {
+  //value es obligatorio en add, replace y test.
+  var valor interface{}
+  if op.Op == "add" || op.Op == "replace" || op.Op == "test" {
+    if op.Value == nil {
+      return nil, fmt.Errorf("falta el campo value")
+    }
+    err := json.Unmarshal(op.Value, &valor)
+    if err != nil {
+      return nil, fmt.Errorf("value invalido, %v", err)
+    }
+  }
+  
+  switch op.Op {
+  case "add":
+    return agregarEnRuta(doc, op.Path, valor)
+  case "remove":
+    doc, _, err := quitarEnRuta(doc, op.Path)
+    return doc, err
+  case "replace":
+    //replace exige que la ruta exista.
+    _, err := buscarEnRuta(doc, op.Path)
+    if err != nil {
+      return nil, err
+    }
+    doc, _, err = quitarEnRuta(doc, op.Path)
+    if err != nil {
+      return nil, err
+    }
+    return agregarEnRuta(doc, op.Path, valor)
+  case "move":
+    if strings.HasPrefix(op.Path, op.From + "/") {
+      return nil, fmt.Errorf("no se puede mover un valor dentro de si mismo")
+    }
+    doc, v, err := quitarEnRuta(doc, op.From)
+    if err != nil {
+      return nil, err
+    }
+    return agregarEnRuta(doc, op.Path, v)
+  case "copy":
+    v, err := buscarEnRuta(doc, op.From)
+    if err != nil {
+      return nil, err
+    }
+    //copiamos por json para no compartir mapas entre las dos rutas.
+    b, _ := json.Marshal(v)
+    var copia interface{}
+    json.Unmarshal(b, &copia)
+    return agregarEnRuta(doc, op.Path, copia)
+  case "test":
+    v, err := buscarEnRuta(doc, op.Path)
+    if err != nil {
+      return nil, err
+    }
+    if !reflect.DeepEqual(v, valor) {
+      return nil, fmt.Errorf("el valor no coincide")
+    }
+    return doc, nil
+  }
+  
+  return nil, fmt.Errorf("operacion desconocida %q", op.Op)
+}
+
+//partesRuta separa un JSON Pointer (RFC 6901) en sus partes ya sin escapes.
+func partesRuta(ruta string) ([]string, error) {
+  if ruta == "" {
+    return nil, nil
+  }
+  if !strings.HasPrefix(ruta, "/") {
+    return nil, fmt.Errorf("ruta invalida %q", ruta)
+  }
+  
+  partes := strings.Split(ruta[1:], "/")
+  for i, p := range partes {
+    p = strings.ReplaceAll(p, "~1", "/")
+    partes[i] = strings.ReplaceAll(p, "~0", "~")
+  }
+  return partes, nil
+}
+
+//indiceArreglo convierte una parte de la ruta a indice valido para el arreglo.
+//permitirFinal deja usar "-" o len(arr) para agregar al final.
+func indiceArreglo(parte string, arr []interface{}, permitirFinal bool) (int, error) {
+  if parte == "-" && permitirFinal {
+    return len(arr), nil
+  }
+  i, err := strconv.Atoi(parte)
+  if err != nil || i < 0 || i > len(arr) || (i == len(arr) && !permitirFinal) {
+    return 0, fmt.Errorf("indice invalido %q", parte)
+  }
+  return i, nil
+}
+
+//buscarEnRuta retorna el valor que hay en la ruta dada.
+func buscarEnRuta(doc interface{}, ruta string) (interface{}, error) {
+  partes, err := partesRuta(ruta)
+  if err != nil {
+    return nil, err
+  }
+  
+  actual := doc
+  for _, p := range partes {
+    switch v := actual.(type) {
+    case map[string]interface{}:
+      siguiente, ok := v[p]
+      if !ok {
+        return nil, fmt.Errorf("la ruta %q no existe", ruta)
+      }
+      actual = siguiente
+    case []interface{}:
+      i, err := indiceArreglo(p, v, false)
+      if err != nil {
+        return nil, err
+      }
+      actual = v[i]
+    default:
+      return nil, fmt.Errorf("la ruta %q no existe", ruta)
+    }
+  }
+  return actual, nil
+}
+
+//agregarEnRuta agrega o reemplaza el valor en la ruta. Como los arreglos
+//pueden cambiar de tamaño se retorna el documento resultante.
+func agregarEnRuta(doc interface{}, ruta string, valor interface{}) (interface{}, error) {
+  partes, err := partesRuta(ruta)
+  if err != nil {
+    return nil, err
+  }
+  //la ruta vacia reemplaza todo el documento.
+  if len(partes) == 0 {
+    return valor, nil
+  }
+  
+  padre, err := buscarEnRuta(doc, unirRuta(partes[:len(partes)-1]))
+  if err != nil {
+    return nil, err
+  }
+  ultima := partes[len(partes)-1]
+  
+  switch v := padre.(type) {
+  case map[string]interface{}:
+    v[ultima] = valor
+    return doc, nil
+  case []interface{}:
+    i, err := indiceArreglo(ultima, v, true)
+    if err != nil {
+      return nil, err
+    }
+    nuevo := append(v[:i:i], append([]interface{}{valor}, v[i:]...)...)
+    return reemplazarEnRuta(doc, partes[:len(partes)-1], nuevo), nil
+  }
+  return nil, fmt.Errorf("la ruta %q no existe", ruta)
+}
+
+//quitarEnRuta elimina el valor de la ruta y lo retorna junto con el documento.
+func quitarEnRuta(doc interface{}, ruta string) (interface{}, interface{}, error) {
+  partes, err := partesRuta(ruta)
+  if err != nil {
+    return nil, nil, err
+  }
+  if len(partes) == 0 {
+    return nil, nil, fmt.Errorf("no se puede eliminar el documento completo")
+  }
+  
+  padre, err := buscarEnRuta(doc, unirRuta(partes[:len(partes)-1]))
+  if err != nil {
+    return nil, nil, err
+  }
+  ultima := partes[len(partes)-1]
+  
+  switch v := padre.(type) {
+  case map[string]interface{}:
+    valor, ok := v[ultima]
+    if !ok {
+      return nil, nil, fmt.Errorf("la ruta %q no existe", ruta)
+    }
+    delete(v, ultima)
+    return doc, valor, nil
+  case []interface{}:
+    i, err := indiceArreglo(ultima, v, false)
+    if err != nil {
+      return nil, nil, err
+    }
+    valor := v[i]
+    nuevo := append(v[:i:i], v[i+1:]...)
+    return reemplazarEnRuta(doc, partes[:len(partes)-1], nuevo), valor, nil
+  }
+  return nil, nil, fmt.Errorf("la ruta %q no existe", ruta)
+}
+
+//reemplazarEnRuta pone el valor en una ruta que ya se sabe que existe.
+//Se usa para guardar los arreglos que cambiaron de tamaño.
+func reemplazarEnRuta(doc interface{}, partes []string, valor interface{}) interface{} {
+  if len(partes) == 0 {
+    return valor
+  }
+  padre, _ := buscarEnRuta(doc, unirRuta(partes[:len(partes)-1]))
+  ultima := partes[len(partes)-1]
+  
+  switch v := padre.(type) {
+  case map[string]interface{}:
+    v[ultima] = valor
+  case []interface{}:
+    i, _ := strconv.Atoi(ultima)
+    v[i] = valor
+  }
+  return doc
+}
+
+//unirRuta arma de nuevo el JSON Pointer escapando cada parte.
+func unirRuta(partes []string) string {
+  var b strings.Builder
+  for _, p := range partes {
+    p = strings.ReplaceAll(p, "~", "~0")
+    b.WriteString("/" + strings.ReplaceAll(p, "/", "~1"))
+  }
+  return b.String()
+}
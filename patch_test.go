@@ -0,0 +1,94 @@
+package main
+
+import (
+  "testing"
+)
+
+func TestAplicarPatch(t *testing.T) {
+  original := `{"monto":100,"detalle":"pan","etiquetas":["a","b"],"extra":{"x":1,"y":2}}`
+  
+  casos := []struct {
+    nombre string
+    patch string
+    contentType string
+    esperado string
+  }{
+    //merge patch
+    {"merge reemplaza", `{"monto":250}`, contenidoMergePatch,
+      `{"detalle":"pan","etiquetas":["a","b"],"extra":{"x":1,"y":2},"monto":250}`},
+    {"merge null elimina", `{"detalle":null}`, contenidoMergePatch,
+      `{"etiquetas":["a","b"],"extra":{"x":1,"y":2},"monto":100}`},
+    {"merge recursivo", `{"extra":{"x":null,"z":3}}`, contenidoMergePatch,
+      `{"detalle":"pan","etiquetas":["a","b"],"extra":{"y":2,"z":3},"monto":100}`},
+    {"merge reemplaza arreglos", `{"etiquetas":["c"]}`, "application/merge-patch+json; charset=utf-8",
+      `{"detalle":"pan","etiquetas":["c"],"extra":{"x":1,"y":2},"monto":100}`},
+    //json patch
+    {"add", `[{"op":"add","path":"/moneda","value":"COP"}]`, contenidoJSONPatch,
+      `{"detalle":"pan","etiquetas":["a","b"],"extra":{"x":1,"y":2},"moneda":"COP","monto":100}`},
+    {"add al final del arreglo", `[{"op":"add","path":"/etiquetas/-","value":"c"}]`, contenidoJSONPatch,
+      `{"detalle":"pan","etiquetas":["a","b","c"],"extra":{"x":1,"y":2},"monto":100}`},
+    {"add en medio del arreglo", `[{"op":"add","path":"/etiquetas/1","value":"c"}]`, contenidoJSONPatch,
+      `{"detalle":"pan","etiquetas":["a","c","b"],"extra":{"x":1,"y":2},"monto":100}`},
+    {"remove del arreglo", `[{"op":"remove","path":"/etiquetas/0"}]`, contenidoJSONPatch,
+      `{"detalle":"pan","etiquetas":["b"],"extra":{"x":1,"y":2},"monto":100}`},
+    {"replace", `[{"op":"replace","path":"/monto","value":5}]`, contenidoJSONPatch,
+      `{"detalle":"pan","etiquetas":["a","b"],"extra":{"x":1,"y":2},"monto":5}`},
+    {"move", `[{"op":"move","from":"/extra/x","path":"/x"}]`, contenidoJSONPatch,
+      `{"detalle":"pan","etiquetas":["a","b"],"extra":{"y":2},"monto":100,"x":1}`},
+    {"copy", `[{"op":"copy","from":"/extra","path":"/otro"}]`, contenidoJSONPatch,
+      `{"detalle":"pan","etiquetas":["a","b"],"extra":{"x":1,"y":2},"monto":100,"otro":{"x":1,"y":2}}`},
+    {"test y replace", `[{"op":"test","path":"/detalle","value":"pan"},{"op":"replace","path":"/detalle","value":"leche"}]`, contenidoJSONPatch,
+      `{"detalle":"leche","etiquetas":["a","b"],"extra":{"x":1,"y":2},"monto":100}`},
+    {"rutas con escapes", `[{"op":"add","path":"/a~1b~0c","value":1}]`, contenidoJSONPatch,
+      `{"a/b~c":1,"detalle":"pan","etiquetas":["a","b"],"extra":{"x":1,"y":2},"monto":100}`},
+    //sin content type se decide por el body
+    {"json sin tipo con arreglo", `[{"op":"remove","path":"/extra"}]`, "application/json",
+      `{"detalle":"pan","etiquetas":["a","b"],"monto":100}`},
+    {"json sin tipo con objeto", `{"extra":null}`, "application/json",
+      `{"detalle":"pan","etiquetas":["a","b"],"monto":100}`},
+  }
+  
+  for _, c := range casos {
+    t.Run(c.nombre, func(t *testing.T) {
+      resultado, err := aplicarPatch([]byte(original), []byte(c.patch), c.contentType)
+      if err != nil {
+        t.Fatalf("error inesperado %v", err)
+      }
+      if string(resultado) != c.esperado {
+        t.Errorf("obtuvo %s, esperaba %s", resultado, c.esperado)
+      }
+    })
+  }
+}
+
+func TestAplicarJSONPatchErrores(t *testing.T) {
+  original := `{"monto":100,"etiquetas":["a","b"],"extra":{"x":1}}`
+  
+  casos := []struct {
+    nombre string
+    patch string
+  }{
+    {"operacion desconocida", `[{"op":"borrar","path":"/monto"}]`},
+    {"add sin value", `[{"op":"add","path":"/moneda"}]`},
+    {"replace de ruta inexistente", `[{"op":"replace","path":"/moneda","value":"COP"}]`},
+    {"remove de ruta inexistente", `[{"op":"remove","path":"/moneda"}]`},
+    {"remove del documento", `[{"op":"remove","path":""}]`},
+    {"ruta sin slash", `[{"op":"add","path":"monto","value":1}]`},
+    {"indice fuera del arreglo", `[{"op":"add","path":"/etiquetas/5","value":"c"}]`},
+    {"indice negativo", `[{"op":"remove","path":"/etiquetas/-1"}]`},
+    {"move dentro de si mismo", `[{"op":"move","from":"/extra","path":"/extra/y"}]`},
+    {"test que no coincide", `[{"op":"test","path":"/monto","value":99}]`},
+    //si una operacion falla no se aplica ninguna, pero igual hay error.
+    {"falla la segunda", `[{"op":"replace","path":"/monto","value":5},{"op":"test","path":"/monto","value":100}]`},
+    {"json invalido", `[{"op":`},
+  }
+  
+  for _, c := range casos {
+    t.Run(c.nombre, func(t *testing.T) {
+      _, err := aplicarPatch([]byte(original), []byte(c.patch), contenidoJSONPatch)
+      if err == nil {
+        t.Errorf("esperaba un error")
+      }
+    })
+  }
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+  "database/sql"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "log"
+  "math/big"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+  
+  "github.com/gorilla/mux"
+)
+
+//Presupuesto es el limite de egresos de un grupo del libro para cada mes a
+//partir del mes Desde. Con Acumular lo que no se gasta en un mes pasa al
+//limite del siguiente.
+type Presupuesto struct {
+  Id int `json:"id"`
+  Libro int `json:"libro"`
+  Grupo string `json:"grupo"`
+  Monto Dinero `json:"monto"`
+  Moneda string `json:"moneda"`
+  Desde string `json:"desde"`
+  Acumular bool `json:"acumular"`
+}
+
+//EstadoPresupuesto es lo gastado en el mes contra el limite. El limite es
+//el monto del presupuesto mas lo acumulado de los meses anteriores.
+type EstadoPresupuesto struct {
+  Presupuesto int `json:"presupuesto"`
+  Grupo string `json:"grupo"`
+  Mes string `json:"mes"`
+  Moneda string `json:"moneda"`
+  Monto Dinero `json:"monto"`
+  Acumulado Dinero `json:"acumulado"`
+  Limite Dinero `json:"limite"`
+  Gastado Dinero `json:"gastado"`
+  Restante Dinero `json:"restante"`
+  Porcentaje int `json:"porcentaje"`
+}
+
+//AlertaPresupuesto avisa que un egreso hizo pasar el grupo de uno de los
+//umbrales de su presupuesto.
+type AlertaPresupuesto struct {
+  Presupuesto int `json:"presupuesto"`
+  Grupo string `json:"grupo"`
+  Mes string `json:"mes"`
+  Umbral int `json:"umbral"`
+  Porcentaje int `json:"porcentaje"`
+  Restante Dinero `json:"restante"`
+  Mensaje string `json:"mensaje"`
+}
+
+//umbrales en porcentaje del limite que generan una alerta al pasarlos.
+var umbralesPresupuesto = []int{80, 100}
+
+//initPresupuestos crea la tabla de presupuestos, uno por grupo en cada
+//libro. El monto va en la unidad menor de la moneda igual que en cuentas.
+func initPresupuestos() {
+  crearTablaPresupuestos := `
+  CREATE TABLE IF NOT EXISTS presupuestos(
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  libro_id INTEGER NOT NULL REFERENCES libros(id),
+  usuario TEXT NOT NULL,
+  grupo TEXT NOT NULL,
+  monto INTEGER NOT NULL,
+  moneda TEXT NOT NULL,
+  desde TEXT NOT NULL,
+  acumular INTEGER NOT NULL DEFAULT 0,
+  UNIQUE(libro_id, grupo)
+  );`
+  
+  _, err := db.Exec(crearTablaPresupuestos)
+  if err != nil {
+    log.Fatal("Error creando la tabla presupuestos", err)
+  }
+}
+
+//validarPresupuesto revisa los datos del presupuesto antes de guardarlo. Si
+//no viene desde aplica desde el mes actual.
+func validarPresupuesto(p *Presupuesto) error {
+  if strings.TrimSpace(p.Grupo) == "" {
+    return fmt.Errorf("el grupo es obligatorio")
+  }
+  if p.Desde == "" {
+    p.Desde = time.Now().UTC().Format("2006-01")
+  }
+  _, err := time.Parse("2006-01", p.Desde)
+  if err != nil {
+    return fmt.Errorf("desde debe ser un mes AAAA-MM")
+  }
+  if p.Moneda == "" {
+    p.Moneda = monedaBase()
+  }
+  p.Moneda = strings.ToUpper(p.Moneda)
+  if !regMoneda.MatchString(p.Moneda) {
+    return fmt.Errorf("la moneda debe ser un codigo de 3 letras, ejm COP")
+  }
+  monto, err := p.Monto.Escalar(exponenteMoneda(p.Moneda))
+  if err != nil {
+    return fmt.Errorf("en el monto, %v", err)
+  }
+  if monto.Unidades <= 0 {
+    return fmt.Errorf("el monto debe ser mayor a 0")
+  }
+  p.Monto = monto
+  return nil
+}
+
+//leerPresupuesto lee y valida el presupuesto del body. El grupo debe ser
+//una categoria del usuario. Si hay error ya lo escribe en w y retorna false.
+func leerPresupuesto(w http.ResponseWriter, r *http.Request) (Presupuesto, bool) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  var p Presupuesto
+  err := json.NewDecoder(r.Body).Decode(&p)
+  if err != nil {
+    http.Error(w, "Error al leer el json.", http.StatusBadRequest)
+    return p, false
+  }
+  err = validarPresupuesto(&p)
+  if err != nil {
+    writeError(w, "Error en el presupuesto", err, http.StatusBadRequest)
+    return p, false
+  }
+  nombre, err := resolverCategoria(nombreUsuario, p.Grupo, false)
+  if errors.Is(err, errCategoriaNoExiste) {
+    writeError(w, "Error en el grupo " + p.Grupo, err, http.StatusUnprocessableEntity)
+    return p, false
+  }
+  if err != nil {
+    writeError(w, "Error al consultar la categoria", err, http.StatusInternalServerError)
+    return p, false
+  }
+  p.Grupo = nombre
+  return p, true
+}
+
+//escanearPresupuesto lee un presupuesto con las columnas de
+//columnasPresupuesto.
+func escanearPresupuesto(s escaner) (p Presupuesto, err error) {
+  err = s.Scan(&p.Id, &p.Libro, &p.Grupo, &p.Monto.Unidades, &p.Moneda, &p.Desde, &p.Acumular)
+  p.Monto.Exponente = exponenteMoneda(p.Moneda)
+  return
+}
+
+//columnas en el orden que las lee escanearPresupuesto.
+const columnasPresupuesto = "id, libro_id, grupo, monto, moneda, desde, acumular"
+
+//buscarPresupuesto retorna el presupuesto si esta en un libro del usuario.
+//Con escritura exige que pueda modificar el libro. Si no responde el error
+//y retorna false.
+func buscarPresupuesto(w http.ResponseWriter, r *http.Request, escritura bool) (Presupuesto, bool) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  id, err := strconv.Atoi(mux.Vars(r)["id"])
+  if err != nil {
+    http.Error(w, "Error, el id debe ser un numero.", http.StatusBadRequest)
+    return Presupuesto{}, false
+  }
+  p, err := escanearPresupuesto(db.QueryRow("SELECT " + columnasPresupuesto + " FROM presupuestos WHERE id = ? AND " + condicionMiembro, id, nombreUsuario))
+  if err == sql.ErrNoRows {
+    http.Error(w, "El presupuesto no existe.", http.StatusNotFound)
+    return p, false
+  }
+  if err != nil {
+    writeError(w, "Error al consultar el presupuesto", err, http.StatusInternalServerError)
+    return p, false
+  }
+  if escritura && !permisoLibro(w, p.Libro, nombreUsuario, true) {
+    return p, false
+  }
+  return p, true
+}
+
+//getPresupuestosLibro retorna los presupuestos del libro, con grupo
+//solo el de ese grupo.
+func getPresupuestosLibro(libro int, grupo string) ([]Presupuesto, error) {
+  consulta := "SELECT " + columnasPresupuesto + " FROM presupuestos WHERE libro_id = ?"
+  args := []interface{}{libro}
+  if grupo != "" {
+    consulta += " AND grupo = ?"
+    args = append(args, grupo)
+  }
+  rows, err := db.Query(consulta + " ORDER BY grupo", args...)
+  if err != nil {
+    return nil, fmt.Errorf("Error al consultar los presupuestos, %v", err)
+  }
+  defer rows.Close()
+  
+  presupuestos := []Presupuesto{}
+  for rows.Next() {
+    p, err := escanearPresupuesto(rows)
+    if err != nil {
+      return nil, fmt.Errorf("Error al escanear los presupuestos, %v", err)
+    }
+    presupuestos = append(presupuestos, p)
+  }
+  return presupuestos, rows.Err()
+}
+
+//getPresupuestos lista los presupuestos del libro.
+//ejm http://100.69.187.16:8080/presupuestos?libro=2
+func getPresupuestos(w http.ResponseWriter, r *http.Request) {
+  libro, ok := libroPeticion(w, r, false)
+  if !ok {
+    return
+  }
+  presupuestos, err := getPresupuestosLibro(libro, "")
+  if err != nil {
+    writeError(w, "Error al consultar los presupuestos", err, http.StatusInternalServerError)
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(presupuestos)
+}
+
+//postPresupuesto crea el presupuesto de un grupo en el libro, cada grupo
+//tiene maximo uno por libro.
+//ejm http://100.69.187.16:8080/presupuestos?libro=2
+//Json ejemplo{"grupo": "Comida", "monto": 800000, "moneda": "COP", "desde": "2024-12", "acumular": true}
+func postPresupuesto(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  libro, ok := libroPeticion(w, r, true)
+  if !ok {
+    return
+  }
+  p, ok := leerPresupuesto(w, r)
+  if !ok {
+    return
+  }
+  p.Libro = libro
+  
+  res, err := db.Exec("INSERT INTO presupuestos(libro_id, usuario, grupo, monto, moneda, desde, acumular) VALUES(?, ?, ?, ?, ?, ?, ?)",
+    p.Libro, nombreUsuario, p.Grupo, p.Monto.Unidades, p.Moneda, p.Desde, p.Acumular)
+  if err != nil {
+    //la unica restriccion que puede fallar es el grupo repetido.
+    writeError(w, "Error, el grupo ya tiene un presupuesto en el libro", err, http.StatusConflict)
+    return
+  }
+  id, _ := res.LastInsertId()
+  p.Id = int(id)
+  
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(http.StatusCreated)
+  json.NewEncoder(w).Encode(p)
+}
+
+//putPresupuesto actualiza el presupuesto, el libro no cambia.
+//ejm http://100.69.187.16:8080/presupuestos/3
+//Json ejemplo{"grupo": "Comida", "monto": 900000, "moneda": "COP", "desde": "2024-12", "acumular": false}
+func putPresupuesto(w http.ResponseWriter, r *http.Request) {
+  anterior, ok := buscarPresupuesto(w, r, true)
+  if !ok {
+    return
+  }
+  p, ok := leerPresupuesto(w, r)
+  if !ok {
+    return
+  }
+  p.Id = anterior.Id
+  p.Libro = anterior.Libro
+  
+  _, err := db.Exec("UPDATE presupuestos SET grupo = ?, monto = ?, moneda = ?, desde = ?, acumular = ? WHERE id = ?",
+    p.Grupo, p.Monto.Unidades, p.Moneda, p.Desde, p.Acumular, p.Id)
+  if err != nil {
+    writeError(w, "Error, el grupo ya tiene un presupuesto en el libro", err, http.StatusConflict)
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(p)
+}
+
+//deletePresupuesto elimina el presupuesto, los registros no cambian.
+//ejm http://100.69.187.16:8080/presupuestos/3
+func deletePresupuesto(w http.ResponseWriter, r *http.Request) {
+  p, ok := buscarPresupuesto(w, r, true)
+  if !ok {
+    return
+  }
+  _, err := db.Exec("DELETE FROM presupuestos WHERE id = ?", p.Id)
+  if err != nil {
+    writeError(w, "Error al eliminar el presupuesto", err, http.StatusInternalServerError)
+    return
+  }
+  w.WriteHeader(http.StatusNoContent)
+}
+
+//getEstadoPresupuestos responde para cada presupuesto del libro lo gastado
+//en el mes contra el limite y lo que queda. Sin mes es el mes actual.
+//ejm http://100.69.187.16:8080/presupuestos/estado?libro=2&mes=2024-12
+func getEstadoPresupuestos(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  mes := time.Now().UTC()
+  if r.URL.Query().Get("mes") != "" {
+    var err error
+    mes, err = time.Parse("2006-01", r.URL.Query().Get("mes"))
+    if err != nil {
+      errorStr := fmt.Sprintf("Error en el mes ingresado, debe ser AAAA-MM, %v", err)
+      http.Error(w, errorStr, http.StatusBadRequest)
+      return
+    }
+  }
+  libro, ok := libroPeticion(w, r, false)
+  if !ok {
+    return
+  }
+  
+  estados, err := estadoPresupuestos(libro, nombreUsuario, "", mes)
+  if err != nil {
+    writeError(w, "Error al calcular el estado de los presupuestos", err, statusConversion(err))
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(estados)
+}
+
+//estadoPresupuestos calcula el estado en el mes de los presupuestos del
+//libro, con grupo solo el de ese grupo. Los que empiezan despues del mes no
+//salen. Lo gastado son los egresos del grupo sin transferencias, pasados a
+//la moneda del presupuesto con la tasa de su dia.
+func estadoPresupuestos(libro int, usuario string, grupo string, mes time.Time) ([]EstadoPresupuesto, error) {
+  estados := []EstadoPresupuesto{}
+  etiqueta := mes.Format("2006-01")
+  
+  presupuestos, err := getPresupuestosLibro(libro, grupo)
+  if err != nil {
+    return nil, err
+  }
+  
+  //con acumular hay que recorrer desde el primer mes del presupuesto.
+  inicio := etiqueta
+  var activos []Presupuesto
+  for _, p := range presupuestos {
+    if p.Desde > etiqueta {
+      continue
+    }
+    activos = append(activos, p)
+    if p.Acumular && p.Desde < inicio {
+      inicio = p.Desde
+    }
+  }
+  if len(activos) == 0 {
+    return estados, nil
+  }
+  
+  desde, _ := time.Parse("2006-01", inicio)
+  hasta := time.Date(mes.Year(), mes.Month() + 1, 1, 0, 0, 0, 0, time.UTC).Add(-time.Nanosecond)
+  gastos, err := gastosPorMes(libro, usuario, grupo, desde, hasta)
+  if err != nil {
+    return nil, err
+  }
+  
+  conversores := map[string]*conversor{}
+  for _, p := range activos {
+    conv, ok := conversores[p.Moneda]
+    if !ok {
+      conv = nuevoConversor(p.Moneda)
+      conversores[p.Moneda] = conv
+    }
+    e, err := estadoPresupuesto(p, etiqueta, gastos[p.Grupo], conv)
+    if err != nil {
+      return nil, err
+    }
+    estados = append(estados, e)
+  }
+  return estados, nil
+}
+
+//gastoDia es la suma de los egresos de un grupo en un dia y una moneda.
+type gastoDia struct {
+  mes string
+  dia string
+  moneda string
+  monto Dinero
+}
+
+//gastosPorMes suma los egresos del libro por grupo, moneda y dia en el
+//rango, con grupo solo los de ese grupo.
+func gastosPorMes(libro int, usuario string, grupo string, desde time.Time, hasta time.Time) (map[string][]gastoDia, error) {
+  consulta := "SELECT grupo, moneda, exponente, substr(fecha, 1, 10), SUM(monto) FROM registros WHERE tipo = 'egreso' AND libro_id = ? AND " + condicionMiembro + " AND " + sinTransferencias + " AND fecha BETWEEN ? AND ?"
+  args := []interface{}{libro, usuario, desde, hasta}
+  if grupo != "" {
+    consulta += " AND grupo = ?"
+    args = append(args, grupo)
+  }
+  rows, err := db.Query(consulta + " GROUP BY 1, 2, 3, 4", args...)
+  if err != nil {
+    return nil, fmt.Errorf("Error al sumar los egresos, %v", err)
+  }
+  defer rows.Close()
+  
+  gastos := map[string][]gastoDia{}
+  for rows.Next() {
+    var g gastoDia
+    var grupoRegistro sql.NullString
+    err = rows.Scan(&grupoRegistro, &g.moneda, &g.monto.Exponente, &g.dia, &g.monto.Unidades)
+    if err != nil {
+      return nil, fmt.Errorf("Error al escanear los egresos, %v", err)
+    }
+    g.mes = g.dia[:7]
+    gastos[grupoRegistro.String] = append(gastos[grupoRegistro.String], g)
+  }
+  return gastos, rows.Err()
+}
+
+//estadoPresupuesto recorre los meses desde el inicio del presupuesto hasta
+//mes. Solo pasa al mes siguiente lo que sobra, lo que se gasta de mas no
+//se descuenta.
+func estadoPresupuesto(p Presupuesto, mes string, gastos []gastoDia, conv *conversor) (EstadoPresupuesto, error) {
+  gastadoMes := map[string]*big.Rat{}
+  for _, g := range gastos {
+    convertido, err := conv.convertir(g.monto, g.moneda, g.dia)
+    if err != nil {
+      return EstadoPresupuesto{}, err
+    }
+    if gastadoMes[g.mes] == nil {
+      gastadoMes[g.mes] = new(big.Rat)
+    }
+    gastadoMes[g.mes].Add(gastadoMes[g.mes], convertido)
+  }
+  
+  exponente := exponenteMoneda(p.Moneda)
+  acumulado := new(big.Rat)
+  if p.Acumular {
+    inicio, _ := time.Parse("2006-01", p.Desde)
+    for t := inicio; t.Format("2006-01") < mes; t = t.AddDate(0, 1, 0) {
+      sobrante := new(big.Rat).Add(p.Monto.Rat(), acumulado)
+      if gastado, ok := gastadoMes[t.Format("2006-01")]; ok {
+        sobrante.Sub(sobrante, gastado)
+      }
+      if sobrante.Sign() < 0 {
+        sobrante.SetInt64(0)
+      }
+      acumulado = sobrante
+    }
+  }
+  
+  gastado := gastadoMes[mes]
+  if gastado == nil {
+    gastado = new(big.Rat)
+  }
+  limite := new(big.Rat).Add(p.Monto.Rat(), acumulado)
+  e := EstadoPresupuesto{
+    Presupuesto: p.Id,
+    Grupo: p.Grupo,
+    Mes: mes,
+    Moneda: p.Moneda,
+    Monto: p.Monto,
+    Acumulado: dineroDeRat(acumulado, exponente),
+    Limite: dineroDeRat(limite, exponente),
+    Gastado: dineroDeRat(gastado, exponente),
+  }
+  e.Restante = e.Limite.Menos(e.Gastado)
+  
+  //el porcentaje va sin decimales y hacia abajo, 99.9% todavia no es 100.
+  porcentaje := new(big.Rat).Quo(new(big.Rat).Mul(gastado, big.NewRat(100, 1)), limite)
+  e.Porcentaje = int(new(big.Int).Quo(porcentaje.Num(), porcentaje.Denom()).Int64())
+  return e, nil
+}
+
+//alertasPresupuesto compara el estado del presupuesto antes y despues de
+//un egreso y retorna una alerta por el umbral mas alto que se paso.
+func alertasPresupuesto(antes []EstadoPresupuesto, despues []EstadoPresupuesto) []AlertaPresupuesto {
+  var alertas []AlertaPresupuesto
+  for _, d := range despues {
+    porcentajeAntes := 0
+    for _, a := range antes {
+      if a.Presupuesto == d.Presupuesto {
+        porcentajeAntes = a.Porcentaje
+      }
+    }
+    umbral := 0
+    for _, u := range umbralesPresupuesto {
+      if porcentajeAntes < u && d.Porcentaje >= u {
+        umbral = u
+      }
+    }
+    if umbral == 0 {
+      continue
+    }
+    alertas = append(alertas, AlertaPresupuesto{
+      Presupuesto: d.Presupuesto,
+      Grupo: d.Grupo,
+      Mes: d.Mes,
+      Umbral: umbral,
+      Porcentaje: d.Porcentaje,
+      Restante: d.Restante,
+      Mensaje: fmt.Sprintf("El grupo %s lleva el %d%% del presupuesto de %s", d.Grupo, d.Porcentaje, d.Mes),
+    })
+  }
+  return alertas
+}
+
+//estadoGrupoEgreso es el estado en el mes del egreso del presupuesto de su
+//grupo. Si no se puede calcular retorna false y el egreso sigue sin alertas.
+func estadoGrupoEgreso(m Registro, usuario string) ([]EstadoPresupuesto, bool) {
+  if m.Grupo == "" {
+    return nil, false
+  }
+  estados, err := estadoPresupuestos(m.Libro, usuario, m.Grupo, m.Fecha)
+  if err != nil {
+    log.Printf("Error al calcular el presupuesto de %s, %v", m.Grupo, err)
+    return nil, false
+  }
+  return estados, len(estados) > 0
+}
@@ -0,0 +1,1041 @@
+package main
+
+import (
+  "database/sql"
+  "encoding/json"
+  "fmt"
+  "log"
+  "net/http"
+  "os"
+  "sort"
+  "strconv"
+  "strings"
+  "sync"
+  "time"
+  
+  "github.com/gorilla/mux"
+)
+
+//Recurrencia es un movimiento que se repite, como el arriendo o el sueldo.
+//La regla es un RRULE (RFC 5545) y el programador crea el registro de cada
+//fecha cuando llega. GeneradaHasta es el ultimo dia que ya se reviso, asi
+//un registro generado que se borra no se vuelve a crear.
+type Recurrencia struct {
+  Id int `json:"id"`
+  Libro int `json:"libro"`
+  Usuario string `json:"usuario"`
+  Tipo string `json:"tipo"`
+  Monto Dinero `json:"monto"`
+  Moneda string `json:"moneda"`
+  Descripcion string `json:"descripcion"`
+  Grupo string `json:"grupo"`
+  Cuenta int `json:"cuenta,omitempty"`
+  Sobre int `json:"sobre,omitempty"`
+  Regla string `json:"regla"`
+  Inicio time.Time `json:"inicio"`
+  Activa bool `json:"activa"`
+  GeneradaHasta *time.Time `json:"generadaHasta,omitempty"`
+}
+
+//ExcepcionRecurrencia cambia una sola fecha de la recurrencia: la omite o
+//le cambia el monto o la descripcion. Fecha es la fecha original AAAA-MM-DD.
+type ExcepcionRecurrencia struct {
+  Fecha string `json:"fecha"`
+  Omitir bool `json:"omitir"`
+  Monto *Dinero `json:"monto,omitempty"`
+  Descripcion *string `json:"descripcion,omitempty"`
+}
+
+//OcurrenciaRecurrencia es una fecha de la recurrencia con lo que se va a
+//registrar. Registro es el id si ya se genero.
+type OcurrenciaRecurrencia struct {
+  Fecha time.Time `json:"fecha"`
+  Monto Dinero `json:"monto"`
+  Descripcion string `json:"descripcion"`
+  Omitida bool `json:"omitida"`
+  Modificada bool `json:"modificada"`
+  Registro int `json:"registro,omitempty"`
+}
+
+//reglaRecurrencia es el RRULE ya leido. Se soporta FREQ DAILY, WEEKLY,
+//MONTHLY y YEARLY con INTERVAL, BYDAY (sin numero adelante), BYMONTHDAY,
+//BYMONTH, BYSETPOS, COUNT y UNTIL.
+type reglaRecurrencia struct {
+  frecuencia string
+  intervalo int
+  diasMes []int
+  diasSemana map[time.Weekday]bool
+  meses map[time.Month]bool
+  posiciones []int
+  cuenta int
+  hasta time.Time
+}
+
+//dias de la semana como se escriben en RRULE.
+var diasRRULE = map[string]time.Weekday{
+  "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday, "TH": time.Thursday,
+  "FR": time.Friday, "SA": time.Saturday, "SU": time.Sunday,
+}
+
+//muRecurrencias evita que el programador y una peticion generen la misma
+//recurrencia al tiempo.
+var muRecurrencias sync.Mutex
+
+//initRecurrencias crea las tablas de recurrencias y sus excepciones y
+//agrega a los registros la recurrencia y la fecha que los genero. El indice
+//unico impide generar dos veces la misma fecha.
+func initRecurrencias() {
+  crearTablaRecurrencias := `
+  CREATE TABLE IF NOT EXISTS recurrencias(
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  libro_id INTEGER NOT NULL REFERENCES libros(id),
+  usuario TEXT NOT NULL,
+  tipo TEXT NOT NULL,
+  monto INTEGER NOT NULL,
+  moneda TEXT NOT NULL,
+  descripcion TEXT NOT NULL DEFAULT '',
+  grupo TEXT NOT NULL DEFAULT '',
+  cuenta_id INTEGER REFERENCES cuentas(id),
+  sobre_id INTEGER REFERENCES sobres(id),
+  regla TEXT NOT NULL,
+  inicio DATETIME NOT NULL,
+  activa INTEGER NOT NULL DEFAULT 1,
+  generada_hasta DATETIME
+  );`
+  
+  crearTablaExcepciones := `
+  CREATE TABLE IF NOT EXISTS excepciones_recurrencia(
+  recurrencia_id INTEGER NOT NULL REFERENCES recurrencias(id),
+  fecha TEXT NOT NULL,
+  omitir INTEGER NOT NULL DEFAULT 0,
+  monto INTEGER,
+  descripcion TEXT,
+  PRIMARY KEY(recurrencia_id, fecha)
+  );`
+  
+  _, err := db.Exec(crearTablaRecurrencias)
+  if err != nil {
+    log.Fatal("Error creando la tabla recurrencias", err)
+  }
+  _, err = db.Exec(crearTablaExcepciones)
+  if err != nil {
+    log.Fatal("Error creando la tabla excepciones_recurrencia", err)
+  }
+  
+  agregarColumna("registros", "recurrencia_id", "INTEGER REFERENCES recurrencias(id)")
+  agregarColumna("registros", "recurrencia_fecha", "TEXT")
+  _, err = db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS registros_recurrencia ON registros(recurrencia_id, recurrencia_fecha)")
+  if err != nil {
+    log.Fatal("Error creando el indice de recurrencias", err)
+  }
+}
+
+//leerRegla lee un RRULE como FREQ=MONTHLY;BYMONTHDAY=5. Lo que no se
+//soporta es un error, no se ignora.
+func leerRegla(s string) (reglaRecurrencia, error) {
+  rg := reglaRecurrencia{intervalo: 1}
+  s = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(s)), "RRULE:")
+  if s == "" {
+    return rg, fmt.Errorf("la regla es obligatoria, ejm FREQ=MONTHLY;BYMONTHDAY=5")
+  }
+  
+  for _, parte := range strings.Split(s, ";") {
+    clave, valor, ok := strings.Cut(parte, "=")
+    if !ok || valor == "" {
+      return rg, fmt.Errorf("parte invalida %q", parte)
+    }
+    var err error
+    switch clave {
+    case "FREQ":
+      if valor != "DAILY" && valor != "WEEKLY" && valor != "MONTHLY" && valor != "YEARLY" {
+        return rg, fmt.Errorf("FREQ solo puede ser DAILY, WEEKLY, MONTHLY o YEARLY")
+      }
+      rg.frecuencia = valor
+    case "INTERVAL":
+      rg.intervalo, err = strconv.Atoi(valor)
+      if err != nil || rg.intervalo < 1 {
+        return rg, fmt.Errorf("INTERVAL debe ser un numero mayor a 0")
+      }
+    case "COUNT":
+      rg.cuenta, err = strconv.Atoi(valor)
+      if err != nil || rg.cuenta < 1 {
+        return rg, fmt.Errorf("COUNT debe ser un numero mayor a 0")
+      }
+    case "UNTIL":
+      //solo importa el dia, ejm 20241231 o 20241231T000000Z.
+      rg.hasta, err = time.Parse("20060102", valor[:min(len(valor), 8)])
+      if err != nil {
+        return rg, fmt.Errorf("UNTIL debe ser AAAAMMDD")
+      }
+    case "BYDAY":
+      rg.diasSemana = map[time.Weekday]bool{}
+      for _, d := range strings.Split(valor, ",") {
+        dia, ok := diasRRULE[d]
+        if !ok {
+          return rg, fmt.Errorf("dia invalido %q en BYDAY, use MO, TU, WE, TH, FR, SA o SU", d)
+        }
+        rg.diasSemana[dia] = true
+      }
+    case "BYMONTH":
+      rg.meses = map[time.Month]bool{}
+      for _, m := range strings.Split(valor, ",") {
+        mes, err := strconv.Atoi(m)
+        if err != nil || mes < 1 || mes > 12 {
+          return rg, fmt.Errorf("mes invalido %q en BYMONTH", m)
+        }
+        rg.meses[time.Month(mes)] = true
+      }
+    case "BYMONTHDAY":
+      rg.diasMes, err = leerEnteros(valor, 31)
+      if err != nil {
+        return rg, fmt.Errorf("BYMONTHDAY %v", err)
+      }
+    case "BYSETPOS":
+      rg.posiciones, err = leerEnteros(valor, 366)
+      if err != nil {
+        return rg, fmt.Errorf("BYSETPOS %v", err)
+      }
+    default:
+      return rg, fmt.Errorf("%s no esta soportado", clave)
+    }
+  }
+  
+  if rg.frecuencia == "" {
+    return rg, fmt.Errorf("FREQ es obligatorio")
+  }
+  if rg.cuenta > 0 && !rg.hasta.IsZero() {
+    return rg, fmt.Errorf("COUNT y UNTIL no se pueden usar juntos")
+  }
+  return rg, nil
+}
+
+//leerEnteros lee una lista como 1,15,-1 donde cada numero esta entre
+//-maximo y maximo y no es 0.
+func leerEnteros(s string, maximo int) ([]int, error) {
+  var numeros []int
+  for _, parte := range strings.Split(s, ",") {
+    n, err := strconv.Atoi(parte)
+    if err != nil || n == 0 || n < -maximo || n > maximo {
+      return nil, fmt.Errorf("debe tener numeros entre 1 y %d o negativos desde el final", maximo)
+    }
+    numeros = append(numeros, n)
+  }
+  return numeros, nil
+}
+
+//inicioPeriodoRegla es el primer dia del periodo k contando desde el de
+//inicio. Las semanas empiezan el lunes.
+func (rg reglaRecurrencia) inicioPeriodoRegla(inicio time.Time, k int) time.Time {
+  paso := k * rg.intervalo
+  switch rg.frecuencia {
+  case "WEEKLY":
+    lunes := inicio.AddDate(0, 0, -((int(inicio.Weekday()) + 6) % 7))
+    return lunes.AddDate(0, 0, 7 * paso)
+  case "MONTHLY":
+    return time.Date(inicio.Year(), inicio.Month() + time.Month(paso), 1, 0, 0, 0, 0, time.UTC)
+  case "YEARLY":
+    return time.Date(inicio.Year() + paso, 1, 1, 0, 0, 0, 0, time.UTC)
+  }
+  return inicio.AddDate(0, 0, paso)
+}
+
+//diasDelMes son los dias del mes que pide la regla. Sin BYMONTHDAY ni
+//BYDAY es el mismo dia del mes de inicio, si el mes no lo tiene no hay.
+func (rg reglaRecurrencia) diasDelMes(anio int, mes time.Month, inicio time.Time) []time.Time {
+  primero := time.Date(anio, mes, 1, 0, 0, 0, 0, time.UTC)
+  ultimo := primero.AddDate(0, 1, -1).Day()
+  var dias []time.Time
+  switch {
+  case len(rg.diasMes) > 0:
+    for _, d := range rg.diasMes {
+      if d < 0 {
+        d = ultimo + 1 + d
+      }
+      if d >= 1 && d <= ultimo {
+        dias = append(dias, primero.AddDate(0, 0, d - 1))
+      }
+    }
+  case len(rg.diasSemana) > 0:
+    for d := 0; d < ultimo; d++ {
+      dias = append(dias, primero.AddDate(0, 0, d))
+    }
+  case inicio.Day() <= ultimo:
+    dias = append(dias, primero.AddDate(0, 0, inicio.Day() - 1))
+  }
+  return dias
+}
+
+//candidatos son las fechas del periodo que cumplen la regla, ordenadas y ya
+//filtradas por BYSETPOS.
+func (rg reglaRecurrencia) candidatos(inicio time.Time, periodo time.Time) []time.Time {
+  var dias []time.Time
+  switch rg.frecuencia {
+  case "DAILY":
+    dias = []time.Time{periodo}
+  case "WEEKLY":
+    semana := rg.diasSemana
+    if len(semana) == 0 {
+      semana = map[time.Weekday]bool{inicio.Weekday(): true}
+    }
+    for d := 0; d < 7; d++ {
+      dia := periodo.AddDate(0, 0, d)
+      if semana[dia.Weekday()] {
+        dias = append(dias, dia)
+      }
+    }
+  case "MONTHLY":
+    dias = rg.diasDelMes(periodo.Year(), periodo.Month(), inicio)
+  case "YEARLY":
+    //sin BYMONTH es el mes de inicio, salvo con BYDAY que es todo el anio.
+    todoElAnio := len(rg.meses) == 0 && len(rg.diasSemana) > 0
+    for mes := time.January; mes <= time.December; mes++ {
+      if todoElAnio || (len(rg.meses) == 0 && mes == inicio.Month()) || rg.meses[mes] {
+        dias = append(dias, rg.diasDelMes(periodo.Year(), mes, inicio)...)
+      }
+    }
+  }
+  
+  //los BY que no definieron los dias los limitan.
+  var filtrados []time.Time
+  for _, dia := range dias {
+    if len(rg.meses) > 0 && !rg.meses[dia.Month()] {
+      continue
+    }
+    if len(rg.diasSemana) > 0 && !rg.diasSemana[dia.Weekday()] {
+      continue
+    }
+    if len(rg.diasMes) > 0 && rg.frecuencia != "MONTHLY" && rg.frecuencia != "YEARLY" && !contieneDiaMes(rg.diasMes, dia) {
+      continue
+    }
+    filtrados = append(filtrados, dia)
+  }
+  sort.Slice(filtrados, func(i, j int) bool {
+    return filtrados[i].Before(filtrados[j])
+  })
+  if len(rg.posiciones) == 0 {
+    return filtrados
+  }
+  
+  var elegidos []time.Time
+  for _, p := range rg.posiciones {
+    if p < 0 {
+      p = len(filtrados) + 1 + p
+    }
+    if p >= 1 && p <= len(filtrados) {
+      elegidos = append(elegidos, filtrados[p - 1])
+    }
+  }
+  sort.Slice(elegidos, func(i, j int) bool {
+    return elegidos[i].Before(elegidos[j])
+  })
+  return elegidos
+}
+
+//contieneDiaMes dice si el dia esta en la lista de BYMONTHDAY, los
+//negativos cuentan desde el final del mes.
+func contieneDiaMes(diasMes []int, dia time.Time) bool {
+  ultimo := time.Date(dia.Year(), dia.Month() + 1, 0, 0, 0, 0, 0, time.UTC).Day()
+  for _, d := range diasMes {
+    if d == dia.Day() || ultimo + 1 + d == dia.Day() {
+      return true
+    }
+  }
+  return false
+}
+
+//ocurrencias retorna las fechas de la regla entre desde y hasta, las dos
+//incluidas. COUNT se cuenta desde inicio aunque desde sea despues.
+func (rg reglaRecurrencia) ocurrencias(inicio time.Time, desde time.Time, hasta time.Time) []time.Time {
+  if !rg.hasta.IsZero() && rg.hasta.Before(hasta) {
+    hasta = rg.hasta
+  }
+  var fechas []time.Time
+  n := 0
+  for k := 0; !rg.inicioPeriodoRegla(inicio, k).After(hasta); k++ {
+    for _, f := range rg.candidatos(inicio, rg.inicioPeriodoRegla(inicio, k)) {
+      if f.Before(inicio) {
+        continue
+      }
+      if f.After(hasta) {
+        return fechas
+      }
+      n++
+      if rg.cuenta > 0 && n > rg.cuenta {
+        return fechas
+      }
+      if !f.Before(desde) {
+        fechas = append(fechas, f)
+      }
+    }
+  }
+  return fechas
+}
+
+//soloDia deja la fecha a las 00:00 UTC, como se guardan los registros.
+func soloDia(t time.Time) time.Time {
+  t = t.UTC()
+  return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+//registro arma el registro de una fecha de la recurrencia.
+func (rc Recurrencia) registro(fecha time.Time) Registro {
+  return Registro{
+    Tipo: rc.Tipo,
+    Monto: rc.Monto,
+    Moneda: rc.Moneda,
+    Descripcion: rc.Descripcion,
+    Grupo: rc.Grupo,
+    Fecha: fecha,
+    Usuario: rc.Usuario,
+    Libro: rc.Libro,
+    Cuenta: rc.Cuenta,
+    Sobre: rc.Sobre,
+    Recurrencia: rc.Id,
+  }
+}
+
+//leerRecurrencia lee la recurrencia del body y la valida igual que
+//postEgreso y postIngreso validan un registro. Si hay error ya lo escribe
+//en w y retorna false.
+func leerRecurrencia(w http.ResponseWriter, r *http.Request, libro int) (Recurrencia, bool) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  var rc Recurrencia
+  err := json.NewDecoder(r.Body).Decode(&rc)
+  if err != nil {
+    http.Error(w, "Error al leer el json.", http.StatusBadRequest)
+    return rc, false
+  }
+  if rc.Tipo != "ingreso" && rc.Tipo != "egreso" {
+    http.Error(w, "Error, el tipo solo puede ser ingreso o egreso.", http.StatusBadRequest)
+    return rc, false
+  }
+  if rc.Monto.Unidades <= 0 || rc.Inicio.IsZero() {
+    http.Error(w, "Error, el monto y el inicio son obligatorios.", http.StatusBadRequest)
+    return rc, false
+  }
+  _, err = leerRegla(rc.Regla)
+  if err != nil {
+    writeError(w, "Error en la regla", err, http.StatusBadRequest)
+    return rc, false
+  }
+  rc.Regla = strings.TrimPrefix(strings.ToUpper(strings.TrimSpace(rc.Regla)), "RRULE:")
+  rc.Inicio = soloDia(rc.Inicio)
+  rc.Libro = libro
+  rc.Usuario = nombreUsuario
+  
+  //el registro de la primera fecha pasa por las mismas validaciones.
+  m := rc.registro(rc.Inicio)
+  if !resolverGrupoRequest(w, r, nombreUsuario, &m) {
+    return rc, false
+  }
+  if !validarCuentaRegistro(w, m) || !resolverMoneda(w, &m) || !validarSobreRegistro(w, m) {
+    return rc, false
+  }
+  rc.Grupo, rc.Moneda, rc.Monto = m.Grupo, m.Moneda, m.Monto
+  return rc, true
+}
+
+//columnas en el orden que las lee escanearRecurrencia.
+const columnasRecurrencia = "id, libro_id, usuario, tipo, monto, moneda, descripcion, grupo, COALESCE(cuenta_id, 0), COALESCE(sobre_id, 0), regla, inicio, activa, generada_hasta"
+
+//escanearRecurrencia lee una recurrencia con las columnas de
+//columnasRecurrencia.
+func escanearRecurrencia(s escaner) (rc Recurrencia, err error) {
+  var generada sql.NullTime
+  err = s.Scan(&rc.Id, &rc.Libro, &rc.Usuario, &rc.Tipo, &rc.Monto.Unidades, &rc.Moneda, &rc.Descripcion, &rc.Grupo, &rc.Cuenta, &rc.Sobre, &rc.Regla, &rc.Inicio, &rc.Activa, &generada)
+  rc.Monto.Exponente = exponenteMoneda(rc.Moneda)
+  if generada.Valid {
+    rc.GeneradaHasta = &generada.Time
+  }
+  return
+}
+
+//buscarRecurrencia retorna la recurrencia de la url si esta en un libro
+//del usuario. Con escritura exige que pueda modificar el libro. Si no
+//responde el error y retorna false.
+func buscarRecurrencia(w http.ResponseWriter, r *http.Request, escritura bool) (Recurrencia, bool) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  id, err := strconv.Atoi(mux.Vars(r)["id"])
+  if err != nil {
+    http.Error(w, "Error, el id debe ser un numero.", http.StatusBadRequest)
+    return Recurrencia{}, false
+  }
+  rc, err := escanearRecurrencia(db.QueryRow("SELECT " + columnasRecurrencia + " FROM recurrencias WHERE id = ? AND " + condicionMiembro, id, nombreUsuario))
+  if err == sql.ErrNoRows {
+    http.Error(w, "La recurrencia no existe.", http.StatusNotFound)
+    return rc, false
+  }
+  if err != nil {
+    writeError(w, "Error al consultar la recurrencia", err, http.StatusInternalServerError)
+    return rc, false
+  }
+  if escritura && !permisoLibro(w, rc.Libro, nombreUsuario, true) {
+    return rc, false
+  }
+  return rc, true
+}
+
+//getExcepciones retorna las excepciones de la recurrencia por fecha.
+func getExcepciones(ex ejecutor, rc Recurrencia) (map[string]ExcepcionRecurrencia, error) {
+  rows, err := ex.Query("SELECT fecha, omitir, monto, descripcion FROM excepciones_recurrencia WHERE recurrencia_id = ?", rc.Id)
+  if err != nil {
+    return nil, fmt.Errorf("Error al consultar las excepciones, %v", err)
+  }
+  defer rows.Close()
+  
+  excepciones := map[string]ExcepcionRecurrencia{}
+  for rows.Next() {
+    var e ExcepcionRecurrencia
+    var monto sql.NullInt64
+    var descripcion sql.NullString
+    err = rows.Scan(&e.Fecha, &e.Omitir, &monto, &descripcion)
+    if err != nil {
+      return nil, fmt.Errorf("Error al escanear las excepciones, %v", err)
+    }
+    if monto.Valid {
+      e.Monto = &Dinero{monto.Int64, rc.Monto.Exponente}
+    }
+    if descripcion.Valid {
+      e.Descripcion = &descripcion.String
+    }
+    excepciones[e.Fecha] = e
+  }
+  return excepciones, rows.Err()
+}
+
+//aplicarExcepcion retorna el registro de la fecha con los cambios de su
+//excepcion, false si esa fecha se omite.
+func aplicarExcepcion(m Registro, e ExcepcionRecurrencia, ok bool) (Registro, bool) {
+  if !ok {
+    return m, true
+  }
+  if e.Omitir {
+    return m, false
+  }
+  if e.Monto != nil {
+    m.Monto = *e.Monto
+  }
+  if e.Descripcion != nil {
+    m.Descripcion = *e.Descripcion
+  }
+  return m, true
+}
+
+//generarRecurrencia crea los registros de las fechas que llegaron desde la
+//ultima revision hasta hoy. Todo va en una transaccion con la nueva fecha
+//de revision, y si una fecha ya tiene registro no se crea otro.
+func generarRecurrencia(rc Recurrencia, hoy time.Time) (int, error) {
+  desde := rc.Inicio
+  if rc.GeneradaHasta != nil {
+    desde = soloDia(*rc.GeneradaHasta).AddDate(0, 0, 1)
+  }
+  if desde.After(hoy) {
+    return 0, nil
+  }
+  regla, err := leerRegla(rc.Regla)
+  if err != nil {
+    return 0, err
+  }
+  
+  tx, err := db.Begin()
+  if err != nil {
+    return 0, err
+  }
+  defer tx.Rollback()
+  
+  excepciones, err := getExcepciones(tx, rc)
+  if err != nil {
+    return 0, err
+  }
+  creados := 0
+  for _, fecha := range regla.ocurrencias(rc.Inicio, desde, hoy) {
+    dia := fecha.Format("2006-01-02")
+    e, ok := excepciones[dia]
+    m, crear := aplicarExcepcion(rc.registro(fecha), e, ok)
+    if !crear {
+      continue
+    }
+    var existe int
+    err = tx.QueryRow("SELECT COUNT(*) FROM registros WHERE recurrencia_id = ? AND recurrencia_fecha = ?", rc.Id, dia).Scan(&existe)
+    if err != nil {
+      return 0, err
+    }
+    if existe > 0 {
+      continue
+    }
+    id, err := insertarRegistro(tx, m, rc.Usuario)
+    if err != nil {
+      return 0, err
+    }
+    _, err = tx.Exec("UPDATE registros SET recurrencia_id = ?, recurrencia_fecha = ? WHERE id = ?", rc.Id, dia, id)
+    if err != nil {
+      return 0, err
+    }
+    creados++
+  }
+  
+  _, err = tx.Exec("UPDATE recurrencias SET generada_hasta = ? WHERE id = ?", hoy, rc.Id)
+  if err != nil {
+    return 0, err
+  }
+  return creados, tx.Commit()
+}
+
+//motivoPausaRecurrencia revisa que el usuario de la recurrencia todavia
+//pueda crear sus registros: que este activo, siga en el libro sin ser
+//lector y que la cuenta y el sobre no esten archivados. Retorna por que no
+//puede, o "" si puede.
+func motivoPausaRecurrencia(rc Recurrencia) (string, error) {
+  var activo bool
+  err := db.QueryRow("SELECT activo FROM usuarios WHERE nombre = ?", rc.Usuario).Scan(&activo)
+  if err == sql.ErrNoRows || (err == nil && !activo) {
+    return fmt.Sprintf("el usuario %s esta desactivado", rc.Usuario), nil
+  }
+  if err != nil {
+    return "", err
+  }
+  rol, err := rolEnLibro(rc.Libro, rc.Usuario)
+  if err == sql.ErrNoRows {
+    return fmt.Sprintf("el usuario %s ya no es miembro del libro %d", rc.Usuario, rc.Libro), nil
+  }
+  if err != nil {
+    return "", err
+  }
+  if rol == "lector" {
+    return fmt.Sprintf("el usuario %s es lector del libro %d", rc.Usuario, rc.Libro), nil
+  }
+  if rc.Cuenta != 0 {
+    var archivada bool
+    err = db.QueryRow("SELECT archivada FROM cuentas WHERE id = ?", rc.Cuenta).Scan(&archivada)
+    if err == sql.ErrNoRows || (err == nil && archivada) {
+      return fmt.Sprintf("la cuenta %d esta archivada", rc.Cuenta), nil
+    }
+    if err != nil {
+      return "", err
+    }
+  }
+  if rc.Sobre != 0 {
+    status, err := sobreDelLibro(rc.Sobre, rc.Libro)
+    if status == http.StatusUnprocessableEntity {
+      return err.Error(), nil
+    }
+    if err != nil {
+      return "", err
+    }
+  }
+  return "", nil
+}
+
+//generarRecurrencias revisa todas las recurrencias activas. Un error en
+//una no detiene las demas, y las que su usuario ya no puede crear se
+//pausan.
+func generarRecurrencias(hoy time.Time) {
+  muRecurrencias.Lock()
+  defer muRecurrencias.Unlock()
+  
+  rows, err := db.Query("SELECT " + columnasRecurrencia + " FROM recurrencias WHERE activa = 1 AND (generada_hasta IS NULL OR generada_hasta < ?)", hoy)
+  if err != nil {
+    log.Printf("Error al consultar las recurrencias, %v", err)
+    return
+  }
+  //leemos todo antes de escribir para no tener la consulta abierta.
+  var recurrencias []Recurrencia
+  for rows.Next() {
+    rc, err := escanearRecurrencia(rows)
+    if err != nil {
+      log.Printf("Error al escanear las recurrencias, %v", err)
+      continue
+    }
+    recurrencias = append(recurrencias, rc)
+  }
+  rows.Close()
+  
+  for _, rc := range recurrencias {
+    motivo, err := motivoPausaRecurrencia(rc)
+    if err != nil {
+      log.Printf("Error al revisar la recurrencia %d, %v", rc.Id, err)
+      continue
+    }
+    if motivo != "" {
+      _, err = db.Exec("UPDATE recurrencias SET activa = 0 WHERE id = ?", rc.Id)
+      if err != nil {
+        log.Printf("Error al pausar la recurrencia %d, %v", rc.Id, err)
+        continue
+      }
+      log.Printf("Recurrencia %d pausada, %s", rc.Id, motivo)
+      continue
+    }
+    creados, err := generarRecurrencia(rc, hoy)
+    if err != nil {
+      log.Printf("Error al generar la recurrencia %d, %v", rc.Id, err)
+      continue
+    }
+    if creados > 0 {
+      log.Printf("Recurrencia %d: %d registros creados", rc.Id, creados)
+    }
+  }
+}
+
+//iniciarProgramador genera lo pendiente al arrancar y luego cada
+//RECURRENCIAS_INTERVALO (por defecto cada hora) en una goroutine.
+func iniciarProgramador() {
+  intervalo := time.Hour
+  if s := os.Getenv("RECURRENCIAS_INTERVALO"); s != "" {
+    d, err := time.ParseDuration(s)
+    if err != nil || d < time.Minute {
+      log.Fatal("Error, RECURRENCIAS_INTERVALO debe ser una duracion de al menos 1m, ejm 30m")
+    }
+    intervalo = d
+  }
+  
+  generarRecurrencias(soloDia(time.Now()))
+  go func() {
+    for range time.Tick(intervalo) {
+      generarRecurrencias(soloDia(time.Now()))
+    }
+  }()
+}
+
+//getRecurrencias lista las recurrencias del libro.
+//ejm http://100.69.187.16:8080/recurrencias?libro=2
+func getRecurrencias(w http.ResponseWriter, r *http.Request) {
+  libro, ok := libroPeticion(w, r, false)
+  if !ok {
+    return
+  }
+  rows, err := db.Query("SELECT " + columnasRecurrencia + " FROM recurrencias WHERE libro_id = ? ORDER BY id", libro)
+  if err != nil {
+    writeError(w, "Error al consultar las recurrencias", err, http.StatusInternalServerError)
+    return
+  }
+  defer rows.Close()
+  
+  recurrencias := []Recurrencia{}
+  for rows.Next() {
+    rc, err := escanearRecurrencia(rows)
+    if err != nil {
+      writeError(w, "Error al escanear las recurrencias", err, http.StatusInternalServerError)
+      return
+    }
+    recurrencias = append(recurrencias, rc)
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(recurrencias)
+}
+
+//postRecurrencia crea la recurrencia y de una vez genera las fechas que ya
+//pasaron desde el inicio.
+//ejm http://100.69.187.16:8080/recurrencias?libro=2
+//Json ejemplo{"tipo": "egreso", "monto": 1200000, "descripcion": "Arriendo", "grupo": "Vivienda", "regla": "FREQ=MONTHLY;BYMONTHDAY=5", "inicio": "2024-01-05T00:00:00Z"}
+func postRecurrencia(w http.ResponseWriter, r *http.Request) {
+  libro, ok := libroPeticion(w, r, true)
+  if !ok {
+    return
+  }
+  rc, ok := leerRecurrencia(w, r, libro)
+  if !ok {
+    return
+  }
+  rc.Activa = true
+  rc.GeneradaHasta = nil
+  
+  res, err := db.Exec("INSERT INTO recurrencias(libro_id, usuario, tipo, monto, moneda, descripcion, grupo, cuenta_id, sobre_id, regla, inicio) VALUES(?, ?, ?, ?, ?, ?, ?, NULLIF(?, 0), NULLIF(?, 0), ?, ?)",
+    rc.Libro, rc.Usuario, rc.Tipo, rc.Monto.Unidades, rc.Moneda, rc.Descripcion, rc.Grupo, rc.Cuenta, rc.Sobre, rc.Regla, rc.Inicio)
+  if err != nil {
+    writeError(w, "Error al guardar la recurrencia", err, http.StatusInternalServerError)
+    return
+  }
+  id, _ := res.LastInsertId()
+  rc.Id = int(id)
+  
+  muRecurrencias.Lock()
+  hoy := soloDia(time.Now())
+  _, err = generarRecurrencia(rc, hoy)
+  muRecurrencias.Unlock()
+  if err != nil {
+    writeError(w, "Error al generar los registros de la recurrencia", err, http.StatusInternalServerError)
+    return
+  }
+  rc.GeneradaHasta = &hoy
+  
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(http.StatusCreated)
+  json.NewEncoder(w).Encode(rc)
+}
+
+//putRecurrencia cambia la recurrencia, los cambios solo aplican a las
+//fechas que no se han generado. Con activa en false se pausa y al volver a
+//activarla no se generan las fechas de la pausa. Asi tambien se reactiva
+//una que pauso el programador.
+//ejm http://100.69.187.16:8080/recurrencias/4
+//Json ejemplo{"tipo": "egreso", "monto": 1300000, "descripcion": "Arriendo", "grupo": "Vivienda", "regla": "FREQ=MONTHLY;BYMONTHDAY=5", "inicio": "2024-01-05T00:00:00Z", "activa": true}
+func putRecurrencia(w http.ResponseWriter, r *http.Request) {
+  anterior, ok := buscarRecurrencia(w, r, true)
+  if !ok {
+    return
+  }
+  rc, ok := leerRecurrencia(w, r, anterior.Libro)
+  if !ok {
+    return
+  }
+  //quien la cambia queda como su usuario, el grupo ya se busco en sus
+  //categorias y asi se puede reactivar una que se pauso por el anterior.
+  rc.Id = anterior.Id
+  rc.GeneradaHasta = anterior.GeneradaHasta
+  if rc.Activa && !anterior.Activa {
+    hoy := soloDia(time.Now())
+    rc.GeneradaHasta = &hoy
+  }
+  
+  _, err := db.Exec("UPDATE recurrencias SET usuario = ?, tipo = ?, monto = ?, moneda = ?, descripcion = ?, grupo = ?, cuenta_id = NULLIF(?, 0), sobre_id = NULLIF(?, 0), regla = ?, inicio = ?, activa = ?, generada_hasta = ? WHERE id = ?",
+    rc.Usuario, rc.Tipo, rc.Monto.Unidades, rc.Moneda, rc.Descripcion, rc.Grupo, rc.Cuenta, rc.Sobre, rc.Regla, rc.Inicio, rc.Activa, rc.GeneradaHasta, rc.Id)
+  if err != nil {
+    writeError(w, "Error al actualizar la recurrencia", err, http.StatusInternalServerError)
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(rc)
+}
+
+//deleteRecurrencia elimina la recurrencia y sus excepciones. Los registros
+//que ya genero se quedan.
+//ejm http://100.69.187.16:8080/recurrencias/4
+func deleteRecurrencia(w http.ResponseWriter, r *http.Request) {
+  rc, ok := buscarRecurrencia(w, r, true)
+  if !ok {
+    return
+  }
+  
+  muRecurrencias.Lock()
+  defer muRecurrencias.Unlock()
+  tx, err := db.Begin()
+  if err != nil {
+    writeError(w, "Error al iniciar la transaccion", err, http.StatusInternalServerError)
+    return
+  }
+  defer tx.Rollback()
+  
+  consultas := []string{
+    "UPDATE registros SET recurrencia_id = NULL, recurrencia_fecha = NULL WHERE recurrencia_id = ?",
+    "DELETE FROM excepciones_recurrencia WHERE recurrencia_id = ?",
+    "DELETE FROM recurrencias WHERE id = ?",
+  }
+  for _, consulta := range consultas {
+    _, err = tx.Exec(consulta, rc.Id)
+    if err != nil {
+      writeError(w, "Error al eliminar la recurrencia", err, http.StatusInternalServerError)
+      return
+    }
+  }
+  err = tx.Commit()
+  if err != nil {
+    writeError(w, "Error al guardar los cambios", err, http.StatusInternalServerError)
+    return
+  }
+  w.WriteHeader(http.StatusNoContent)
+}
+
+//leerCantidad lee ?n= con un valor por defecto y un maximo.
+func leerCantidad(r *http.Request, defecto int, maximo int) (int, error) {
+  s := r.URL.Query().Get("n")
+  if s == "" {
+    return defecto, nil
+  }
+  n, err := strconv.Atoi(s)
+  if err != nil || n < 1 || n > maximo {
+    return 0, fmt.Errorf("n debe ser un numero entre 1 y %d", maximo)
+  }
+  return n, nil
+}
+
+//proximasOcurrencias retorna hasta n fechas de la regla desde el dia dado,
+//buscando maximo 10 años adelante.
+func proximasOcurrencias(regla reglaRecurrencia, inicio time.Time, desde time.Time, n int) []time.Time {
+  if desde.Before(inicio) {
+    desde = inicio
+  }
+  fechas := regla.ocurrencias(inicio, desde, desde.AddDate(10, 0, 0))
+  if len(fechas) > n {
+    fechas = fechas[:n]
+  }
+  return fechas
+}
+
+//getProximasRecurrencia muestra las proximas fechas de la recurrencia con
+//sus excepciones y el registro si ya se genero. Sin desde es desde hoy.
+//ejm http://100.69.187.16:8080/recurrencias/4/proximas?n=12&desde=2024-01-01T00:00:00Z
+func getProximasRecurrencia(w http.ResponseWriter, r *http.Request) {
+  rc, ok := buscarRecurrencia(w, r, false)
+  if !ok {
+    return
+  }
+  n, err := leerCantidad(r, 10, 100)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  desde := soloDia(time.Now())
+  if r.URL.Query().Get("desde") != "" {
+    desde, err = leerFecha(r, "desde")
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusBadRequest)
+      return
+    }
+  }
+  regla, err := leerRegla(rc.Regla)
+  if err != nil {
+    writeError(w, "Error en la regla guardada", err, http.StatusInternalServerError)
+    return
+  }
+  excepciones, err := getExcepciones(db, rc)
+  if err != nil {
+    writeError(w, "Error al consultar las excepciones", err, http.StatusInternalServerError)
+    return
+  }
+  
+  proximas := []OcurrenciaRecurrencia{}
+  for _, fecha := range proximasOcurrencias(regla, rc.Inicio, soloDia(desde), n) {
+    dia := fecha.Format("2006-01-02")
+    e, conExcepcion := excepciones[dia]
+    m, crear := aplicarExcepcion(rc.registro(fecha), e, conExcepcion)
+    o := OcurrenciaRecurrencia{Fecha: fecha, Monto: m.Monto, Descripcion: m.Descripcion, Omitida: !crear, Modificada: conExcepcion && crear}
+    err = db.QueryRow("SELECT id FROM registros WHERE recurrencia_id = ? AND recurrencia_fecha = ?", rc.Id, dia).Scan(&o.Registro)
+    if err != nil && err != sql.ErrNoRows {
+      writeError(w, "Error al consultar los registros generados", err, http.StatusInternalServerError)
+      return
+    }
+    proximas = append(proximas, o)
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(proximas)
+}
+
+//getPrevisualizarRegla muestra las fechas de una regla antes de crear la
+//recurrencia. Sin inicio empieza hoy.
+//ejm http://100.69.187.16:8080/recurrencias/previsualizar?regla=FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=-1&n=6
+func getPrevisualizarRegla(w http.ResponseWriter, r *http.Request) {
+  regla, err := leerRegla(r.URL.Query().Get("regla"))
+  if err != nil {
+    writeError(w, "Error en la regla", err, http.StatusBadRequest)
+    return
+  }
+  n, err := leerCantidad(r, 10, 100)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  inicio := soloDia(time.Now())
+  if r.URL.Query().Get("inicio") != "" {
+    inicio, err = leerFecha(r, "inicio")
+    if err != nil {
+      http.Error(w, err.Error(), http.StatusBadRequest)
+      return
+    }
+  }
+  
+  fechas := proximasOcurrencias(regla, inicio, inicio, n)
+  if fechas == nil {
+    fechas = []time.Time{}
+  }
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(fechas)
+}
+
+//putOcurrenciaRecurrencia omite o cambia una sola fecha de la recurrencia.
+//La fecha debe ser de la regla y no haberse generado, lo ya generado se
+//cambia en /movimiento/{id}.
+//ejm http://100.69.187.16:8080/recurrencias/4/ocurrencias/2024-12-05
+//Json ejemplo{"omitir": false, "monto": 1350000, "descripcion": "Arriendo con administracion"}
+func putOcurrenciaRecurrencia(w http.ResponseWriter, r *http.Request) {
+  rc, ok := buscarRecurrencia(w, r, true)
+  if !ok {
+    return
+  }
+  e, ok := fechaOcurrencia(w, r, rc)
+  if !ok {
+    return
+  }
+  var generado int
+  err := db.QueryRow("SELECT COUNT(*) FROM registros WHERE recurrencia_id = ? AND recurrencia_fecha = ?", rc.Id, e.Fecha).Scan(&generado)
+  if err != nil {
+    writeError(w, "Error al consultar los registros generados", err, http.StatusInternalServerError)
+    return
+  }
+  if generado > 0 {
+    http.Error(w, "Error, esa fecha ya se genero, cambie el registro en /movimiento/{id}.", http.StatusConflict)
+    return
+  }
+  
+  fecha := e.Fecha
+  err = json.NewDecoder(r.Body).Decode(&e)
+  if err != nil {
+    http.Error(w, "Error al leer el json.", http.StatusBadRequest)
+    return
+  }
+  e.Fecha = fecha
+  var monto interface{}
+  if e.Monto != nil {
+    escalado, err := e.Monto.Escalar(rc.Monto.Exponente)
+    if err != nil || escalado.Unidades <= 0 {
+      http.Error(w, "Error, el monto debe ser mayor a 0 y con los decimales de la moneda.", http.StatusBadRequest)
+      return
+    }
+    e.Monto = &escalado
+    monto = escalado.Unidades
+  }
+  
+  _, err = db.Exec("INSERT OR REPLACE INTO excepciones_recurrencia(recurrencia_id, fecha, omitir, monto, descripcion) VALUES(?, ?, ?, ?, ?)",
+    rc.Id, e.Fecha, e.Omitir, monto, e.Descripcion)
+  if err != nil {
+    writeError(w, "Error al guardar la excepcion", err, http.StatusInternalServerError)
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(e)
+}
+
+//deleteOcurrenciaRecurrencia quita la excepcion de la fecha, vuelve a ser
+//como dice la recurrencia.
+//ejm http://100.69.187.16:8080/recurrencias/4/ocurrencias/2024-12-05
+func deleteOcurrenciaRecurrencia(w http.ResponseWriter, r *http.Request) {
+  rc, ok := buscarRecurrencia(w, r, true)
+  if !ok {
+    return
+  }
+  res, err := db.Exec("DELETE FROM excepciones_recurrencia WHERE recurrencia_id = ? AND fecha = ?", rc.Id, mux.Vars(r)["fecha"])
+  if err != nil {
+    writeError(w, "Error al eliminar la excepcion", err, http.StatusInternalServerError)
+    return
+  }
+  if filas, _ := res.RowsAffected(); filas == 0 {
+    http.Error(w, "Esa fecha no tiene excepcion.", http.StatusNotFound)
+    return
+  }
+  w.WriteHeader(http.StatusNoContent)
+}
+
+//fechaOcurrencia lee la fecha de la url y revisa que sea de la regla. Si
+//no responde el error y retorna false.
+func fechaOcurrencia(w http.ResponseWriter, r *http.Request, rc Recurrencia) (ExcepcionRecurrencia, bool) {
+  fecha, err := time.Parse("2006-01-02", mux.Vars(r)["fecha"])
+  if err != nil {
+    http.Error(w, "Error, la fecha debe ser AAAA-MM-DD.", http.StatusBadRequest)
+    return ExcepcionRecurrencia{}, false
+  }
+  regla, err := leerRegla(rc.Regla)
+  if err != nil {
+    writeError(w, "Error en la regla guardada", err, http.StatusInternalServerError)
+    return ExcepcionRecurrencia{}, false
+  }
+  if len(regla.ocurrencias(rc.Inicio, fecha, fecha)) == 0 {
+    http.Error(w, "Error, la recurrencia no tiene esa fecha.", http.StatusUnprocessableEntity)
+    return ExcepcionRecurrencia{}, false
+  }
+  return ExcepcionRecurrencia{Fecha: fecha.Format("2006-01-02")}, true
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+  "strings"
+  "testing"
+  "time"
+)
+
+func TestLeerReglaErrores(t *testing.T) {
+  casos := []string{
+    "",
+    "BYMONTHDAY=5",
+    "FREQ=HOURLY",
+    "FREQ=MONTHLY;INTERVAL=0",
+    "FREQ=MONTHLY;COUNT=-1",
+    "FREQ=MONTHLY;COUNT=3;UNTIL=20241231",
+    "FREQ=MONTHLY;UNTIL=2024-12-31",
+    "FREQ=WEEKLY;BYDAY=2",
+    "FREQ=WEEKLY;BYDAY=2MO",
+    "FREQ=YEARLY;BYMONTH=13",
+    "FREQ=MONTHLY;BYMONTHDAY=0",
+    "FREQ=MONTHLY;BYMONTHDAY=32",
+    "FREQ=MONTHLY;BYSETPOS=x",
+    "FREQ=MONTHLY;BYHOUR=9",
+    "FREQ=MONTHLY;BYMONTHDAY",
+  }
+  
+  for _, regla := range casos {
+    if _, err := leerRegla(regla); err == nil {
+      t.Errorf("leerRegla(%q) esperaba un error", regla)
+    }
+  }
+}
+
+func TestOcurrencias(t *testing.T) {
+  casos := []struct {
+    regla string
+    inicio string
+    desde string
+    hasta string
+    esperado string
+  }{
+    {"FREQ=DAILY;INTERVAL=3", "2024-01-01", "2024-01-01", "2024-01-10",
+      "2024-01-01 2024-01-04 2024-01-07 2024-01-10"},
+    {"FREQ=WEEKLY;INTERVAL=2", "2024-01-03", "2024-01-01", "2024-02-15",
+      "2024-01-03 2024-01-17 2024-01-31 2024-02-14"},
+    {"FREQ=WEEKLY;BYDAY=MO,FR", "2024-01-03", "2024-01-01", "2024-01-15",
+      "2024-01-05 2024-01-08 2024-01-12 2024-01-15"},
+    //el ultimo dia habil de cada mes.
+    {"FREQ=MONTHLY;BYDAY=MO,TU,WE,TH,FR;BYSETPOS=-1", "2024-01-01", "2024-01-01", "2024-06-30",
+      "2024-01-31 2024-02-29 2024-03-29 2024-04-30 2024-05-31 2024-06-28"},
+    //los meses sin dia 31 se saltan.
+    {"FREQ=MONTHLY", "2024-01-31", "2024-01-01", "2024-06-30",
+      "2024-01-31 2024-03-31 2024-05-31"},
+    {"FREQ=MONTHLY;BYMONTHDAY=-1;COUNT=3", "2024-01-01", "2024-01-01", "2024-12-31",
+      "2024-01-31 2024-02-29 2024-03-31"},
+    {"FREQ=MONTHLY;BYMONTHDAY=1,15", "2024-01-10", "2024-01-01", "2024-02-29",
+      "2024-01-15 2024-02-01 2024-02-15"},
+    {"FREQ=MONTHLY;UNTIL=20240315", "2024-01-15", "2024-01-01", "2024-12-31",
+      "2024-01-15 2024-02-15 2024-03-15"},
+    //COUNT se cuenta desde inicio aunque desde sea despues.
+    {"FREQ=MONTHLY;COUNT=3", "2024-01-05", "2024-02-01", "2024-12-31",
+      "2024-02-05 2024-03-05"},
+    {"FREQ=YEARLY;BYMONTH=3,9;BYMONTHDAY=10", "2024-01-01", "2024-01-01", "2025-06-30",
+      "2024-03-10 2024-09-10 2025-03-10"},
+    //sin BYMONTH el BYDAY es sobre todo el anio, el primer lunes de cada uno.
+    {"FREQ=YEARLY;BYDAY=MO;BYSETPOS=1", "2024-06-15", "2024-01-01", "2026-12-31",
+      "2025-01-06 2026-01-05"},
+    {"FREQ=YEARLY;BYDAY=SU;COUNT=3", "2024-12-20", "2024-01-01", "2025-12-31",
+      "2024-12-22 2024-12-29 2025-01-05"},
+    {"FREQ=YEARLY", "2024-02-29", "2024-01-01", "2028-12-31",
+      "2024-02-29 2028-02-29"},
+    {"RRULE:freq=monthly;bymonthday=5", "2024-01-01", "2024-01-01", "2024-02-29",
+      "2024-01-05 2024-02-05"},
+  }
+  
+  for _, c := range casos {
+    t.Run(c.regla, func(t *testing.T) {
+      rg, err := leerRegla(c.regla)
+      if err != nil {
+        t.Fatalf("error inesperado %v", err)
+      }
+      var fechas []string
+      for _, f := range rg.ocurrencias(fechaPrueba(t, c.inicio), fechaPrueba(t, c.desde), fechaPrueba(t, c.hasta)) {
+        fechas = append(fechas, f.Format("2006-01-02"))
+      }
+      if obtenido := strings.Join(fechas, " "); obtenido != c.esperado {
+        t.Errorf("obtuvo %s, esperaba %s", obtenido, c.esperado)
+      }
+    })
+  }
+}
+
+//fechaPrueba lee una fecha AAAA-MM-DD en UTC.
+func fechaPrueba(t *testing.T, s string) time.Time {
+  t.Helper()
+  f, err := time.Parse("2006-01-02", s)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return f
+}
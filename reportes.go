@@ -0,0 +1,320 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "net/http"
+  "sort"
+  "strings"
+  "time"
+  
+  "github.com/jung-kurt/gofpdf"
+)
+
+//ReporteMensual es el extracto de un mes: saldo con el que inicia, los
+//movimientos por grupo y el saldo con el que cierra.
+type ReporteMensual struct {
+  Mes string `json:"mes"`
+  Moneda string `json:"moneda"`
+  SaldoInicial Dinero `json:"saldoInicial"`
+  Ingresos Dinero `json:"ingresos"`
+  Egresos Dinero `json:"egresos"`
+  SaldoFinal Dinero `json:"saldoFinal"`
+  Grupos []GrupoReporte `json:"grupos"`
+}
+
+//GrupoReporte son los movimientos de un grupo dentro del reporte con sus
+//subtotales.
+type GrupoReporte struct {
+  Grupo string `json:"grupo"`
+  Ingresos Dinero `json:"ingresos"`
+  Egresos Dinero `json:"egresos"`
+  Registros []RegistroSimple `json:"registros"`
+}
+
+//getReporteMensual genera el extracto del mes en pdf, con formato=json
+//responde los mismos datos sin armar el documento. Con moneda=USD todo el
+//extracto sale en esa moneda.
+//ejm http://100.69.187.16:8080/reportes/mensual?mes=2024-12&formato=pdf&moneda=USD
+func getReporteMensual(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  mes, err := time.Parse("2006-01", r.URL.Query().Get("mes"))
+  if err != nil {
+    errorStr := fmt.Sprintf("Error en el mes ingresado, debe ser AAAA-MM, %v", err)
+    http.Error(w, errorStr, http.StatusBadRequest)
+    return
+  }
+  formato := r.URL.Query().Get("formato")
+  if formato == "" {
+    formato = "pdf"
+  }
+  if formato != "pdf" && formato != "json" {
+    http.Error(w, "El formato solo puede ser pdf o json.", http.StatusBadRequest)
+    return
+  }
+  moneda, err := leerMoneda(r)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  
+  libro, ok := libroPeticion(w, r, false)
+  if !ok {
+    return
+  }
+  
+  reporte, err := getReporte(libro, nombreUsuario, mes, moneda)
+  if err != nil {
+    writeError(w, "Error al armar el reporte", err, statusConversion(err))
+    return
+  }
+  
+  if formato == "json" {
+    w.Header().Set("Content-Type", "application/json")
+    json.NewEncoder(w).Encode(reporte)
+    return
+  }
+  
+  //armamos el pdf completo antes de escribir para poder responder el error.
+  pdf := generarPDFReporte(reporte, nombreUsuario)
+  if pdf.Err() {
+    writeError(w, "Error al generar el pdf", pdf.Error(), http.StatusInternalServerError)
+    return
+  }
+  w.Header().Set("Content-Disposition", "attachment; filename=extracto-" + reporte.Mes + ".pdf")
+  w.Header().Set("Content-Type", "application/pdf")
+  err = pdf.Output(w)
+  if err != nil {
+    writeError(w, "Error al escribir el pdf", err, http.StatusInternalServerError)
+  }
+}
+
+//getReporte junta los datos del mes, hasta el ultimo instante del ultimo
+//dia porque la api acepta registros a cualquier hora. Cada registro se pasa
+//a la moneda del reporte con la tasa de su fecha.
+func getReporte(libro int, usuario string, mes time.Time, moneda string) (ReporteMensual, error) {
+  desde := time.Date(mes.Year(), mes.Month(), 1, 0, 0, 0, 0, time.UTC)
+  hasta := desde.AddDate(0, 1, 0).Add(-time.Nanosecond)
+  reporte := ReporteMensual{Mes: desde.Format("2006-01"), Moneda: moneda, Grupos: []GrupoReporte{}}
+  
+  //el saldo inicial es todo lo anterior al primer dia del mes.
+  inicial, err := getBalance(libro, usuario, desde, false, moneda)
+  if err != nil {
+    return reporte, err
+  }
+  reporte.SaldoInicial = inicial.Balance
+  
+  reporte.Ingresos, err = getTotal("ingreso", desde, hasta, libro, usuario, moneda)
+  if err != nil {
+    return reporte, err
+  }
+  reporte.Egresos, err = getTotal("egreso", desde, hasta, libro, usuario, moneda)
+  if err != nil {
+    return reporte, err
+  }
+  reporte.SaldoFinal = reporte.SaldoInicial.Mas(reporte.Ingresos).Menos(reporte.Egresos)
+  
+  registros, err := getRegistrosFechas(desde, hasta, libro, usuario)
+  if err != nil {
+    return reporte, err
+  }
+  
+  //los registros vienen por fecha, asi que cada grupo queda ordenado.
+  conv := nuevoConversor(moneda)
+  exponente := exponenteMoneda(moneda)
+  indices := map[string]int{}
+  for j, m := range registrosASimples(registros) {
+    convertido, err := conv.convertir(m.Monto, registros[j].Moneda, m.Fecha.Format("2006-01-02"))
+    if err != nil {
+      return reporte, err
+    }
+    m.Monto, m.Moneda = dineroDeRat(convertido, exponente), moneda
+    i, ok := indices[m.Grupo]
+    if !ok {
+      i = len(reporte.Grupos)
+      indices[m.Grupo] = i
+      reporte.Grupos = append(reporte.Grupos, GrupoReporte{Grupo: m.Grupo, Ingresos: Dinero{0, exponente}, Egresos: Dinero{0, exponente}})
+    }
+    g := &reporte.Grupos[i]
+    g.Registros = append(g.Registros, m)
+    //las transferencias salen en la lista pero no suman, como en los totales.
+    if registros[j].Transferencia != 0 {
+      continue
+    }
+    if m.Tipo == "ingreso" {
+      g.Ingresos = g.Ingresos.Mas(m.Monto)
+    } else {
+      g.Egresos = g.Egresos.Mas(m.Monto)
+    }
+  }
+  sort.Slice(reporte.Grupos, func(i, j int) bool {
+    return reporte.Grupos[i].Grupo < reporte.Grupos[j].Grupo
+  })
+  
+  return reporte, nil
+}
+
+//generarPDFReporte dibuja el extracto: encabezado con los saldos, una
+//tabla por grupo con su subtotal y al final la grafica de egresos por grupo.
+//Los errores de gofpdf quedan guardados en el documento, se revisan con Err.
+func generarPDFReporte(reporte ReporteMensual, usuario string) *gofpdf.Fpdf {
+  pdf := gofpdf.New("P", "mm", "A4", "")
+  //las fuentes basicas no son utf-8, traducimos tildes y eñes.
+  tr := pdf.UnicodeTranslatorFromDescriptor("")
+  pdf.SetTitle("Extracto " + reporte.Mes, true)
+  pdf.SetAuthor(usuario, true)
+  pdf.AliasNbPages("")
+  pdf.SetFooterFunc(func() {
+    pdf.SetY(-15)
+    pdf.SetFont("Helvetica", "I", 8)
+    pdf.CellFormat(0, 10, fmt.Sprintf("Pagina %d de {nb}", pdf.PageNo()), "", 0, "C", false, 0, "")
+  })
+  pdf.AddPage()
+  
+  pdf.SetFont("Helvetica", "B", 16)
+  pdf.CellFormat(0, 10, tr("Extracto mensual " + reporte.Mes + " (" + reporte.Moneda + ")"), "", 1, "L", false, 0, "")
+  pdf.SetFont("Helvetica", "", 10)
+  pdf.CellFormat(0, 6, tr("Usuario: " + usuario), "", 1, "L", false, 0, "")
+  pdf.Ln(4)
+  
+  //resumen de saldos
+  filasSaldo := [][2]string{
+    {"Saldo inicial", formatearMonto(reporte.SaldoInicial)},
+    {"Ingresos", formatearMonto(reporte.Ingresos)},
+    {"Egresos", formatearMonto(Dinero{-reporte.Egresos.Unidades, reporte.Egresos.Exponente})},
+    {"Saldo final", formatearMonto(reporte.SaldoFinal)},
+  }
+  for i, f := range filasSaldo {
+    estilo := ""
+    if i == 0 || i == len(filasSaldo) - 1 {
+      estilo = "B"
+    }
+    pdf.SetFont("Helvetica", estilo, 11)
+    pdf.CellFormat(50, 7, tr(f[0]), "", 0, "L", false, 0, "")
+    pdf.CellFormat(40, 7, f[1] + " " + reporte.Moneda, "", 1, "R", false, 0, "")
+  }
+  pdf.Ln(6)
+  
+  //una tabla por grupo
+  anchos := []float64{25, 95, 35, 35}
+  for _, g := range reporte.Grupos {
+    nombre := g.Grupo
+    if nombre == "" {
+      nombre = "Sin grupo"
+    }
+    pdf.SetFont("Helvetica", "B", 12)
+    pdf.SetFillColor(230, 230, 230)
+    pdf.CellFormat(0, 8, tr(nombre), "", 1, "L", true, 0, "")
+  
+    pdf.SetFont("Helvetica", "B", 9)
+    for i, titulo := range []string{"Fecha", "Descripcion", "Ingreso", "Egreso"} {
+      alineacion := "L"
+      if i > 1 {
+        alineacion = "R"
+      }
+      pdf.CellFormat(anchos[i], 6, tr(titulo), "B", 0, alineacion, false, 0, "")
+    }
+    pdf.Ln(-1)
+  
+    pdf.SetFont("Helvetica", "", 9)
+    for _, m := range g.Registros {
+      ingreso, egreso := "", ""
+      if m.Tipo == "ingreso" {
+        ingreso = formatearMonto(m.Monto)
+      } else {
+        egreso = formatearMonto(m.Monto)
+      }
+      pdf.CellFormat(anchos[0], 6, m.Fecha.Format("2006-01-02"), "", 0, "L", false, 0, "")
+      pdf.CellFormat(anchos[1], 6, tr(recortarTexto(m.Descripcion, 60)), "", 0, "L", false, 0, "")
+      pdf.CellFormat(anchos[2], 6, ingreso, "", 0, "R", false, 0, "")
+      pdf.CellFormat(anchos[3], 6, egreso, "", 1, "R", false, 0, "")
+    }
+  
+    pdf.SetFont("Helvetica", "B", 9)
+    pdf.CellFormat(anchos[0] + anchos[1], 6, "Subtotal", "T", 0, "R", false, 0, "")
+    pdf.CellFormat(anchos[2], 6, formatearMonto(g.Ingresos), "T", 0, "R", false, 0, "")
+    pdf.CellFormat(anchos[3], 6, formatearMonto(g.Egresos), "T", 1, "R", false, 0, "")
+    pdf.Ln(4)
+  }
+  
+  graficaEgresosPDF(pdf, reporte, tr)
+  return pdf
+}
+
+//graficaEgresosPDF dibuja una barra horizontal por grupo con lo que se
+//gasto, la barra mas larga es el grupo con mas egresos.
+func graficaEgresosPDF(pdf *gofpdf.Fpdf, reporte ReporteMensual, tr func(string) string) {
+  var grupos []GrupoReporte
+  maximo := 0.0
+  for _, g := range reporte.Grupos {
+    if g.Egresos.Unidades > 0 {
+      grupos = append(grupos, g)
+      if g.Egresos.Float64() > maximo {
+        maximo = g.Egresos.Float64()
+      }
+    }
+  }
+  if len(grupos) == 0 {
+    return
+  }
+  sort.SliceStable(grupos, func(i, j int) bool {
+    return grupos[i].Egresos.Rat().Cmp(grupos[j].Egresos.Rat()) > 0
+  })
+  
+  //si no cabe el titulo con la primera barra pasamos a otra pagina.
+  const altoBarra, anchoEtiqueta, anchoMaximo = 7.0, 45.0, 105.0
+  _, altoPagina := pdf.GetPageSize()
+  _, _, _, margenInferior := pdf.GetMargins()
+  if pdf.GetY() + 12 + altoBarra > altoPagina - margenInferior {
+    pdf.AddPage()
+  }
+  
+  pdf.SetFont("Helvetica", "B", 12)
+  pdf.CellFormat(0, 10, "Egresos por grupo", "", 1, "L", false, 0, "")
+  pdf.SetFont("Helvetica", "", 9)
+  pdf.SetFillColor(70, 110, 180)
+  
+  izquierda, _, _, _ := pdf.GetMargins()
+  for _, g := range grupos {
+    if pdf.GetY() + altoBarra > altoPagina - margenInferior {
+      pdf.AddPage()
+    }
+    nombre := g.Grupo
+    if nombre == "" {
+      nombre = "Sin grupo"
+    }
+    y := pdf.GetY()
+    pdf.CellFormat(anchoEtiqueta, altoBarra, tr(recortarTexto(nombre, 25)), "", 0, "L", false, 0, "")
+    ancho := anchoMaximo * g.Egresos.Float64() / maximo
+    pdf.Rect(izquierda + anchoEtiqueta, y + 1, ancho, altoBarra - 2, "F")
+    pdf.SetX(izquierda + anchoEtiqueta + ancho + 2)
+    pdf.CellFormat(0, altoBarra, formatearMonto(g.Egresos), "", 1, "L", false, 0, "")
+  }
+}
+
+//formatearMonto pone puntos de miles y coma decimal al monto, ejm
+//1234567.50 -> 1.234.567,50
+func formatearMonto(d Dinero) string {
+  signo := ""
+  if d.Unidades < 0 {
+    signo = "-"
+  }
+  s, decimales := d.Abs().String(), ""
+  if i := strings.Index(s, "."); i >= 0 {
+    s, decimales = s[:i], "," + s[i + 1:]
+  }
+  for i := len(s) - 3; i > 0; i -= 3 {
+    s = s[:i] + "." + s[i:]
+  }
+  return signo + s + decimales
+}
+
+//recortarTexto deja el texto en maximo n letras para que quepa en la celda.
+func recortarTexto(s string, n int) string {
+  letras := []rune(s)
+  if len(letras) <= n {
+    return s
+  }
+  return string(letras[:n - 3]) + "..."
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+  "encoding/json"
+  "fmt"
+  "math/big"
+  "net/http"
+  "sort"
+  "strings"
+  "time"
+)
+
+//Resumen es la suma de un grupo y/o periodo. Grupo es puntero para que un
+//grupo vacio aparezca cuando se agrupa por grupo y no aparezca si no.
+type Resumen struct {
+  Periodo string `json:"periodo,omitempty"`
+  Grupo *string `json:"grupo,omitempty"`
+  Ingresos Dinero `json:"ingresos"`
+  Egresos Dinero `json:"egresos"`
+  Neto Dinero `json:"neto"`
+  Cantidad int `json:"cantidad"`
+}
+
+//expresionesPeriodo tiene para cada paso la expresion sql que da el inicio
+//del periodo. La fecha se guarda como texto que inicia con YYYY-MM-DD, asi
+//que tomamos esos 10 caracteres para usar las funciones de fecha de sqlite.
+var expresionesPeriodo = map[string]string{
+  "dia": "substr(fecha, 1, 10)",
+  "semana": "date(substr(fecha, 1, 10), 'weekday 0', '-6 days')",
+  "mes": "substr(fecha, 1, 7)",
+}
+
+//getResumen suma ingresos, egresos, neto y cantidad por grupo y/o periodo.
+//Los periodos sin movimientos salen en 0 para que las graficas sean continuas.
+//Con moneda=USD los montos se convierten con la tasa de cada fecha.
+//ejm http://100.69.187.16:8080/resumen?desde=2024-01-01T00:00:00Z&hasta=2024-12-31T00:00:00Z&agrupar=grupo,mes&moneda=USD
+func getResumen(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  desde, err := leerFecha(r, "desde")
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  hasta, err := leerFecha(r, "hasta")
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  if hasta.Before(desde) {
+    http.Error(w, "Error, la fecha 'hasta' es anterior a 'desde'.", http.StatusBadRequest)
+    return
+  }
+  
+  porGrupo, paso, err := leerAgrupar(r.URL.Query().Get("agrupar"))
+  if err != nil {
+    writeError(w, "Error en agrupar", err, http.StatusBadRequest)
+    return
+  }
+  moneda, err := leerMoneda(r)
+  if err != nil {
+    http.Error(w, err.Error(), http.StatusBadRequest)
+    return
+  }
+  
+  libro, ok := libroPeticion(w, r, false)
+  if !ok {
+    return
+  }
+  
+  resumen, err := getResumenes(libro, nombreUsuario, desde, hasta, porGrupo, paso, moneda)
+  if err != nil {
+    writeError(w, "Error al consultar el resumen", err, statusConversion(err))
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(resumen)
+}
+
+//leerAgrupar valida el parametro agrupar. Se puede agrupar por grupo, por
+//un solo paso de tiempo (dia, semana o mes) o por los dos.
+func leerAgrupar(s string) (porGrupo bool, paso string, err error) {
+  if s == "" {
+    return false, "", fmt.Errorf("agrupar es obligatorio: grupo, mes, semana, dia o grupo,mes")
+  }
+  for _, parte := range strings.Split(s, ",") {
+    parte = strings.TrimSpace(parte)
+    if parte == "grupo" && !porGrupo {
+      porGrupo = true
+      continue
+    }
+    if _, ok := expresionesPeriodo[parte]; ok && paso == "" {
+      paso = parte
+      continue
+    }
+    return false, "", fmt.Errorf("valor no permitido o repetido %q", parte)
+  }
+  return porGrupo, paso, nil
+}
+
+//getResumenes hace la suma en sql y luego rellena con ceros los grupos y
+//periodos que no tuvieron movimientos. Las sumas salen por moneda y dia
+//para convertirlas con la tasa de ese dia.
+func getResumenes(libro int, usuario string, desde time.Time, hasta time.Time, porGrupo bool, paso string, moneda string) ([]Resumen, error) {
+  //si no se agrupa por alguna de las dos usamos una constante vacia.
+  periodoSQL, grupoSQL := "''", "''"
+  if paso != "" {
+    periodoSQL = expresionesPeriodo[paso]
+  }
+  if porGrupo {
+    grupoSQL = "COALESCE(grupo, '')"
+  }
+  
+  consulta := fmt.Sprintf(`SELECT %s, %s, moneda, exponente, substr(fecha, 1, 10),
+  COALESCE(SUM(CASE WHEN tipo = 'ingreso' THEN monto END), 0),
+  COALESCE(SUM(CASE WHEN tipo = 'egreso' THEN monto END), 0),
+  COUNT(*)
+  FROM registros WHERE libro_id = ? AND %s AND %s AND fecha BETWEEN ? AND ?
+  GROUP BY 1, 2, 3, 4, 5`, periodoSQL, grupoSQL, condicionMiembro, sinTransferencias)
+  
+  rows, err := db.Query(consulta, libro, usuario, desde, hasta)
+  if err != nil {
+    return nil, fmt.Errorf("Error al sumar los registros, %v", err)
+  }
+  defer rows.Close()
+  
+  //guardamos las sumas convertidas por periodo y grupo para luego rellenar.
+  type suma struct {
+    ingresos, egresos big.Rat
+    cantidad int
+  }
+  conv := nuevoConversor(moneda)
+  sumas := map[[2]string]*suma{}
+  grupos := map[string]bool{}
+  for rows.Next() {
+    var periodo, grupo, monedaRegistro, dia string
+    var ingresos, egresos Dinero
+    var cantidad int
+    err = rows.Scan(&periodo, &grupo, &monedaRegistro, &ingresos.Exponente, &dia, &ingresos.Unidades, &egresos.Unidades, &cantidad)
+    egresos.Exponente = ingresos.Exponente
+    if err != nil {
+      return nil, fmt.Errorf("Error al escanear el resumen, %v", err)
+    }
+    s, ok := sumas[[2]string{periodo, grupo}]
+    if !ok {
+      s = &suma{}
+      sumas[[2]string{periodo, grupo}] = s
+    }
+    convertido, err := conv.convertir(ingresos, monedaRegistro, dia)
+    if err != nil {
+      return nil, err
+    }
+    s.ingresos.Add(&s.ingresos, convertido)
+    convertido, err = conv.convertir(egresos, monedaRegistro, dia)
+    if err != nil {
+      return nil, err
+    }
+    s.egresos.Add(&s.egresos, convertido)
+    s.cantidad += cantidad
+    grupos[grupo] = true
+  }
+  if err = rows.Err(); err != nil {
+    return nil, fmt.Errorf("Error al sumar los registros, %v", err)
+  }
+  
+  //los grupos a mostrar son las categorias del usuario mas los que salieron.
+  listaGrupos := []string{""}
+  if porGrupo {
+    categorias, err := getCategorias(usuario)
+    if err != nil {
+      return nil, err
+    }
+    for _, c := range categorias {
+      grupos[c.Nombre] = true
+    }
+    listaGrupos = listaGrupos[:0]
+    for g := range grupos {
+      listaGrupos = append(listaGrupos, g)
+    }
+    sort.Strings(listaGrupos)
+  }
+  
+  listaPeriodos := []string{""}
+  if paso != "" {
+    listaPeriodos = periodos(desde, hasta, paso)
+  }
+  
+  exponente := exponenteMoneda(moneda)
+  resumen := []Resumen{}
+  for _, periodo := range listaPeriodos {
+    for _, grupo := range listaGrupos {
+      s := Resumen{Periodo: periodo, Ingresos: Dinero{0, exponente}, Egresos: Dinero{0, exponente}}
+      if c, ok := sumas[[2]string{periodo, grupo}]; ok {
+        s.Ingresos = dineroDeRat(&c.ingresos, exponente)
+        s.Egresos = dineroDeRat(&c.egresos, exponente)
+        s.Cantidad = c.cantidad
+      }
+      if porGrupo {
+        g := grupo
+        s.Grupo = &g
+      }
+      s.Neto = s.Ingresos.Menos(s.Egresos)
+      resumen = append(resumen, s)
+    }
+  }
+  return resumen, nil
+}
+
+//inicioPeriodo retorna la fecha en que empieza el periodo que contiene a t.
+//Las semanas inician el lunes igual que en expresionesPeriodo.
+func inicioPeriodo(t time.Time, paso string) time.Time {
+  t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+  switch paso {
+  case "semana":
+    return t.AddDate(0, 0, -((int(t.Weekday()) + 6) % 7))
+  case "mes":
+    return t.AddDate(0, 0, 1 - t.Day())
+  }
+  return t
+}
+
+//siguientePeriodo retorna el inicio del periodo siguiente.
+func siguientePeriodo(t time.Time, paso string) time.Time {
+  switch paso {
+  case "semana":
+    return t.AddDate(0, 0, 7)
+  case "mes":
+    return t.AddDate(0, 1, 0)
+  }
+  return t.AddDate(0, 0, 1)
+}
+
+//etiquetaPeriodo formatea el inicio del periodo igual que lo hace el sql.
+func etiquetaPeriodo(t time.Time, paso string) string {
+  if paso == "mes" {
+    return t.Format("2006-01")
+  }
+  return t.Format("2006-01-02")
+}
+
+//periodos retorna las etiquetas de todos los periodos entre las fechas.
+func periodos(desde time.Time, hasta time.Time, paso string) []string {
+  var lista []string
+  for t := inicioPeriodo(desde, paso); !t.After(hasta); t = siguientePeriodo(t, paso) {
+    lista = append(lista, etiquetaPeriodo(t, paso))
+  }
+  return lista
+}
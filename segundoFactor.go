@@ -0,0 +1,423 @@
+package main
+
+import (
+  "bytes"
+  "database/sql"
+  "encoding/base64"
+  "encoding/json"
+  "fmt"
+  "image/png"
+  "log"
+  "net/http"
+  "os"
+  "regexp"
+  "strings"
+  "time"
+  
+  "github.com/golang-jwt/jwt"
+  "github.com/pquerna/otp"
+  "github.com/pquerna/otp/hotp"
+  "github.com/pquerna/otp/totp"
+)
+
+//el desafio que da login cuando hay 2FA solo sirve para enviar el codigo.
+const duracionDesafio = 5 * time.Minute
+
+//cuantos codigos de recuperacion se generan cada vez.
+const cantidadRecuperacion = 10
+
+//regCodigoTOTP son los 6 digitos que da la app de autenticacion.
+var regCodigoTOTP = regexp.MustCompile(`^\d{6}$`)
+
+//InscripcionTOTP es lo que necesita el usuario para agregar la cuenta a su
+//app de autenticacion. QR es un PNG en base64.
+type InscripcionTOTP struct {
+  Secreto string `json:"secreto"`
+  Uri string `json:"uri"`
+  QR string `json:"qr"`
+}
+
+//initSegundoFactor agrega a usuarios el secreto TOTP y crea la tabla de
+//codigos de recuperacion. totp_ultimo es el ultimo paso de 30s usado, asi
+//un codigo no se puede usar dos veces.
+func initSegundoFactor() {
+  agregarColumna("usuarios", "totp_secreto", "TEXT NOT NULL DEFAULT ''")
+  agregarColumna("usuarios", "totp_activo", "INTEGER NOT NULL DEFAULT 0")
+  agregarColumna("usuarios", "totp_ultimo", "INTEGER NOT NULL DEFAULT 0")
+  
+  crearTablaRecuperacion := `
+  CREATE TABLE IF NOT EXISTS codigos_recuperacion(
+  usuario TEXT NOT NULL,
+  hash TEXT NOT NULL,
+  usado INTEGER NOT NULL DEFAULT 0,
+  PRIMARY KEY(usuario, hash)
+  );`
+  
+  _, err := db.Exec(crearTablaRecuperacion)
+  if err != nil {
+    log.Fatal("Error creando la tabla codigos_recuperacion", err)
+  }
+}
+
+//tiene2FA dice si el usuario ya confirmo el segundo factor.
+func tiene2FA(usuario string) (bool, error) {
+  var activo bool
+  err := db.QueryRow("SELECT totp_activo FROM usuarios WHERE nombre = ?", usuario).Scan(&activo)
+  if err != nil {
+    return false, fmt.Errorf("Error al consultar el segundo factor, %v", err)
+  }
+  return activo, nil
+}
+
+//inscribir2FA crea un secreto nuevo para el usuario. Queda pendiente hasta
+//que se confirme con un codigo, mientras tanto login no lo pide.
+//ejm http://100.69.187.16:8080/2fa/inscribir
+func inscribir2FA(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  activo, err := tiene2FA(nombreUsuario)
+  if err != nil {
+    writeError(w, "Error al consultar el usuario", err, http.StatusInternalServerError)
+    return
+  }
+  if activo {
+    http.Error(w, "El segundo factor ya esta activo, desactivelo antes de inscribir otro.", http.StatusConflict)
+    return
+  }
+  
+  emisor := os.Getenv("TOTP_EMISOR")
+  if emisor == "" {
+    emisor = "ApiMoney"
+  }
+  clave, err := totp.Generate(totp.GenerateOpts{Issuer: emisor, AccountName: nombreUsuario})
+  if err != nil {
+    writeError(w, "Error al generar el secreto", err, http.StatusInternalServerError)
+    return
+  }
+  
+  imagen, err := clave.Image(256, 256)
+  if err != nil {
+    writeError(w, "Error al generar el QR", err, http.StatusInternalServerError)
+    return
+  }
+  var qr bytes.Buffer
+  err = png.Encode(&qr, imagen)
+  if err != nil {
+    writeError(w, "Error al generar el QR", err, http.StatusInternalServerError)
+    return
+  }
+  
+  _, err = db.Exec("UPDATE usuarios SET totp_secreto = ?, totp_ultimo = 0 WHERE nombre = ?", clave.Secret(), nombreUsuario)
+  if err != nil {
+    writeError(w, "Error al guardar el secreto", err, http.StatusInternalServerError)
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(InscripcionTOTP{clave.Secret(), clave.URL(), base64.StdEncoding.EncodeToString(qr.Bytes())})
+}
+
+//confirmar2FA activa el segundo factor con un codigo de la app y responde
+//con los codigos de recuperacion, solo se muestran esta vez.
+//Json ejemplo{"codigo": "123456"}
+func confirmar2FA(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  var datos struct {
+    Codigo string `json:"codigo"`
+  }
+  err := json.NewDecoder(r.Body).Decode(&datos)
+  if err != nil {
+    writeError(w, "Error al obtener los datos del body", err, http.StatusBadRequest)
+    return
+  }
+  
+  activo, err := tiene2FA(nombreUsuario)
+  if err != nil {
+    writeError(w, "Error al consultar el usuario", err, http.StatusInternalServerError)
+    return
+  }
+  if activo {
+    http.Error(w, "El segundo factor ya esta activo.", http.StatusConflict)
+    return
+  }
+  
+  ok, err := validarTOTP(nombreUsuario, datos.Codigo)
+  if err == sql.ErrNoRows {
+    http.Error(w, "Primero inscriba el segundo factor.", http.StatusConflict)
+    return
+  }
+  if err != nil {
+    writeError(w, "Error al validar el codigo", err, http.StatusInternalServerError)
+    return
+  }
+  if !ok {
+    http.Error(w, "Codigo incorrecto.", http.StatusUnauthorized)
+    return
+  }
+  
+  _, err = db.Exec("UPDATE usuarios SET totp_activo = 1 WHERE nombre = ?", nombreUsuario)
+  if err != nil {
+    writeError(w, "Error al activar el segundo factor", err, http.StatusInternalServerError)
+    return
+  }
+  responderCodigosRecuperacion(w, nombreUsuario)
+}
+
+//desactivar2FA quita el segundo factor, pide la clave y un codigo de la
+//app o de recuperacion.
+//Json ejemplo{"clave": "Clave1#", "codigo": "123456"}
+func desactivar2FA(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  var datos struct {
+    Clave string `json:"clave"`
+    Codigo string `json:"codigo"`
+  }
+  err := json.NewDecoder(r.Body).Decode(&datos)
+  if err != nil {
+    writeError(w, "Error al obtener los datos del body", err, http.StatusBadRequest)
+    return
+  }
+  
+  err = comprobarUsuario(Usuario{Nombre: nombreUsuario, Clave: datos.Clave})
+  if err != nil {
+    http.Error(w, "Error, la clave no es correcta.", http.StatusForbidden)
+    return
+  }
+  if !verificarSegundoFactorHTTP(w, nombreUsuario, datos.Codigo) {
+    return
+  }
+  
+  _, err = db.Exec("UPDATE usuarios SET totp_secreto = '', totp_activo = 0, totp_ultimo = 0 WHERE nombre = ?", nombreUsuario)
+  if err != nil {
+    writeError(w, "Error al desactivar el segundo factor", err, http.StatusInternalServerError)
+    return
+  }
+  _, err = db.Exec("DELETE FROM codigos_recuperacion WHERE usuario = ?", nombreUsuario)
+  if err != nil {
+    writeError(w, "Error al borrar los codigos de recuperacion", err, http.StatusInternalServerError)
+    return
+  }
+  w.WriteHeader(http.StatusNoContent)
+}
+
+//regenerarRecuperacion cambia los codigos de recuperacion por unos nuevos,
+//los anteriores dejan de servir. Pide un codigo de la app.
+//Json ejemplo{"codigo": "123456"}
+func regenerarRecuperacion(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  var datos struct {
+    Codigo string `json:"codigo"`
+  }
+  err := json.NewDecoder(r.Body).Decode(&datos)
+  if err != nil {
+    writeError(w, "Error al obtener los datos del body", err, http.StatusBadRequest)
+    return
+  }
+  
+  activo, err := tiene2FA(nombreUsuario)
+  if err != nil {
+    writeError(w, "Error al consultar el usuario", err, http.StatusInternalServerError)
+    return
+  }
+  if !activo {
+    http.Error(w, "El segundo factor no esta activo.", http.StatusConflict)
+    return
+  }
+  ok, err := validarTOTP(nombreUsuario, datos.Codigo)
+  if err != nil {
+    writeError(w, "Error al validar el codigo", err, http.StatusInternalServerError)
+    return
+  }
+  if !ok {
+    http.Error(w, "Codigo incorrecto.", http.StatusUnauthorized)
+    return
+  }
+  responderCodigosRecuperacion(w, nombreUsuario)
+}
+
+//responderCodigosRecuperacion genera los codigos, guarda sus hash y los
+//envia al cliente.
+func responderCodigosRecuperacion(w http.ResponseWriter, usuario string) {
+  tx, err := db.Begin()
+  if err != nil {
+    writeError(w, "Error al iniciar la transaccion", err, http.StatusInternalServerError)
+    return
+  }
+  defer tx.Rollback()
+  
+  _, err = tx.Exec("DELETE FROM codigos_recuperacion WHERE usuario = ?", usuario)
+  if err != nil {
+    writeError(w, "Error al borrar los codigos anteriores", err, http.StatusInternalServerError)
+    return
+  }
+  codigos := make([]string, cantidadRecuperacion)
+  for i := range codigos {
+    //10 caracteres hexadecimales separados en dos para leerlos facil.
+    c := tokenAleatorio(5)
+    codigos[i] = c[:5] + "-" + c[5:]
+    _, err = tx.Exec("INSERT INTO codigos_recuperacion(usuario, hash) VALUES(?, ?)", usuario, hashToken(c))
+    if err != nil {
+      writeError(w, "Error al guardar los codigos", err, http.StatusInternalServerError)
+      return
+    }
+  }
+  err = tx.Commit()
+  if err != nil {
+    writeError(w, "Error al guardar los codigos", err, http.StatusInternalServerError)
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(map[string][]string{
+    "codigosRecuperacion": codigos,
+  })
+}
+
+//validarTOTP compara el codigo con el secreto del usuario aceptando un paso
+//antes o despues por diferencias de reloj. El paso usado se guarda y no se
+//acepta de nuevo ni uno anterior. Si no tiene secreto retorna sql.ErrNoRows.
+func validarTOTP(usuario string, codigo string) (bool, error) {
+  if !regCodigoTOTP.MatchString(codigo) {
+    return false, nil
+  }
+  var secreto string
+  var ultimo int64
+  err := db.QueryRow("SELECT totp_secreto, totp_ultimo FROM usuarios WHERE nombre = ?", usuario).Scan(&secreto, &ultimo)
+  if err != nil {
+    return false, err
+  }
+  if secreto == "" {
+    return false, sql.ErrNoRows
+  }
+  
+  paso := time.Now().Unix() / 30
+  for _, p := range []int64{paso - 1, paso, paso + 1} {
+    if p <= ultimo {
+      continue
+    }
+    ok, err := hotp.ValidateCustom(codigo, uint64(p), secreto, hotp.ValidateOpts{Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1})
+    if err != nil {
+      return false, err
+    }
+    if !ok {
+      continue
+    }
+    //si otra peticion uso el mismo paso primero esta pierde.
+    res, err := db.Exec("UPDATE usuarios SET totp_ultimo = ? WHERE nombre = ? AND totp_ultimo < ?", p, usuario, p)
+    if err != nil {
+      return false, err
+    }
+    n, _ := res.RowsAffected()
+    return n == 1, nil
+  }
+  return false, nil
+}
+
+//usarCodigoRecuperacion marca el codigo como usado si existe y no se habia
+//usado. Se aceptan con o sin guion y en mayusculas.
+func usarCodigoRecuperacion(usuario string, codigo string) (bool, error) {
+  codigo = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(codigo), "-", ""))
+  res, err := db.Exec("UPDATE codigos_recuperacion SET usado = 1 WHERE usuario = ? AND hash = ? AND usado = 0", usuario, hashToken(codigo))
+  if err != nil {
+    return false, err
+  }
+  n, _ := res.RowsAffected()
+  return n == 1, nil
+}
+
+//verificarSegundoFactorHTTP valida un codigo de la app o de recuperacion y
+//si no es valido escribe la respuesta de error.
+func verificarSegundoFactorHTTP(w http.ResponseWriter, usuario string, codigo string) bool {
+  var ok bool
+  var err error
+  if regCodigoTOTP.MatchString(codigo) {
+    ok, err = validarTOTP(usuario, codigo)
+  } else {
+    ok, err = usarCodigoRecuperacion(usuario, codigo)
+  }
+  if err != nil && err != sql.ErrNoRows {
+    writeError(w, "Error al validar el codigo", err, http.StatusInternalServerError)
+    return false
+  }
+  if !ok {
+    http.Error(w, "Codigo incorrecto.", http.StatusUnauthorized)
+    return false
+  }
+  return true
+}
+
+//crearDesafio2FA firma el token que da login cuando el usuario tiene 2FA.
+//No tiene sid ni jti asi que authMiddleware no lo acepta.
+func crearDesafio2FA(nombre string) (string, error) {
+  token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+    "nombreUsuario": nombre,
+    "tipo": "2fa",
+    "exp": time.Now().Add(duracionDesafio).Unix(),
+  })
+  return token.SignedString([]byte(os.Getenv("FRASE")))
+}
+
+//leerDesafio2FA valida el desafio y retorna el usuario.
+func leerDesafio2FA(desafio string) (string, error) {
+  token, err := jwt.Parse(desafio, func(t *jwt.Token) (interface{}, error) {
+    if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+      return nil, fmt.Errorf("Firma inesperada.")
+    }
+    return []byte(os.Getenv("FRASE")), nil
+  })
+  if err != nil || !token.Valid {
+    return "", fmt.Errorf("desafio invalido o vencido")
+  }
+  claims, _ := token.Claims.(jwt.MapClaims)
+  nombre, _ := claims["nombreUsuario"].(string)
+  if claims["tipo"] != "2fa" || nombre == "" {
+    return "", fmt.Errorf("desafio invalido")
+  }
+  return nombre, nil
+}
+
+//login2FA cambia el desafio de login y un codigo de la app o de
+//recuperacion por los tokens de la sesion.
+//Json ejemplo{"desafio": "eyJhbGciOi...", "codigo": "123456"}
+func login2FA(w http.ResponseWriter, r *http.Request) {
+  var datos struct {
+    Desafio string `json:"desafio"`
+    Codigo string `json:"codigo"`
+  }
+  err := json.NewDecoder(r.Body).Decode(&datos)
+  if err != nil {
+    writeError(w, "Error al obtener los datos del body", err, http.StatusBadRequest)
+    return
+  }
+  
+  nombre, err := leerDesafio2FA(datos.Desafio)
+  if err != nil {
+    writeError(w, "Error en el desafio", err, http.StatusUnauthorized)
+    return
+  }
+  //los codigos fallidos cuentan igual que una clave errada, son solo 6
+  //digitos y se podrian adivinar.
+  ip := ipCliente(r)
+  if !limitarIntentos(w, nombre, ip) {
+    return
+  }
+  if !verificarSegundoFactorHTTP(w, nombre, datos.Codigo) {
+    registrarIntento(nombre, ip, false, "2fa")
+    return
+  }
+  registrarIntento(nombre, ip, true, "2fa")
+  if !permitirLogin(w, nombre) {
+    return
+  }
+  
+  tokens, err := crearSesion(nombre, r)
+  if err != nil {
+    writeError(w, "Error al crear el jwt.", err, http.StatusInternalServerError)
+    return
+  }
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(tokens)
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "os"
+  "strings"
+  "testing"
+  "time"
+  
+  "github.com/golang-jwt/jwt"
+  "github.com/pquerna/otp"
+  "github.com/pquerna/otp/hotp"
+)
+
+const secretoPrueba = "JBSWY3DPEHPK3PXP"
+
+//usuario2FA crea al usuario con el secreto TOTP de prueba ya activo.
+func usuario2FA(t *testing.T, nombre string) {
+  t.Helper()
+  if err := guardarUsuario(Usuario{Nombre: nombre, Clave: "Clave123#"}); err != nil {
+    t.Fatal(err)
+  }
+  if _, err := db.Exec("UPDATE usuarios SET totp_secreto = ?, totp_activo = 1 WHERE nombre = ?", secretoPrueba, nombre); err != nil {
+    t.Fatal(err)
+  }
+}
+
+//codigoPaso es el codigo que muestra la app en el paso de 30s dado.
+func codigoPaso(t *testing.T, paso int64) string {
+  t.Helper()
+  codigo, err := hotp.GenerateCodeCustom(secretoPrueba, uint64(paso), hotp.ValidateOpts{Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1})
+  if err != nil {
+    t.Fatal(err)
+  }
+  return codigo
+}
+
+//pasoActual espera si el paso esta por cambiar, asi la prueba no depende
+//de en que segundo corre.
+func pasoActual() int64 {
+  if time.Now().Unix() % 30 >= 28 {
+    time.Sleep(3 * time.Second)
+  }
+  return time.Now().Unix() / 30
+}
+
+func TestValidarTOTPVentana(t *testing.T) {
+  prepararDB(t)
+  usuario2FA(t, "anita")
+  
+  casos := []struct {
+    nombre string
+    desfase int64
+    valido bool
+  }{
+    {"paso anterior", -1, true},
+    {"paso actual", 0, true},
+    {"paso siguiente", 1, true},
+    {"dos pasos antes", -2, false},
+    {"dos pasos despues", 2, false},
+  }
+  for _, c := range casos {
+    t.Run(c.nombre, func(t *testing.T) {
+      db.Exec("UPDATE usuarios SET totp_ultimo = 0 WHERE nombre = 'anita'")
+      paso := pasoActual()
+      ok, err := validarTOTP("anita", codigoPaso(t, paso + c.desfase))
+      if err != nil {
+        t.Fatal(err)
+      }
+      if ok != c.valido {
+        t.Errorf("validarTOTP = %v, esperaba %v", ok, c.valido)
+      }
+    })
+  }
+}
+
+func TestValidarTOTPNoSeReutiliza(t *testing.T) {
+  prepararDB(t)
+  usuario2FA(t, "anita")
+  
+  paso := pasoActual()
+  codigo := codigoPaso(t, paso)
+  if ok, err := validarTOTP("anita", codigo); !ok || err != nil {
+    t.Fatalf("el codigo no sirvio la primera vez: %v %v", ok, err)
+  }
+  if ok, _ := validarTOTP("anita", codigo); ok {
+    t.Errorf("el mismo codigo sirvio dos veces")
+  }
+  //tampoco sirve uno de un paso anterior al ya usado.
+  if ok, _ := validarTOTP("anita", codigoPaso(t, paso - 1)); ok {
+    t.Errorf("sirvio un codigo anterior al ultimo usado")
+  }
+  
+  var ultimo int64
+  db.QueryRow("SELECT totp_ultimo FROM usuarios WHERE nombre = 'anita'").Scan(&ultimo)
+  if ultimo != paso {
+    t.Errorf("totp_ultimo es %d, esperaba %d", ultimo, paso)
+  }
+}
+
+func TestCodigosRecuperacionUnSoloUso(t *testing.T) {
+  prepararDB(t)
+  usuario2FA(t, "anita")
+  
+  w := httptest.NewRecorder()
+  responderCodigosRecuperacion(w, "anita")
+  var respuesta struct {
+    CodigosRecuperacion []string `json:"codigosRecuperacion"`
+  }
+  if err := json.NewDecoder(w.Body).Decode(&respuesta); err != nil {
+    t.Fatal(err)
+  }
+  codigos := respuesta.CodigosRecuperacion
+  if len(codigos) != cantidadRecuperacion {
+    t.Fatalf("se generaron %d codigos", len(codigos))
+  }
+  
+  if ok, err := usarCodigoRecuperacion("anita", codigos[0]); !ok || err != nil {
+    t.Fatalf("el codigo no sirvio: %v %v", ok, err)
+  }
+  if ok, _ := usarCodigoRecuperacion("anita", codigos[0]); ok {
+    t.Errorf("el codigo de recuperacion sirvio dos veces")
+  }
+  //sin guion y en mayusculas tambien sirve, pero solo para su usuario.
+  otro := strings.ToUpper(strings.ReplaceAll(codigos[1], "-", ""))
+  if ok, _ := usarCodigoRecuperacion("pedro", otro); ok {
+    t.Errorf("el codigo sirvio para otro usuario")
+  }
+  if ok, _ := usarCodigoRecuperacion("anita", otro); !ok {
+    t.Errorf("el codigo sin guion y en mayusculas no sirvio")
+  }
+  
+  //regenerarlos invalida los anteriores.
+  responderCodigosRecuperacion(httptest.NewRecorder(), "anita")
+  if ok, _ := usarCodigoRecuperacion("anita", codigos[2]); ok {
+    t.Errorf("sirvio un codigo de antes de regenerarlos")
+  }
+}
+
+func TestDesafio2FA(t *testing.T) {
+  prepararDB(t)
+  usuario2FA(t, "anita")
+  
+  desafio, err := crearDesafio2FA("anita")
+  if err != nil {
+    t.Fatal(err)
+  }
+  if nombre, err := leerDesafio2FA(desafio); nombre != "anita" || err != nil {
+    t.Errorf("leerDesafio2FA = %q, %v", nombre, err)
+  }
+  
+  //un desafio de hace mas de 5 minutos ya vencio.
+  vencido, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+    "nombreUsuario": "anita",
+    "tipo": "2fa",
+    "exp": time.Now().Add(-time.Second).Unix(),
+  }).SignedString([]byte(os.Getenv("FRASE")))
+  if _, err := leerDesafio2FA(vencido); err == nil {
+    t.Errorf("se acepto un desafio vencido")
+  }
+  //un token de acceso no sirve como desafio.
+  acceso, _ := crearJWT("anita", "sesion", "usuario")
+  if _, err := leerDesafio2FA(acceso); err == nil {
+    t.Errorf("se acepto un token de acceso como desafio")
+  }
+  
+  codigo := codigoPaso(t, pasoActual())
+  w := enviarJSON(login2FA, `{"desafio": "` + vencido + `", "codigo": "` + codigo + `"}`)
+  if w.Code != http.StatusUnauthorized {
+    t.Errorf("login2FA con desafio vencido respondio %d", w.Code)
+  }
+  w = enviarJSON(login2FA, `{"desafio": "` + desafio + `", "codigo": "` + codigo + `"}`)
+  if w.Code != http.StatusOK {
+    t.Errorf("login2FA respondio %d %s", w.Code, w.Body)
+  }
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+  "crypto/sha256"
+  "database/sql"
+  "encoding/hex"
+  "encoding/json"
+  "fmt"
+  "log"
+  "net/http"
+  "time"
+  
+  "github.com/gorilla/mux"
+)
+
+//el token de acceso dura poco, para seguir usando la api se pide otro con
+//el refresh token que dura mucho mas.
+const (
+  duracionAcceso = 15 * time.Minute
+  duracionSesion = 30 * 24 * time.Hour
+)
+
+//Sesion es un inicio de sesion del usuario, dura mientras se siga
+//renovando el refresh token y no se cierre.
+type Sesion struct {
+  Id string `json:"id"`
+  Creada time.Time `json:"creada"`
+  UltimoUso time.Time `json:"ultimoUso"`
+  Expira time.Time `json:"expira"`
+  Agente string `json:"agente"`
+  Ip string `json:"ip"`
+  Actual bool `json:"actual"`
+}
+
+//Tokens es lo que recibe el cliente al iniciar sesion o renovar.
+type Tokens struct {
+  Token string `json:"token"`
+  RefreshToken string `json:"refreshToken"`
+  Expira int `json:"expira"`
+}
+
+//initSesiones crea las tablas de sesiones y de tokens revocados. Los
+//refresh tokens se guardan como hash igual que las claves, si se filtra la
+//base no sirven para entrar. Tambien se borra lo que ya vencio.
+func initSesiones() {
+  crearTablaSesiones := `
+  CREATE TABLE IF NOT EXISTS sesiones(
+  id TEXT PRIMARY KEY,
+  usuario TEXT NOT NULL,
+  refresh_hash TEXT UNIQUE NOT NULL,
+  refresh_anterior TEXT NOT NULL DEFAULT '',
+  creada TEXT NOT NULL,
+  ultimo_uso TEXT NOT NULL,
+  expira TEXT NOT NULL,
+  agente TEXT NOT NULL DEFAULT '',
+  ip TEXT NOT NULL DEFAULT '',
+  revocada INTEGER NOT NULL DEFAULT 0
+  );`
+  
+  crearTablaRevocados := `
+  CREATE TABLE IF NOT EXISTS tokens_revocados(
+  jti TEXT PRIMARY KEY,
+  expira TEXT NOT NULL
+  );`
+  
+  _, err := db.Exec(crearTablaSesiones)
+  if err != nil {
+    log.Fatal("Error creando la tabla sesiones", err)
+  }
+  _, err = db.Exec(crearTablaRevocados)
+  if err != nil {
+    log.Fatal("Error creando la tabla tokens_revocados", err)
+  }
+  
+  ahora := time.Now().UTC().Format(time.RFC3339)
+  _, err = db.Exec("DELETE FROM tokens_revocados WHERE expira < ?", ahora)
+  if err != nil {
+    log.Fatal("Error borrando los tokens vencidos ", err)
+  }
+  _, err = db.Exec("DELETE FROM sesiones WHERE expira < ?", ahora)
+  if err != nil {
+    log.Fatal("Error borrando las sesiones vencidas ", err)
+  }
+}
+
+//hashToken es el sha256 del token en hexadecimal. Los tokens son aleatorios
+//y largos, no hace falta bcrypt para que no se puedan adivinar.
+func hashToken(token string) string {
+  suma := sha256.Sum256([]byte(token))
+  return hex.EncodeToString(suma[:])
+}
+
+//crearSesion guarda una sesion nueva para el usuario y retorna sus tokens.
+func crearSesion(usuario string, r *http.Request) (Tokens, error) {
+  id := tokenAleatorio(16)
+  refresh := tokenAleatorio(32)
+  ahora := time.Now().UTC()
+  
+  agente := r.UserAgent()
+  if len(agente) > 255 {
+    agente = agente[:255]
+  }
+  _, err := db.Exec("INSERT INTO sesiones(id, usuario, refresh_hash, creada, ultimo_uso, expira, agente, ip) VALUES(?, ?, ?, ?, ?, ?, ?, ?)",
+    id, usuario, hashToken(refresh), ahora.Format(time.RFC3339), ahora.Format(time.RFC3339), ahora.Add(duracionSesion).Format(time.RFC3339), agente, ipCliente(r))
+  if err != nil {
+    return Tokens{}, fmt.Errorf("Error al guardar la sesion, %v", err)
+  }
+  
+  return tokensSesion(usuario, id, refresh)
+}
+
+//tokensSesion firma el token de acceso de la sesion y lo junta con el refresh.
+func tokensSesion(usuario string, sesion string, refresh string) (Tokens, error) {
+  rol, err := rolUsuario(usuario)
+  if err != nil {
+    return Tokens{}, err
+  }
+  token, err := crearJWT(usuario, sesion, rol)
+  if err != nil {
+    return Tokens{}, err
+  }
+  return Tokens{token, refresh, int(duracionAcceso.Seconds())}, nil
+}
+
+//tokenRevocado dice si el token de acceso ya no se puede usar, porque se
+//agrego su jti a la lista de revocados o porque su sesion se cerro.
+func tokenRevocado(jti string, sesion string) (bool, error) {
+  var revocado bool
+  err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM tokens_revocados WHERE jti = ?)
+  OR NOT EXISTS(SELECT 1 FROM sesiones WHERE id = ? AND revocada = 0)`, jti, sesion).Scan(&revocado)
+  if err != nil {
+    return true, fmt.Errorf("Error al consultar los tokens revocados, %v", err)
+  }
+  return revocado, nil
+}
+
+//refrescarToken cambia un refresh token por uno nuevo y un token de acceso.
+//El refresh usado deja de servir. Si llega uno que ya se habia cambiado
+//alguien lo copio, asi que se cierra la sesion completa.
+//Json ejemplo{"refreshToken": "9f86d0..."}
+func refrescarToken(w http.ResponseWriter, r *http.Request) {
+  var datos struct {
+    RefreshToken string `json:"refreshToken"`
+  }
+  err := json.NewDecoder(r.Body).Decode(&datos)
+  if err != nil || datos.RefreshToken == "" {
+    http.Error(w, "Error, falta el refreshToken.", http.StatusBadRequest)
+    return
+  }
+  hash := hashToken(datos.RefreshToken)
+  ahora := time.Now().UTC()
+  
+  var id, usuario, expira string
+  var revocada bool
+  err = db.QueryRow("SELECT id, usuario, expira, revocada FROM sesiones WHERE refresh_hash = ?", hash).Scan(&id, &usuario, &expira, &revocada)
+  if err == sql.ErrNoRows {
+    //buscamos si es un refresh que ya se uso.
+    res, err := db.Exec("UPDATE sesiones SET revocada = 1 WHERE refresh_anterior = ?", hash)
+    if err == nil {
+      if n, _ := res.RowsAffected(); n > 0 {
+        log.Printf("Refresh token reutilizado, se cierra la sesion")
+      }
+    }
+    http.Error(w, "Refresh token invalido.", http.StatusUnauthorized)
+    return
+  }
+  if err != nil {
+    writeError(w, "Error al consultar la sesion", err, http.StatusInternalServerError)
+    return
+  }
+  fin, _ := time.Parse(time.RFC3339, expira)
+  if revocada || ahora.After(fin) {
+    http.Error(w, "La sesion esta cerrada o vencida.", http.StatusUnauthorized)
+    return
+  }
+  
+  //solo cambia si el hash sigue siendo el mismo, si dos peticiones usan el
+  //mismo refresh al tiempo solo una gana.
+  refresh := tokenAleatorio(32)
+  res, err := db.Exec("UPDATE sesiones SET refresh_hash = ?, refresh_anterior = ?, ultimo_uso = ?, expira = ? WHERE id = ? AND refresh_hash = ?",
+    hashToken(refresh), hash, ahora.Format(time.RFC3339), ahora.Add(duracionSesion).Format(time.RFC3339), id, hash)
+  if err != nil {
+    writeError(w, "Error al actualizar la sesion", err, http.StatusInternalServerError)
+    return
+  }
+  if n, _ := res.RowsAffected(); n == 0 {
+    http.Error(w, "Refresh token invalido.", http.StatusUnauthorized)
+    return
+  }
+  
+  tokens, err := tokensSesion(usuario, id, refresh)
+  if err != nil {
+    writeError(w, "Error al crear el jwt.", err, http.StatusInternalServerError)
+    return
+  }
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(tokens)
+}
+
+//logout cierra la sesion del token con el que se llama y revoca el token
+//de acceso para que no se pueda usar el tiempo que le queda.
+func logout(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  sesion := r.Context().Value("sesion").(string)
+  jti := r.Context().Value("jti").(string)
+  expira := r.Context().Value("expira").(time.Time)
+  
+  err := revocarSesion(nombreUsuario, sesion)
+  if err != nil && err != sql.ErrNoRows {
+    writeError(w, "Error al cerrar la sesion", err, http.StatusInternalServerError)
+    return
+  }
+  _, err = db.Exec("INSERT OR IGNORE INTO tokens_revocados(jti, expira) VALUES(?, ?)", jti, expira.UTC().Format(time.RFC3339))
+  if err != nil {
+    writeError(w, "Error al revocar el token", err, http.StatusInternalServerError)
+    return
+  }
+  w.WriteHeader(http.StatusNoContent)
+}
+
+//revocarSesion cierra una sesion del usuario, si no es suya o no existe
+//retorna sql.ErrNoRows.
+func revocarSesion(usuario string, id string) error {
+  res, err := db.Exec("UPDATE sesiones SET revocada = 1 WHERE id = ? AND usuario = ? AND revocada = 0", id, usuario)
+  if err != nil {
+    return fmt.Errorf("Error al revocar la sesion, %v", err)
+  }
+  if n, _ := res.RowsAffected(); n == 0 {
+    return sql.ErrNoRows
+  }
+  return nil
+}
+
+//getSesiones lista las sesiones abiertas del usuario, la que hace la
+//peticion sale con actual en true.
+//ejm http://100.69.187.16:8080/sesiones
+func getSesiones(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  actual := r.Context().Value("sesion").(string)
+  
+  rows, err := db.Query("SELECT id, creada, ultimo_uso, expira, agente, ip FROM sesiones WHERE usuario = ? AND revocada = 0 AND expira > ? ORDER BY ultimo_uso DESC",
+    nombreUsuario, time.Now().UTC().Format(time.RFC3339))
+  if err != nil {
+    writeError(w, "Error al consultar las sesiones", err, http.StatusInternalServerError)
+    return
+  }
+  defer rows.Close()
+  
+  sesiones := []Sesion{}
+  for rows.Next() {
+    var s Sesion
+    var creada, ultimoUso, expira string
+    err = rows.Scan(&s.Id, &creada, &ultimoUso, &expira, &s.Agente, &s.Ip)
+    if err != nil {
+      writeError(w, "Error al escanear las sesiones", err, http.StatusInternalServerError)
+      return
+    }
+    s.Creada, _ = time.Parse(time.RFC3339, creada)
+    s.UltimoUso, _ = time.Parse(time.RFC3339, ultimoUso)
+    s.Expira, _ = time.Parse(time.RFC3339, expira)
+    s.Actual = s.Id == actual
+    sesiones = append(sesiones, s)
+  }
+  if err = rows.Err(); err != nil {
+    writeError(w, "Error al consultar las sesiones", err, http.StatusInternalServerError)
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(sesiones)
+}
+
+//deleteSesion cierra otra sesion del usuario, por ejemplo la de un equipo
+//que perdio. Sus tokens de acceso dejan de servir de inmediato.
+//ejm http://100.69.187.16:8080/sesiones/3f2a...
+func deleteSesion(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  id := mux.Vars(r)["id"]
+  
+  err := revocarSesion(nombreUsuario, id)
+  if err == sql.ErrNoRows {
+    http.Error(w, "La sesion no existe.", http.StatusNotFound)
+    return
+  }
+  if err != nil {
+    writeError(w, "Error al cerrar la sesion", err, http.StatusInternalServerError)
+    return
+  }
+  w.WriteHeader(http.StatusNoContent)
+}
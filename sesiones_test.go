@@ -0,0 +1,124 @@
+package main
+
+import (
+  "encoding/json"
+  "net/http"
+  "net/http/httptest"
+  "strings"
+  "testing"
+)
+
+//peticion llama al handler con el header Authorization dado, ejm
+//"Bearer eyJ..." o "ApiKey am_...".
+func peticion(h http.Handler, metodo string, autorizacion string, body string) *httptest.ResponseRecorder {
+  r := httptest.NewRequest(metodo, "/", strings.NewReader(body))
+  if autorizacion != "" {
+    r.Header.Set("Authorization", autorizacion)
+  }
+  w := httptest.NewRecorder()
+  h.ServeHTTP(w, r)
+  return w
+}
+
+//sesionPrueba crea al usuario con una sesion abierta.
+func sesionPrueba(t *testing.T, usuario string) Tokens {
+  t.Helper()
+  if err := guardarUsuario(Usuario{Nombre: usuario, Clave: "Clave123#"}); err != nil {
+    t.Fatal(err)
+  }
+  tokens, err := crearSesion(usuario, httptest.NewRequest("POST", "/login", nil))
+  if err != nil {
+    t.Fatal(err)
+  }
+  return tokens
+}
+
+//refrescar pide tokens nuevos con el refresh y retorna el status.
+func refrescar(t *testing.T, refresh string) (Tokens, int) {
+  t.Helper()
+  w := enviarJSON(refrescarToken, `{"refreshToken": "` + refresh + `"}`)
+  var tokens Tokens
+  if w.Code == http.StatusOK {
+    if err := json.NewDecoder(w.Body).Decode(&tokens); err != nil {
+      t.Fatal(err)
+    }
+  }
+  return tokens, w.Code
+}
+
+func TestRefrescarTokenRota(t *testing.T) {
+  prepararDB(t)
+  primeros := sesionPrueba(t, "anita")
+  
+  segundos, status := refrescar(t, primeros.RefreshToken)
+  if status != http.StatusOK {
+    t.Fatalf("refrescar: %d", status)
+  }
+  if segundos.RefreshToken == primeros.RefreshToken || segundos.Token == "" {
+    t.Fatalf("el refresh no cambio: %+v", segundos)
+  }
+  
+  //el nuevo refresh sirve y el token de acceso nuevo tambien.
+  if _, status = refrescar(t, segundos.RefreshToken); status != http.StatusOK {
+    t.Errorf("el refresh nuevo no sirve: %d", status)
+  }
+  if w := peticion(authMiddleware(http.HandlerFunc(getSesiones)), "GET", "Bearer " + segundos.Token, ""); w.Code != http.StatusOK {
+    t.Errorf("el token de acceso nuevo no sirve: %d %s", w.Code, w.Body)
+  }
+  
+  if _, status = refrescar(t, "no-existe"); status != http.StatusUnauthorized {
+    t.Errorf("un refresh inventado respondio %d", status)
+  }
+}
+
+func TestRefrescarTokenReutilizadoCierraSesion(t *testing.T) {
+  prepararDB(t)
+  primeros := sesionPrueba(t, "anita")
+  segundos, status := refrescar(t, primeros.RefreshToken)
+  if status != http.StatusOK {
+    t.Fatalf("refrescar: %d", status)
+  }
+  
+  //alguien usa el refresh viejo, se cierra toda la sesion.
+  if _, status = refrescar(t, primeros.RefreshToken); status != http.StatusUnauthorized {
+    t.Fatalf("el refresh viejo respondio %d", status)
+  }
+  if _, status = refrescar(t, segundos.RefreshToken); status != http.StatusUnauthorized {
+    t.Errorf("el refresh nuevo sigue sirviendo despues de reutilizar el viejo: %d", status)
+  }
+  if w := peticion(authMiddleware(http.HandlerFunc(getSesiones)), "GET", "Bearer " + segundos.Token, ""); w.Code != http.StatusUnauthorized {
+    t.Errorf("el token de acceso sigue sirviendo: %d", w.Code)
+  }
+  
+  var revocada bool
+  db.QueryRow("SELECT revocada FROM sesiones WHERE usuario = 'anita'").Scan(&revocada)
+  if !revocada {
+    t.Errorf("la sesion no quedo revocada")
+  }
+}
+
+func TestLogoutRevocaToken(t *testing.T) {
+  prepararDB(t)
+  tokens := sesionPrueba(t, "anita")
+  sesiones := authMiddleware(http.HandlerFunc(getSesiones))
+  
+  if w := peticion(sesiones, "GET", "Bearer " + tokens.Token, ""); w.Code != http.StatusOK {
+    t.Fatalf("antes del logout: %d %s", w.Code, w.Body)
+  }
+  if w := peticion(authMiddleware(requiereSesion(http.HandlerFunc(logout))), "POST", "Bearer " + tokens.Token, ""); w.Code != http.StatusNoContent {
+    t.Fatalf("logout: %d %s", w.Code, w.Body)
+  }
+  
+  //el token de acceso no sirve aunque no haya vencido.
+  if w := peticion(sesiones, "GET", "Bearer " + tokens.Token, ""); w.Code != http.StatusUnauthorized {
+    t.Errorf("el token sigue sirviendo despues del logout: %d", w.Code)
+  }
+  var revocados int
+  db.QueryRow("SELECT COUNT(*) FROM tokens_revocados").Scan(&revocados)
+  if revocados != 1 {
+    t.Errorf("hay %d jti revocados, esperaba 1", revocados)
+  }
+  if _, status := refrescar(t, tokens.RefreshToken); status != http.StatusUnauthorized {
+    t.Errorf("el refresh sigue sirviendo despues del logout: %d", status)
+  }
+}
@@ -0,0 +1,619 @@
+package main
+
+import (
+  "database/sql"
+  "encoding/json"
+  "fmt"
+  "log"
+  "math/big"
+  "net/http"
+  "strconv"
+  "strings"
+  "time"
+  "unicode/utf8"
+  
+  "github.com/gorilla/mux"
+)
+
+//Sobre es una bolsa del presupuesto base cero: recibe plata de lo que hay
+//por asignar y los egresos que dicen su sobre salen de ella. Los sobres van
+//en la moneda base.
+type Sobre struct {
+  Id int `json:"id"`
+  Libro int `json:"libro"`
+  Nombre string `json:"nombre"`
+  Archivado bool `json:"archivado"`
+  Saldo Dinero `json:"saldo"`
+}
+
+//AsignacionSobre mueve plata de Origen a Destino. Un sobre en 0 es lo que
+//hay por asignar, asi una asignacion es de 0 a un sobre y devolver plata es
+//de un sobre a 0.
+type AsignacionSobre struct {
+  Id int `json:"id"`
+  Libro int `json:"libro"`
+  Origen int `json:"origen"`
+  Destino int `json:"destino"`
+  Monto Dinero `json:"monto"`
+  Fecha time.Time `json:"fecha"`
+  Descripcion string `json:"descripcion"`
+  Usuario string `json:"usuario"`
+}
+
+//SobreMes es como le fue a un sobre en el mes.
+type SobreMes struct {
+  Sobre int `json:"sobre"`
+  Nombre string `json:"nombre"`
+  Archivado bool `json:"archivado"`
+  SaldoInicial Dinero `json:"saldoInicial"`
+  Asignado Dinero `json:"asignado"`
+  Gastado Dinero `json:"gastado"`
+  SaldoFinal Dinero `json:"saldoFinal"`
+}
+
+//ReporteSobres es el estado de los sobres del libro en un mes. PorAsignar
+//son los ingresos que todavia no estan en ningun sobre, menos los egresos
+//que no salieron de un sobre.
+type ReporteSobres struct {
+  Libro int `json:"libro"`
+  Mes string `json:"mes"`
+  Moneda string `json:"moneda"`
+  Ingresos Dinero `json:"ingresos"`
+  SinSobre Dinero `json:"sinSobre"`
+  PorAsignarInicial Dinero `json:"porAsignarInicial"`
+  PorAsignar Dinero `json:"porAsignar"`
+  Sobres []SobreMes `json:"sobres"`
+}
+
+//initSobres crea las tablas de sobres y asignaciones y agrega el sobre a
+//los registros.
+func initSobres() {
+  crearTablaSobres := `
+  CREATE TABLE IF NOT EXISTS sobres(
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  libro_id INTEGER NOT NULL REFERENCES libros(id),
+  nombre TEXT NOT NULL,
+  archivado INTEGER NOT NULL DEFAULT 0
+  );`
+  
+  crearTablaAsignaciones := `
+  CREATE TABLE IF NOT EXISTS asignaciones_sobres(
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  libro_id INTEGER NOT NULL REFERENCES libros(id),
+  origen_id INTEGER REFERENCES sobres(id),
+  destino_id INTEGER REFERENCES sobres(id),
+  monto INTEGER NOT NULL,
+  fecha DATETIME NOT NULL,
+  descripcion TEXT NOT NULL DEFAULT '',
+  usuario TEXT NOT NULL
+  );`
+  
+  _, err := db.Exec(crearTablaSobres)
+  if err != nil {
+    log.Fatal("Error creando la tabla sobres", err)
+  }
+  _, err = db.Exec(crearTablaAsignaciones)
+  if err != nil {
+    log.Fatal("Error creando la tabla asignaciones_sobres", err)
+  }
+  
+  agregarColumna("registros", "sobre_id", "INTEGER REFERENCES sobres(id)")
+  _, err = db.Exec("CREATE INDEX IF NOT EXISTS asignaciones_sobres_libro ON asignaciones_sobres(libro_id, fecha)")
+  if err != nil {
+    log.Fatal("Error creando el indice de asignaciones", err)
+  }
+}
+
+//validarSobre revisa los datos del sobre antes de guardarlo.
+func validarSobre(s *Sobre) error {
+  s.Nombre = strings.TrimSpace(s.Nombre)
+  if s.Nombre == "" || utf8.RuneCountInString(s.Nombre) > 50 {
+    return fmt.Errorf("el nombre es obligatorio y de maximo 50 caracteres")
+  }
+  return nil
+}
+
+//buscarSobre retorna el sobre si esta en un libro del usuario. Con
+//escritura exige que pueda modificar el libro. Si no responde el error y
+//retorna false.
+func buscarSobre(w http.ResponseWriter, r *http.Request, id int, escritura bool) (Sobre, bool) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  var s Sobre
+  err := db.QueryRow("SELECT id, libro_id, nombre, archivado FROM sobres WHERE id = ? AND " + condicionMiembro, id, nombreUsuario).Scan(
+    &s.Id, &s.Libro, &s.Nombre, &s.Archivado)
+  if err == sql.ErrNoRows {
+    http.Error(w, "El sobre no existe.", http.StatusNotFound)
+    return s, false
+  }
+  if err != nil {
+    writeError(w, "Error al consultar el sobre", err, http.StatusInternalServerError)
+    return s, false
+  }
+  if escritura && !permisoLibro(w, s.Libro, nombreUsuario, true) {
+    return s, false
+  }
+  return s, true
+}
+
+//sobreDelLibro revisa que el sobre sea del libro y no este archivado. Si
+//no retorna el error para el cliente.
+func sobreDelLibro(sobre int, libro int) (int, error) {
+  var archivado bool
+  err := db.QueryRow("SELECT archivado FROM sobres WHERE id = ? AND libro_id = ?", sobre, libro).Scan(&archivado)
+  if err == sql.ErrNoRows {
+    return http.StatusUnprocessableEntity, fmt.Errorf("el sobre %d no existe en el libro", sobre)
+  }
+  if err != nil {
+    return http.StatusInternalServerError, err
+  }
+  if archivado {
+    return http.StatusUnprocessableEntity, fmt.Errorf("el sobre %d esta archivado", sobre)
+  }
+  return 0, nil
+}
+
+//validarSobreRegistro revisa que el sobre del registro sea del mismo libro,
+//no este archivado y que el registro sea un egreso. Sin sobre no revisa
+//nada. Si responde un error retorna false.
+func validarSobreRegistro(w http.ResponseWriter, m Registro) bool {
+  if m.Sobre == 0 {
+    return true
+  }
+  if m.Tipo != "egreso" {
+    http.Error(w, "Error, solo los egresos pueden salir de un sobre.", http.StatusUnprocessableEntity)
+    return false
+  }
+  status, err := sobreDelLibro(m.Sobre, m.Libro)
+  if err != nil {
+    writeError(w, "Error en el sobre del registro", err, status)
+    return false
+  }
+  return true
+}
+
+//sumasSobres son los movimientos de un rango en la moneda base. La clave 0
+//de asignado es lo que hay por asignar.
+type sumasSobres struct {
+  ingresos big.Rat
+  sinSobre big.Rat
+  asignado map[int]*big.Rat
+  gastado map[int]*big.Rat
+}
+
+//sumar agrega el monto a la suma de la clave, creandola si no existe.
+func sumar(sumas map[int]*big.Rat, clave int, monto *big.Rat) {
+  if sumas[clave] == nil {
+    sumas[clave] = new(big.Rat)
+  }
+  sumas[clave].Add(sumas[clave], monto)
+}
+
+//porAsignar es lo que el rango le suma a la plata sin sobre.
+func (s *sumasSobres) porAsignar() *big.Rat {
+  total := new(big.Rat).Sub(&s.ingresos, &s.sinSobre)
+  if asignado, ok := s.asignado[0]; ok {
+    total.Add(total, asignado)
+  }
+  return total
+}
+
+//saldo es lo que el rango le suma al saldo del sobre.
+func (s *sumasSobres) saldo(sobre int) *big.Rat {
+  total := new(big.Rat)
+  if asignado, ok := s.asignado[sobre]; ok {
+    total.Add(total, asignado)
+  }
+  if gastado, ok := s.gastado[sobre]; ok {
+    total.Sub(total, gastado)
+  }
+  return total
+}
+
+//getSumasSobres suma los registros sin transferencias y las asignaciones
+//del libro en el rango. Los registros se pasan a la moneda base con la tasa
+//de su dia.
+func getSumasSobres(libro int, usuario string, desde time.Time, hasta time.Time) (*sumasSobres, error) {
+  s := &sumasSobres{asignado: map[int]*big.Rat{}, gastado: map[int]*big.Rat{}}
+  
+  rows, err := db.Query("SELECT COALESCE(sobre_id, 0), tipo, moneda, exponente, substr(fecha, 1, 10), SUM(monto) FROM registros WHERE libro_id = ? AND " + condicionMiembro + " AND " + sinTransferencias + " AND fecha BETWEEN ? AND ? GROUP BY 1, 2, 3, 4, 5", libro, usuario, desde, hasta)
+  if err != nil {
+    return nil, fmt.Errorf("Error al sumar los registros, %v", err)
+  }
+  defer rows.Close()
+  
+  conv := nuevoConversor(monedaBase())
+  for rows.Next() {
+    var sobre int
+    var tipo, moneda, dia string
+    var monto Dinero
+    err = rows.Scan(&sobre, &tipo, &moneda, &monto.Exponente, &dia, &monto.Unidades)
+    if err != nil {
+      return nil, fmt.Errorf("Error al escanear los registros, %v", err)
+    }
+    convertido, err := conv.convertir(monto, moneda, dia)
+    if err != nil {
+      return nil, err
+    }
+    switch {
+    case tipo == "ingreso":
+      s.ingresos.Add(&s.ingresos, convertido)
+    case sobre == 0:
+      s.sinSobre.Add(&s.sinSobre, convertido)
+    default:
+      sumar(s.gastado, sobre, convertido)
+    }
+  }
+  if err = rows.Err(); err != nil {
+    return nil, fmt.Errorf("Error al sumar los registros, %v", err)
+  }
+  
+  asignaciones, err := db.Query("SELECT COALESCE(origen_id, 0), COALESCE(destino_id, 0), SUM(monto) FROM asignaciones_sobres WHERE libro_id = ? AND fecha BETWEEN ? AND ? GROUP BY 1, 2", libro, desde, hasta)
+  if err != nil {
+    return nil, fmt.Errorf("Error al sumar las asignaciones, %v", err)
+  }
+  defer asignaciones.Close()
+  
+  exponente := exponenteMoneda(monedaBase())
+  for asignaciones.Next() {
+    var origen, destino int
+    monto := Dinero{0, exponente}
+    err = asignaciones.Scan(&origen, &destino, &monto.Unidades)
+    if err != nil {
+      return nil, fmt.Errorf("Error al escanear las asignaciones, %v", err)
+    }
+    sumar(s.asignado, destino, monto.Rat())
+    sumar(s.asignado, origen, new(big.Rat).Neg(monto.Rat()))
+  }
+  return s, asignaciones.Err()
+}
+
+//getSobresLibro lista los sobres del libro, los archivados solo con
+//archivados en true.
+func getSobresLibro(libro int, archivados bool) ([]Sobre, error) {
+  consulta := "SELECT id, libro_id, nombre, archivado FROM sobres WHERE libro_id = ?"
+  if !archivados {
+    consulta += " AND archivado = 0"
+  }
+  rows, err := db.Query(consulta + " ORDER BY archivado, nombre", libro)
+  if err != nil {
+    return nil, fmt.Errorf("Error al consultar los sobres, %v", err)
+  }
+  defer rows.Close()
+  
+  sobres := []Sobre{}
+  for rows.Next() {
+    var s Sobre
+    err = rows.Scan(&s.Id, &s.Libro, &s.Nombre, &s.Archivado)
+    if err != nil {
+      return nil, fmt.Errorf("Error al escanear los sobres, %v", err)
+    }
+    sobres = append(sobres, s)
+  }
+  return sobres, rows.Err()
+}
+
+//getSobres lista los sobres del libro con su saldo de hoy. Los archivados
+//solo salen con archivados=true.
+//ejm http://100.69.187.16:8080/sobres?libro=2&archivados=true
+func getSobres(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  libro, ok := libroPeticion(w, r, false)
+  if !ok {
+    return
+  }
+  sobres, err := getSobresLibro(libro, r.URL.Query().Get("archivados") == "true")
+  if err != nil {
+    writeError(w, "Error al consultar los sobres", err, http.StatusInternalServerError)
+    return
+  }
+  sumas, err := getSumasSobres(libro, nombreUsuario, time.Time{}, time.Now().UTC())
+  if err != nil {
+    writeError(w, "Error al calcular el saldo de los sobres", err, statusConversion(err))
+    return
+  }
+  exponente := exponenteMoneda(monedaBase())
+  for i := range sobres {
+    sobres[i].Saldo = dineroDeRat(sumas.saldo(sobres[i].Id), exponente)
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(sobres)
+}
+
+//postSobre crea un sobre vacio en el libro.
+//ejm http://100.69.187.16:8080/sobres?libro=2
+//Json ejemplo{"nombre": "Mercado"}
+func postSobre(w http.ResponseWriter, r *http.Request) {
+  libro, ok := libroPeticion(w, r, true)
+  if !ok {
+    return
+  }
+  var s Sobre
+  err := json.NewDecoder(r.Body).Decode(&s)
+  if err != nil {
+    http.Error(w, "Error al leer el json.", http.StatusBadRequest)
+    return
+  }
+  err = validarSobre(&s)
+  if err != nil {
+    writeError(w, "Error en el sobre", err, http.StatusBadRequest)
+    return
+  }
+  s.Libro = libro
+  s.Archivado = false
+  s.Saldo = Dinero{0, exponenteMoneda(monedaBase())}
+  
+  res, err := db.Exec("INSERT INTO sobres(libro_id, nombre) VALUES(?, ?)", s.Libro, s.Nombre)
+  if err != nil {
+    writeError(w, "Error al guardar el sobre", err, http.StatusInternalServerError)
+    return
+  }
+  id, _ := res.LastInsertId()
+  s.Id = int(id)
+  
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(http.StatusCreated)
+  json.NewEncoder(w).Encode(s)
+}
+
+//putSobre cambia el nombre del sobre o lo archiva. Solo se archiva con el
+//saldo en 0 para no perder plata asignada.
+//ejm http://100.69.187.16:8080/sobres/3
+//Json ejemplo{"nombre": "Mercado", "archivado": true}
+func putSobre(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  id, err := strconv.Atoi(mux.Vars(r)["id"])
+  if err != nil {
+    http.Error(w, "Error, el id debe ser un numero.", http.StatusBadRequest)
+    return
+  }
+  anterior, ok := buscarSobre(w, r, id, true)
+  if !ok {
+    return
+  }
+  
+  var s Sobre
+  err = json.NewDecoder(r.Body).Decode(&s)
+  if err != nil {
+    http.Error(w, "Error al leer el json.", http.StatusBadRequest)
+    return
+  }
+  err = validarSobre(&s)
+  if err != nil {
+    writeError(w, "Error en el sobre", err, http.StatusBadRequest)
+    return
+  }
+  s.Id = anterior.Id
+  s.Libro = anterior.Libro
+  
+  sumas, err := getSumasSobres(s.Libro, nombreUsuario, time.Time{}, time.Now().UTC())
+  if err != nil {
+    writeError(w, "Error al calcular el saldo del sobre", err, statusConversion(err))
+    return
+  }
+  s.Saldo = dineroDeRat(sumas.saldo(s.Id), exponenteMoneda(monedaBase()))
+  if s.Archivado && !anterior.Archivado && s.Saldo.Unidades != 0 {
+    http.Error(w, "Error, el sobre tiene saldo, muevalo a otro sobre antes de archivarlo.", http.StatusConflict)
+    return
+  }
+  
+  _, err = db.Exec("UPDATE sobres SET nombre = ?, archivado = ? WHERE id = ?", s.Nombre, s.Archivado, s.Id)
+  if err != nil {
+    writeError(w, "Error al actualizar el sobre", err, http.StatusInternalServerError)
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(s)
+}
+
+//postAsignacionSobre asigna plata a un sobre o la mueve entre sobres. Con
+//origen 0 sale de lo que hay por asignar y con destino 0 vuelve a ello.
+//Si el origen no tiene saldo suficiente responde 409. Sin fecha queda con
+//la de hoy.
+//ejm http://100.69.187.16:8080/sobres/asignaciones?libro=2
+//Json ejemplo{"origen": 0, "destino": 3, "monto": 400000, "fecha": "2024-12-01T00:00:00Z", "descripcion": "quincena"}
+func postAsignacionSobre(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  libro, ok := libroPeticion(w, r, true)
+  if !ok {
+    return
+  }
+  var a AsignacionSobre
+  err := json.NewDecoder(r.Body).Decode(&a)
+  if err != nil {
+    http.Error(w, "Error al leer el json.", http.StatusBadRequest)
+    return
+  }
+  if a.Origen == a.Destino {
+    http.Error(w, "Error, el origen y el destino deben ser distintos.", http.StatusBadRequest)
+    return
+  }
+  a.Monto, err = a.Monto.Escalar(exponenteMoneda(monedaBase()))
+  if err != nil {
+    writeError(w, "Error en el monto", err, http.StatusBadRequest)
+    return
+  }
+  if a.Monto.Unidades <= 0 {
+    http.Error(w, "Error, el monto debe ser mayor a 0.", http.StatusBadRequest)
+    return
+  }
+  if a.Fecha.IsZero() {
+    hoy := time.Now().UTC()
+    a.Fecha = time.Date(hoy.Year(), hoy.Month(), hoy.Day(), 0, 0, 0, 0, time.UTC)
+  }
+  for _, sobre := range []int{a.Origen, a.Destino} {
+    if sobre == 0 {
+      continue
+    }
+    status, err := sobreDelLibro(sobre, libro)
+    if err != nil {
+      writeError(w, "Error en la asignacion", err, status)
+      return
+    }
+  }
+  
+  //el origen debe tener con que cubrir el monto. Se cuenta todo hasta hoy o
+  //hasta la fecha de la asignacion si es despues, asi no se gasta plata que
+  //ya se movio con otra asignacion.
+  hasta := time.Now().UTC()
+  if a.Fecha.After(hasta) {
+    hasta = a.Fecha
+  }
+  sumas, err := getSumasSobres(libro, nombreUsuario, time.Time{}, hasta)
+  if err != nil {
+    writeError(w, "Error al calcular el saldo del origen", err, statusConversion(err))
+    return
+  }
+  disponible := sumas.porAsignar()
+  if a.Origen != 0 {
+    disponible = sumas.saldo(a.Origen)
+  }
+  if disponible.Cmp(a.Monto.Rat()) < 0 {
+    errorStr := fmt.Sprintf("Error, el origen solo tiene %s disponible.", dineroDeRat(disponible, a.Monto.Exponente))
+    http.Error(w, errorStr, http.StatusConflict)
+    return
+  }
+  a.Libro = libro
+  a.Usuario = nombreUsuario
+  
+  res, err := db.Exec("INSERT INTO asignaciones_sobres(libro_id, origen_id, destino_id, monto, fecha, descripcion, usuario) VALUES(?, NULLIF(?, 0), NULLIF(?, 0), ?, ?, ?, ?)",
+    a.Libro, a.Origen, a.Destino, a.Monto.Unidades, a.Fecha, a.Descripcion, a.Usuario)
+  if err != nil {
+    writeError(w, "Error al guardar la asignacion", err, http.StatusInternalServerError)
+    return
+  }
+  id, _ := res.LastInsertId()
+  a.Id = int(id)
+  
+  w.Header().Set("Content-Type", "application/json")
+  w.WriteHeader(http.StatusCreated)
+  json.NewEncoder(w).Encode(a)
+}
+
+//deleteAsignacionSobre deshace una asignacion, la plata vuelve al origen.
+//ejm http://100.69.187.16:8080/sobres/asignaciones/7
+func deleteAsignacionSobre(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  id, err := strconv.Atoi(mux.Vars(r)["id"])
+  if err != nil {
+    http.Error(w, "Error, el id debe ser un numero.", http.StatusBadRequest)
+    return
+  }
+  var libro, archivados int
+  err = db.QueryRow("SELECT libro_id, (SELECT COUNT(*) FROM sobres WHERE archivado = 1 AND id IN (origen_id, destino_id)) FROM asignaciones_sobres WHERE id = ? AND " + condicionMiembro, id, nombreUsuario).Scan(&libro, &archivados)
+  if err == sql.ErrNoRows {
+    http.Error(w, "La asignacion no existe.", http.StatusNotFound)
+    return
+  }
+  if err != nil {
+    writeError(w, "Error al consultar la asignacion", err, http.StatusInternalServerError)
+    return
+  }
+  if !permisoLibro(w, libro, nombreUsuario, true) {
+    return
+  }
+  //si no la plata quedaria en un sobre archivado.
+  if archivados > 0 {
+    http.Error(w, "Error, la asignacion es de un sobre archivado.", http.StatusConflict)
+    return
+  }
+  
+  _, err = db.Exec("DELETE FROM asignaciones_sobres WHERE id = ?", id)
+  if err != nil {
+    writeError(w, "Error al eliminar la asignacion", err, http.StatusInternalServerError)
+    return
+  }
+  w.WriteHeader(http.StatusNoContent)
+}
+
+//getReporteSobres responde el saldo de cada sobre al inicio y al final del
+//mes con lo que se le asigno y lo que se gasto, y lo que queda por asignar.
+//Sin mes es el mes actual.
+//ejm http://100.69.187.16:8080/sobres/reporte?libro=2&mes=2024-12
+func getReporteSobres(w http.ResponseWriter, r *http.Request) {
+  nombreUsuario := r.Context().Value("usuario").(string)
+  
+  mes := time.Now().UTC()
+  if r.URL.Query().Get("mes") != "" {
+    var err error
+    mes, err = time.Parse("2006-01", r.URL.Query().Get("mes"))
+    if err != nil {
+      errorStr := fmt.Sprintf("Error en el mes ingresado, debe ser AAAA-MM, %v", err)
+      http.Error(w, errorStr, http.StatusBadRequest)
+      return
+    }
+  }
+  libro, ok := libroPeticion(w, r, false)
+  if !ok {
+    return
+  }
+  
+  reporte, err := getReporteSobresMes(libro, nombreUsuario, mes)
+  if err != nil {
+    writeError(w, "Error al armar el reporte de sobres", err, statusConversion(err))
+    return
+  }
+  
+  w.Header().Set("Content-Type", "application/json")
+  json.NewEncoder(w).Encode(reporte)
+}
+
+//getReporteSobresMes suma todo lo anterior al mes para los saldos
+//iniciales y luego lo del mes. Los archivados salen si tuvieron
+//movimientos.
+func getReporteSobresMes(libro int, usuario string, mes time.Time) (ReporteSobres, error) {
+  inicio := time.Date(mes.Year(), mes.Month(), 1, 0, 0, 0, 0, time.UTC)
+  fin := inicio.AddDate(0, 1, 0).Add(-time.Nanosecond)
+  moneda := monedaBase()
+  exponente := exponenteMoneda(moneda)
+  reporte := ReporteSobres{Libro: libro, Mes: inicio.Format("2006-01"), Moneda: moneda, Sobres: []SobreMes{}}
+  
+  antes, err := getSumasSobres(libro, usuario, time.Time{}, inicio.Add(-time.Nanosecond))
+  if err != nil {
+    return reporte, err
+  }
+  enMes, err := getSumasSobres(libro, usuario, inicio, fin)
+  if err != nil {
+    return reporte, err
+  }
+  
+  porAsignarInicial := antes.porAsignar()
+  reporte.PorAsignarInicial = dineroDeRat(porAsignarInicial, exponente)
+  reporte.PorAsignar = dineroDeRat(porAsignarInicial.Add(porAsignarInicial, enMes.porAsignar()), exponente)
+  reporte.Ingresos = dineroDeRat(&enMes.ingresos, exponente)
+  reporte.SinSobre = dineroDeRat(&enMes.sinSobre, exponente)
+  
+  sobres, err := getSobresLibro(libro, true)
+  if err != nil {
+    return reporte, err
+  }
+  for _, s := range sobres {
+    inicial := antes.saldo(s.Id)
+    sm := SobreMes{
+      Sobre: s.Id,
+      Nombre: s.Nombre,
+      Archivado: s.Archivado,
+      SaldoInicial: dineroDeRat(inicial, exponente),
+      Asignado: Dinero{0, exponente},
+      Gastado: Dinero{0, exponente},
+    }
+    if asignado, ok := enMes.asignado[s.Id]; ok {
+      sm.Asignado = dineroDeRat(asignado, exponente)
+    }
+    if gastado, ok := enMes.gastado[s.Id]; ok {
+      sm.Gastado = dineroDeRat(gastado, exponente)
+    }
+    sm.SaldoFinal = dineroDeRat(inicial.Add(inicial, enMes.saldo(s.Id)), exponente)
+    if s.Archivado && sm.SaldoInicial.Unidades == 0 && sm.SaldoFinal.Unidades == 0 && sm.Gastado.Unidades == 0 && sm.Asignado.Unidades == 0 {
+      continue
+    }
+    reporte.Sobres = append(reporte.Sobres, sm)
+  }
+  return reporte, nil
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+  "fmt"
+  "net/http"
+  "testing"
+  "time"
+)
+
+func TestAsignacionSobreSinSaldo(t *testing.T) {
+  prepararDB(t)
+  t.Setenv("MONEDA_BASE", "USD")
+  tokens := sesionPrueba(t, "anita")
+  libro, err := libroPersonal(db, "anita")
+  if err != nil {
+    t.Fatal(err)
+  }
+  
+  //hay 100 USD por asignar y un sobre vacio.
+  ingreso := Registro{Tipo: "ingreso", Monto: Dinero{10000, 2}, Moneda: "USD", Descripcion: "sueldo", Grupo: "Sueldo", Fecha: time.Now().UTC().AddDate(0, 0, -1), Libro: libro}
+  if _, err := insertarRegistro(db, ingreso, "anita"); err != nil {
+    t.Fatal(err)
+  }
+  res, err := db.Exec("INSERT INTO sobres(libro_id, nombre) VALUES(?, 'Mercado')", libro)
+  if err != nil {
+    t.Fatal(err)
+  }
+  sobre, _ := res.LastInsertId()
+  
+  h := authMiddleware(http.HandlerFunc(postAsignacionSobre))
+  casos := []struct {
+    nombre string
+    origen int64
+    destino int64
+    monto string
+    status int
+  }{
+    {"asigna lo que hay", 0, sobre, "60", http.StatusCreated},
+    {"no asigna mas de lo que queda", 0, sobre, "40.01", http.StatusConflict},
+    {"el sobre no devuelve mas de su saldo", sobre, 0, "70", http.StatusConflict},
+    {"el sobre devuelve su saldo", sobre, 0, "60", http.StatusCreated},
+    {"asigna todo", 0, sobre, "100", http.StatusCreated},
+  }
+  for _, c := range casos {
+    body := fmt.Sprintf(`{"origen": %d, "destino": %d, "monto": %s}`, c.origen, c.destino, c.monto)
+    if w := peticion(h, "POST", "Bearer " + tokens.Token, body); w.Code != c.status {
+      t.Errorf("%s: respondio %d, esperaba %d, %s", c.nombre, w.Code, c.status, w.Body)
+    }
+  }
+  
+  //las rechazadas no se guardaron.
+  var cantidad int
+  if err := db.QueryRow("SELECT COUNT(*) FROM asignaciones_sobres").Scan(&cantidad); err != nil {
+    t.Fatal(err)
+  }
+  if cantidad != 3 {
+    t.Errorf("quedaron %d asignaciones, esperaba 3", cantidad)
+  }
+}